@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"strings"
 
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/time"
@@ -42,6 +43,7 @@ type Config struct {
 	SubnetMask    tcpip.AddressMask // client address subnet mask
 	Router        []tcpip.Address   // client router addresses
 	DNS           []tcpip.Address   // client DNS server addresses
+	DomainSearch  []string          // client DNS search domains
 	UpdatedAt     time.Time         // monotonic time at which lease was last updated
 	LeaseLength   Seconds           // time until lease expires, relative to the value of UpdatedAt
 	RenewTime     Seconds           // time until client enters RENEWING state, relative to the value of UpdatedAt
@@ -51,6 +53,9 @@ type Config struct {
 
 func (cfg *Config) decode(opts []option) error {
 	*cfg = Config{}
+	// The domain search option may be split across multiple instances, which
+	// must be concatenated before decoding as per RFC 3396.
+	var domainSearch []byte
 	for _, opt := range opts {
 		b := opt.body
 		if !opt.code.lenValid(len(b)) {
@@ -77,8 +82,17 @@ func (cfg *Config) decode(opts []option) error {
 				cfg.DNS = append(cfg.DNS, tcpip.Address(b[:4]))
 				b = b[4:]
 			}
+		case optDomainSearch:
+			domainSearch = append(domainSearch, b...)
 		}
 	}
+	if len(domainSearch) != 0 {
+		domains, err := decodeDomainSearch(domainSearch)
+		if err != nil {
+			return fmt.Errorf("%s: %w", optDomainSearch, err)
+		}
+		cfg.DomainSearch = domains
+	}
 	return nil
 }
 
@@ -103,6 +117,19 @@ func (cfg Config) encode() (opts []option) {
 		}
 		opts = append(opts, option{optDomainNameServer, dns})
 	}
+	if len(cfg.DomainSearch) > 0 {
+		// Values longer than the maximum option length are split across
+		// multiple instances as per RFC 3396.
+		b := encodeDomainSearch(cfg.DomainSearch)
+		for len(b) != 0 {
+			n := len(b)
+			if n > math.MaxUint8 {
+				n = math.MaxUint8
+			}
+			opts = append(opts, option{optDomainSearch, b[:n]})
+			b = b[n:]
+		}
+	}
 	if l := cfg.LeaseLength; l != 0 {
 		opts = append(opts, serializeLeaseOption(l, optLeaseTime))
 	}
@@ -115,6 +142,85 @@ func (cfg Config) encode() (opts []option) {
 	return opts
 }
 
+// decodeDomainSearch decodes the body of the domain search option.
+//
+// RFC 3397 Section 2
+// https://tools.ietf.org/html/rfc3397#section-2
+//
+//   The list of domain names in the 'Searchstring' MUST be encoded as
+//   specified in section "Domain Names - Implementation And Specification"
+//   of RFC 1035 [3].
+//
+// Compression pointers are offsets into the concatenated option body.
+func decodeDomainSearch(b []byte) ([]string, error) {
+	var domains []string
+	for off := 0; off < len(b); {
+		domain, next, err := decodeDomainName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+		off = next
+	}
+	return domains, nil
+}
+
+// decodeDomainName decodes the domain name starting at offset off of b and
+// returns it along with the offset following its encoding.
+func decodeDomainName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for pointers := 0; ; {
+		if off >= len(b) {
+			return "", 0, fmt.Errorf("domain name truncated at offset %d", off)
+		}
+		switch l := int(b[off]); {
+		case l == 0:
+			if next == -1 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, fmt.Errorf("compression pointer truncated at offset %d", off)
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			// Following more pointers than there are bytes implies a loop.
+			if pointers++; pointers > len(b) {
+				return "", 0, fmt.Errorf("compression pointer loop at offset %d", off)
+			}
+			off = (l&0x3f)<<8 | int(b[off+1])
+		case l&0xc0 != 0:
+			return "", 0, fmt.Errorf("invalid label length %#x at offset %d", l, off)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, fmt.Errorf("label truncated at offset %d", off)
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// encodeDomainSearch encodes domains as the body of the domain search option,
+// without compression.
+func encodeDomainSearch(domains []string) []byte {
+	var b []byte
+	for _, domain := range domains {
+		for _, label := range strings.Split(domain, ".") {
+			if len(label) == 0 {
+				continue
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	return b
+}
+
 func serializeLeaseOption(s Seconds, o optionCode) option {
 	v := make([]byte, 4)
 	binary.BigEndian.PutUint32(v, uint32(s))
@@ -317,6 +423,7 @@ const (
 	optRenewalTime      optionCode = 58
 	optRebindingTime    optionCode = 59
 	optClientID         optionCode = 61
+	optDomainSearch     optionCode = 119
 )
 
 func (i optionCode) lenValid(l int) bool {
@@ -332,7 +439,7 @@ func (i optionCode) lenValid(l int) bool {
 		return l == 1
 	case optRouter, optDomainNameServer:
 		return l%4 == 0
-	case optMessage, optDomainName, optClientID:
+	case optMessage, optDomainName, optClientID, optDomainSearch:
 		return l >= 1
 	case optParamReq:
 		return true // no fixed length
@@ -88,6 +88,7 @@ func _() {
 	_ = x[optRenewalTime-58]
 	_ = x[optRebindingTime-59]
 	_ = x[optClientID-61]
+	_ = x[optDomainSearch-119]
 }
 
 const (
@@ -99,6 +100,7 @@ const (
 	_optionCode_name_5 = "optDHCPMsgTypeoptDHCPServeroptParamReqoptMessage"
 	_optionCode_name_6 = "optRenewalTimeoptRebindingTime"
 	_optionCode_name_7 = "optClientID"
+	_optionCode_name_8 = "optDomainSearch"
 )
 
 var (
@@ -128,6 +130,8 @@ func (i optionCode) String() string {
 		return _optionCode_name_6[_optionCode_index_6[i]:_optionCode_index_6[i+1]]
 	case i == 61:
 		return _optionCode_name_7
+	case i == 119:
+		return _optionCode_name_8
 	default:
 		return "optionCode(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
@@ -1861,6 +1861,81 @@ func TestNoNullTerminator(t *testing.T) {
 	}
 }
 
+func TestDomainSearch(t *testing.T) {
+	// The example from RFC 3397 section 3, which uses compression pointers.
+	compressed := "\x03eng\x05apple\x03com\x00" + "\x09marketing\xc0\x04"
+
+	var long []string
+	for i := 0; i < 20; i++ {
+		long = append(long, fmt.Sprintf("subdomain%d.example.com", i))
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []option
+		want []string
+	}{
+		{
+			name: "compressed",
+			opts: []option{{optDomainSearch, []byte(compressed)}},
+			want: []string{"eng.apple.com", "marketing.apple.com"},
+		},
+		{
+			name: "split",
+			opts: []option{
+				{optDomainSearch, []byte(compressed[:7])},
+				{optDomainNameServer, []byte(serverAddr)},
+				{optDomainSearch, []byte(compressed[7:])},
+			},
+			want: []string{"eng.apple.com", "marketing.apple.com"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg Config
+			if err := cfg.decode(tc.opts); err != nil {
+				t.Fatalf("cfg.decode(%s) = %s", tc.opts, err)
+			}
+			if diff := cmp.Diff(tc.want, cfg.DomainSearch); diff != "" {
+				t.Errorf("cfg.DomainSearch mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("roundtrip", func(t *testing.T) {
+		cfg := Config{DomainSearch: long}
+		opts := cfg.encode()
+		if len(opts) < 2 {
+			t.Errorf("got len(cfg.encode()) = %d, want >= 2", len(opts))
+		}
+		var got Config
+		if err := got.decode(opts); err != nil {
+			t.Fatalf("got.decode(%s) = %s", opts, err)
+		}
+		if diff := cmp.Diff(long, got.DomainSearch); diff != "" {
+			t.Errorf("got.DomainSearch mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		body string
+	}{
+		{name: "truncated label", body: "\x03en"},
+		{name: "missing terminator", body: "\x03eng"},
+		{name: "truncated pointer", body: "\x03eng\xc0"},
+		{name: "pointer loop", body: "\xc0\x00"},
+		{name: "bad label length", body: "\x40"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg Config
+			opts := []option{{optDomainSearch, []byte(tc.body)}}
+			if err := cfg.decode(opts); err == nil {
+				t.Errorf("cfg.decode(%s) = nil, want error; cfg.DomainSearch = %s", opts, cfg.DomainSearch)
+			}
+		})
+	}
+}
+
 func TestTwoServers(t *testing.T) {
 	var serverLinkEP, clientLinkEP endpoint
 	serverLinkEP.remote = append(serverLinkEP.remote, &clientLinkEP)
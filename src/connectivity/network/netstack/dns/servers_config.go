@@ -8,6 +8,9 @@
 package dns
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/sync"
@@ -23,6 +26,17 @@ const (
 	DefaultDNSPort = 53
 
 	syslogTagName = "dns"
+
+	// maxDomainNameLength is the maximum length of a domain name in its
+	// textual form, excluding the trailing dot.
+	//
+	// As per RFC 1035 section 2.3.4, names are limited to 255 octets in their
+	// wire encoding, which holds two more octets than the textual form.
+	maxDomainNameLength = 253
+
+	// maxLabelLength is the maximum length of a single label of a domain name,
+	// as per RFC 1035 section 2.3.4.
+	maxLabelLength = 63
 )
 
 // expiringDNSServerState is the state for an expiring DNS server.
@@ -72,6 +86,13 @@ type ServersConfig struct {
 
 		// Closed and replaced when the server list changes.
 		serversChanged chan struct{}
+
+		// Default DNS search domains.
+		defaultSearchDomains []string
+
+		// DNS search domains configured at runtime by DHCP, keyed by the NIC
+		// on which they were learned.
+		dhcpSearchDomains map[tcpip.NICID][]string
 	}
 }
 
@@ -81,6 +102,7 @@ func MakeServersConfig(clock tcpip.Clock) ServersConfig {
 	}
 	d.mu.ndpServers = make(map[tcpip.FullAddress]expiringDNSServerState)
 	d.mu.dhcpServers = make(map[tcpip.NICID]*[]tcpip.Address)
+	d.mu.dhcpSearchDomains = make(map[tcpip.NICID][]string)
 	d.mu.serversChanged = make(chan struct{})
 	return d
 }
@@ -339,3 +361,109 @@ func (d *ServersConfig) RemoveAllServersWithNIC(nicID tcpip.NICID) {
 
 	close(ch)
 }
+
+// GetSearchDomains returns the list of DNS search domains.
+//
+// The runtime domains will be at the front of the list, ordered by NIC,
+// followed by the default domains. The list will be deduplicated.
+func (d *ServersConfig) GetSearchDomains() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	nicids := make([]tcpip.NICID, 0, len(d.mu.dhcpSearchDomains))
+	for nicid := range d.mu.dhcpSearchDomains {
+		nicids = append(nicids, nicid)
+	}
+	sort.Slice(nicids, func(i, j int) bool { return nicids[i] < nicids[j] })
+
+	var domains []string
+	have := make(map[string]struct{})
+	add := func(l []string) {
+		for _, domain := range l {
+			if _, ok := have[domain]; ok {
+				continue
+			}
+			have[domain] = struct{}{}
+			domains = append(domains, domain)
+		}
+	}
+	for _, nicid := range nicids {
+		add(d.mu.dhcpSearchDomains[nicid])
+	}
+	add(d.mu.defaultSearchDomains)
+	return domains
+}
+
+// SetDefaultSearchDomains sets the default list of DNS search domains.
+//
+// Returns an error without modifying the configuration if any of the domains
+// is not a valid domain name.
+func (d *ServersConfig) SetDefaultSearchDomains(domains []string) error {
+	normalized, err := normalizeSearchDomains(domains)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.mu.defaultSearchDomains = normalized
+	d.mu.Unlock()
+	return nil
+}
+
+// UpdateDhcpSearchDomains updates the list of DNS search domains learned by
+// DHCP on the specified NIC.
+//
+// Invalid domain names are dropped. A nil or empty list removes all search
+// domains associated with the NIC.
+func (d *ServersConfig) UpdateDhcpSearchDomains(nicid tcpip.NICID, domains []string) {
+	var valid []string
+	for _, domain := range domains {
+		normalized, err := normalizeSearchDomain(domain)
+		if err != nil {
+			_ = syslog.WarnTf(syslogTagName, "ignoring DHCP search domain on NIC %d: %s", nicid, err)
+			continue
+		}
+		valid = append(valid, normalized)
+	}
+
+	d.mu.Lock()
+	if len(valid) != 0 {
+		d.mu.dhcpSearchDomains[nicid] = valid
+	} else {
+		delete(d.mu.dhcpSearchDomains, nicid)
+	}
+	d.mu.Unlock()
+}
+
+func normalizeSearchDomains(domains []string) ([]string, error) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		n, err := normalizeSearchDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+// normalizeSearchDomain validates domain and returns it lowercased and without
+// a trailing dot.
+func normalizeSearchDomain(domain string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSuffix(domain, "."))
+	if len(normalized) == 0 {
+		return "", fmt.Errorf("empty search domain %q", domain)
+	}
+	if len(normalized) > maxDomainNameLength {
+		return "", fmt.Errorf("search domain %q exceeds %d characters", domain, maxDomainNameLength)
+	}
+	for _, label := range strings.Split(normalized, ".") {
+		if len(label) == 0 {
+			return "", fmt.Errorf("search domain %q has an empty label", domain)
+		}
+		if len(label) > maxLabelLength {
+			return "", fmt.Errorf("search domain %q has a label exceeding %d characters", domain, maxLabelLength)
+		}
+	}
+	return normalized, nil
+}
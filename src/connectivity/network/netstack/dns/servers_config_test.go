@@ -8,6 +8,7 @@
 package dns_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -818,3 +819,38 @@ func TestTimerCleanup(t *testing.T) {
 		t.Errorf("d.GetServersCache() mismatch (-want +got):\n%s", diff)
 	}
 }
+
+func TestSearchDomains(t *testing.T) {
+	d := dns.MakeServersConfig(faketime.NewManualClock())
+
+	if got := d.GetSearchDomains(); len(got) != 0 {
+		t.Errorf("got d.GetSearchDomains() = %s, want = []", got)
+	}
+
+	if err := d.SetDefaultSearchDomains([]string{"Example.com.", "corp.example.com"}); err != nil {
+		t.Fatalf("d.SetDefaultSearchDomains(...) = %s", err)
+	}
+	d.UpdateDhcpSearchDomains(2, []string{"b.example", "corp.example.com"})
+	d.UpdateDhcpSearchDomains(1, []string{"a.example", "bad..example"})
+
+	if diff := cmp.Diff([]string{"a.example", "b.example", "corp.example.com", "example.com"}, d.GetSearchDomains()); diff != "" {
+		t.Errorf("d.GetSearchDomains() mismatch (-want +got):\n%s", diff)
+	}
+
+	d.UpdateDhcpSearchDomains(1, nil)
+	if diff := cmp.Diff([]string{"b.example", "corp.example.com", "example.com"}, d.GetSearchDomains()); diff != "" {
+		t.Errorf("d.GetSearchDomains() mismatch (-want +got):\n%s", diff)
+	}
+
+	longLabel := strings.Repeat("a", 64)
+	longName := strings.Repeat("a.", 128)
+	for _, domain := range []string{"", ".", "bad..example", longLabel, longName} {
+		if err := d.SetDefaultSearchDomains([]string{"ok.example", domain}); err == nil {
+			t.Errorf("d.SetDefaultSearchDomains([ok.example %q]) = nil, want error", domain)
+		}
+	}
+	// Failed updates must not modify the configuration.
+	if diff := cmp.Diff([]string{"b.example", "corp.example.com", "example.com"}, d.GetSearchDomains()); diff != "" {
+		t.Errorf("d.GetSearchDomains() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -823,9 +823,14 @@ type socketInfoMapInspectImpl struct {
 	value *endpointsMap
 }
 
-func (*socketInfoMapInspectImpl) ReadData() inspect.Object {
+func (impl *socketInfoMapInspectImpl) ReadData() inspect.Object {
+	sendBytes, recvBytes := impl.value.socketMemoryUsage()
 	return inspect.Object{
 		Name: socketInfo,
+		Metrics: []inspect.Metric{
+			{Key: "SendBufferBytes", Value: inspect.MetricValueWithUintValue(sendBytes)},
+			{Key: "ReceiveBufferBytes", Value: inspect.MetricValueWithUintValue(recvBytes)},
+		},
 	}
 }
 
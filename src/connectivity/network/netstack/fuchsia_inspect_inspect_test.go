@@ -369,6 +369,17 @@ func TestSocketStatCounterInspectImpl(t *testing.T) {
 		t.Errorf("ListChildren() mismatch (-want +got):\n%s", diff)
 	}
 
+	sendBytes, recvBytes := ns.GetSocketMemoryUsage()
+	if diff := cmp.Diff(inspect.Object{
+		Name: socketInfo,
+		Metrics: []inspect.Metric{
+			{Key: "SendBufferBytes", Value: inspect.MetricValueWithUintValue(sendBytes)},
+			{Key: "ReceiveBufferBytes", Value: inspect.MetricValueWithUintValue(recvBytes)},
+		},
+	}, v.ReadData(), cmpopts.IgnoreUnexported(inspect.Object{}, inspect.Metric{}, inspect.Property{})); diff != "" {
+		t.Errorf("ReadData() mismatch (-want +got):\n%s", diff)
+	}
+
 	childName := "not a real child"
 	if child := v.GetChild(childName); child != nil {
 		t.Errorf("got GetChild(%s) = %s, want = nil", childName, child)
@@ -376,7 +376,7 @@ func (ci *adminControlImpl) AddAddress(_ fidl.Context, interfaceAddr net.Interfa
 			return admin.AddressRemovalReasonAlreadyAssigned
 		}
 
-		status := ci.ns.addInterfaceAddress(ci.nicid, protocolAddr, false /* addRoute */)
+		status := ci.ns.addInterfaceAddress(ci.nicid, protocolAddr, false /* addRoute */, false /* skipDAD */)
 		_ = syslog.DebugTf(addressStateProviderName, "addInterfaceAddress(%d, %+v, false) = %s", ci.nicid, protocolAddr, status)
 		switch status {
 		case zx.ErrOk:
@@ -294,7 +294,7 @@ func TestInterfacesWatcher(t *testing.T) {
 			PrefixLen: 16,
 		},
 	}
-	if status := ni.ns.addInterfaceAddress(ifs.nicid, protocolAddr, false /* addRoute */); status != zx.ErrOk {
+	if status := ni.ns.addInterfaceAddress(ifs.nicid, protocolAddr, false /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
 		t.Fatalf("addInterfaceAddress(%d, %#v, false): %s", ifs.nicid, protocolAddr, status)
 	}
 	addressAdded := id
@@ -385,3 +385,117 @@ func TestInterfacesWatcher(t *testing.T) {
 	ifs.RemoveByUser()
 	verifyWatchResults(interfaces.EventWithRemoved(uint64(ifs.nicid)))
 }
+
+func TestReplaceAddresses(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
+
+	makeAddr := func(d byte) tcpip.ProtocolAddress {
+		return tcpip.ProtocolAddress{
+			Protocol: header.IPv4ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.Address(net.IPv4(192, 168, 0, d).To4()),
+				PrefixLen: 24,
+			},
+		}
+	}
+	oldAddr := makeAddr(1)
+	if status := ns.addInterfaceAddress(ifs.nicid, oldAddr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+		t.Fatalf("addInterfaceAddress(%d, %#v, true): %s", ifs.nicid, oldAddr, status)
+	}
+
+	// Observe events directly rather than through a served Watcher.
+	w := &interfaceWatcherImpl{
+		cancelServe: func() {},
+		ready:       make(chan struct{}, 1),
+	}
+	ns.interfaceWatchers.mu.Lock()
+	ns.interfaceWatchers.mu.watchers[w] = struct{}{}
+	ns.interfaceWatchers.mu.Unlock()
+
+	newAddrs := []tcpip.ProtocolAddress{makeAddr(2), makeAddr(3)}
+	if err := ifs.replaceAddresses(newAddrs); err != nil {
+		t.Fatalf("replaceAddresses(%#v): %s", newAddrs, err)
+	}
+
+	var gotAddrs []tcpip.ProtocolAddress
+	for _, addr := range ns.stack.NICInfo()[ifs.nicid].ProtocolAddresses {
+		if !header.IsV6LinkLocalUnicastAddress(addr.AddressWithPrefix.Address) {
+			gotAddrs = append(gotAddrs, addr)
+		}
+	}
+	if diff := cmp.Diff(newAddrs, gotAddrs, cmpopts.SortSlices(func(a, b tcpip.ProtocolAddress) bool {
+		return a.AddressWithPrefix.Address < b.AddressWithPrefix.Address
+	})); diff != "" {
+		t.Errorf("NIC addresses mismatch (-want +got):\n%s", diff)
+	}
+
+	w.mu.Lock()
+	queue := w.mu.queue
+	w.mu.Unlock()
+	if len(queue) != 1 {
+		t.Fatalf("got %d events, want 1: %#v", len(queue), queue)
+	}
+	var want interfaces.Properties
+	want.SetId(uint64(ifs.nicid))
+	properties := wantInterfaceProperties(ns, ifs.nicid)
+	want.SetAddresses(properties.GetAddresses())
+	if err := assertWatchResult(queue[0], nil, interfaces.EventWithChanged(want)); err != nil {
+		t.Error(err)
+	}
+
+	for _, r := range ns.GetExtendedRouteTable() {
+		if r.Route.Destination == oldAddr.AddressWithPrefix.Subnet() {
+			return
+		}
+	}
+	t.Errorf("subnet route for %s missing after replacing addresses in the same subnet", oldAddr.AddressWithPrefix)
+}
+
+// Replacing [.1/24, .2/24] with [.2/24] keeps the subnet route, which .2 still
+// needs, and removing every address in the subnet deletes it.
+func TestReplaceAddressesSharedSubnet(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
+
+	makeAddr := func(d byte) tcpip.ProtocolAddress {
+		return tcpip.ProtocolAddress{
+			Protocol: header.IPv4ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   tcpip.Address(net.IPv4(192, 168, 0, d).To4()),
+				PrefixLen: 24,
+			},
+		}
+	}
+	first, second := makeAddr(1), makeAddr(2)
+	for _, addr := range []tcpip.ProtocolAddress{first, second} {
+		if status := ns.addInterfaceAddress(ifs.nicid, addr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+			t.Fatalf("addInterfaceAddress(%d, %#v, true): %s", ifs.nicid, addr, status)
+		}
+	}
+	subnet := first.AddressWithPrefix.Subnet()
+	hasSubnetRoute := func() bool {
+		for _, r := range ns.GetExtendedRouteTable() {
+			if r.Route.Destination == subnet && r.Route.NIC == ifs.nicid {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := ifs.replaceAddresses([]tcpip.ProtocolAddress{second}); err != nil {
+		t.Fatalf("replaceAddresses([%#v]): %s", second, err)
+	}
+	if !hasSubnetRoute() {
+		t.Errorf("subnet route for %s missing while %s is still assigned", subnet, second.AddressWithPrefix)
+	}
+
+	if err := ifs.replaceAddresses(nil); err != nil {
+		t.Fatalf("replaceAddresses(nil): %s", err)
+	}
+	if hasSubnetRoute() {
+		t.Errorf("subnet route for %s left after removing all of its addresses", subnet)
+	}
+}
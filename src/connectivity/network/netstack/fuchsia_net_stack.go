@@ -101,7 +101,7 @@ func (ns *Netstack) addInterfaceAddr(id uint64, ifAddr net.Subnet) stack.StackAd
 		return result
 	}
 
-	switch status := ns.addInterfaceAddress(tcpip.NICID(id), protocolAddr, true /* addRoute */); status {
+	switch status := ns.addInterfaceAddress(tcpip.NICID(id), protocolAddr, true /* addRoute */, false /* skipDAD */); status {
 	case zx.ErrOk:
 		result.SetResponse(stack.StackAddInterfaceAddressDeprecatedResponse{})
 		return result
@@ -112,6 +112,10 @@ func (ns *Netstack) addInterfaceAddr(id uint64, ifAddr net.Subnet) stack.StackAd
 		_ = syslog.Warnf("(*Netstack).addInterfaceAddr(%s) failed (NIC %d): %s", protocolAddr.AddressWithPrefix, id, status)
 		result.SetErr(stack.ErrorAlreadyExists)
 		return result
+	case zx.ErrNoResources:
+		_ = syslog.Errorf("(*Netstack).addInterfaceAddr(%s) failed (NIC %d): route table is full", protocolAddr.AddressWithPrefix, id)
+		result.SetErr(stack.ErrorInternal)
+		return result
 	default:
 		panic(fmt.Sprintf("NIC %d: failed to add address %s: %s", id, protocolAddr.AddressWithPrefix, status))
 	}
@@ -41,6 +41,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
@@ -224,6 +225,9 @@ type terminalError struct {
 		sync.Mutex
 		ch  <-chan tcpip.Error
 		err tcpip.Error
+		// latched holds the latest non-terminal error retrieved from the
+		// endpoint by LatchLastError that has yet to be consumed.
+		latched tcpip.Error
 	}
 }
 
@@ -332,6 +336,40 @@ type endpoint struct {
 	pending signaler
 
 	terminal terminalError
+
+	// reusePortGroup is the reuseport group the endpoint joined when it was
+	// bound, if any. Guarded by ns.reusePortGroups.mu.
+	reusePortGroup *reusePortGroup
+
+	// multicastGroups holds the number of memberships the endpoint holds in
+	// each multicast group. Guarded by ns.multicastGroups.mu.
+	multicastGroups map[tcpip.Address]int
+
+	// hopLimit tracks whether the IPv6 hop limit was set explicitly or is the
+	// default of the interface the socket is routed through.
+	hopLimit socketHopLimit
+
+	keepalive struct {
+		sync.Mutex
+		// set holds the TCP keepalive options set on the socket, which
+		// connections it accepts inherit instead of the stack-wide defaults.
+		set tcpKeepaliveOptions
+	}
+}
+
+// setKeepaliveOption records that the TCP keepalive option o was set on the
+// socket.
+func (ep *endpoint) setKeepaliveOption(o tcpKeepaliveOptions) {
+	ep.keepalive.Lock()
+	defer ep.keepalive.Unlock()
+	ep.keepalive.set |= o
+}
+
+// keepaliveOptionsSet returns the TCP keepalive options set on the socket.
+func (ep *endpoint) keepaliveOptionsSet() tcpKeepaliveOptions {
+	ep.keepalive.Lock()
+	defer ep.keepalive.Unlock()
+	return ep.keepalive.set
 }
 
 func (ep *endpoint) incRef() {
@@ -407,9 +445,50 @@ func (ep *endpoint) Bind(_ fidl.Context, sockaddr fidlnet.SocketAddress) (socket
 	if err != nil {
 		return socket.BaseNetworkSocketBindResultWithErr(tcpipErrorToCode(&tcpip.ErrBadAddress{})), nil
 	}
-	if err := ep.ep.Bind(addr); err != nil {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if err := ep.bindLocked(addr); err != nil {
 		return socket.BaseNetworkSocketBindResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	return socket.BaseNetworkSocketBindResultWithResponse(socket.BaseNetworkSocketBindResponse{}), nil
+}
+
+// bindLocked binds the endpoint to addr. Binding an endpoint with SO_REUSEPORT
+// set fails with ErrPortInUse if its reuseport group is full, as it does when
+// addr is held by an endpoint that does not share it; the two cases are logged
+// differently.
+func (ep *endpoint) bindLocked(addr tcpip.FullAddress) tcpip.Error {
+	if addr.Port == 0 || !ep.ep.SocketOptions().GetReusePort() {
+		return ep.bindEndpointLocked(addr)
+	}
+
+	groups := &ep.ns.reusePortGroups
+	groups.mu.Lock()
+	defer groups.mu.Unlock()
+
+	group := reusePortGroup{netProto: ep.netProto, transProto: ep.transProto, addr: addr}
+	if n := groups.sizes[group]; groups.maxSize != 0 && n >= groups.maxSize {
+		_ = syslog.DebugTf("bind", "%p: reuseport group for %+v is full (%d endpoints)", ep, addr, n)
+		return &tcpip.ErrPortInUse{}
+	}
+	if err := ep.bindEndpointLocked(addr); err != nil {
+		return err
+	}
+	if groups.sizes == nil {
+		groups.sizes = make(map[reusePortGroup]int)
+	}
+	groups.sizes[group]++
+	ep.reusePortGroup = &group
+	return nil
+}
+
+func (ep *endpoint) bindEndpointLocked(addr tcpip.FullAddress) tcpip.Error {
+	if err := ep.ep.Bind(addr); err != nil {
+		if _, ok := err.(*tcpip.ErrPortInUse); ok {
+			_ = syslog.DebugTf("bind", "%p: %+v is in use by an endpoint not sharing it with SO_REUSEPORT", ep, addr)
+		}
+		return err
+	}
 
 	{
 		localAddr, err := ep.ep.GetLocalAddress()
@@ -419,7 +498,36 @@ func (ep *endpoint) Bind(_ fidl.Context, sockaddr fidlnet.SocketAddress) (socket
 		_ = syslog.DebugTf("bind", "%p: local=%+v", ep, localAddr)
 	}
 
-	return socket.BaseNetworkSocketBindResultWithResponse(socket.BaseNetworkSocketBindResponse{}), nil
+	return nil
+}
+
+// BindWithDevice binds the endpoint to the named device and to the socket
+// address as a single operation, so that neither can interleave with another
+// bind on the same endpoint. An empty device name leaves the endpoint unbound
+// from any device.
+//
+// If binding to the address fails, the endpoint's previous device binding is
+// restored.
+func (ep *endpoint) BindWithDevice(sockaddr fidlnet.SocketAddress, device string) posix.Errno {
+	addr, err := toTCPIPFullAddress(sockaddr)
+	if err != nil {
+		return tcpipErrorToCode(&tcpip.ErrBadAddress{})
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	previous := ep.ep.SocketOptions().GetBindToDevice()
+	if err := ep.bindToDeviceLocked(device); err != nil {
+		return tcpipErrorToCode(err)
+	}
+	if err := ep.bindLocked(addr); err != nil {
+		if err := ep.ep.SocketOptions().SetBindToDevice(previous); err != nil {
+			panic(fmt.Sprintf("SetBindToDevice(%d) = %s", previous, err))
+		}
+		return tcpipErrorToCode(err)
+	}
+	return 0
 }
 
 func (ep *endpoint) connect(address fidlnet.SocketAddress) tcpip.Error {
@@ -435,6 +543,9 @@ func (ep *endpoint) connect(address fidlnet.SocketAddress) tcpip.Error {
 	}
 
 	{
+		ep.hopLimit.Lock()
+		ep.applyRouteHopLimitLocked(&addr)
+		ep.hopLimit.Unlock()
 		ep.terminal.mu.Lock()
 		err := ep.ep.Connect(addr)
 		ch := ep.terminal.setConsumedLockedInner(err)
@@ -558,27 +669,178 @@ func (ep *endpoint) domain() (socket.Domain, tcpip.Error) {
 	return 0, &tcpip.ErrNotSupported{}
 }
 
-func (ep *endpoint) GetError(fidl.Context) (socket.BaseSocketGetErrorResult, error) {
+// socketStats holds the counters of a single socket.
+//
+// It is laid out like a FIDL table: each counter is accompanied by a presence
+// bit that is set only if the counter is tracked by the socket's transport
+// protocol.
+type socketStats struct {
+	PacketsSent            uint64
+	PacketsSentPresent     bool
+	PacketsReceived        uint64
+	PacketsReceivedPresent bool
+	SendErrors             uint64
+	SendErrorsPresent      bool
+	ReceiveErrors          uint64
+	ReceiveErrorsPresent   bool
+	Retransmits            uint64
+	RetransmitsPresent     bool
+}
+
+func (s *socketStats) SetPacketsSent(v uint64) {
+	s.PacketsSent = v
+	s.PacketsSentPresent = true
+}
+
+func (s *socketStats) SetPacketsReceived(v uint64) {
+	s.PacketsReceived = v
+	s.PacketsReceivedPresent = true
+}
+
+func (s *socketStats) SetSendErrors(v uint64) {
+	s.SendErrors = v
+	s.SendErrorsPresent = true
+}
+
+func (s *socketStats) SetReceiveErrors(v uint64) {
+	s.ReceiveErrors = v
+	s.ReceiveErrorsPresent = true
+}
+
+func (s *socketStats) SetRetransmits(v uint64) {
+	s.Retransmits = v
+	s.RetransmitsPresent = true
+}
+
+func sendErrorsCount(errs *tcpip.SendErrors) uint64 {
+	return errs.SendToNetworkFailed.Value() + errs.NoRoute.Value()
+}
+
+func receiveErrorsCount(errs *tcpip.ReceiveErrors) uint64 {
+	return errs.ReceiveBufferOverflow.Value() + errs.MalformedPacketsReceived.Value() + errs.ClosedReceiver.Value() + errs.ChecksumErrors.Value()
+}
+
+// stats returns the endpoint's counters as reported by ep.ep.Stats().
+func (ep *endpoint) stats() socketStats {
+	var stats socketStats
+	switch t := ep.ep.Stats().(type) {
+	case *tcp.Stats:
+		stats.SetPacketsSent(t.SegmentsSent.Value())
+		stats.SetPacketsReceived(t.SegmentsReceived.Value())
+		stats.SetSendErrors(sendErrorsCount(&t.SendErrors.SendErrors) + t.SendErrors.SegmentSendToNetworkFailed.Value() + t.SendErrors.SynSendToNetworkFailed.Value())
+		stats.SetReceiveErrors(receiveErrorsCount(&t.ReceiveErrors.ReceiveErrors) + t.ReceiveErrors.SegmentQueueDropped.Value() + t.ReceiveErrors.ChecksumErrors.Value())
+		stats.SetRetransmits(t.SendErrors.Retransmits.Value())
+	case *tcpip.TransportEndpointStats:
+		stats.SetPacketsSent(t.PacketsSent.Value())
+		stats.SetPacketsReceived(t.PacketsReceived.Value())
+		stats.SetSendErrors(sendErrorsCount(&t.SendErrors))
+		stats.SetReceiveErrors(receiveErrorsCount(&t.ReceiveErrors))
+	}
+	return stats
+}
+
+// incomingCPU returns the index of the receive queue on which the endpoint's
+// flow arrives, or -1 if the endpoint is not associated with an interface or
+// the interface has a single receive queue.
+func (ep *endpoint) incomingCPU() int32 {
+	info, ok := ep.ep.Info().(*stack.TransportEndpointInfo)
+	if !ok || info.RegisterNICID == 0 {
+		return -1
+	}
+	nicInfo, ok := ep.ns.stack.NICInfo()[info.RegisterNICID]
+	if !ok {
+		return -1
+	}
+	ifs := nicInfo.Context.(*ifState)
+	if ifs.rxQueues == nil {
+		return -1
+	}
+	return ifs.rxQueues.RxQueueIndex(info.ID)
+}
+
+// consumeError returns the endpoint's pending error and marks it consumed.
+func (ep *endpoint) consumeError(tag string) tcpip.Error {
 	err := func() tcpip.Error {
 		ep.terminal.mu.Lock()
 		defer ep.terminal.mu.Unlock()
+		// Whatever error was latched is consumed along with the pending error.
+		latched := ep.terminal.mu.latched
+		ep.terminal.mu.latched = nil
 		if ch := ep.terminal.mu.ch; ch != nil {
 			err := <-ch
-			_ = syslog.DebugTf("GetError", "%p: err=%#v", ep, err)
+			_ = syslog.DebugTf(tag, "%p: err=%#v", ep, err)
 			return err
 		}
+		// An error the endpoint holds is newer than the one latched, if any.
 		err := ep.ep.LastError()
+		if err == nil {
+			err = latched
+		}
 		ep.terminal.setConsumedLocked(err)
-		_ = syslog.DebugTf("GetError", "%p: err=%#v", ep, err)
+		_ = syslog.DebugTf(tag, "%p: err=%#v", ep, err)
 		return err
 	}()
 	ep.pending.mustUpdate()
-	if err != nil {
+	return err
+}
+
+func (ep *endpoint) GetError(fidl.Context) (socket.BaseSocketGetErrorResult, error) {
+	if err := ep.consumeError("GetError"); err != nil {
 		return socket.BaseSocketGetErrorResultWithErr(tcpipErrorToCode(err)), nil
 	}
 	return socket.BaseSocketGetErrorResultWithResponse(socket.BaseSocketGetErrorResponse{}), nil
 }
 
+// LatchLastError returns the error that would be returned by GetError without
+// consuming it.
+//
+// gVisor clears an endpoint's error when it is retrieved, so this moves a
+// non-terminal error from the endpoint to the socket, where GetError and
+// ClearLastError still find it. The endpoint then no longer reports the
+// error, e.g. through EventErr readiness.
+//
+// Intended for debugging; fdio relies on the consuming semantics of GetError.
+func (ep *endpoint) LatchLastError() tcpip.Error {
+	ep.terminal.mu.Lock()
+	defer ep.terminal.mu.Unlock()
+	if ep.terminal.mu.ch == nil {
+		// gVisor clears the error on retrieval, so hold on to it until it is
+		// consumed. A newer error replaces it, as a socket only holds the last
+		// one.
+		if err := ep.ep.LastError(); err != nil {
+			ep.terminal.mu.latched = err
+		}
+	}
+	return ep.latchedErrorLocked()
+}
+
+// latchedError returns the error held by the socket that GetError would
+// return, without retrieving a new one from the endpoint. Unlike
+// LatchLastError, it leaves the socket and the endpoint unchanged.
+func (ep *endpoint) latchedError() tcpip.Error {
+	ep.terminal.mu.Lock()
+	defer ep.terminal.mu.Unlock()
+	return ep.latchedErrorLocked()
+}
+
+func (ep *endpoint) latchedErrorLocked() tcpip.Error {
+	if ch := ep.terminal.mu.ch; ch != nil {
+		// The channel is buffered and closed after being filled, so it holds a
+		// value only while the terminal error is unconsumed.
+		if len(ch) == 0 {
+			return nil
+		}
+		return ep.terminal.mu.err
+	}
+	return ep.terminal.mu.latched
+}
+
+// ClearLastError consumes and returns the error that would be returned by
+// GetError.
+func (ep *endpoint) ClearLastError() tcpip.Error {
+	return ep.consumeError("ClearLastError")
+}
+
 func setBufferSize(size uint64, set func(int64, bool), limits func() (min, max int64)) {
 	if size > math.MaxInt64 {
 		size = math.MaxInt64
@@ -614,6 +876,33 @@ func (ep *endpoint) SetSendBuffer(_ fidl.Context, size uint64) (socket.BaseSocke
 	return socket.BaseSocketSetSendBufferResultWithResponse(socket.BaseSocketSetSendBufferResponse{}), nil
 }
 
+// maxForcedBufferSize is the ceiling on buffer sizes set with SO_SNDBUFFORCE
+// and SO_RCVBUFFORCE, which otherwise bypass the stack's maximum.
+const maxForcedBufferSize = math.MaxInt32
+
+// setBufferSizeForce is like setBufferSize, but clamps to maxForcedBufferSize
+// rather than the stack's maximum.
+func setBufferSizeForce(size uint64, set func(int64, bool), limits func() (min, max int64)) {
+	setBufferSize(size, set, func() (int64, int64) {
+		min, _ := limits()
+		return min, maxForcedBufferSize
+	})
+}
+
+// setSendBufferForce implements SO_SNDBUFFORCE. On Linux it requires
+// CAP_NET_ADMIN, which the caller must check.
+func (ep *endpoint) setSendBufferForce(size uint64) {
+	opts := ep.ep.SocketOptions()
+	setBufferSizeForce(size, opts.SetSendBufferSize, opts.SendBufferLimits)
+}
+
+// setReceiveBufferForce implements SO_RCVBUFFORCE. On Linux it requires
+// CAP_NET_ADMIN, which the caller must check.
+func (ep *endpoint) setReceiveBufferForce(size uint64) {
+	opts := ep.ep.SocketOptions()
+	setBufferSizeForce(size, opts.SetReceiveBufferSize, opts.ReceiveBufferLimits)
+}
+
 func (ep *endpoint) GetSendBuffer(fidl.Context) (socket.BaseSocketGetSendBufferResult, error) {
 	size := ep.ep.SocketOptions().GetSendBufferSize()
 	return socket.BaseSocketGetSendBufferResultWithResponse(socket.BaseSocketGetSendBufferResponse{ValueBytes: uint64(size)}), nil
@@ -659,22 +948,26 @@ func (ep *endpoint) GetAcceptConn(fidl.Context) (socket.BaseSocketGetAcceptConnR
 }
 
 func (ep *endpoint) SetBindToDevice(_ fidl.Context, value string) (socket.BaseSocketSetBindToDeviceResult, error) {
-	if err := func() tcpip.Error {
-		if len(value) == 0 {
-			return ep.ep.SocketOptions().SetBindToDevice(0)
-		}
-		for id, info := range ep.ns.stack.NICInfo() {
-			if value == info.Name {
-				return ep.ep.SocketOptions().SetBindToDevice(int32(id))
-			}
-		}
-		return &tcpip.ErrUnknownDevice{}
-	}(); err != nil {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if err := ep.bindToDeviceLocked(value); err != nil {
 		return socket.BaseSocketSetBindToDeviceResultWithErr(tcpipErrorToCode(err)), nil
 	}
 	return socket.BaseSocketSetBindToDeviceResultWithResponse(socket.BaseSocketSetBindToDeviceResponse{}), nil
 }
 
+func (ep *endpoint) bindToDeviceLocked(value string) tcpip.Error {
+	if len(value) == 0 {
+		return ep.ep.SocketOptions().SetBindToDevice(0)
+	}
+	for id, info := range ep.ns.stack.NICInfo() {
+		if value == info.Name {
+			return ep.ep.SocketOptions().SetBindToDevice(int32(id))
+		}
+	}
+	return &tcpip.ErrUnknownDevice{}
+}
+
 func (ep *endpoint) GetBindToDevice(fidl.Context) (socket.BaseSocketGetBindToDeviceResult, error) {
 	id := ep.ep.SocketOptions().GetBindToDevice()
 	if id == 0 {
@@ -831,14 +1124,14 @@ func (ep *endpoint) SetIpv6UnicastHops(_ fidl.Context, value socket.OptionalUint
 	if err != nil {
 		return socket.BaseNetworkSocketSetIpv6UnicastHopsResultWithErr(tcpipErrorToCode(err)), nil
 	}
-	if err := ep.ep.SetSockOptInt(tcpip.IPv6HopLimitOption, v); err != nil {
+	if err := ep.setUnicastHops(v); err != nil {
 		return socket.BaseNetworkSocketSetIpv6UnicastHopsResultWithErr(tcpipErrorToCode(err)), nil
 	}
 	return socket.BaseNetworkSocketSetIpv6UnicastHopsResultWithResponse(socket.BaseNetworkSocketSetIpv6UnicastHopsResponse{}), nil
 }
 
 func (ep *endpoint) GetIpv6UnicastHops(fidl.Context) (socket.BaseNetworkSocketGetIpv6UnicastHopsResult, error) {
-	value, err := ep.ep.GetSockOptInt(tcpip.IPv6HopLimitOption)
+	value, err := ep.unicastHops()
 	if err != nil {
 		return socket.BaseNetworkSocketGetIpv6UnicastHopsResultWithErr(tcpipErrorToCode(err)), nil
 	}
@@ -983,6 +1276,7 @@ func (ep *endpoint) AddIpMembership(_ fidl.Context, membership socket.IpMulticas
 	if err := ep.ep.SetSockOpt(&opt); err != nil {
 		return socket.BaseNetworkSocketAddIpMembershipResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	ep.ns.joinMulticastGroup(ep, opt.MulticastAddr)
 	return socket.BaseNetworkSocketAddIpMembershipResultWithResponse(socket.BaseNetworkSocketAddIpMembershipResponse{}), nil
 }
 
@@ -995,6 +1289,7 @@ func (ep *endpoint) DropIpMembership(_ fidl.Context, membership socket.IpMultica
 	if err := ep.ep.SetSockOpt(&opt); err != nil {
 		return socket.BaseNetworkSocketDropIpMembershipResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	ep.ns.leaveMulticastGroup(ep, opt.MulticastAddr)
 	return socket.BaseNetworkSocketDropIpMembershipResultWithResponse(socket.BaseNetworkSocketDropIpMembershipResponse{}), nil
 }
 
@@ -1006,6 +1301,7 @@ func (ep *endpoint) AddIpv6Membership(_ fidl.Context, membership socket.Ipv6Mult
 	if err := ep.ep.SetSockOpt(&opt); err != nil {
 		return socket.BaseNetworkSocketAddIpv6MembershipResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	ep.ns.joinMulticastGroup(ep, opt.MulticastAddr)
 	return socket.BaseNetworkSocketAddIpv6MembershipResultWithResponse(socket.BaseNetworkSocketAddIpv6MembershipResponse{}), nil
 }
 
@@ -1017,6 +1313,7 @@ func (ep *endpoint) DropIpv6Membership(_ fidl.Context, membership socket.Ipv6Mul
 	if err := ep.ep.SetSockOpt(&opt); err != nil {
 		return socket.BaseNetworkSocketDropIpv6MembershipResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	ep.ns.leaveMulticastGroup(ep, opt.MulticastAddr)
 	return socket.BaseNetworkSocketDropIpv6MembershipResultWithResponse(socket.BaseNetworkSocketDropIpv6MembershipResponse{}), nil
 }
 
@@ -1050,6 +1347,27 @@ func (ep *endpoint) GetIpPacketInfo(fidl.Context) (socket.BaseNetworkSocketGetIp
 	return socket.BaseNetworkSocketGetIpPacketInfoResultWithResponse(socket.BaseNetworkSocketGetIpPacketInfoResponse{Value: value}), nil
 }
 
+// SetIpReceiveErr implements IP_RECVERR. While it is enabled, ICMP errors
+// received for the socket are queued on its error queue; disabling it clears
+// the queue.
+func (ep *endpoint) SetIpReceiveErr(value bool) {
+	ep.ep.SocketOptions().SetRecvError(value)
+}
+
+func (ep *endpoint) GetIpReceiveErr() bool {
+	return ep.ep.SocketOptions().GetRecvError()
+}
+
+// SetIpv6ReceiveErr implements IPV6_RECVERR, the IPv6 counterpart of
+// IP_RECVERR.
+func (ep *endpoint) SetIpv6ReceiveErr(value bool) {
+	ep.ep.SocketOptions().SetIPv6RecvError(value)
+}
+
+func (ep *endpoint) GetIpv6ReceiveErr() bool {
+	return ep.ep.SocketOptions().GetIPv6RecvError()
+}
+
 // endpointWithSocket implements a network socket that uses a zircon socket for
 // its data plane. This structure creates a pair of goroutines which are
 // responsible for moving data and signals between the underlying
@@ -1089,6 +1407,12 @@ type endpointWithSocket struct {
 
 	// onConnect is used to register callbacks for connected sockets.
 	onConnect sync.Once
+
+	// tcpRepair holds whether TCP_REPAIR is enabled.
+	tcpRepair struct {
+		sync.Mutex
+		enabled bool
+	}
 }
 
 func newEndpointWithSocket(ep tcpip.Endpoint, wq *waiter.Queue, transProto tcpip.TransportProtocolNumber, netProto tcpip.NetworkProtocolNumber, ns *Netstack) (*endpointWithSocket, error) {
@@ -1188,6 +1512,13 @@ func (epe *endpointWithEvent) shutdown(how socket.ShutdownMode) (posix.Errno, er
 		return tcpipErrorToCode(err), nil
 	}
 	if flags&tcpip.ShutdownRead != 0 {
+		// The endpoint is now readable, as reads return EOF once the receive
+		// queue is drained. Refresh the signals before unregistering so that
+		// clients blocked waiting for incoming data are woken up even if the
+		// endpoint's notification raced with the shutdown.
+		if err := epe.pending.update(); err != nil {
+			return 0, err
+		}
 		epe.wq.EventUnregister(&epe.entry)
 	}
 	if err := epe.local.SignalPeer(0, signals); err != nil {
@@ -1396,6 +1727,16 @@ func (eps *endpointWithSocket) Accept(wantAddr bool) (posix.Errno, *tcpip.FullAd
 			panic(err)
 		}
 	}
+	// Accepted endpoints get the stack-wide keepalive defaults like any other
+	// new endpoint, rather than those in effect when the listener was created,
+	// except for the options set on the listener, which they inherit.
+	keepaliveSet := eps.keepaliveOptionsSet()
+	if eps.transProto == tcp.ProtocolNumber {
+		if err := eps.endpoint.ns.applyTCPKeepaliveDefaults(ep, keepaliveSet); err != nil {
+			ep.Close()
+			return tcpipErrorToCode(err), nil, nil, nil
+		}
+	}
 
 	switch localAddr, err := ep.GetLocalAddress(); err.(type) {
 	case *tcpip.ErrNotConnected:
@@ -1424,10 +1765,20 @@ func (eps *endpointWithSocket) Accept(wantAddr bool) (posix.Errno, *tcpip.FullAd
 	}
 
 	{
+		eps.hopLimit.Lock()
+		hopLimit := eps.hopLimit.socketHopLimitState
+		eps.hopLimit.Unlock()
 		eps, err := newEndpointWithSocket(ep, wq, eps.transProto, eps.netProto, eps.endpoint.ns)
 		if err != nil {
 			return 0, nil, nil, err
 		}
+		eps.keepalive.set = keepaliveSet
+		// The accepted endpoint inherits the listener's hop limit, which only
+		// becomes the interface default once the route to the peer is known.
+		eps.hopLimit.Lock()
+		eps.hopLimit.socketHopLimitState = hopLimit
+		eps.applyRouteHopLimitLocked(nil)
+		eps.hopLimit.Unlock()
 
 		// NB: signal connectedness before handling any error below to ensure
 		// correct interpretation in fdio.
@@ -1623,6 +1974,8 @@ func (eps *endpointWithSocket) loopRead(ch chan<- struct{}) {
 		case nil, *tcpip.ErrBadBuffer:
 			if err == nil {
 				eps.ep.ModerateRecvBuf(res.Count)
+				// TODO(https://fxbug.dev/21106): deliver the TOS of received
+				// segments when IP_RECVTOS is set.
 			}
 			// `tcpip.Endpoint.Read` returns a nil error if _anything_ was written
 			// - even if the writer returned an error - we always want to handle
@@ -1930,6 +2283,14 @@ func (s *datagramSocket) recvMsg(opts tcpip.ReadOptions, dataLen uint32) ([]byte
 	return b.Bytes(), res, err
 }
 
+// isRecvEOF returns true if err reports that the endpoint was shut down for
+// reading and its receive queue is drained. RecvMsg reports this as a
+// zero-length read, as Linux does.
+func isRecvEOF(err tcpip.Error) bool {
+	_, ok := err.(*tcpip.ErrClosedForReceive)
+	return ok
+}
+
 func (s *networkDatagramSocket) recvMsg(wantAddr bool, dataLen uint32, peek bool) (fidlnet.SocketAddress, []byte, uint32, tcpip.ControlMessages, tcpip.Error) {
 	bytes, res, err := s.datagramSocket.recvMsg(tcpip.ReadOptions{
 		Peek:           peek,
@@ -1947,9 +2308,66 @@ func (s *networkDatagramSocket) recvMsg(wantAddr bool, dataLen uint32, peek bool
 	return addr, bytes, uint32(res.Total - res.Count), res.ControlMessages, nil
 }
 
+// sockExtendedError describes an error read from a socket's error queue, like
+// Linux's struct sock_extended_err.
+type sockExtendedError struct {
+	Errno  posix.Errno
+	Origin tcpip.SockErrOrigin
+	Type   uint8
+	Code   uint8
+	Info   uint32
+	// Offender is the address of the node that reported the error.
+	Offender fidlnet.SocketAddress
+}
+
+// recvErr implements recvmsg with MSG_ERRQUEUE: it returns the oldest error on
+// the socket's error queue along with the destination and payload of the
+// packet that caused it. The queue is only populated while IP_RECVERR or
+// IPV6_RECVERR is enabled.
+func (s *networkDatagramSocket) recvErr(wantAddr bool, dataLen uint32, peek bool) (fidlnet.SocketAddress, []byte, uint32, sockExtendedError, tcpip.Error) {
+	opts := s.ep.SocketOptions()
+	var sockErr *tcpip.SockError
+	if peek {
+		sockErr = opts.PeekErr()
+	} else {
+		sockErr = opts.DequeueErr()
+	}
+	if err := s.pending.update(); err != nil {
+		panic(err)
+	}
+	if sockErr == nil {
+		return fidlnet.SocketAddress{}, nil, 0, sockExtendedError{}, &tcpip.ErrWouldBlock{}
+	}
+
+	var addr fidlnet.SocketAddress
+	if wantAddr {
+		addr = toNetSocketAddress(sockErr.NetProto, sockErr.Dst)
+	}
+	data := sockErr.Payload
+	var truncated uint32
+	if n := uint32(len(data)); n > dataLen {
+		truncated = n - dataLen
+		data = data[:dataLen]
+	}
+	extended := sockExtendedError{
+		Errno:    tcpipErrorToCode(sockErr.Err),
+		Offender: toNetSocketAddress(sockErr.NetProto, sockErr.Offender),
+	}
+	if cause := sockErr.Cause; cause != nil {
+		extended.Origin = cause.Origin()
+		extended.Type = cause.Type()
+		extended.Code = cause.Code()
+		extended.Info = cause.Info()
+	}
+	return addr, append([]byte(nil), data...), truncated, extended, nil
+}
+
 func (s *datagramSocketImpl) RecvMsg(_ fidl.Context, wantAddr bool, dataLen uint32, wantControl bool, flags socket.RecvMsgFlags) (socket.DatagramSocketRecvMsgResult, error) {
 	addr, data, truncated, cmsg, err := s.recvMsg(wantAddr, dataLen, flags&socket.RecvMsgFlagsPeek != 0)
 	if err != nil {
+		if isRecvEOF(err) {
+			return socket.DatagramSocketRecvMsgResultWithResponse(socket.DatagramSocketRecvMsgResponse{}), nil
+		}
 		return socket.DatagramSocketRecvMsgResultWithErr(tcpipErrorToCode(err)), nil
 	}
 	var pAddr *fidlnet.SocketAddress
@@ -1998,6 +2416,11 @@ func (s *networkDatagramSocket) sendMsg(addr *fidlnet.SocketAddress, data []uint
 		to = &fullAddr
 	}
 
+	if s.endpoint.netProto == ipv6.ProtocolNumber {
+		s.hopLimit.Lock()
+		defer s.hopLimit.Unlock()
+		s.applyRouteHopLimitLocked(to)
+	}
 	return s.datagramSocket.sendMsg(to, data)
 }
 
@@ -2032,6 +2455,17 @@ func (s *datagramSocketImpl) GetInfo(fidl.Context) (socket.DatagramSocketGetInfo
 	}), nil
 }
 
+// GetSocketStats returns the socket's counters.
+func (s *datagramSocketImpl) GetSocketStats(fidl.Context) (socketStats, error) {
+	return s.stats(), nil
+}
+
+// GetIncomingCpu returns the index of the receive queue on which the socket's
+// packets arrive, or -1 if it is unknown.
+func (s *datagramSocketImpl) GetIncomingCpu(fidl.Context) (int32, error) {
+	return s.incomingCPU(), nil
+}
+
 type streamSocketImpl struct {
 	*endpointWithSocket
 
@@ -2249,6 +2683,17 @@ func (s *streamSocketImpl) GetInfo(fidl.Context) (socket.StreamSocketGetInfoResu
 	}), nil
 }
 
+// GetSocketStats returns the socket's counters.
+func (s *streamSocketImpl) GetSocketStats(fidl.Context) (socketStats, error) {
+	return s.stats(), nil
+}
+
+// GetIncomingCpu returns the index of the receive queue on which the socket's
+// packets arrive, or -1 if it is unknown.
+func (s *streamSocketImpl) GetIncomingCpu(fidl.Context) (int32, error) {
+	return s.incomingCPU(), nil
+}
+
 func (s *streamSocketImpl) SetTcpNoDelay(_ fidl.Context, value bool) (socket.StreamSocketSetTcpNoDelayResult, error) {
 	s.ep.SocketOptions().SetDelayOption(!value)
 	return socket.StreamSocketSetTcpNoDelayResultWithResponse(socket.StreamSocketSetTcpNoDelayResponse{}), nil
@@ -2309,6 +2754,7 @@ func (s *streamSocketImpl) SetTcpKeepAliveIdle(_ fidl.Context, valueSecs uint32)
 	if err := s.ep.SetSockOpt(&opt); err != nil {
 		return socket.StreamSocketSetTcpKeepAliveIdleResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	s.setKeepaliveOption(tcpKeepaliveIdle)
 	return socket.StreamSocketSetTcpKeepAliveIdleResultWithResponse(socket.StreamSocketSetTcpKeepAliveIdleResponse{}), nil
 }
 
@@ -2331,6 +2777,7 @@ func (s *streamSocketImpl) SetTcpKeepAliveInterval(_ fidl.Context, valueSecs uin
 	if err := s.ep.SetSockOpt(&opt); err != nil {
 		return socket.StreamSocketSetTcpKeepAliveIntervalResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	s.setKeepaliveOption(tcpKeepaliveInterval)
 	return socket.StreamSocketSetTcpKeepAliveIntervalResultWithResponse(socket.StreamSocketSetTcpKeepAliveIntervalResponse{}), nil
 }
 
@@ -2352,6 +2799,7 @@ func (s *streamSocketImpl) SetTcpKeepAliveCount(_ fidl.Context, value uint32) (s
 	if err := s.ep.SetSockOptInt(tcpip.KeepaliveCountOption, int(value)); err != nil {
 		return socket.StreamSocketSetTcpKeepAliveCountResultWithErr(tcpipErrorToCode(err)), nil
 	}
+	s.setKeepaliveOption(tcpKeepaliveCount)
 	return socket.StreamSocketSetTcpKeepAliveCountResultWithResponse(socket.StreamSocketSetTcpKeepAliveCountResponse{}), nil
 }
 
@@ -2553,6 +3001,83 @@ func (s *streamSocketImpl) GetTcpLinger(fidl.Context) (socket.StreamSocketGetTcp
 	}), nil
 }
 
+// tcpRepairEndpoint is implemented by TCP endpoints which can export their
+// full state, as required by TCP_REPAIR.
+type tcpRepairEndpoint interface {
+	CompleteState() *stack.TCPEndpointState
+}
+
+// tcpRepairState is the state of a TCP connection exported in repair mode.
+type tcpRepairState struct {
+	// SendUnacknowledged is the sequence number of the oldest byte sent but
+	// not yet acknowledged by the peer.
+	SendUnacknowledged uint32
+	// SendNext is the sequence number of the next byte to send.
+	SendNext uint32
+	// ReceiveNext is the sequence number of the next byte expected from the
+	// peer.
+	ReceiveNext uint32
+	// SendQueueSize and ReceiveQueueSize hold the number of bytes in the send
+	// and receive queues.
+	SendQueueSize    int
+	ReceiveQueueSize int
+}
+
+// SetTcpRepair implements TCP_REPAIR, which allows the state of the connection
+// to be read with GetTcpRepairState, e.g. to checkpoint it.
+//
+// ENOPROTOOPT is returned if the transport endpoint cannot export its state.
+// On Linux it requires CAP_NET_ADMIN, which the caller must check. Restoring a
+// connection from its state is not supported.
+func (s *streamSocketImpl) SetTcpRepair(value bool) posix.Errno {
+	if _, ok := s.ep.(tcpRepairEndpoint); !ok {
+		return posix.ErrnoEnoprotoopt
+	}
+	s.tcpRepair.Lock()
+	s.tcpRepair.enabled = value
+	s.tcpRepair.Unlock()
+	return 0
+}
+
+func (s *streamSocketImpl) GetTcpRepair() (bool, posix.Errno) {
+	if _, ok := s.ep.(tcpRepairEndpoint); !ok {
+		return false, posix.ErrnoEnoprotoopt
+	}
+	s.tcpRepair.Lock()
+	defer s.tcpRepair.Unlock()
+	return s.tcpRepair.enabled, 0
+}
+
+// GetTcpRepairState returns the sequence numbers and queue sizes of the
+// connection. Like TCP_QUEUE_SEQ on Linux, it fails with EPERM unless
+// TCP_REPAIR is enabled.
+func (s *streamSocketImpl) GetTcpRepairState() (tcpRepairState, posix.Errno) {
+	ep, ok := s.ep.(tcpRepairEndpoint)
+	if !ok {
+		return tcpRepairState{}, posix.ErrnoEnoprotoopt
+	}
+	s.tcpRepair.Lock()
+	enabled := s.tcpRepair.enabled
+	s.tcpRepair.Unlock()
+	if !enabled {
+		return tcpRepairState{}, posix.ErrnoEperm
+	}
+
+	complete := ep.CompleteState()
+	state := tcpRepairState{
+		SendUnacknowledged: uint32(complete.Sender.SndUna),
+		SendNext:           uint32(complete.Sender.SndNxt),
+		ReceiveNext:        uint32(complete.Receiver.RcvNxt),
+	}
+	if v, err := s.ep.GetSockOptInt(tcpip.SendQueueSizeOption); err == nil {
+		state.SendQueueSize = v
+	}
+	if v, err := s.ep.GetSockOptInt(tcpip.ReceiveQueueSizeOption); err == nil {
+		state.ReceiveQueueSize = v
+	}
+	return state, 0
+}
+
 func (ns *Netstack) onAddEndpoint(e *endpoint) {
 	ns.stats.SocketsCreated.Increment()
 	var key uint64
@@ -2573,6 +3098,7 @@ func (ns *Netstack) onAddEndpoint(e *endpoint) {
 		_ = syslog.Errorf("endpoint map store error, key %d exists for endpoint %+v", key, info)
 	} else {
 		e.key = key
+		ns.sockets.Store(key, e)
 	}
 }
 
@@ -2583,10 +3109,137 @@ func (ns *Netstack) onRemoveEndpoint(key uint64) bool {
 	if key == 0 {
 		return false
 	}
+	if e, ok := ns.sockets.LoadAndDelete(key); ok {
+		ep := e.(*endpoint)
+		ns.leaveReusePortGroup(ep)
+		ns.leaveMulticastGroups(ep)
+	}
 	_, deleted := ns.endpoints.LoadAndDelete(key)
 	return deleted
 }
 
+// EndpointSummary describes a socket for diagnostics.
+type EndpointSummary struct {
+	// Key is the socket's key in the endpoints map.
+	Key        uint64
+	NetProto   tcpip.NetworkProtocolNumber
+	TransProto tcpip.TransportProtocolNumber
+	// ID holds the socket's local and remote addresses and ports.
+	ID           stack.TransportEndpointID
+	BindNICID    tcpip.NICID
+	ReuseAddress bool
+	ReusePort    bool
+	State        string
+	// ReceiveQueueSize and SendQueueSize hold the number of bytes in the
+	// socket's receive and send buffers.
+	ReceiveQueueSize int
+	SendQueueSize    int
+	// LastError is the error the socket holds for GetError to return. Errors
+	// the endpoint has yet to hand over to the socket are not included, so
+	// that summarizing a socket does not change it. It is nil for endpoints not
+	// created through the socket provider. It is nil for endpoints not created through the socket
+	// provider.
+	LastError tcpip.Error
+}
+
+func (ns *Netstack) summarizeEndpoint(key uint64, ep tcpip.Endpoint, info *stack.TransportEndpointInfo) EndpointSummary {
+	opts := ep.SocketOptions()
+	summary := EndpointSummary{
+		Key:          key,
+		NetProto:     info.NetProto,
+		TransProto:   info.TransProto,
+		ID:           info.ID,
+		BindNICID:    info.BindNICID,
+		ReuseAddress: opts.GetReuseAddress(),
+		ReusePort:    opts.GetReusePort(),
+		State:        endpointStateString(info.TransProto, ep.State()),
+	}
+	if v, err := ep.GetSockOptInt(tcpip.ReceiveQueueSizeOption); err == nil {
+		summary.ReceiveQueueSize = v
+	}
+	if v, err := ep.GetSockOptInt(tcpip.SendQueueSizeOption); err == nil {
+		summary.SendQueueSize = v
+	}
+	if e, ok := ns.sockets.Load(key); ok {
+		summary.LastError = e.(*endpoint).latchedError()
+	}
+	return summary
+}
+
+// WhoHoldsAddress returns summaries of the sockets, sorted by key, whose
+// binding conflicts with a bind to the local address and port: those bound to
+// the port on the same address or on the unspecified address. An unspecified
+// addr matches sockets bound to the port on any address.
+//
+// It is meant to help find the socket responsible for EADDRINUSE.
+func (ns *Netstack) WhoHoldsAddress(addr tcpip.Address, port uint16) []EndpointSummary {
+	var summaries []EndpointSummary
+	ns.endpoints.Range(func(key uint64, ep tcpip.Endpoint) bool {
+		info, ok := ep.Info().(*stack.TransportEndpointInfo)
+		if !ok {
+			return true
+		}
+		if info.ID.LocalPort != port {
+			return true
+		}
+		if local := info.ID.LocalAddress; len(addr) != 0 && len(local) != 0 && local != addr {
+			return true
+		}
+		summaries = append(summaries, ns.summarizeEndpoint(key, ep, info))
+		return true
+	})
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Key < summaries[j].Key })
+	return summaries
+}
+
+// LookupConnection returns a summary of the socket whose local and remote
+// addresses and ports match the given ones exactly. The NICs of the given
+// addresses are ignored. If several sockets match, the one with the smallest
+// key is returned.
+func (ns *Netstack) LookupConnection(local, remote tcpip.FullAddress) (EndpointSummary, bool) {
+	var (
+		found     bool
+		foundKey  uint64
+		foundEP   tcpip.Endpoint
+		foundInfo *stack.TransportEndpointInfo
+	)
+	ns.endpoints.Range(func(key uint64, ep tcpip.Endpoint) bool {
+		info, ok := ep.Info().(*stack.TransportEndpointInfo)
+		if !ok {
+			return true
+		}
+		if info.ID.LocalAddress != local.Addr || info.ID.LocalPort != local.Port || info.ID.RemoteAddress != remote.Addr || info.ID.RemotePort != remote.Port {
+			return true
+		}
+		if !found || key < foundKey {
+			found, foundKey, foundEP, foundInfo = true, key, ep, info
+		}
+		return true
+	})
+	if !found {
+		return EndpointSummary{}, false
+	}
+	return ns.summarizeEndpoint(foundKey, foundEP, foundInfo), true
+}
+
+// GetSocketMemoryUsage returns the total size of the send and receive buffers
+// of all sockets. Buffers are counted at their configured size rather than
+// their occupancy, as an upper bound on the memory they may consume.
+func (ns *Netstack) GetSocketMemoryUsage() (sendBytes, recvBytes uint64) {
+	return ns.endpoints.socketMemoryUsage()
+}
+
+func endpointStateString(transProto tcpip.TransportProtocolNumber, state uint32) string {
+	switch transProto {
+	case tcp.ProtocolNumber:
+		return tcp.EndpointState(state).String()
+	case udp.ProtocolNumber:
+		return transport.DatagramEndpointState(state).String()
+	default:
+		return ""
+	}
+}
+
 type providerImpl struct {
 	ns *Netstack
 }
@@ -2731,6 +3384,12 @@ func (sp *providerImpl) StreamSocket(_ fidl.Context, domain socket.Domain, proto
 		if err != nil {
 			return socket.ProviderStreamSocketResultWithErr(tcpipErrorToCode(err)), nil
 		}
+		if transProto == tcp.ProtocolNumber {
+			if err := sp.ns.applyTCPKeepaliveDefaults(ep, 0); err != nil {
+				ep.Close()
+				return socket.ProviderStreamSocketResultWithErr(tcpipErrorToCode(err)), nil
+			}
+		}
 	}
 
 	socketEp, err := newEndpointWithSocket(ep, wq, transProto, netProto, sp.ns)
@@ -2779,10 +3438,7 @@ func (sp *rawProviderImpl) Socket(ctx fidl.Context, domain socket.Domain, proto
 	}
 
 	// If the endpoint is unassociated, then the protocol number doesn't matter.
-	//
-	// 255 is a reserved protocol number as per
-	// https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml.
-	transProto := tcpip.TransportProtocolNumber(255)
+	transProto := tcpip.TransportProtocolNumber(unassociatedRawProtocol)
 	associated := true
 	switch tag := proto.Which(); tag {
 	case rawsocket.ProtocolAssociationUnassociated:
@@ -2833,6 +3489,13 @@ func (sp *rawProviderImpl) Socket(ctx fidl.Context, domain socket.Domain, proto
 	}), nil
 }
 
+// unassociatedRawProtocol is the protocol number reported by raw sockets that
+// are not associated with an IP protocol.
+//
+// 255 is a reserved protocol number as per
+// https://www.iana.org/assignments/protocol-numbers/protocol-numbers.xhtml.
+const unassociatedRawProtocol = 255
+
 type rawSocketImpl struct {
 	networkDatagramSocket
 
@@ -2902,6 +3565,9 @@ func (s *rawSocketImpl) Reopen(ctx fidl.Context, options fidlio.ConnectionOption
 func (s *rawSocketImpl) RecvMsg(_ fidl.Context, wantAddr bool, dataLen uint32, wantControl bool, flags socket.RecvMsgFlags) (rawsocket.SocketRecvMsgResult, error) {
 	addr, data, truncated, cmsg, err := s.recvMsg(wantAddr, dataLen, flags&socket.RecvMsgFlagsPeek != 0)
 	if err != nil {
+		if isRecvEOF(err) {
+			return rawsocket.SocketRecvMsgResultWithResponse(rawsocket.SocketRecvMsgResponse{}), nil
+		}
 		return rawsocket.SocketRecvMsgResultWithErr(tcpipErrorToCode(err)), nil
 	}
 	var pAddr *fidlnet.SocketAddress
@@ -2947,6 +3613,20 @@ func (s *rawSocketImpl) GetInfo(fidl.Context) (rawsocket.SocketGetInfoResult, er
 	}), nil
 }
 
+// GetProtocol returns the IP protocol number the socket is associated with, or
+// unassociatedRawProtocol if it is unassociated, matching Linux's SO_PROTOCOL
+// on raw sockets.
+func (s *rawSocketImpl) GetProtocol() uint8 {
+	switch tag := s.proto.Which(); tag {
+	case rawsocket.ProtocolAssociationUnassociated:
+		return unassociatedRawProtocol
+	case rawsocket.ProtocolAssociationAssociated:
+		return s.proto.Associated
+	default:
+		panic(fmt.Sprintf("unhandled association = %d; %#v", tag, s.proto))
+	}
+}
+
 func (s *rawSocketImpl) SetIpHeaderIncluded(_ fidl.Context, value bool) (rawsocket.SocketSetIpHeaderIncludedResult, error) {
 	s.ep.SocketOptions().SetHeaderIncluded(value)
 	return rawsocket.SocketSetIpHeaderIncludedResultWithResponse(rawsocket.SocketSetIpHeaderIncludedResponse{}), nil
@@ -3194,6 +3874,87 @@ type packetSocketImpl struct {
 	datagramSocket
 
 	kind packetsocket.Kind
+
+	// filter is shared by all connections to the socket.
+	filter *packetSocketFilter
+}
+
+// packetSocketFilter holds the BPF program attached to a packet socket.
+type packetSocketFilter struct {
+	mu struct {
+		sync.Mutex
+		program *bpfProgram
+	}
+}
+
+// SetBpfFilter validates the classic BPF program and attaches it to the
+// socket, replacing any previously attached program.
+//
+// Received packets that the program rejects are dropped before being
+// delivered to the client.
+func (s *packetSocketImpl) SetBpfFilter(instructions []bpfInstruction) posix.Errno {
+	program, err := newBPFProgram(instructions)
+	if err != nil {
+		_ = syslog.DebugTf("SetBpfFilter", "%p: %s", s.endpointWithEvent, err)
+		return posix.ErrnoEinval
+	}
+	s.filter.mu.Lock()
+	s.filter.mu.program = &program
+	s.filter.mu.Unlock()
+	return 0
+}
+
+// RemoveBpfFilter detaches the BPF program attached to the socket, if any.
+func (s *packetSocketImpl) RemoveBpfFilter() posix.Errno {
+	s.filter.mu.Lock()
+	defer s.filter.mu.Unlock()
+	if s.filter.mu.program == nil {
+		return posix.ErrnoEnoent
+	}
+	s.filter.mu.program = nil
+	return 0
+}
+
+// recvMsg reads a packet from the endpoint, dropping packets rejected by the
+// attached BPF program.
+func (s *packetSocketImpl) recvMsg(opts tcpip.ReadOptions, dataLen uint32) ([]byte, tcpip.ReadResult, tcpip.Error) {
+	s.filter.mu.Lock()
+	defer s.filter.mu.Unlock()
+
+	program := s.filter.mu.program
+	if program == nil {
+		return s.datagramSocket.recvMsg(opts, dataLen)
+	}
+
+	peekOpts := opts
+	peekOpts.Peek = true
+	peekOpts.NeedLinkPacketInfo = true
+	for {
+		// Peek the whole packet so that the filter can inspect it regardless of
+		// the length requested by the client.
+		b, res, err := s.datagramSocket.recvMsg(peekOpts, math.MaxUint32)
+		if err != nil {
+			return nil, res, err
+		}
+		accept := program.run(b, res.LinkPacketInfo.Protocol)
+		if accept == 0 || !opts.Peek {
+			if _, _, err := s.datagramSocket.recvMsg(tcpip.ReadOptions{}, 0); err != nil {
+				return nil, res, err
+			}
+		}
+		if accept == 0 {
+			continue
+		}
+		if uint64(len(b)) > uint64(accept) {
+			b = b[:accept]
+		}
+		res.Total = len(b)
+		if uint64(len(b)) > uint64(dataLen) {
+			b = b[:dataLen]
+		}
+		res.Count = len(b)
+		return b, res, nil
+	}
 }
 
 func (s *packetSocketImpl) Describe(fidl.Context) (fidlio.NodeInfo, error) {
@@ -3316,22 +4077,10 @@ func (s *packetSocketImpl) GetInfo(fidl.Context) (packetsocket.SocketGetInfoResu
 			return packetsocket.SocketGetInfoResultWithErr(posix.ErrnoEnodev), nil
 		}
 
-		var hwType packetsocket.HardwareType
-		switch nicInfo.ARPHardwareType {
-		case header.ARPHardwareNone:
-			hwType = packetsocket.HardwareTypeNetworkOnly
-		case header.ARPHardwareEther:
-			hwType = packetsocket.HardwareTypeEthernet
-		case header.ARPHardwareLoopback:
-			hwType = packetsocket.HardwareTypeLoopback
-		default:
-			panic(fmt.Sprintf("unhandled %[1]T variant = %[1]d", nicInfo.ARPHardwareType))
-		}
-
 		boundInterface = packetsocket.BoundInterfaceWithSpecified(packetsocket.InterfaceProperties{
 			Id:   uint64(addr.NIC),
 			Addr: tcpipLinkAddressToFidlHWAddr(nicInfo.LinkAddress),
-			Type: hwType,
+			Type: arpHardwareTypeToFidl(nicInfo.ARPHardwareType),
 		})
 	}
 
@@ -3342,6 +4091,19 @@ func (s *packetSocketImpl) GetInfo(fidl.Context) (packetsocket.SocketGetInfoResu
 	}), nil
 }
 
+func arpHardwareTypeToFidl(v header.ARPHardwareType) packetsocket.HardwareType {
+	switch v {
+	case header.ARPHardwareNone:
+		return packetsocket.HardwareTypeNetworkOnly
+	case header.ARPHardwareEther:
+		return packetsocket.HardwareTypeEthernet
+	case header.ARPHardwareLoopback:
+		return packetsocket.HardwareTypeLoopback
+	default:
+		panic(fmt.Sprintf("unhandled %[1]T variant = %[1]d", v))
+	}
+}
+
 func tcpipPacketTypeToFidl(v tcpip.PacketType) packetsocket.PacketType {
 	switch v {
 	case tcpip.PacketHost:
@@ -3382,12 +4144,15 @@ func (s *packetSocketImpl) RecvMsg(_ fidl.Context, wantPacketInfo bool, dataLen
 	// TODO(https://fxbug.dev/21106): do something with control messages.
 	_ = wantControl
 
-	bytes, res, err := s.datagramSocket.recvMsg(tcpip.ReadOptions{
+	bytes, res, err := s.recvMsg(tcpip.ReadOptions{
 		Peek:               flags&socket.RecvMsgFlagsPeek != 0,
 		NeedRemoteAddr:     wantPacketInfo,
 		NeedLinkPacketInfo: wantPacketInfo,
 	}, dataLen)
 	if err != nil {
+		if isRecvEOF(err) {
+			return packetsocket.SocketRecvMsgResultWithResponse(packetsocket.SocketRecvMsgResponse{}), nil
+		}
 		return packetsocket.SocketRecvMsgResultWithErr(tcpipErrorToCode(err)), nil
 	}
 
@@ -3449,6 +4214,29 @@ type packetProviderImpl struct {
 	ns *Netstack
 }
 
+// interfaceIdentity identifies an interface by ID and name.
+type interfaceIdentity struct {
+	id   tcpip.NICID
+	name string
+}
+
+// GetInterfacesByHardwareType returns the interfaces with the given hardware
+// type, ordered by ID.
+func (sp *packetProviderImpl) GetInterfacesByHardwareType(hwType packetsocket.HardwareType) []interfaceIdentity {
+	var result []interfaceIdentity
+	for id, info := range sp.ns.stack.NICInfo() {
+		if arpHardwareTypeToFidl(info.ARPHardwareType) == hwType {
+			result = append(result, interfaceIdentity{id: id, name: info.Name})
+		}
+	}
+
+	// Ensure deterministic API response.
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].id < result[j].id
+	})
+	return result
+}
+
 func (sp *packetProviderImpl) Socket(ctx fidl.Context, kind packetsocket.Kind) (packetsocket.ProviderSocketResult, error) {
 	cooked := false
 	switch kind {
@@ -3477,6 +4265,7 @@ func (sp *packetProviderImpl) Socket(ctx fidl.Context, kind packetsocket.Kind) (
 	s := packetSocketImpl{
 		datagramSocket: datagramSocket,
 		kind:           kind,
+		filter:         &packetSocketFilter{},
 	}
 
 	localC, peerC, err := zx.NewChannel(0)
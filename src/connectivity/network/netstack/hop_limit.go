@@ -0,0 +1,119 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build !build_with_native_toolchain
+// +build !build_with_native_toolchain
+
+package netstack
+
+import (
+	"sync/atomic"
+
+	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// socketHopLimit tracks how the IPv6 unicast hop limit of a socket was chosen.
+type socketHopLimit struct {
+	// Mutex serializes choosing the hop limit with the writes that use it.
+	sync.Mutex
+	socketHopLimitState
+}
+
+// socketHopLimitState is the state of a socketHopLimit, which accepted
+// sockets inherit from their listener along with its hop limit.
+type socketHopLimitState struct {
+	// explicit is true if the hop limit was set with IPV6_UNICAST_HOPS, in
+	// which case it takes precedence over the default of the interface.
+	explicit bool
+	// fromInterface is true if the hop limit is the default of an interface
+	// rather than the stack-wide default.
+	fromInterface bool
+}
+
+// setUnicastHops sets the hop limit requested with IPV6_UNICAST_HOPS; -1
+// restores the default of the interface the socket is routed through.
+func (ep *endpoint) setUnicastHops(v int) tcpip.Error {
+	ep.hopLimit.Lock()
+	defer ep.hopLimit.Unlock()
+	if err := ep.ep.SetSockOptInt(tcpip.IPv6HopLimitOption, v); err != nil {
+		return err
+	}
+	ep.hopLimit.explicit = v != -1
+	ep.hopLimit.fromInterface = false
+	ep.applyRouteHopLimitLocked(nil)
+	return nil
+}
+
+// unicastHops returns the hop limit requested with IPV6_UNICAST_HOPS, or -1
+// if none was.
+func (ep *endpoint) unicastHops() (int, tcpip.Error) {
+	ep.hopLimit.Lock()
+	defer ep.hopLimit.Unlock()
+	if !ep.hopLimit.explicit {
+		return -1, nil
+	}
+	return ep.ep.GetSockOptInt(tcpip.IPv6HopLimitOption)
+}
+
+// applyRouteHopLimitLocked makes the socket send to remote with the default
+// hop limit of the interface the route to remote goes through, unless a hop
+// limit was set with IPV6_UNICAST_HOPS. A nil remote stands for the
+// connected peer, if any.
+//
+// gVisor only has a stack-wide default hop limit, so the default of the
+// interface is applied as the socket's hop limit whenever its route is
+// chosen: before connecting, upon accepting and before sending. The route is
+// only looked up while some interface has a default hop limit of its own.
+func (ep *endpoint) applyRouteHopLimitLocked(remote *tcpip.FullAddress) {
+	if ep.netProto != ipv6.ProtocolNumber || ep.hopLimit.explicit {
+		return
+	}
+	if atomic.LoadInt32(&ep.ns.hopLimitOverrides) == 0 {
+		if ep.hopLimit.fromInterface {
+			ep.hopLimit.fromInterface = false
+			_ = ep.ep.SetSockOptInt(tcpip.IPv6HopLimitOption, -1)
+		}
+		return
+	}
+	if remote == nil {
+		addr, err := ep.ep.GetRemoteAddress()
+		if err != nil {
+			return
+		}
+		remote = &addr
+	}
+	if len(remote.Addr) != header.IPv6AddressSize {
+		return
+	}
+
+	nicID, localAddr := remote.NIC, tcpip.Address("")
+	if info, ok := ep.ep.Info().(*stack.TransportEndpointInfo); ok {
+		if nicID == 0 {
+			nicID = info.BindNICID
+		}
+		localAddr = info.ID.LocalAddress
+	}
+	route, err := ep.ns.stack.FindRoute(nicID, localAddr, remote.Addr, ipv6.ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		return
+	}
+	nicID = route.NICID()
+	route.Release()
+
+	hopLimit := -1
+	if nicInfo, ok := ep.ns.stack.NICInfo()[nicID]; ok {
+		if ifs, ok := nicInfo.Context.(*ifState); ok {
+			if v := atomic.LoadUint32(&ifs.hopLimit); v != 0 {
+				hopLimit = int(v)
+			}
+		}
+	}
+	ep.hopLimit.fromInterface = hopLimit != -1
+	_ = ep.ep.SetSockOptInt(tcpip.IPv6HopLimitOption, hopLimit)
+}
@@ -197,6 +197,9 @@ func Main() {
 	noOpaqueIID := false
 	flags.BoolVar(&noOpaqueIID, "no-opaque-iids", false, "disable opaque IIDs")
 
+	var maxReusePortGroupSize int
+	flags.IntVar(&maxReusePortGroupSize, "max-reuseport-group-size", 0, "set the largest number of sockets that may share an address and port with SO_REUSEPORT; 0 means unlimited")
+
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		panic(err)
 	}
@@ -261,6 +264,22 @@ func Main() {
 		RetransmitTimer:        dadRetransmitTimer,
 	}
 
+	ndpConfigs := ipv6.NDPConfigurations{
+		MaxRtrSolicitations:           maxRtrSolicitations,
+		RtrSolicitationInterval:       rtrSolicitationInterval,
+		MaxRtrSolicitationDelay:       maxRtrSolicitationDelay,
+		HandleRAs:                     handleRAs,
+		DiscoverDefaultRouters:        true,
+		DiscoverMoreSpecificRoutes:    true,
+		DiscoverOnLinkPrefixes:        true,
+		AutoGenGlobalAddresses:        true,
+		AutoGenAddressConflictRetries: autoGenAddressConflictRetries,
+		AutoGenTempGlobalAddresses:    true,
+		MaxTempAddrValidLifetime:      maxTempAddrValidLifetime,
+		MaxTempAddrPreferredLifetime:  maxTempAddrPreferredLifetime,
+		RegenAdvanceDuration:          regenAdvanceDuration,
+	}
+
 	stk := tcpipstack.New(tcpipstack.Options{
 		NetworkProtocols: []tcpipstack.NetworkProtocolFactory{
 			arp.NewProtocolWithOptions(arp.Options{
@@ -272,22 +291,8 @@ func Main() {
 				},
 			}),
 			ipv6.NewProtocolWithOptions(ipv6.Options{
-				DADConfigs: dadConfigs,
-				NDPConfigs: ipv6.NDPConfigurations{
-					MaxRtrSolicitations:           maxRtrSolicitations,
-					RtrSolicitationInterval:       rtrSolicitationInterval,
-					MaxRtrSolicitationDelay:       maxRtrSolicitationDelay,
-					HandleRAs:                     handleRAs,
-					DiscoverDefaultRouters:        true,
-					DiscoverMoreSpecificRoutes:    true,
-					DiscoverOnLinkPrefixes:        true,
-					AutoGenGlobalAddresses:        true,
-					AutoGenAddressConflictRetries: autoGenAddressConflictRetries,
-					AutoGenTempGlobalAddresses:    true,
-					MaxTempAddrValidLifetime:      maxTempAddrValidLifetime,
-					MaxTempAddrPreferredLifetime:  maxTempAddrPreferredLifetime,
-					RegenAdvanceDuration:          regenAdvanceDuration,
-				},
+				DADConfigs:       dadConfigs,
+				NDPConfigs:       ndpConfigs,
 				AutoGenLinkLocal: true,
 				NDPDisp:          ndpDisp,
 				OpaqueIIDOpts:    opaqueIIDOpts,
@@ -329,9 +334,15 @@ func Main() {
 		dnsConfig:          dns.MakeServersConfig(stk.Clock()),
 		stack:              stk,
 		stats:              stats{Stats: stk.Stats()},
+		ndpConfigs:         ndpConfigs,
+		dadConfigs:         dadConfigs,
 		nicRemovedHandlers: []NICRemovedHandler{&ndpDisp.dynamicAddressSourceTracker, f},
 	}
 
+	if err := ns.SetMaxReusePortGroupSize(maxReusePortGroupSize); err != nil {
+		syslog.Fatalf("max-reuseport-group-size: %s", err)
+	}
+
 	ns.interfaceWatchers.mu.watchers = make(map[*interfaceWatcherImpl]struct{})
 	ns.interfaceWatchers.mu.lastObserved = make(map[tcpip.NICID]interfaces.Properties)
 
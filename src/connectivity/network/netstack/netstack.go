@@ -12,7 +12,10 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"sync/atomic"
 	"syscall/zx"
+	"time"
 
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/dhcp"
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/dns"
@@ -30,6 +33,7 @@ import (
 	"fidl/fuchsia/netstack"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
 	"gvisor.dev/gvisor/pkg/tcpip/link/loopback"
@@ -38,6 +42,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 )
 
 const (
@@ -53,6 +58,10 @@ const (
 	dhcpAcquisition    = 60 * zxtime.Second
 	dhcpBackoff        = 1 * zxtime.Second
 	dhcpRetransmission = 4 * zxtime.Second
+
+	// minTCPMinRTO is the smallest value accepted for the stack-wide TCP
+	// minimum retransmission timeout.
+	minTCPMinRTO = time.Millisecond
 )
 
 func ipv6LinkLocalOnLinkRoute(nicID tcpip.NICID) tcpip.Route {
@@ -121,6 +130,18 @@ func (m *endpointsMap) Range(f func(key uint64, value tcpip.Endpoint) bool) {
 	})
 }
 
+// socketMemoryUsage returns the sums of the send and receive buffer sizes
+// configured on the endpoints.
+func (m *endpointsMap) socketMemoryUsage() (sendBytes, recvBytes uint64) {
+	m.Range(func(_ uint64, ep tcpip.Endpoint) bool {
+		opts := ep.SocketOptions()
+		sendBytes += uint64(opts.GetSendBufferSize())
+		recvBytes += uint64(opts.GetReceiveBufferSize())
+		return true
+	})
+	return sendBytes, recvBytes
+}
+
 // NICRemovedHandler is an interface implemented by types that are interested
 // in NICs that have been removed.
 type NICRemovedHandler interface {
@@ -140,12 +161,67 @@ type Netstack struct {
 	mu struct {
 		sync.Mutex
 		countNIC tcpip.NICID
+		// ipv4Forwarding and ipv6Forwarding hold the stack-wide forwarding
+		// configuration last set by SetIPForwarding.
+		ipv4Forwarding, ipv6Forwarding bool
 	}
 
 	stats stats
 
 	endpoints endpointsMap
 
+	// sockets maps the keys of endpoints to the *endpoint wrapping them, for
+	// diagnostics that need state kept outside of gVisor.
+	sockets sync.Map
+
+	reusePortGroups struct {
+		mu sync.Mutex
+		// maxSize is the largest number of endpoints that may be bound to the
+		// same address and port with SO_REUSEPORT set; zero means unlimited.
+		// mu is held while such endpoints are bound so that the check and the
+		// bind are atomic.
+		maxSize int
+		// sizes holds the number of endpoints in each reuseport group.
+		sizes map[reusePortGroup]int
+	}
+
+	routeLimit struct {
+		mu sync.Mutex
+		// max is the largest number of routes the route table may hold; zero
+		// means unlimited. mu is held while routes are added so that the check
+		// and the addition are atomic.
+		max int
+	}
+
+	tcpKeepalive struct {
+		mu sync.Mutex
+		// defaults holds the keepalive parameters applied to new TCP
+		// endpoints; zero values leave gVisor's defaults in place.
+		defaults tcpKeepaliveDefaults
+	}
+
+	multicastGroups struct {
+		mu sync.Mutex
+		// refs holds the number of memberships sockets hold in each multicast
+		// group; groups without memberships have no entry. Memberships are
+		// held per NIC, so entries are confirmed against the stack's
+		// membership state when read.
+		refs map[tcpip.Address]int
+	}
+
+	// ndpConfigs holds the NDP configurations new interfaces start with, as
+	// passed to the IPv6 protocol when the stack was created.
+	ndpConfigs ipv6.NDPConfigurations
+
+	// hopLimitOverrides is the number of interfaces with a default hop limit
+	// of their own, so that sockets only look up the interface they are routed
+	// through when there is one. Accessed atomically.
+	hopLimitOverrides int32
+
+	// dadConfigs holds the DAD configurations new interfaces start with, as
+	// passed to the IPv6 protocol when the stack was created.
+	dadConfigs stack.DADConfigurations
+
 	nicRemovedHandlers []NICRemovedHandler
 }
 
@@ -175,7 +251,22 @@ type ifState struct {
 			// Used to restart the DHCP client when we go from down to up.
 			enabled bool
 		}
-	}
+		// statsBaseline holds the NIC's counters as of the last call to
+		// ResetInterfaceStats.
+		statsBaseline interfaceStats
+		// ndpConfigs mirrors the NDP configurations of the NIC's IPv6
+		// endpoint, which the stack does not expose.
+		ndpConfigs ipv6.NDPConfigurations
+		// dadConfigs mirrors the DAD configurations of the NIC's IPv6
+		// endpoint, which the stack does not expose.
+		dadConfigs stack.DADConfigurations
+	}
+
+	// addressMu is held while IPv6 addresses are added to the NIC and while
+	// its NDP configurations are changed. Adding an address without DAD
+	// changes the NIC's DAD and NDP configurations for the duration of the
+	// add, which must not apply to other addresses.
+	addressMu sync.Mutex
 
 	adminControls         adminControlCollection
 	addressStateProviders addressStateProviderCollection
@@ -183,7 +274,8 @@ type ifState struct {
 	dns struct {
 		mu struct {
 			sync.Mutex
-			servers []tcpip.Address
+			servers       []tcpip.Address
+			searchDomains []string
 		}
 	}
 
@@ -193,6 +285,19 @@ type ifState struct {
 
 	bridgeable *bridge.BridgeableEndpoint
 
+	// hopLimit is the default hop limit of IPv6 packets sent by sockets
+	// routed through the interface, or 0 if the stack-wide default is used.
+	// Accessed atomically.
+	hopLimit uint32
+
+	// proxy answers ARP and NDP requests received on the interface on behalf
+	// of other hosts.
+	proxy *proxyEndpoint
+
+	// rxQueues is the innermost link endpoint if it has multiple receive
+	// queues, and nil otherwise.
+	rxQueues rxQueueReporter
+
 	// TODO(https://fxbug.dev/86665): Bridged interfaces are disabled within
 	// gVisor upon creation and thus the bridge must keep track of them
 	// in order to re-enable them when the bridge is removed. This is a
@@ -200,6 +305,14 @@ type ifState struct {
 	bridgedInterfaces []tcpip.NICID
 }
 
+// rxQueueReporter is implemented by link endpoints with multiple receive
+// queues.
+type rxQueueReporter interface {
+	// RxQueueIndex returns the index of the receive queue on which packets of
+	// the flow identified by id arrive.
+	RxQueueIndex(id stack.TransportEndpointID) int32
+}
+
 func (ifs *ifState) LinkOnlineLocked() bool {
 	return ifs.observer == nil || ifs.mu.linkOnline
 }
@@ -275,7 +388,11 @@ func (ns *Netstack) addRoutesWithPreference(rs []tcpip.Route, prf routes.Prefere
 
 	_ = syslog.Infof("adding routes [%s] prf=%d metric=%d dynamic=%t", rs, prf, metric, dynamic)
 
-	var defaultRouteAdded bool
+	type resolvedRoute struct {
+		route tcpip.Route
+		ifs   *ifState
+	}
+	resolved := make([]resolvedRoute, 0, len(rs))
 	for _, r := range rs {
 		// If we don't have an interface set, find it using the gateway address.
 		if r.NIC == 0 {
@@ -291,7 +408,34 @@ func (ns *Netstack) addRoutesWithPreference(rs []tcpip.Route, prf routes.Prefere
 			return fmt.Errorf("error getting nicInfo for NIC %d, not in map: %w", r.NIC, routes.ErrNoSuchNIC)
 		}
 
-		ifs := nicInfo.Context.(*ifState)
+		resolved = append(resolved, resolvedRoute{route: r, ifs: nicInfo.Context.(*ifState)})
+	}
+
+	ns.routeLimit.mu.Lock()
+	defer ns.routeLimit.mu.Unlock()
+
+	if max := ns.routeLimit.max; max != 0 {
+		existing := ns.routeTable.GetExtendedRouteTable()
+		seen := make(map[tcpip.Route]struct{}, len(existing)+len(resolved))
+		for _, er := range existing {
+			seen[er.Route] = struct{}{}
+		}
+		count := len(existing)
+		for _, r := range resolved {
+			if _, ok := seen[r.route]; !ok {
+				seen[r.route] = struct{}{}
+				count++
+			}
+		}
+		if count > max {
+			_ = syslog.Warnf("rejecting routes [%s]: the route table would hold %d routes, more than the maximum of %d", rs, count, max)
+			return fmt.Errorf("adding %d routes to a table of %d: %w", len(rs), len(existing), routes.ErrTooManyRoutes)
+		}
+	}
+
+	var defaultRouteAdded bool
+	for _, r := range resolved {
+		ifs := r.ifs
 
 		ifs.mu.Lock()
 		enabled := ifs.IsUpLocked()
@@ -300,10 +444,10 @@ func (ns *Netstack) addRoutesWithPreference(rs []tcpip.Route, prf routes.Prefere
 			metric = ifs.mu.metric
 		}
 
-		ns.routeTable.AddRoute(r, prf, metric, metricTracksInterface, dynamic, enabled)
+		ns.routeTable.AddRoute(r.route, prf, metric, metricTracksInterface, dynamic, enabled)
 		ifs.mu.Unlock()
 
-		if util.IsAny(r.Destination.ID()) && enabled {
+		if util.IsAny(r.route.Destination.ID()) && enabled {
 			defaultRouteAdded = true
 		}
 	}
@@ -314,6 +458,67 @@ func (ns *Netstack) addRoutesWithPreference(rs []tcpip.Route, prf routes.Prefere
 	return nil
 }
 
+// SetMaxRoutes sets the largest number of routes the route table may hold.
+// Additions that would exceed it fail with routes.ErrTooManyRoutes. Zero
+// means unlimited, which is the default. Routes already in the table are kept
+// even if they exceed a newly lowered maximum.
+func (ns *Netstack) SetMaxRoutes(max int) error {
+	if max < 0 {
+		return fmt.Errorf("invalid maximum number of routes %d", max)
+	}
+	ns.routeLimit.mu.Lock()
+	defer ns.routeLimit.mu.Unlock()
+	ns.routeLimit.max = max
+	_ = syslog.Infof("set maximum number of routes to %d", max)
+	return nil
+}
+
+// GetMaxRoutes returns the largest number of routes the route table may hold,
+// or zero if unlimited.
+func (ns *Netstack) GetMaxRoutes() int {
+	ns.routeLimit.mu.Lock()
+	defer ns.routeLimit.mu.Unlock()
+	return ns.routeLimit.max
+}
+
+// reusePortGroup identifies the endpoints bound to the same address and port
+// with SO_REUSEPORT set.
+type reusePortGroup struct {
+	netProto   tcpip.NetworkProtocolNumber
+	transProto tcpip.TransportProtocolNumber
+	addr       tcpip.FullAddress
+}
+
+// SetMaxReusePortGroupSize sets the largest number of endpoints that may be
+// bound to the same address and port with SO_REUSEPORT set. Binds that would
+// exceed it fail with EADDRINUSE. Zero means unlimited, which is the default.
+// Groups already larger than a newly lowered maximum are kept.
+func (ns *Netstack) SetMaxReusePortGroupSize(max int) error {
+	if max < 0 {
+		return fmt.Errorf("invalid maximum reuseport group size %d", max)
+	}
+	ns.reusePortGroups.mu.Lock()
+	defer ns.reusePortGroups.mu.Unlock()
+	ns.reusePortGroups.maxSize = max
+	_ = syslog.Infof("set maximum reuseport group size to %d", max)
+	return nil
+}
+
+// leaveReusePortGroup removes ep from the reuseport group it joined on bind,
+// if any.
+func (ns *Netstack) leaveReusePortGroup(ep *endpoint) {
+	ns.reusePortGroups.mu.Lock()
+	defer ns.reusePortGroups.mu.Unlock()
+	group := ep.reusePortGroup
+	if group == nil {
+		return
+	}
+	ep.reusePortGroup = nil
+	if ns.reusePortGroups.sizes[*group]--; ns.reusePortGroups.sizes[*group] == 0 {
+		delete(ns.reusePortGroups.sizes, *group)
+	}
+}
+
 // DelRoute deletes a single route from the route table.
 func (ns *Netstack) DelRoute(r tcpip.Route) error {
 	_ = syslog.Infof("deleting route %s", r)
@@ -333,6 +538,109 @@ func (ns *Netstack) GetExtendedRouteTable() []routes.ExtendedRoute {
 	return ns.routeTable.GetExtendedRouteTable()
 }
 
+// InterfaceHasDefaultRoute returns whether the NIC has an enabled IPv4 and
+// IPv6 default route, respectively.
+func (ns *Netstack) InterfaceHasDefaultRoute(nicid tcpip.NICID) (bool, bool) {
+	var v4, v6 bool
+	for _, er := range ns.GetExtendedRouteTable() {
+		if !er.Enabled || er.Route.NIC != nicid || !util.IsAny(er.Route.Destination.ID()) {
+			continue
+		}
+		switch len(er.Route.Destination.ID()) {
+		case header.IPv4AddressSize:
+			v4 = true
+		case header.IPv6AddressSize:
+			v6 = true
+		}
+	}
+	return v4, v6
+}
+
+// interfaceStats holds an interface's traffic counters.
+type interfaceStats struct {
+	TxPackets, TxBytes uint64
+	RxPackets, RxBytes uint64
+}
+
+func readInterfaceStats(s stack.NICStats) interfaceStats {
+	return interfaceStats{
+		TxPackets: s.Tx.Packets.Value(),
+		TxBytes:   s.Tx.Bytes.Value(),
+		RxPackets: s.Rx.Packets.Value(),
+		RxBytes:   s.Rx.Bytes.Value(),
+	}
+}
+
+func (s interfaceStats) sub(o interfaceStats) interfaceStats {
+	return interfaceStats{
+		TxPackets: s.TxPackets - o.TxPackets,
+		TxBytes:   s.TxBytes - o.TxBytes,
+		RxPackets: s.RxPackets - o.RxPackets,
+		RxBytes:   s.RxBytes - o.RxBytes,
+	}
+}
+
+// ResetInterfaceStats zeroes the traffic counters of the NIC as reported by
+// InterfaceStats.
+//
+// The stack's counters cannot be reset, so their current values are recorded
+// as a baseline that is subtracted from later reads.
+func (ns *Netstack) ResetInterfaceStats(nicid tcpip.NICID) tcpip.Error {
+	info, ok := ns.stack.NICInfo()[nicid]
+	if !ok {
+		return &tcpip.ErrUnknownNICID{}
+	}
+	ifs := info.Context.(*ifState)
+	ifs.mu.Lock()
+	ifs.mu.statsBaseline = readInterfaceStats(info.Stats)
+	ifs.mu.Unlock()
+	_ = syslog.Infof("NIC %s: reset stats", info.Name)
+	return nil
+}
+
+// InterfaceStats returns the traffic counters of the NIC since it was created
+// or since the last call to ResetInterfaceStats.
+func (ns *Netstack) InterfaceStats(nicid tcpip.NICID) (interfaceStats, tcpip.Error) {
+	info, ok := ns.stack.NICInfo()[nicid]
+	if !ok {
+		return interfaceStats{}, &tcpip.ErrUnknownNICID{}
+	}
+	ifs := info.Context.(*ifState)
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+	return readInterfaceStats(info.Stats).sub(ifs.mu.statsBaseline), nil
+}
+
+// FlushDynamicRoutes removes the dynamic routes of every interface.
+func (ns *Netstack) FlushDynamicRoutes() {
+	_ = syslog.Infof("flushing dynamic routes")
+
+	nics := make(map[tcpip.NICID]struct{})
+	var defaultRouteRemoved bool
+	for _, er := range ns.GetExtendedRouteTable() {
+		if !er.Dynamic {
+			continue
+		}
+		nics[er.Route.NIC] = struct{}{}
+		if er.Enabled && util.IsAny(er.Route.Destination.ID()) {
+			defaultRouteRemoved = true
+		}
+	}
+	if len(nics) == 0 {
+		return
+	}
+
+	for nicid := range nics {
+		ns.routeTable.UpdateRoutesByInterface(nicid, routes.ActionDeleteDynamic)
+	}
+	ns.routeTable.UpdateStack(ns.stack)
+	if defaultRouteRemoved {
+		// Like UpdateRoutesByInterface, run the default route change handler in
+		// a goroutine as callers may hold ifState locks.
+		go ns.onDefaultRouteChange()
+	}
+}
+
 // UpdateRoutesByInterface applies update actions to the routes for a
 // given interface.
 func (ns *Netstack) UpdateRoutesByInterface(nicid tcpip.NICID, action routes.Action) {
@@ -347,7 +655,305 @@ func (ns *Netstack) UpdateRoutesByInterface(nicid tcpip.NICID, action routes.Act
 	go ns.onDefaultRouteChange()
 }
 
+// SelectSourceAddress returns the source address and the interface the stack
+// would use to send a packet to dest, as chosen by the stack's source address
+// selection for the route to dest.
+func (ns *Netstack) SelectSourceAddress(dest tcpip.Address) (tcpip.Address, tcpip.NICID, error) {
+	var protocol tcpip.NetworkProtocolNumber
+	switch len(dest) {
+	case header.IPv4AddressSize:
+		protocol = ipv4.ProtocolNumber
+	case header.IPv6AddressSize:
+		protocol = ipv6.ProtocolNumber
+	default:
+		return "", 0, fmt.Errorf("invalid destination address %s: %w", dest, WrapTcpIpError(&tcpip.ErrBadAddress{}))
+	}
+	route, err := ns.stack.FindRoute(0, "", dest, protocol, false /* multicastLoop */)
+	if err != nil {
+		return "", 0, fmt.Errorf("error finding route to %s: %w", dest, WrapTcpIpError(err))
+	}
+	defer route.Release()
+	return route.LocalAddress(), route.NICID(), nil
+}
+
+func validateForwardingProtocol(protocol tcpip.NetworkProtocolNumber) tcpip.Error {
+	switch protocol {
+	case ipv4.ProtocolNumber, ipv6.ProtocolNumber:
+		return nil
+	default:
+		return &tcpip.ErrUnknownProtocol{}
+	}
+}
+
+// SetIPForwarding enables or disables forwarding of packets of the network
+// protocol on all interfaces, including interfaces added later.
+func (ns *Netstack) SetIPForwarding(protocol tcpip.NetworkProtocolNumber, enabled bool) tcpip.Error {
+	if err := validateForwardingProtocol(protocol); err != nil {
+		return err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if err := ns.stack.SetForwardingDefaultAndAllNICs(protocol, enabled); err != nil {
+		return err
+	}
+	switch protocol {
+	case ipv4.ProtocolNumber:
+		ns.mu.ipv4Forwarding = enabled
+	case ipv6.ProtocolNumber:
+		ns.mu.ipv6Forwarding = enabled
+	}
+	_ = syslog.Infof("set %s forwarding to %t on all interfaces", networkProtocolToString(protocol), enabled)
+	return nil
+}
+
+// GetIPForwarding returns the stack-wide forwarding configuration for the
+// network protocol, as last set by SetIPForwarding.
+func (ns *Netstack) GetIPForwarding(protocol tcpip.NetworkProtocolNumber) (bool, tcpip.Error) {
+	if err := validateForwardingProtocol(protocol); err != nil {
+		return false, err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	switch protocol {
+	case ipv4.ProtocolNumber:
+		return ns.mu.ipv4Forwarding, nil
+	default:
+		return ns.mu.ipv6Forwarding, nil
+	}
+}
+
+// SetMinRTO sets the minimum TCP retransmission timeout used by all TCP
+// endpoints in the stack.
+//
+// The value must be at least minTCPMinRTO and must not exceed the stack's
+// maximum TCP retransmission timeout.
+func (ns *Netstack) SetMinRTO(d time.Duration) tcpip.Error {
+	if d < minTCPMinRTO {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	var maxRTO tcpip.TCPMaxRTOOption
+	if err := ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &maxRTO); err != nil {
+		return err
+	}
+	if d > time.Duration(maxRTO) {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	opt := tcpip.TCPMinRTOOption(d)
+	if err := ns.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+		return err
+	}
+	_ = syslog.Infof("set TCP minimum RTO to %s", d)
+	return nil
+}
+
+// GetMinRTO returns the minimum TCP retransmission timeout used by all TCP
+// endpoints in the stack.
+func (ns *Netstack) GetMinRTO() (time.Duration, tcpip.Error) {
+	var opt tcpip.TCPMinRTOOption
+	if err := ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+		return 0, err
+	}
+	return time.Duration(opt), nil
+}
+
+// tcpKeepaliveDefaults holds stack-wide TCP keepalive parameters.
+type tcpKeepaliveDefaults struct {
+	idle, interval time.Duration
+	count          int
+}
+
+// tcpKeepaliveOptions is a set of TCP keepalive options.
+type tcpKeepaliveOptions uint8
+
+const (
+	tcpKeepaliveIdle tcpKeepaliveOptions = 1 << iota
+	tcpKeepaliveInterval
+	tcpKeepaliveCount
+)
+
+// SetTCPKeepaliveDefaults sets the keepalive idle time, probe interval and
+// probe count applied to TCP endpoints created afterwards. Sockets may
+// override them with the per-socket options.
+//
+// The values are subject to the same bounds as the per-socket options.
+func (ns *Netstack) SetTCPKeepaliveDefaults(idle, interval time.Duration, count int) tcpip.Error {
+	if idle < time.Second || idle > maxTCPKeepIdle*time.Second {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	if interval < time.Second || interval > maxTCPKeepIntvl*time.Second {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	if count < 1 || count > maxTCPKeepCnt {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	ns.tcpKeepalive.mu.Lock()
+	ns.tcpKeepalive.defaults = tcpKeepaliveDefaults{
+		idle:     idle,
+		interval: interval,
+		count:    count,
+	}
+	ns.tcpKeepalive.mu.Unlock()
+	_ = syslog.Infof("set TCP keepalive defaults to idle=%s interval=%s count=%d", idle, interval, count)
+	return nil
+}
+
+// GetTCPKeepaliveDefaults returns the keepalive parameters applied to new TCP
+// endpoints. Zero values indicate gVisor's defaults are used.
+func (ns *Netstack) GetTCPKeepaliveDefaults() (idle, interval time.Duration, count int) {
+	ns.tcpKeepalive.mu.Lock()
+	defer ns.tcpKeepalive.mu.Unlock()
+	d := ns.tcpKeepalive.defaults
+	return d.idle, d.interval, d.count
+}
+
+// applyTCPKeepaliveDefaults configures ep with the stack-wide TCP keepalive
+// parameters, if any have been set, except for the options in set, which were
+// set on the socket itself.
+func (ns *Netstack) applyTCPKeepaliveDefaults(ep tcpip.Endpoint, set tcpKeepaliveOptions) tcpip.Error {
+	ns.tcpKeepalive.mu.Lock()
+	d := ns.tcpKeepalive.defaults
+	ns.tcpKeepalive.mu.Unlock()
+
+	if set&tcpKeepaliveIdle != 0 {
+		d.idle = 0
+	}
+	if set&tcpKeepaliveInterval != 0 {
+		d.interval = 0
+	}
+	if set&tcpKeepaliveCount != 0 {
+		d.count = 0
+	}
+	if d.idle != 0 {
+		opt := tcpip.KeepaliveIdleOption(d.idle)
+		if err := ep.SetSockOpt(&opt); err != nil {
+			return err
+		}
+	}
+	if d.interval != 0 {
+		opt := tcpip.KeepaliveIntervalOption(d.interval)
+		if err := ep.SetSockOpt(&opt); err != nil {
+			return err
+		}
+	}
+	if d.count != 0 {
+		if err := ep.SetSockOptInt(tcpip.KeepaliveCountOption, d.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinMulticastGroup records that ep joined the multicast group addr, so that
+// it is reported by GetMulticastMemberships.
+func (ns *Netstack) joinMulticastGroup(ep *endpoint, addr tcpip.Address) {
+	ns.multicastGroups.mu.Lock()
+	defer ns.multicastGroups.mu.Unlock()
+	if ns.multicastGroups.refs == nil {
+		ns.multicastGroups.refs = make(map[tcpip.Address]int)
+	}
+	if ep.multicastGroups == nil {
+		ep.multicastGroups = make(map[tcpip.Address]int)
+	}
+	ns.multicastGroups.refs[addr]++
+	ep.multicastGroups[addr]++
+}
+
+// leaveMulticastGroup records that ep left the multicast group addr.
+func (ns *Netstack) leaveMulticastGroup(ep *endpoint, addr tcpip.Address) {
+	ns.multicastGroups.mu.Lock()
+	defer ns.multicastGroups.mu.Unlock()
+	if ep.multicastGroups[addr] == 0 {
+		return
+	}
+	if ep.multicastGroups[addr]--; ep.multicastGroups[addr] == 0 {
+		delete(ep.multicastGroups, addr)
+	}
+	ns.releaseMulticastGroupLocked(addr, 1)
+}
+
+// leaveMulticastGroups records that ep left all of its multicast groups, as
+// sockets do when closed.
+func (ns *Netstack) leaveMulticastGroups(ep *endpoint) {
+	ns.multicastGroups.mu.Lock()
+	defer ns.multicastGroups.mu.Unlock()
+	for addr, n := range ep.multicastGroups {
+		ns.releaseMulticastGroupLocked(addr, n)
+	}
+	ep.multicastGroups = nil
+}
+
+func (ns *Netstack) releaseMulticastGroupLocked(addr tcpip.Address, n int) {
+	if ns.multicastGroups.refs[addr] -= n; ns.multicastGroups.refs[addr] <= 0 {
+		delete(ns.multicastGroups.refs, addr)
+	}
+}
+
+// GetMulticastMemberships returns the multicast groups joined on the NIC,
+// sorted.
+//
+// The stack does not enumerate memberships, so the groups joined by sockets,
+// the all-systems and all-nodes groups and the solicited-node groups of the
+// NIC's IPv6 addresses are each checked against the stack's membership state.
+func (ns *Netstack) GetMulticastMemberships(nicid tcpip.NICID) ([]tcpip.Address, tcpip.Error) {
+	info, ok := ns.stack.NICInfo()[nicid]
+	if !ok {
+		return nil, &tcpip.ErrUnknownNICID{}
+	}
+
+	candidates := map[tcpip.Address]struct{}{
+		header.IPv4AllSystems:               {},
+		header.IPv6AllNodesMulticastAddress: {},
+	}
+	for _, addr := range info.ProtocolAddresses {
+		if addr.Protocol == ipv6.ProtocolNumber {
+			candidates[header.SolicitedNodeAddr(addr.AddressWithPrefix.Address)] = struct{}{}
+		}
+	}
+	ns.multicastGroups.mu.Lock()
+	for addr := range ns.multicastGroups.refs {
+		candidates[addr] = struct{}{}
+	}
+	ns.multicastGroups.mu.Unlock()
+
+	var groups []tcpip.Address
+	for addr := range candidates {
+		joined, err := ns.stack.IsInGroup(nicid, addr)
+		if err != nil {
+			return nil, err
+		}
+		if joined {
+			groups = append(groups, addr)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	return groups, nil
+}
+
 func (ns *Netstack) removeInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolAddress, removeRoute bool) zx.Status {
+	if status := ns.removeInterfaceAddressNoNotify(nic, addr, removeRoute); status != zx.ErrOk {
+		return status
+	}
+
+	ns.onPropertiesChange(nic, nil)
+	ns.onAddressRemoved(nic, addr)
+	return zx.ErrOk
+}
+
+// onAddressRemoved shuts down the address state provider of a removed
+// address.
+func (ns *Netstack) onAddressRemoved(nic tcpip.NICID, addr tcpip.ProtocolAddress) {
+	// If the interface cannot be found, then all address state providers would
+	// have been shut down anyway.
+	if nicInfo, ok := ns.stack.NICInfo()[nic]; ok {
+		nicInfo.Context.(*ifState).addressStateProviders.onAddressRemove(addr.AddressWithPrefix.Address)
+	}
+}
+
+// removeInterfaceAddressNoNotify is like removeInterfaceAddress, but does not
+// notify interface watchers or address state providers.
+func (ns *Netstack) removeInterfaceAddressNoNotify(nic tcpip.NICID, addr tcpip.ProtocolAddress, removeRoute bool) zx.Status {
 	_ = syslog.Infof("removing static IP %+v from NIC %d, removeRoute=%t", addr, nic, removeRoute)
 
 	if removeRoute {
@@ -370,23 +976,90 @@ func (ns *Netstack) removeInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolA
 	default:
 		panic(fmt.Sprintf("stack.RemoveAddress(%d, %+v) = %s", nic, addr, err))
 	}
-
-	ns.onPropertiesChange(nic, nil)
-	// If the interface cannot be found, then all address state providers would
-	// have been shut down anyway.
-	if nicInfo, ok := ns.stack.NICInfo()[nic]; ok {
-		nicInfo.Context.(*ifState).addressStateProviders.onAddressRemove(addr.AddressWithPrefix.Address)
-	}
 	return zx.ErrOk
 }
 
 // addInterfaceAddress adds `addr` to `nic`, returning `zx.ErrOk` if successful.
+// If `skipDAD` is set, an IPv6 address is assigned without duplicate address
+// detection.
 //
 // TODO(https://fxbug.dev/21222): Change this function to return
 // `admin.AddressRemovalReason` when we no longer need it for
 // `fuchsia.net.stack/Stack` or `fuchsia.netstack/Netstack`.
-func (ns *Netstack) addInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolAddress, addRoute bool) zx.Status {
-	_ = syslog.Infof("adding static IP %s to NIC %d, addRoute=%t", addr.AddressWithPrefix, nic, addRoute)
+func (ns *Netstack) addInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolAddress, addRoute, skipDAD bool) zx.Status {
+	if status := ns.addInterfaceAddressNoNotify(nic, addr, addRoute, skipDAD); status != zx.ErrOk {
+		return status
+	}
+
+	switch addr.Protocol {
+	case header.IPv4ProtocolNumber:
+		ns.interfaceWatchers.onAddressAdd(nic, addr, zxtime.Monotonic(int64(zx.TimensecInfinite)))
+	// TODO(https://fxbug.dev/82045): This assumes that DAD is always enabled, and relies on the DAD
+	// completion callback to unblock hanging gets waiting for interface address changes.
+	case header.IPv6ProtocolNumber:
+	default:
+	}
+	return zx.ErrOk
+}
+
+// addProtocolAddress adds the address to the NIC. If skipDAD is set, an IPv6
+// address is assigned immediately rather than after duplicate address
+// detection.
+//
+// gVisor has no per-address DAD option, so DAD is disabled on the NIC's IPv6
+// endpoint while the address is added, and SLAAC address generation is
+// suspended so that the stack does not add addresses of its own meanwhile.
+// DAD for an address starts when it is added only if the NIC is enabled, so
+// skipping it fails on a disabled NIC.
+func (ns *Netstack) addProtocolAddress(nic tcpip.NICID, addr tcpip.ProtocolAddress, skipDAD bool) tcpip.Error {
+	if addr.Protocol != header.IPv6ProtocolNumber {
+		return ns.stack.AddProtocolAddress(nic, addr, stack.AddressProperties{})
+	}
+
+	nicInfo, ok := ns.stack.NICInfo()[nic]
+	if !ok {
+		return &tcpip.ErrUnknownNICID{}
+	}
+	ifs := nicInfo.Context.(*ifState)
+	ifs.addressMu.Lock()
+	defer ifs.addressMu.Unlock()
+
+	if !skipDAD {
+		return ns.stack.AddProtocolAddress(nic, addr, stack.AddressProperties{})
+	}
+
+	ep, err := ns.stack.GetNetworkEndpoint(nic, header.IPv6ProtocolNumber)
+	if err != nil {
+		return err
+	}
+	if !ns.stack.CheckNIC(nic) {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+
+	ifs.mu.Lock()
+	dadConfigs, ndpConfigs := ifs.mu.dadConfigs, ifs.mu.ndpConfigs
+	ifs.mu.Unlock()
+
+	ndp := ep.(ipv6.NDPEndpoint)
+	noSLAAC := ndpConfigs
+	noSLAAC.AutoGenGlobalAddresses = false
+	noSLAAC.AutoGenTempGlobalAddresses = false
+	ndp.SetNDPConfigurations(noSLAAC)
+	defer ndp.SetNDPConfigurations(ndpConfigs)
+
+	dad := ep.(stack.DuplicateAddressDetector)
+	noDAD := dadConfigs
+	noDAD.DupAddrDetectTransmits = 0
+	dad.SetDADConfigurations(noDAD)
+	defer dad.SetDADConfigurations(dadConfigs)
+
+	return ns.stack.AddProtocolAddress(nic, addr, stack.AddressProperties{})
+}
+
+// addInterfaceAddressNoNotify is like addInterfaceAddress, but does not notify
+// interface watchers.
+func (ns *Netstack) addInterfaceAddressNoNotify(nic tcpip.NICID, addr tcpip.ProtocolAddress, addRoute, skipDAD bool) zx.Status {
+	_ = syslog.Infof("adding static IP %s to NIC %d, addRoute=%t, skipDAD=%t", addr.AddressWithPrefix, nic, addRoute, skipDAD)
 
 	if info, ok := ns.stack.NICInfo()[nic]; ok {
 		for _, candidate := range info.ProtocolAddresses {
@@ -410,12 +1083,14 @@ func (ns *Netstack) addInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolAddr
 		}
 	}
 
-	switch err := ns.stack.AddProtocolAddress(nic, addr, stack.AddressProperties{}); err.(type) {
+	switch err := ns.addProtocolAddress(nic, addr, skipDAD); err.(type) {
 	case nil:
 	case *tcpip.ErrUnknownNICID:
 		return zx.ErrNotFound
 	case *tcpip.ErrDuplicateAddress:
 		return zx.ErrAlreadyExists
+	case *tcpip.ErrInvalidEndpointState:
+		return zx.ErrBadState
 	default:
 		panic(fmt.Sprintf("NIC %d: failed to add address %s: %s", nic, addr.AddressWithPrefix, err))
 	}
@@ -424,22 +1099,137 @@ func (ns *Netstack) addInterfaceAddress(nic tcpip.NICID, addr tcpip.ProtocolAddr
 		route := addressWithPrefixRoute(nic, addr.AddressWithPrefix)
 		_ = syslog.Infof("creating subnet route %s with metric=<not-set>, dynamic=false", route)
 		if err := ns.AddRoute(route, metricNotSet, false); err != nil {
-			if !errors.Is(err, routes.ErrNoSuchNIC) {
+			switch {
+			case errors.Is(err, routes.ErrNoSuchNIC):
+				return zx.ErrNotFound
+			case errors.Is(err, routes.ErrTooManyRoutes):
+				// Don't leave the address behind without its subnet route.
+				if err := ns.stack.RemoveAddress(nic, addr.AddressWithPrefix.Address); err != nil {
+					_ = syslog.Warnf("NIC %d: failed to remove address %s after failing to add its subnet route: %s", nic, addr.AddressWithPrefix, err)
+				}
+				return zx.ErrNoResources
+			default:
 				panic(fmt.Sprintf("NIC %d: failed to add subnet route %s: %s", nic, route, err))
 			}
-			return zx.ErrNotFound
 		}
 	}
+	return zx.ErrOk
+}
+
+// replaceAddresses replaces the addresses on the interface with addrs, along
+// with their subnet routes, and notifies interface watchers of the resulting
+// set of addresses with a single change event.
+//
+// Addresses managed by the netstack itself, i.e. IPv6 link-local addresses
+// and addresses assigned through DHCP or SLAAC, are left in place. The subnet
+// route of a removed address is only deleted if no address left on the
+// interface is in the same subnet.
+func (ifs *ifState) replaceAddresses(addrs []tcpip.ProtocolAddress) error {
+	nicInfo, ok := ifs.ns.stack.NICInfo()[ifs.nicid]
+	if !ok {
+		return fmt.Errorf("NIC %d: %w", ifs.nicid, routes.ErrNoSuchNIC)
+	}
 
+	want := make(map[tcpip.ProtocolAddress]struct{})
+	for _, addr := range addrs {
+		want[addr] = struct{}{}
+	}
+	var removed []tcpip.ProtocolAddress
+	for _, addr := range nicInfo.ProtocolAddresses {
+		if _, ok := want[addr]; ok {
+			delete(want, addr)
+			continue
+		}
+		if ifs.isManagedAddress(addr) {
+			continue
+		}
+		removed = append(removed, addr)
+	}
+
+	// Notify watchers of whatever was applied, even on failure, so that they
+	// observe the interface's actual state.
+	defer func() {
+		ifs.removeOrphanedSubnetRoutes(removed)
+		ifs.ns.onPropertiesChange(ifs.nicid, nil)
+		for _, addr := range removed {
+			ifs.ns.onAddressRemoved(ifs.nicid, addr)
+		}
+	}()
+
+	for i, addr := range removed {
+		switch status := ifs.ns.removeInterfaceAddressNoNotify(ifs.nicid, addr, false /* removeRoute */); status {
+		case zx.ErrOk, zx.ErrNotFound:
+		default:
+			removed = removed[:i]
+			return fmt.Errorf("removing address %s: %w", addr.AddressWithPrefix, &zx.Error{Status: status})
+		}
+	}
+	// Add in the caller's order so that the first address of each protocol
+	// becomes the primary one.
+	for _, addr := range addrs {
+		if _, ok := want[addr]; !ok {
+			continue
+		}
+		delete(want, addr)
+		if status := ifs.ns.addInterfaceAddressNoNotify(ifs.nicid, addr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+			return fmt.Errorf("adding address %s: %w", addr.AddressWithPrefix, &zx.Error{Status: status})
+		}
+	}
+	return nil
+}
+
+// isManagedAddress returns whether addr is managed by the netstack rather
+// than by its clients: IPv6 link-local addresses, and addresses assigned
+// through DHCP or SLAAC.
+func (ifs *ifState) isManagedAddress(addr tcpip.ProtocolAddress) bool {
 	switch addr.Protocol {
 	case header.IPv4ProtocolNumber:
-		ns.interfaceWatchers.onAddressAdd(nic, addr, zxtime.Monotonic(int64(zx.TimensecInfinite)))
-	// TODO(https://fxbug.dev/82045): This assumes that DAD is always enabled, and relies on the DAD
-	// completion callback to unblock hanging gets waiting for interface address changes.
+		ifs.mu.Lock()
+		c := ifs.mu.dhcp.Client
+		ifs.mu.Unlock()
+		return c != nil && c.Info().Assigned == addr.AddressWithPrefix
 	case header.IPv6ProtocolNumber:
-	default:
+		if header.IsV6LinkLocalUnicastAddress(addr.AddressWithPrefix.Address) {
+			return true
+		}
+		ep, err := ifs.ns.stack.GetNetworkEndpoint(ifs.nicid, header.IPv6ProtocolNumber)
+		if err != nil {
+			return false
+		}
+		addressEP := ep.(stack.AddressableEndpoint).AcquireAssignedAddress(addr.AddressWithPrefix.Address, true /* allowTemp */, stack.NeverPrimaryEndpoint)
+		if addressEP == nil {
+			return false
+		}
+		defer addressEP.DecRef()
+		switch addressEP.ConfigType() {
+		case stack.AddressConfigSlaac, stack.AddressConfigSlaacTemp:
+			return true
+		}
+	}
+	return false
+}
+
+// removeOrphanedSubnetRoutes deletes the subnet routes of the removed
+// addresses which no address left on the interface shares.
+func (ifs *ifState) removeOrphanedSubnetRoutes(removed []tcpip.ProtocolAddress) {
+	nicInfo, ok := ifs.ns.stack.NICInfo()[ifs.nicid]
+	if !ok {
+		return
+	}
+	remaining := make(map[tcpip.Route]struct{})
+	for _, addr := range nicInfo.ProtocolAddresses {
+		remaining[addressWithPrefixRoute(ifs.nicid, addr.AddressWithPrefix)] = struct{}{}
+	}
+	for _, addr := range removed {
+		route := addressWithPrefixRoute(ifs.nicid, addr.AddressWithPrefix)
+		if _, ok := remaining[route]; ok {
+			continue
+		}
+		_ = syslog.Infof("removing subnet route %s", route)
+		if err := ifs.ns.DelRoute(route); err != nil && err != routes.ErrNoSuchRoute {
+			_ = syslog.Warnf("NIC %d: failed to remove subnet route %s: %s", ifs.nicid, route, err)
+		}
 	}
-	return zx.ErrOk
 }
 
 func (ns *Netstack) onInterfaceAdd(nicid tcpip.NICID) {
@@ -586,6 +1376,9 @@ func (ifs *ifState) dhcpAcquired(lost, acquired tcpip.AddressWithPrefix, config
 	if updated := ifs.setDNSServers(config.DNS); updated {
 		_ = syslog.Infof("NIC %s: set DNS servers: %s", name, config.DNS)
 	}
+	if updated := ifs.setDNSSearchDomains(config.DomainSearch); updated {
+		_ = syslog.Infof("NIC %s: set DNS search domains: %s", name, config.DomainSearch)
+	}
 }
 
 // setDNSServers updates the receiver's dnsServers if necessary and returns
@@ -609,6 +1402,27 @@ func (ifs *ifState) setDNSServers(servers []tcpip.Address) bool {
 	return !sameDNS
 }
 
+// setDNSSearchDomains updates the receiver's DNS search domains if necessary
+// and returns whether they were updated.
+func (ifs *ifState) setDNSSearchDomains(domains []string) bool {
+	ifs.dns.mu.Lock()
+	sameDomains := len(ifs.dns.mu.searchDomains) == len(domains)
+	if sameDomains {
+		for i := range ifs.dns.mu.searchDomains {
+			sameDomains = ifs.dns.mu.searchDomains[i] == domains[i]
+			if !sameDomains {
+				break
+			}
+		}
+	}
+	if !sameDomains {
+		ifs.dns.mu.searchDomains = domains
+		ifs.ns.dnsConfig.UpdateDhcpSearchDomains(ifs.nicid, domains)
+	}
+	ifs.dns.mu.Unlock()
+	return !sameDomains
+}
+
 // setDHCPStatus updates the DHCP status on an interface and runs the DHCP
 // client if it should be enabled.
 //
@@ -662,6 +1476,7 @@ func (ifs *ifState) onDownLocked(name string, closed bool) {
 	// Remove DNS servers through ifs.
 	ifs.ns.dnsConfig.RemoveAllServersWithNIC(ifs.nicid)
 	ifs.setDNSServers(nil)
+	ifs.setDNSSearchDomains(nil)
 
 	if closed {
 		// The interface is removed, force all of its routes to be removed.
@@ -712,6 +1527,267 @@ func (ifs *ifState) onDownLocked(name string, closed bool) {
 	}
 }
 
+// setForwarding enables or disables forwarding of packets of the network
+// protocol on the interface, overriding the stack-wide configuration.
+func (ifs *ifState) setForwarding(protocol tcpip.NetworkProtocolNumber, enabled bool) tcpip.Error {
+	if err := validateForwardingProtocol(protocol); err != nil {
+		return err
+	}
+	if err := ifs.ns.stack.SetNICForwarding(ifs.nicid, protocol, enabled); err != nil {
+		return err
+	}
+	_ = syslog.Infof("NIC %s: set %s forwarding to %t", ifs.ns.name(ifs.nicid), networkProtocolToString(protocol), enabled)
+	return nil
+}
+
+// forwarding returns whether forwarding of packets of the network protocol is
+// enabled on the interface.
+func (ifs *ifState) forwarding(protocol tcpip.NetworkProtocolNumber) (bool, tcpip.Error) {
+	if err := validateForwardingProtocol(protocol); err != nil {
+		return false, err
+	}
+	return ifs.ns.stack.NICForwarding(ifs.nicid, protocol)
+}
+
+// setDefaultHopLimit overrides the stack-wide default hop limit for IPv6
+// packets sent by sockets routed through the interface. A hop limit of 0
+// removes the override.
+//
+// Sockets which set IPV6_UNICAST_HOPS keep their hop limit, and packets not
+// originated by a socket (e.g. forwarded packets) are not affected.
+func (ifs *ifState) setDefaultHopLimit(hopLimit uint8) {
+	switch previous := atomic.SwapUint32(&ifs.hopLimit, uint32(hopLimit)); {
+	case previous == 0 && hopLimit != 0:
+		atomic.AddInt32(&ifs.ns.hopLimitOverrides, 1)
+	case previous != 0 && hopLimit == 0:
+		atomic.AddInt32(&ifs.ns.hopLimitOverrides, -1)
+	}
+	_ = syslog.Infof("NIC %s: set IPv6 default hop limit to %d", ifs.ns.name(ifs.nicid), hopLimit)
+}
+
+// defaultHopLimit returns the hop limit used by default for IPv6 packets
+// sent by sockets routed through the interface.
+func (ifs *ifState) defaultHopLimit() uint8 {
+	if hopLimit := uint8(atomic.LoadUint32(&ifs.hopLimit)); hopLimit != 0 {
+		return hopLimit
+	}
+	var defaultHopLimit tcpip.DefaultTTLOption
+	if err := ifs.ns.stack.NetworkProtocolOption(header.IPv6ProtocolNumber, &defaultHopLimit); err != nil {
+		panic(fmt.Sprintf("stack.NetworkProtocolOption(header.IPv6ProtocolNumber, _): %s", err))
+	}
+	return uint8(defaultHopLimit)
+}
+
+// setProxyARP enables or disables answering ARP requests received on the
+// interface for IPv4 addresses routed through other interfaces.
+func (ifs *ifState) setProxyARP(enabled bool) {
+	ifs.proxy.setARP(enabled)
+	_ = syslog.Infof("NIC %s: set proxy ARP to %t", ifs.ns.name(ifs.nicid), enabled)
+}
+
+// proxyARP returns whether proxy ARP is enabled on the interface.
+func (ifs *ifState) proxyARP() bool {
+	return ifs.proxy.arp()
+}
+
+// setProxyNDP enables or disables answering neighbor solicitations received on
+// the interface for the IPv6 address.
+func (ifs *ifState) setProxyNDP(addr tcpip.Address, enabled bool) tcpip.Error {
+	if len(addr) != header.IPv6AddressSize {
+		return &tcpip.ErrBadAddress{}
+	}
+	ifs.proxy.setNDP(addr, enabled)
+	_ = syslog.Infof("NIC %s: set proxy NDP for %s to %t", ifs.ns.name(ifs.nicid), addr, enabled)
+	return nil
+}
+
+// proxyNDPAddresses returns the IPv6 addresses for which neighbor solicitations
+// are answered on the interface, sorted.
+func (ifs *ifState) proxyNDPAddresses() []tcpip.Address {
+	return ifs.proxy.ndp()
+}
+
+// setTemporaryAddressGeneration enables or disables the generation of IPv6
+// temporary addresses (RFC 4941) through SLAAC on the interface. Disabling it
+// removes the interface's existing temporary addresses.
+func (ifs *ifState) setTemporaryAddressGeneration(enabled bool) tcpip.Error {
+	ep, err := ifs.ns.stack.GetNetworkEndpoint(ifs.nicid, ipv6.ProtocolNumber)
+	if err != nil {
+		return err
+	}
+
+	ifs.addressMu.Lock()
+	ifs.mu.Lock()
+	ifs.mu.ndpConfigs.AutoGenTempGlobalAddresses = enabled
+	ep.(ipv6.NDPEndpoint).SetNDPConfigurations(ifs.mu.ndpConfigs)
+	ifs.mu.Unlock()
+	ifs.addressMu.Unlock()
+	_ = syslog.Infof("NIC %s: set IPv6 temporary address generation to %t", ifs.ns.name(ifs.nicid), enabled)
+
+	if enabled {
+		return nil
+	}
+
+	// The stack keeps temporary addresses until they expire, so remove them.
+	// Removing them through the stack also invalidates its SLAAC state for
+	// them and notifies the NDP dispatcher.
+	nicInfo, ok := ifs.ns.stack.NICInfo()[ifs.nicid]
+	if !ok {
+		return &tcpip.ErrUnknownNICID{}
+	}
+	addressable := ep.(stack.AddressableEndpoint)
+	for _, addr := range nicInfo.ProtocolAddresses {
+		if addr.Protocol != ipv6.ProtocolNumber {
+			continue
+		}
+		addressEP := addressable.AcquireAssignedAddress(addr.AddressWithPrefix.Address, false /* allowTemp */, stack.NeverPrimaryEndpoint)
+		if addressEP == nil {
+			continue
+		}
+		temporary := addressEP.ConfigType() == stack.AddressConfigSlaacTemp
+		addressEP.DecRef()
+		if !temporary {
+			continue
+		}
+		switch err := ifs.ns.stack.RemoveAddress(ifs.nicid, addr.AddressWithPrefix.Address); err.(type) {
+		case nil, *tcpip.ErrBadLocalAddress:
+			// The address may have been invalidated concurrently.
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// temporaryAddressGeneration returns whether IPv6 temporary addresses are
+// generated on the interface.
+func (ifs *ifState) temporaryAddressGeneration() bool {
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+	return ifs.mu.ndpConfigs.AutoGenTempGlobalAddresses
+}
+
+// validateNUDConfigurations returns an error if any of the timers or probe
+// counts of config is out of range.
+//
+// The stack silently replaces invalid values with defaults, so they are
+// rejected here instead.
+func validateNUDConfigurations(config stack.NUDConfigurations) tcpip.Error {
+	switch {
+	case config.BaseReachableTime <= 0,
+		config.RetransmitTimer <= 0,
+		config.DelayFirstProbeTime <= 0,
+		config.MaxMulticastProbes == 0,
+		config.MaxUnicastProbes == 0,
+		config.MinRandomFactor <= 0,
+		config.MaxRandomFactor < config.MinRandomFactor,
+		config.MaxAnycastDelayTime < 0:
+		return &tcpip.ErrInvalidOptionValue{}
+	default:
+		return nil
+	}
+}
+
+// setNUDConfigurations sets the configuration of neighbor unreachability
+// detection for the network protocol on the interface, i.e. ARP for IPv4 and
+// NDP for IPv6.
+func (ifs *ifState) setNUDConfigurations(protocol tcpip.NetworkProtocolNumber, config stack.NUDConfigurations) tcpip.Error {
+	if err := validateForwardingProtocol(protocol); err != nil {
+		return err
+	}
+	if err := validateNUDConfigurations(config); err != nil {
+		return err
+	}
+	if err := ifs.ns.stack.SetNUDConfigurations(ifs.nicid, protocol, config); err != nil {
+		return err
+	}
+	_ = syslog.Infof(
+		"NIC %s: set NUD configurations for network protocol %d: base reachable time %s, retransmit timer %s, max multicast probes %d, max unicast probes %d",
+		ifs.ns.name(ifs.nicid),
+		protocol,
+		config.BaseReachableTime,
+		config.RetransmitTimer,
+		config.MaxMulticastProbes,
+		config.MaxUnicastProbes,
+	)
+	return nil
+}
+
+// nudConfigurations returns the configuration of neighbor unreachability
+// detection for the network protocol on the interface.
+func (ifs *ifState) nudConfigurations(protocol tcpip.NetworkProtocolNumber) (stack.NUDConfigurations, tcpip.Error) {
+	if err := validateForwardingProtocol(protocol); err != nil {
+		return stack.NUDConfigurations{}, err
+	}
+	return ifs.ns.stack.NUDConfigurations(ifs.nicid, protocol)
+}
+
+// solicitRoutersNow sends an NDP router solicitation on the interface
+// immediately, rather than waiting for the stack's solicitation timer, e.g.
+// after the link came up on a different network.
+//
+// gVisor does not expose a way to restart router solicitation, so the
+// solicitation is written directly to the link. Advertisements sent in
+// response are handled by the stack as usual.
+func (ifs *ifState) solicitRoutersNow() tcpip.Error {
+	forwarding, err := ifs.ns.stack.NICForwarding(ifs.nicid, ipv6.ProtocolNumber)
+	if err != nil {
+		return err
+	}
+	if forwarding {
+		// Routers do not solicit router advertisements (RFC 4861 section 6.3.7).
+		return &tcpip.ErrNotPermitted{}
+	}
+	nicInfo, ok := ifs.ns.stack.NICInfo()[ifs.nicid]
+	if !ok {
+		return &tcpip.ErrUnknownNICID{}
+	}
+	if !nicInfo.Flags.Up {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+
+	// The solicitation is sent from an assigned link-local address if there is
+	// one, and from the unspecified address otherwise, in which case it must
+	// not include a source link-layer address (RFC 4861 section 4.1).
+	src := header.IPv6Any
+	for _, addr := range nicInfo.ProtocolAddresses {
+		if addr.Protocol == ipv6.ProtocolNumber && header.IsV6LinkLocalUnicastAddress(addr.AddressWithPrefix.Address) {
+			src = addr.AddressWithPrefix.Address
+			break
+		}
+	}
+	var opts header.NDPOptionsSerializer
+	if src != header.IPv6Any && len(nicInfo.LinkAddress) != 0 {
+		opts = header.NDPOptionsSerializer{
+			header.NDPSourceLinkLayerAddressOption(nicInfo.LinkAddress),
+		}
+	}
+
+	dst := header.IPv6AllRoutersLinkLocalMulticastAddress
+	icmpSize := header.ICMPv6RouterSolicitMinimumSize + opts.Length()
+	pkt := make(buffer.View, header.IPv6MinimumSize+icmpSize)
+	header.IPv6(pkt).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(icmpSize),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          header.NDPHopLimit,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	rs := header.ICMPv6(pkt[header.IPv6MinimumSize:])
+	rs.SetType(header.ICMPv6RouterSolicit)
+	header.NDPRouterSolicit(rs.MessageBody()).Options().Serialize(opts)
+	rs.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: rs,
+		Src:    src,
+		Dst:    dst,
+	}))
+	if err := ifs.ns.stack.WritePacketToRemote(ifs.nicid, header.EthernetAddressFromMulticastIPv6Address(dst), ipv6.ProtocolNumber, pkt.ToVectorisedView()); err != nil {
+		return err
+	}
+	_ = syslog.Infof("NIC %s: sent router solicitation from %s", ifs.ns.name(ifs.nicid), src)
+	return nil
+}
+
 func (ifs *ifState) stateChangeLocked(name string, adminUp, linkOnline bool) bool {
 	before := ifs.IsUpLocked()
 	after := adminUp && linkOnline
@@ -883,6 +1959,10 @@ func (ifs *ifState) remove(reason admin.InterfaceRemovedReason) {
 	ifs.onDownLocked(name, true /* closed */)
 	ifs.mu.Unlock()
 
+	if atomic.SwapUint32(&ifs.hopLimit, 0) != 0 {
+		atomic.AddInt32(&ifs.ns.hopLimitOverrides, -1)
+	}
+
 	_ = syslog.Infof("NIC %s: removed", name)
 
 	ifs.ns.interfaceWatchers.onInterfaceRemove(ifs.nicid)
@@ -923,9 +2003,15 @@ func (ns *Netstack) addLoopback() error {
 		// Must never fail, but the compiler can't tell.
 		ndpEP := ep.(ipv6.NDPEndpoint)
 		ndpEP.SetNDPConfigurations(ipv6.NDPConfigurations{})
+		ifs.mu.Lock()
+		ifs.mu.ndpConfigs = ipv6.NDPConfigurations{}
+		ifs.mu.Unlock()
 
 		dadEP := ep.(stack.DuplicateAddressDetector)
 		dadEP.SetDADConfigurations(stack.DADConfigurations{})
+		ifs.mu.Lock()
+		ifs.mu.dadConfigs = stack.DADConfigurations{}
+		ifs.mu.Unlock()
 
 		return nil
 	}(); err != nil {
@@ -1083,6 +2169,8 @@ func (ns *Netstack) addEndpoint(
 	}
 
 	ifs.mu.metric = metric
+	ifs.mu.ndpConfigs = ns.ndpConfigs
+	ifs.mu.dadConfigs = ns.dadConfigs
 	ifs.mu.dhcp.running = func() bool { return false }
 	ifs.mu.dhcp.cancel = func() {}
 
@@ -1092,11 +2180,16 @@ func (ns *Netstack) addEndpoint(
 	ns.mu.Unlock()
 	name := nameFn(ifs.nicid)
 
+	if r, ok := ep.(rxQueueReporter); ok {
+		ifs.rxQueues = r
+	}
+
 	// LinkEndpoint chains:
 	// Put sniffer as close as the NIC.
 	// A wrapper LinkEndpoint should encapsulate the underlying
 	// one, and manifest itself to 3rd party netstack.
-	ifs.bridgeable = bridge.NewEndpoint(sniffer.NewWithPrefix(packetsocket.New(ep), fmt.Sprintf("[%s(id=%d)] ", name, ifs.nicid)))
+	ifs.proxy = newProxyEndpoint(ns.stack, ifs.nicid, sniffer.NewWithPrefix(packetsocket.New(ep), fmt.Sprintf("[%s(id=%d)] ", name, ifs.nicid)))
+	ifs.bridgeable = bridge.NewEndpoint(ifs.proxy)
 	ep = ifs.bridgeable
 	ifs.endpoint = ep
 
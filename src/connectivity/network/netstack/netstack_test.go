@@ -8,6 +8,7 @@
 package netstack
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
@@ -18,16 +19,21 @@ import (
 	"sort"
 	"sync/atomic"
 	"syscall/zx"
+	"syscall/zx/zxsocket"
 	"testing"
 	"time"
 
-	"fidl/fuchsia/hardware/ethernet"
+	fidlethernet "fidl/fuchsia/hardware/ethernet"
 	"fidl/fuchsia/io"
 	"fidl/fuchsia/logger"
 	fidlnet "fidl/fuchsia/net"
 	"fidl/fuchsia/net/interfaces"
 	"fidl/fuchsia/net/stack"
 	"fidl/fuchsia/netstack"
+	"fidl/fuchsia/posix"
+	"fidl/fuchsia/posix/socket"
+	packetsocket "fidl/fuchsia/posix/socket/packet"
+	rawsocket "fidl/fuchsia/posix/socket/raw"
 
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/dhcp"
 	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/dns"
@@ -40,8 +46,10 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/faketime"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
 	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
 	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
@@ -118,1271 +126,2426 @@ func TestDelRouteErrors(t *testing.T) {
 	}
 }
 
-// TestStackNICEnableDisable tests that the NIC in stack.Stack is enabled or
-// disabled when the underlying link is brought up or down, respectively.
-func TestStackNICEnableDisable(t *testing.T) {
+func TestMaxRoutes(t *testing.T) {
 	ns, _ := newNetstack(t, netstackTestOptions{})
+
 	ifs := addNoopEndpoint(t, ns, "")
 	t.Cleanup(ifs.RemoveByUser)
 
-	// The NIC should initially be disabled in stack.Stack.
-	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
-		t.Fatalf("got ns.stack.CheckNIC(%d) = true, want = false", ifs.nicid)
+	if got := ns.GetMaxRoutes(); got != 0 {
+		t.Errorf("got GetMaxRoutes() = %d, want = 0", got)
 	}
-
-	isUp := func() bool {
-		ifs.mu.Lock()
-		defer ifs.mu.Unlock()
-		return ifs.IsUpLocked()
+	if err := ns.SetMaxRoutes(-1); err == nil {
+		t.Error("SetMaxRoutes(-1) succeeded, want error")
 	}
 
-	if isUp() {
-		t.Fatal("got initial link state up, want down")
+	makeRoute := func(d byte) tcpip.Route {
+		return tcpip.Route{
+			Destination: util.PointSubnet(tcpip.Address([]byte{10, 0, 0, d})),
+			Gateway:     "\x01\x02\x03\x04",
+			NIC:         ifs.nicid,
+		}
 	}
 
-	// Bringing the link up should enable the NIC in stack.Stack.
-	if err := ifs.Up(); err != nil {
-		t.Fatal("ifs.Up(): ", err)
+	base := len(ns.GetExtendedRouteTable())
+	const max = 2
+	if err := ns.SetMaxRoutes(base + max); err != nil {
+		t.Fatalf("SetMaxRoutes(%d): %s", base+max, err)
 	}
-	if enabled := ns.stack.CheckNIC(ifs.nicid); !enabled {
-		t.Fatalf("got ns.stack.CheckNIC(%d) = false, want = true", ifs.nicid)
+	if got := ns.GetMaxRoutes(); got != base+max {
+		t.Errorf("got GetMaxRoutes() = %d, want = %d", got, base+max)
 	}
 
-	if !isUp() {
-		t.Fatal("got post-up link state down, want up")
+	if err := ns.AddRoute(makeRoute(1), metricNotSet, false); err != nil {
+		t.Fatalf("AddRoute(%s, metricNotSet, false): %s", makeRoute(1), err)
 	}
 
-	// Bringing the link down should disable the NIC in stack.Stack.
-	if err := ifs.Down(); err != nil {
-		t.Fatal("ifs.Down(): ", err)
+	// Adding two more routes would exceed the maximum, so neither is added.
+	rs := []tcpip.Route{makeRoute(2), makeRoute(3)}
+	if err := ns.AddRoutes(rs, metricNotSet, false); !errors.Is(err, routes.ErrTooManyRoutes) {
+		t.Errorf("got AddRoutes(%s, metricNotSet, false) = %v, want = %s", rs, err, routes.ErrTooManyRoutes)
 	}
-	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
-		t.Fatalf("got ns.stack.CheckNIC(%d) = true, want = false", ifs.nicid)
+	if got, want := len(ns.GetExtendedRouteTable()), base+1; got != want {
+		t.Errorf("got %d routes after rejected addition, want = %d", got, want)
 	}
 
-	if isUp() {
-		t.Fatal("got post-down link state up, want down")
+	// Re-adding an existing route doesn't grow the table.
+	rs = []tcpip.Route{makeRoute(1), makeRoute(2)}
+	if err := ns.AddRoutes(rs, metricNotSet, false); err != nil {
+		t.Fatalf("AddRoutes(%s, metricNotSet, false): %s", rs, err)
+	}
+	if got, want := len(ns.GetExtendedRouteTable()), base+max; got != want {
+		t.Errorf("got %d routes, want = %d", got, want)
+	}
+	if err := ns.AddRoute(makeRoute(3), metricNotSet, false); !errors.Is(err, routes.ErrTooManyRoutes) {
+		t.Errorf("got AddRoute(%s, metricNotSet, false) = %v, want = %s", makeRoute(3), err, routes.ErrTooManyRoutes)
+	}
+
+	// Removing the limit allows further additions.
+	if err := ns.SetMaxRoutes(0); err != nil {
+		t.Fatalf("SetMaxRoutes(0): %s", err)
+	}
+	if err := ns.AddRoute(makeRoute(3), metricNotSet, false); err != nil {
+		t.Errorf("AddRoute(%s, metricNotSet, false): %s", makeRoute(3), err)
 	}
 }
 
-var _ NICRemovedHandler = (*testNicRemovedHandler)(nil)
+var _ tcpipstack.LinkEndpoint = (*hopLimitRecordingEndpoint)(nil)
 
-type testNicRemovedHandler struct {
-	removedNICID tcpip.NICID
+// hopLimitRecordingEndpoint records the hop limit of every outgoing IPv6 UDP
+// packet.
+type hopLimitRecordingEndpoint struct {
+	noopEndpoint
+	hopLimits chan uint8
 }
 
-func (h *testNicRemovedHandler) RemovedNIC(nicID tcpip.NICID) {
-	h.removedNICID = nicID
+func (ep *hopLimitRecordingEndpoint) WritePackets(pkts tcpipstack.PacketBufferList) (int, tcpip.Error) {
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		if pkt.NetworkProtocolNumber != header.IPv6ProtocolNumber {
+			continue
+		}
+		ip := header.IPv6(pkt.NetworkHeader().View())
+		if ip.TransportProtocol() != header.UDPProtocolNumber {
+			continue
+		}
+		ep.hopLimits <- ip.HopLimit()
+	}
+	return pkts.Len(), nil
 }
 
-// TestStackNICRemove tests that the NIC in stack.Stack is removed when the
-// underlying link is closed.
-func TestStackNICRemove(t *testing.T) {
-	nicRemovedHandler := testNicRemovedHandler{}
-	ns, _ := newNetstack(t, netstackTestOptions{nicRemovedHandler: &nicRemovedHandler})
-	var obs noopObserver
+func TestDefaultHopLimit(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
 
+	linkEP := &hopLimitRecordingEndpoint{hopLimits: make(chan uint8, 1)}
 	ifs, err := ns.addEndpoint(
 		func(tcpip.NICID) string { return t.Name() },
-		&noopEndpoint{},
+		linkEP,
 		&noopController{},
-		&obs,
-		0, /* metric */
+		nil, /* observer */
+		0,   /* metric */
 	)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// The NIC should initially be disabled in stack.Stack.
-	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
-		t.Errorf("got ns.stack.CheckNIC(%d) = true, want = false", ifs.nicid)
-	}
-	if _, ok := ns.stack.NICInfo()[ifs.nicid]; !ok {
-		t.Errorf("missing NICInfo for NIC %d", ifs.nicid)
+	t.Cleanup(ifs.RemoveByUser)
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
 	}
-	if _, err := ns.stack.GetMainNICAddress(ifs.nicid, header.IPv6ProtocolNumber); err != nil {
-		t.Errorf("GetMainNICAddress(%d, header.IPv6ProtocolNumber): %s", ifs.nicid, err)
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol: ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   testV6Address,
+			PrefixLen: 64,
+		},
 	}
-
-	if t.Failed() {
-		t.FailNow()
+	if status := ns.addInterfaceAddress(ifs.nicid, protocolAddr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+		t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", ifs.nicid, protocolAddr.AddressWithPrefix, status)
 	}
 
-	// Closing the link should remove the NIC from stack.Stack.
-	obs.onLinkClosed()
-
-	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
-		t.Errorf("got ns.stack.CheckNIC(%d) = false, want = true", ifs.nicid)
+	wq := new(waiter.Queue)
+	ep, tcpipErr := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, wq)
+	if tcpipErr != nil {
+		t.Fatalf("NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, _) = %s", tcpipErr)
 	}
-	if nicInfo, ok := ns.stack.NICInfo()[ifs.nicid]; ok {
-		t.Errorf("unexpected NICInfo found for NIC %d = %+v", ifs.nicid, nicInfo)
+	ds, err := makeDatagramSocket(ep, ipv6.ProtocolNumber, udp.ProtocolNumber, wq, ns)
+	if err != nil {
+		t.Fatalf("makeDatagramSocket(...) = %s", err)
 	}
-	{
-		addr, err := ns.stack.GetMainNICAddress(ifs.nicid, header.IPv6ProtocolNumber)
-		if _, ok := err.(*tcpip.ErrUnknownNICID); !ok {
-			t.Errorf("got GetMainNICAddress(%d, header.IPv6ProtocolNumber) = (%s, %T), want = (_, *tcpip.ErrUnknownNICID)", ifs.nicid, addr, err)
+	s := networkDatagramSocket{datagramSocket: ds}
+	t.Cleanup(func() {
+		s.wq.EventUnregister(&s.entry)
+		s.ep.Close()
+		if err := s.local.Close(); err != nil {
+			t.Errorf("s.local.Close() = %s", err)
 		}
+		if err := s.peer.Close(); err != nil {
+			t.Errorf("s.peer.Close() = %s", err)
+		}
+	})
+
+	to := tcpip.FullAddress{Addr: testV6Address[:15] + "\x01", Port: 9}
+	send := func() uint8 {
+		t.Helper()
+		addr := toNetSocketAddress(ipv6.ProtocolNumber, to)
+		if _, err := s.sendMsg(&addr, []byte("hello")); err != nil {
+			t.Fatalf("s.sendMsg(%#v, _) = %s", to, err)
+		}
+		return <-linkEP.hopLimits
 	}
-	if nicRemovedHandler.removedNICID != ifs.nicid {
-		t.Errorf("got nicRemovedHandler.removedNICID = %d, want = %d", nicRemovedHandler.removedNICID, ifs.nicid)
+	setUnicastHops := func(v int) {
+		t.Helper()
+		if err := s.setUnicastHops(v); err != nil {
+			t.Fatalf("s.setUnicastHops(%d) = %s", v, err)
+		}
 	}
 
-	// Wait for the controller to stop and free up its resources.
-	ifs.endpoint.Wait()
-}
-
-func containsRoute(rs []tcpip.Route, r tcpip.Route) bool {
-	for _, i := range rs {
-		if i == r {
-			return true
-		}
+	stackDefault := ifs.defaultHopLimit()
+	if got := send(); got != stackDefault {
+		t.Errorf("got hop limit = %d, want = %d", got, stackDefault)
 	}
 
-	return false
-}
+	const hopLimit = 7
+	ifs.setDefaultHopLimit(hopLimit)
+	if got := ifs.defaultHopLimit(); got != hopLimit {
+		t.Errorf("got ifs.defaultHopLimit() = %d, want = %d", got, hopLimit)
+	}
+	if got := send(); got != hopLimit {
+		t.Errorf("got hop limit = %d, want = %d", got, hopLimit)
+	}
 
-func TestEndpoint_Close(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
-	var wq waiter.Queue
-	// Avoid polluting everything with err of type tcpip.Error.
-	ep := func() tcpip.Endpoint {
-		ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
-		if err != nil {
-			t.Fatalf("NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, _) = %s", err)
+	// Per-socket hop limits take precedence, including one equal to the
+	// stack-wide default.
+	for _, socketHopLimit := range []uint8{3, stackDefault} {
+		setUnicastHops(int(socketHopLimit))
+		if got := send(); got != socketHopLimit {
+			t.Errorf("got hop limit = %d, want = %d", got, socketHopLimit)
 		}
-		return ep
-	}()
-	defer ep.Close()
+	}
+	setUnicastHops(-1)
+	if got := send(); got != hopLimit {
+		t.Errorf("got hop limit = %d, want = %d", got, hopLimit)
+	}
 
-	eps, err := newEndpointWithSocket(ep, &wq, tcp.ProtocolNumber, ipv6.ProtocolNumber, ns)
+	// Forwarded packets keep their hop limit.
+	injectEP := &injectableEndpoint{}
+	ingress, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() + "-ingress" },
+		injectEP,
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer eps.close()
-
-	eps.mu.Lock()
-	channels := []struct {
-		ch   <-chan struct{}
-		name string
-	}{
-		{ch: eps.closing, name: "closing"},
-		{ch: eps.mu.loopReadDone, name: "loopReadDone"},
-		{ch: eps.mu.loopWriteDone, name: "loopWriteDone"},
+	t.Cleanup(ingress.RemoveByUser)
+	if err := ingress.Up(); err != nil {
+		t.Fatal("ingress.Up(): ", err)
 	}
-	eps.mu.Unlock()
-
-	// Check starting conditions.
-	for _, ch := range channels {
-		select {
-		case <-ch.ch:
-			t.Errorf("%s cleaned up prematurely", ch.name)
-		default:
-		}
+	if err := ns.SetIPForwarding(ipv6.ProtocolNumber, true); err != nil {
+		t.Fatalf("ns.SetIPForwarding(%d, true) = %s", ipv6.ProtocolNumber, err)
 	}
-
-	if _, ok := eps.ns.endpoints.Load(eps.endpoint.key); !ok {
-		var keys []uint64
-		eps.ns.endpoints.Range(func(key uint64, _ tcpip.Endpoint) bool {
-			keys = append(keys, key)
-			return true
+	{
+		payload := []byte("hello")
+		udpLen := header.UDPMinimumSize + len(payload)
+		b := buffer.NewView(header.IPv6MinimumSize + udpLen)
+		header.IPv6(b).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(udpLen),
+			TransportProtocol: header.UDPProtocolNumber,
+			HopLimit:          stackDefault + 1,
+			SrcAddr:           util.Parse("fd00::2"),
+			DstAddr:           to.Addr,
 		})
-		t.Errorf("got endpoints map = %d at creation, want %d", keys, eps.endpoint.key)
+		u := header.UDP(b[header.IPv6MinimumSize:])
+		u.Encode(&header.UDPFields{SrcPort: to.Port, DstPort: to.Port, Length: uint16(udpLen)})
+		copy(u.Payload(), payload)
+		pkt := tcpipstack.NewPacketBuffer(tcpipstack.PacketBufferOptions{
+			Data: b.ToVectorisedView(),
+		})
+		injectEP.dispatcher.DeliverNetworkPacket(ipv6.ProtocolNumber, pkt)
+		pkt.DecRef()
+		if got := <-linkEP.hopLimits; got != stackDefault {
+			t.Errorf("got forwarded hop limit = %d, want = %d", got, stackDefault)
+		}
 	}
 
-	if t.Failed() {
-		t.FailNow()
+	ifs.setDefaultHopLimit(0)
+	if got := ifs.defaultHopLimit(); got != stackDefault {
+		t.Errorf("got ifs.defaultHopLimit() = %d, want = %d", got, stackDefault)
 	}
-
-	// Create a referent.
-	s, err := newStreamSocket(eps)
-	if err != nil {
-		t.Fatalf("newStreamSocket() = %s", err)
+	if got := send(); got != stackDefault {
+		t.Errorf("got hop limit = %d, want = %d", got, stackDefault)
 	}
-	defer func() {
-		func() {
-			result, err := s.Close(context.Background())
-			if err, ok := err.(*zx.Error); ok && err.Status == zx.ErrPeerClosed {
-				return
-			}
-			t.Errorf("s.Close() = (%#v, %v)", result, err)
-		}()
-		if err := s.Channel.Close(); err != nil {
-			t.Errorf("s.Channel.Close() = %s", err)
-		}
-	}()
+}
 
-	// Create another referent.
-	localC, peerC, err := zx.NewChannel(0)
-	if err != nil {
-		t.Fatalf("zx.NewChannel() = %s", err)
+func TestResetInterfaceStats(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	var nics []*ifState
+	for i := 0; i < 2; i++ {
+		ifs := addNoopEndpoint(t, ns, "")
+		t.Cleanup(ifs.RemoveByUser)
+		nics = append(nics, ifs)
 	}
-	defer func() {
-		// Already closed below.
-		if err := localC.Close(); err != nil {
-			t.Errorf("localC.Close() = %s", err)
-		}
 
-		// By-value copy already closed by the server when we closed the peer.
-		err := peerC.Close()
-		if err, ok := err.(*zx.Error); ok && err.Status == zx.ErrBadHandle {
-			return
+	// Traffic is simulated by incrementing the NICs' counters directly.
+	addTraffic := func(ifs *ifState, packets, bytes uint64) {
+		t.Helper()
+		info, ok := ns.stack.NICInfo()[ifs.nicid]
+		if !ok {
+			t.Fatalf("NIC %d not found", ifs.nicid)
 		}
-		t.Errorf("peerC.Close() = %v", err)
-	}()
+		info.Stats.Tx.Packets.IncrementBy(packets)
+		info.Stats.Tx.Bytes.IncrementBy(bytes)
+		info.Stats.Rx.Packets.IncrementBy(packets)
+		info.Stats.Rx.Bytes.IncrementBy(bytes)
+	}
+	checkStats := func(ifs *ifState, packets, bytes uint64) {
+		t.Helper()
+		got, err := ns.InterfaceStats(ifs.nicid)
+		if err != nil {
+			t.Fatalf("InterfaceStats(%d) = %s", ifs.nicid, err)
+		}
+		want := interfaceStats{
+			TxPackets: packets,
+			TxBytes:   bytes,
+			RxPackets: packets,
+			RxBytes:   bytes,
+		}
+		if got != want {
+			t.Errorf("got InterfaceStats(%d) = %+v, want = %+v", ifs.nicid, got, want)
+		}
+	}
 
-	if err := s.Clone(context.Background(), 0, io.NodeWithCtxInterfaceRequest{Channel: peerC}); err != nil {
-		t.Fatalf("s.Clone() = %s", err)
+	// Counters may be non-zero after creation; measure from a reset.
+	for _, ifs := range nics {
+		if err := ns.ResetInterfaceStats(ifs.nicid); err != nil {
+			t.Fatalf("ResetInterfaceStats(%d) = %s", ifs.nicid, err)
+		}
 	}
+	addTraffic(nics[0], 1, 100)
+	addTraffic(nics[1], 2, 200)
+	checkStats(nics[0], 1, 100)
+	checkStats(nics[1], 2, 200)
 
-	// Close the original referent.
-	if result, err := s.Close(context.Background()); err != nil {
-		t.Fatalf("s.Close() = %s", err)
-	} else if result.Which() != io.Node2CloseResultResponse {
-		t.Fatalf("s.Close() = %s", zx.Status(result.Err))
+	if err := ns.ResetInterfaceStats(nics[0].nicid); err != nil {
+		t.Fatalf("ResetInterfaceStats(%d) = %s", nics[0].nicid, err)
 	}
+	checkStats(nics[0], 0, 0)
+	checkStats(nics[1], 2, 200)
 
-	// There's still a referent.
-	for _, ch := range channels {
-		select {
-		case <-ch.ch:
-			t.Errorf("%s cleaned up prematurely", ch.name)
-		default:
-		}
+	addTraffic(nics[0], 3, 300)
+	addTraffic(nics[1], 4, 400)
+	checkStats(nics[0], 3, 300)
+	checkStats(nics[1], 6, 600)
+
+	const unknownNICID = 1000
+	if err := ns.ResetInterfaceStats(unknownNICID); err == nil {
+		t.Errorf("ResetInterfaceStats(%d) = nil, want error", unknownNICID)
+	} else if _, ok := err.(*tcpip.ErrUnknownNICID); !ok {
+		t.Errorf("got ResetInterfaceStats(%d) = %s, want = %s", unknownNICID, err, &tcpip.ErrUnknownNICID{})
 	}
+}
 
-	if _, ok := eps.ns.endpoints.Load(eps.endpoint.key); !ok {
-		var keys []uint64
-		eps.ns.endpoints.Range(func(key uint64, _ tcpip.Endpoint) bool {
-			keys = append(keys, key)
-			return true
-		})
-		t.Errorf("got endpoints map prematurely = %d, want %d", keys, eps.endpoint.key)
+func TestTemporaryAddressGeneration(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ns.ndpConfigs.AutoGenTempGlobalAddresses = true
+	ns.ndpConfigs.MaxRtrSolicitations = 5
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
 	}
 
-	if t.Failed() {
-		t.FailNow()
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol: ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   testV6Address,
+			PrefixLen: 64,
+		},
+	}
+	if status := ns.addInterfaceAddress(ifs.nicid, protocolAddr, false /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+		t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", ifs.nicid, protocolAddr.AddressWithPrefix, status)
 	}
 
-	// Close the last reference.
-	if err := localC.Close(); err != nil {
-		t.Fatalf("localC.Close() = %s", err)
+	if !ifs.temporaryAddressGeneration() {
+		t.Fatal("got ifs.temporaryAddressGeneration() = false, want = true")
 	}
 
-	// Give a generous timeout for the closed channel to be detected.
-	timeout := make(chan struct{})
-	time.AfterFunc(5*time.Second, func() { close(timeout) })
-	for _, ch := range channels {
-		if ch.ch != nil {
-			select {
-			case <-ch.ch:
-			case <-timeout:
-				t.Errorf("%s not cleaned up", ch.name)
+	for _, enabled := range []bool{false, true, false} {
+		if err := ifs.setTemporaryAddressGeneration(enabled); err != nil {
+			t.Fatalf("ifs.setTemporaryAddressGeneration(%t) = %s", enabled, err)
+		}
+		if got := ifs.temporaryAddressGeneration(); got != enabled {
+			t.Errorf("got ifs.temporaryAddressGeneration() = %t, want = %t", got, enabled)
+		}
+		ifs.mu.Lock()
+		configs := ifs.mu.ndpConfigs
+		ifs.mu.Unlock()
+		if configs.AutoGenTempGlobalAddresses != enabled {
+			t.Errorf("got NDP configurations AutoGenTempGlobalAddresses = %t, want = %t", configs.AutoGenTempGlobalAddresses, enabled)
+		}
+		// The other configurations are those the interface started with.
+		if got, want := configs.MaxRtrSolicitations, ns.ndpConfigs.MaxRtrSolicitations; got != want {
+			t.Errorf("got NDP configurations MaxRtrSolicitations = %d, want = %d", got, want)
+		}
+
+		// Static addresses are never removed.
+		var found bool
+		for _, addr := range ns.stack.NICInfo()[ifs.nicid].ProtocolAddresses {
+			if addr.AddressWithPrefix.Address == testV6Address {
+				found = true
 			}
 		}
+		if !found {
+			t.Errorf("static address %s removed after setTemporaryAddressGeneration(%t)", testV6Address, enabled)
+		}
 	}
+}
 
-	for {
-		if _, ok := eps.ns.endpoints.Load(eps.endpoint.key); ok {
-			select {
-			case <-timeout:
-				var keys []uint64
-				eps.ns.endpoints.Range(func(key uint64, _ tcpip.Endpoint) bool {
-					keys = append(keys, key)
-					return true
-				})
-				t.Errorf("got endpoints map = %d after closure, want *not* %d", keys, eps.endpoint.key)
-			default:
-				continue
-			}
-		}
-		break
-	}
+func TestNUDConfigurations(t *testing.T) {
+	const (
+		localAddr    = tcpip.Address("\xc0\xa8\x2a\x01")
+		neighborAddr = tcpip.Address("\xc0\xa8\x2a\x02")
+	)
 
-	if t.Failed() {
-		t.FailNow()
+	ns, clock := newNetstack(t, netstackTestOptions{})
+	linkEP := &arpRecordingEndpoint{
+		noopEndpoint: noopEndpoint{
+			linkAddress:  tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01"),
+			capabilities: tcpipstack.CapabilityResolutionRequired,
+		},
+		arp: make(chan header.ARP, 10),
 	}
-}
-
-// TestTCPEndpointMapAcceptAfterReset tests that an already-reset endpoint
-// isn't added to the endpoints map, since such an endpoint wouldn't receive a
-// hangup notification and its reference in the map would leak.
-func TestTCPEndpointMapAcceptAfterReset(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
-	if err := ns.addLoopback(); err != nil {
-		t.Fatalf("ns.addLoopback() = %s", err)
+	ifs, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() },
+		linkEP,
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	listener := createEP(t, ns, new(waiter.Queue))
-
-	if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
-		t.Fatalf("Bind({}) = %s", err)
+	t.Cleanup(ifs.RemoveByUser)
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
 	}
-	if err := listener.ep.Listen(1); err != nil {
-		t.Fatalf("Listen(1) = %s", err)
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: localAddr, PrefixLen: 24},
+	}
+	if status := ns.addInterfaceAddress(ifs.nicid, protocolAddr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+		t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", ifs.nicid, protocolAddr.AddressWithPrefix, status)
 	}
 
-	client := createEP(t, ns, new(waiter.Queue))
-
-	// Connect and wait for the incoming connection.
-	func() {
-		connectAddr, err := listener.ep.GetLocalAddress()
-		if err != nil {
-			t.Fatalf("GetLocalAddress() = %s", err)
-		}
-
-		waitEntry, notifyCh := waiter.NewChannelEntry(waiter.EventIn)
-		listener.wq.EventRegister(&waitEntry)
-		defer listener.wq.EventUnregister(&waitEntry)
-
-		switch err := client.ep.Connect(connectAddr); err.(type) {
-		case *tcpip.ErrConnectStarted:
-		default:
-			t.Fatalf("Connect(%#v) = %s", connectAddr, err)
-		}
-		<-notifyCh
-	}()
+	if _, err := ifs.nudConfigurations(arp.ProtocolNumber); err != (&tcpip.ErrUnknownProtocol{}) {
+		t.Errorf("got ifs.nudConfigurations(%d) = %s, want = %s", arp.ProtocolNumber, err, &tcpip.ErrUnknownProtocol{})
+	}
 
-	// Initiate a RST of the connection sitting in the accept queue.
-	client.ep.SocketOptions().SetLinger(tcpip.LingerOption{
-		Enabled: true,
-		Timeout: 0,
-	})
-	client.ep.Close()
+	config := tcpipstack.DefaultNUDConfigurations()
+	config.RetransmitTimer = 5 * time.Second
+	config.MaxMulticastProbes = 2
 
-	// Wait for the RST to be processed by the stack.
-	time.Sleep(100 * time.Millisecond)
+	invalid := config
+	invalid.MaxMulticastProbes = 0
+	if err := ifs.setNUDConfigurations(ipv4.ProtocolNumber, invalid); err != (&tcpip.ErrInvalidOptionValue{}) {
+		t.Errorf("got ifs.setNUDConfigurations(%d, %#v) = %s, want = %s", ipv4.ProtocolNumber, invalid, err, &tcpip.ErrInvalidOptionValue{})
+	}
 
-	_, _, eps, err := listener.Accept(false)
+	if err := ifs.setNUDConfigurations(ipv4.ProtocolNumber, config); err != nil {
+		t.Fatalf("ifs.setNUDConfigurations(%d, %#v) = %s", ipv4.ProtocolNumber, config, err)
+	}
+	got, err := ifs.nudConfigurations(ipv4.ProtocolNumber)
 	if err != nil {
-		t.Fatalf("ep.Accept(nil) = %s", err)
+		t.Fatalf("ifs.nudConfigurations(%d) = %s", ipv4.ProtocolNumber, err)
 	}
-	defer eps.close()
-
-	// Expect the `Accept` to have removed the endpoint from the map.
-	if _, ok := ns.endpoints.Load(eps.endpoint.key); ok {
-		t.Fatalf("got endpoints.Load(%d) = (_, true)", eps.endpoint.key)
+	if got != config {
+		t.Errorf("got ifs.nudConfigurations(%d) = %#v, want = %#v", ipv4.ProtocolNumber, got, config)
 	}
 
-	eps.mu.Lock()
-	channels := []struct {
-		ch   <-chan struct{}
-		name string
-	}{
-		{ch: eps.closing, name: "closing"},
-		{ch: eps.mu.loopReadDone, name: "loopReadDone"},
-		{ch: eps.mu.loopWriteDone, name: "loopWriteDone"},
+	ch := make(chan tcpipstack.LinkResolutionResult, 1)
+	if err := ns.stack.GetLinkAddress(ifs.nicid, neighborAddr, localAddr, ipv4.ProtocolNumber, func(result tcpipstack.LinkResolutionResult) {
+		ch <- result
+	}); err != (&tcpip.ErrWouldBlock{}) {
+		t.Fatalf("got ns.stack.GetLinkAddress(%d, %s, %s, %d, _) = %s, want = %s", ifs.nicid, neighborAddr, localAddr, ipv4.ProtocolNumber, err, &tcpip.ErrWouldBlock{})
 	}
-	eps.mu.Unlock()
 
-	// Give a generous timeout for the closed channel to be detected.
-	timeout := make(chan struct{})
-	time.AfterFunc(5*time.Second, func() { close(timeout) })
-	for _, ch := range channels {
-		if ch.ch != nil {
+	// expectProbes checks that exactly n ARP requests for neighborAddr were sent.
+	expectProbes := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
 			select {
-			case <-ch.ch:
-			case <-timeout:
-				t.Errorf("%s not cleaned up", ch.name)
+			case packet := <-linkEP.arp:
+				if got := tcpip.Address(packet.ProtocolAddressTarget()); got != neighborAddr {
+					t.Errorf("got ARP request target = %s, want = %s", got, neighborAddr)
+				}
+			default:
+				t.Fatalf("got %d ARP requests, want %d", i, n)
 			}
 		}
+		select {
+		case <-linkEP.arp:
+			t.Fatalf("got more than %d ARP requests", n)
+		default:
+		}
 	}
-}
 
-func createEP(t *testing.T, ns *Netstack, wq *waiter.Queue) *endpointWithSocket {
-	// Avoid polluting the scope with err of type tcpip.Error.
-	ep := func() tcpip.Endpoint {
-		ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
-		if err != nil {
-			t.Fatalf("NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", err)
+	clock.Advance(0)
+	expectProbes(1)
+
+	// The default retransmit timer must not be used.
+	clock.Advance(config.RetransmitTimer - time.Nanosecond)
+	expectProbes(0)
+	clock.Advance(time.Nanosecond)
+	expectProbes(1)
+
+	// Resolution fails once the configured number of probes is exhausted.
+	select {
+	case result := <-ch:
+		t.Fatalf("resolution completed early: %#v", result)
+	default:
+	}
+	clock.Advance(config.RetransmitTimer)
+	expectProbes(0)
+	select {
+	case result := <-ch:
+		if result.Err == nil {
+			t.Errorf("got resolution result = %#v, want error", result)
 		}
-		return ep
-	}()
-	t.Cleanup(ep.Close)
-	eps, err := newEndpointWithSocket(ep, wq, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
-	if err != nil {
-		t.Fatal(err)
+	default:
+		t.Fatal("resolution did not complete after max multicast probes")
 	}
-	t.Cleanup(eps.close)
-	return eps
 }
 
-func TestTCPEndpointMapClose(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
-	eps := createEP(t, ns, new(waiter.Queue))
+var _ tcpipstack.LinkEndpoint = (*routerSolicitRecordingEndpoint)(nil)
 
-	// Closing the endpoint should remove it from the endpoints map.
-	if _, ok := ns.endpoints.Load(eps.endpoint.key); !ok {
-		t.Fatalf("got endpoints.Load(%d) = (_, false)", eps.endpoint.key)
-	}
-	eps.close()
-	if _, ok := ns.endpoints.Load(eps.endpoint.key); ok {
-		t.Fatalf("got endpoints.Load(%d) = (_, true)", eps.endpoint.key)
+// routerSolicitRecordingEndpoint records outgoing NDP router solicitations.
+type routerSolicitRecordingEndpoint struct {
+	noopEndpoint
+	solicitations chan header.IPv6
+}
+
+func (ep *routerSolicitRecordingEndpoint) WritePackets(pkts tcpipstack.PacketBufferList) (int, tcpip.Error) {
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		if pkt.NetworkProtocolNumber != header.IPv6ProtocolNumber {
+			continue
+		}
+		var b buffer.View
+		b = append(b, pkt.NetworkHeader().View()...)
+		b = append(b, pkt.TransportHeader().View()...)
+		b = append(b, pkt.Data().AsRange().ToOwnedView()...)
+		ip := header.IPv6(b)
+		if !ip.IsValid(len(ip)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			continue
+		}
+		if icmp := header.ICMPv6(ip.Payload()); len(icmp) >= header.ICMPv6RouterSolicitMinimumSize && icmp.Type() == header.ICMPv6RouterSolicit {
+			ep.solicitations <- ip
+		}
 	}
+	return pkts.Len(), nil
 }
 
-func TestTCPEndpointMapConnect(t *testing.T) {
-	ns, clock := newNetstack(t, netstackTestOptions{})
+func TestSolicitRoutersNow(t *testing.T) {
+	const (
+		linkAddr      = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+		linkLocalAddr = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	)
 
-	var linkEP tcpipstack.LinkEndpoint = &noopEndpoint{
-		capabilities: tcpipstack.CapabilityResolutionRequired,
-	}
-	if testing.Verbose() {
-		linkEP = sniffer.New(linkEP)
+	ns, clock := newNetstack(t, netstackTestOptions{})
+	linkEP := &routerSolicitRecordingEndpoint{
+		noopEndpoint: noopEndpoint{
+			linkAddress:  linkAddr,
+			capabilities: tcpipstack.CapabilityResolutionRequired,
+		},
+		solicitations: make(chan header.IPv6, 10),
 	}
 	ifs, err := ns.addEndpoint(
 		func(tcpip.NICID) string { return t.Name() },
 		linkEP,
 		&noopController{},
-		nil,
-		0, /* metric */
+		nil, /* observer */
+		0,   /* metric */
 	)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := ns.stack.EnableNIC(ifs.nicid); err != nil {
-		t.Fatal(err)
-	}
+	t.Cleanup(ifs.RemoveByUser)
 
-	address := tcpip.Address([]byte{1, 2, 3, 4})
-	destination := tcpip.FullAddress{
-		Addr: address,
-		Port: 1,
-	}
-	source := tcpip.Address([]byte{5, 6, 7, 8})
-	protocolAddress := tcpip.ProtocolAddress{
-		Protocol:          ipv4.ProtocolNumber,
-		AddressWithPrefix: source.WithPrefix(),
+	if err := ifs.solicitRoutersNow(); err != (&tcpip.ErrInvalidEndpointState{}) {
+		t.Errorf("got ifs.solicitRoutersNow() on a down interface = %s, want = %s", err, &tcpip.ErrInvalidEndpointState{})
 	}
-	if err := ns.stack.AddProtocolAddress(ifs.nicid, protocolAddress, tcpipstack.AddressProperties{}); err != nil {
-		t.Fatalf("AddProtocolAddress(%d, %#v, {}) = %s", ifs.nicid, protocolAddress, err)
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
 	}
 
-	ns.stack.SetRouteTable([]tcpip.Route{
-		{
-			Destination: address.WithPrefix().Subnet(),
-			NIC:         ifs.nicid,
-		},
-	})
-
-	var wq waiter.Queue
-	eps := createEP(t, ns, &wq)
-
-	events := make(chan waiter.EventMask)
-	waitEntry := waiter.NewFunctionEntry(math.MaxUint64, func(m waiter.EventMask) {
-		events <- m
-	})
-	wq.EventRegister(&waitEntry)
-	defer wq.EventUnregister(&waitEntry)
-
-	switch err := eps.ep.Connect(destination); err.(type) {
-	case *tcpip.ErrConnectStarted:
-	default:
-		t.Fatalf("got Connect(%#v) = %v, want %s", destination, err, &tcpip.ErrConnectStarted{})
+	// drain discards the solicitations sent by the stack on its own schedule.
+	drain := func() {
+		for {
+			select {
+			case <-linkEP.solicitations:
+			default:
+				return
+			}
+		}
 	}
-
-	{
-		nudConfig, err := ns.stack.NUDConfigurations(ifs.nicid, ipv4.ProtocolNumber)
+	// expectSolicitation checks that exactly one solicitation was sent from src.
+	expectSolicitation := func(src tcpip.Address, wantSourceLinkAddr tcpip.LinkAddress) {
+		t.Helper()
+		var ip header.IPv6
+		select {
+		case ip = <-linkEP.solicitations:
+		default:
+			t.Fatal("no router solicitation sent")
+		}
+		select {
+		case <-linkEP.solicitations:
+			t.Fatal("more than one router solicitation sent")
+		default:
+		}
+		if got := ip.SourceAddress(); got != src {
+			t.Errorf("got source address = %s, want = %s", got, src)
+		}
+		if got, want := ip.DestinationAddress(), header.IPv6AllRoutersLinkLocalMulticastAddress; got != want {
+			t.Errorf("got destination address = %s, want = %s", got, want)
+		}
+		if got := ip.HopLimit(); got != header.NDPHopLimit {
+			t.Errorf("got hop limit = %d, want = %d", got, header.NDPHopLimit)
+		}
+		icmp := header.ICMPv6(ip.Payload())
+		if got, want := icmp.Checksum(), header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: icmp,
+			Src:    ip.SourceAddress(),
+			Dst:    ip.DestinationAddress(),
+		}); got != want {
+			t.Errorf("got checksum = %#x, want = %#x", got, want)
+		}
+		it, err := header.NDPRouterSolicit(icmp.MessageBody()).Options().Iter(true /* check */)
 		if err != nil {
-			t.Fatalf("stack.NUDConfigurations(): %s", err)
+			t.Fatalf("iterating options: %s", err)
+		}
+		var sourceLinkAddr tcpip.LinkAddress
+		for {
+			opt, done, err := it.Next()
+			if err != nil {
+				t.Fatalf("iterating options: %s", err)
+			}
+			if done {
+				break
+			}
+			if sllao, ok := opt.(header.NDPSourceLinkLayerAddressOption); ok {
+				sourceLinkAddr = sllao.EthernetAddress()
+			}
+		}
+		if sourceLinkAddr != wantSourceLinkAddr {
+			t.Errorf("got source link-layer address = %q, want = %q", sourceLinkAddr, wantSourceLinkAddr)
 		}
-		clock.Advance(time.Duration(nudConfig.MaxMulticastProbes) * nudConfig.RetransmitTimer)
 	}
 
-	if got, want := <-events, waiter.ReadableEvents|waiter.WritableEvents|waiter.EventErr|waiter.EventHUp; got != want {
-		t.Fatalf("got event = %b, want %b", got, want)
+	drain()
+	if err := ifs.solicitRoutersNow(); err != nil {
+		t.Fatalf("ifs.solicitRoutersNow() = %s", err)
 	}
+	expectSolicitation(header.IPv6Any, "")
 
-	// The callback on HUp should have removed the endpoint from the map.
-	if _, ok := ns.endpoints.Load(eps.endpoint.key); ok {
-		t.Fatalf("got endpoints.Load(%d) = (_, true)", eps.endpoint.key)
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: linkLocalAddr, PrefixLen: 64},
 	}
-}
-
-// TestTCPEndpointMapClosing validates the endpoint in a closing state like
-// FIN_WAIT2 to be present in the endpoints map and is deleted when the
-// endpoint transitions to CLOSED state.
-func TestTCPEndpointMapClosing(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
-	if err := ns.addLoopback(); err != nil {
-		t.Fatalf("ns.addLoopback() = %s", err)
+	if status := ns.addInterfaceAddress(ifs.nicid, protocolAddr, false /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+		t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", ifs.nicid, protocolAddr.AddressWithPrefix, status)
 	}
-	listener := createEP(t, ns, new(waiter.Queue))
+	// Let duplicate address detection complete.
+	clock.Advance(time.Minute)
+	drain()
+	if err := ifs.solicitRoutersNow(); err != nil {
+		t.Fatalf("ifs.solicitRoutersNow() = %s", err)
+	}
+	expectSolicitation(linkLocalAddr, linkAddr)
 
-	if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
-		t.Fatalf("ep.Bind({}) = %s", err)
+	if err := ns.SetIPForwarding(ipv6.ProtocolNumber, true); err != nil {
+		t.Fatalf("ns.SetIPForwarding(%d, true) = %s", ipv6.ProtocolNumber, err)
 	}
-	if err := listener.ep.Listen(1); err != nil {
-		t.Fatalf("ep.Listen(1) = %s", err)
+	if err := ifs.solicitRoutersNow(); err != (&tcpip.ErrNotPermitted{}) {
+		t.Errorf("got ifs.solicitRoutersNow() with forwarding enabled = %s, want = %s", err, &tcpip.ErrNotPermitted{})
 	}
-	connectAddr, err := listener.ep.GetLocalAddress()
+}
+
+// ipv6AddressAssigned returns whether addr is assigned to the NIC, i.e. is
+// not tentative.
+func ipv6AddressAssigned(t *testing.T, ns *Netstack, nicid tcpip.NICID, addr tcpip.Address) bool {
+	t.Helper()
+
+	ep, err := ns.stack.GetNetworkEndpoint(nicid, ipv6.ProtocolNumber)
 	if err != nil {
-		t.Fatalf("ep.GetLocalAddress() = %s", err)
+		t.Fatalf("ns.stack.GetNetworkEndpoint(%d, %d) = %s", nicid, ipv6.ProtocolNumber, err)
 	}
-	client := createEP(t, ns, new(waiter.Queue))
-
-	waitEntry, inCh := waiter.NewChannelEntry(waiter.EventIn)
-	listener.wq.EventRegister(&waitEntry)
-	defer listener.wq.EventUnregister(&waitEntry)
+	addressEP := ep.(tcpipstack.AddressableEndpoint).AcquireAssignedAddress(addr, false /* allowTemp */, tcpipstack.NeverPrimaryEndpoint)
+	if addressEP == nil {
+		return false
+	}
+	addressEP.DecRef()
+	return true
+}
 
-	switch err := client.ep.Connect(connectAddr); err.(type) {
-	case *tcpip.ErrConnectStarted:
-	default:
-		t.Fatalf("ep.Connect(%#v) = %s", connectAddr, err)
+func addIPv6Address(ns *Netstack, nicid tcpip.NICID, addr tcpip.Address, skipDAD bool) zx.Status {
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: addr, PrefixLen: 64},
 	}
-	// Wait for the newly established connection to show up as acceptable by
-	// the peer.
-	<-inCh
+	return ns.addInterfaceAddress(nicid, protocolAddr, false /* addRoute */, skipDAD)
+}
 
-	server, _, err := listener.ep.Accept(nil)
-	if err != nil {
-		t.Fatalf("ep.Accept(nil) = %s", err)
-	}
+func TestAddInterfaceAddressSkipDAD(t *testing.T) {
+	const retransmitTimer = time.Second
 
-	// Ensure that the client endpoint is present in our internal map.
-	if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
-		t.Fatalf("got endpoints.Load(%d) = (_,false)", client.endpoint.key)
+	ns, clock := newNetstack(t, netstackTestOptions{
+		dadConfigs: tcpipstack.DADConfigurations{
+			DupAddrDetectTransmits: 1,
+			RetransmitTimer:        retransmitTimer,
+		},
+	})
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
 	}
 
-	// Trigger an active close from the client.
-	client.close()
+	withDAD := util.Parse("2001:db8::1")
+	if status := addIPv6Address(ns, ifs.nicid, withDAD, false); status != zx.ErrOk {
+		t.Fatalf("addIPv6Address(_, %d, %s, false) = %s", ifs.nicid, withDAD, status)
+	}
+	if ipv6AddressAssigned(t, ns, ifs.nicid, withDAD) {
+		t.Fatalf("%s assigned before DAD completed", withDAD)
+	}
 
-	// The client endpoint should not be removed from endpoints map even after
-	// an endpoint close.
-	if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
-		t.Fatalf("got endpoints.Load(%d) = (_,false)", client.endpoint.key)
+	skipped := util.Parse("2001:db8::2")
+	if status := addIPv6Address(ns, ifs.nicid, skipped, true); status != zx.ErrOk {
+		t.Fatalf("addIPv6Address(_, %d, %s, true) = %s", ifs.nicid, skipped, status)
+	}
+	if !ipv6AddressAssigned(t, ns, ifs.nicid, skipped) {
+		t.Fatalf("%s not assigned immediately with DAD skipped", skipped)
 	}
 
-	ticker := time.NewTicker(10 * time.Millisecond)
-	defer ticker.Stop()
-	// Wait and check for the client active close to reach FIN_WAIT2 state.
-	for {
-		if tcp.EndpointState(client.ep.State()) == tcp.StateFinWait2 {
-			break
+	// DAD is performed again for addresses added later.
+	after := util.Parse("2001:db8::3")
+	if status := addIPv6Address(ns, ifs.nicid, after, false); status != zx.ErrOk {
+		t.Fatalf("addIPv6Address(_, %d, %s, false) = %s", ifs.nicid, after, status)
+	}
+	if ipv6AddressAssigned(t, ns, ifs.nicid, after) {
+		t.Fatalf("%s assigned before DAD completed", after)
+	}
+	clock.Advance(retransmitTimer)
+	for _, addr := range []tcpip.Address{withDAD, skipped, after} {
+		if !ipv6AddressAssigned(t, ns, ifs.nicid, addr) {
+			t.Errorf("%s not assigned after DAD completed", addr)
 		}
-		<-ticker.C
 	}
 
-	// Lookup for the client once more in the endpoints map, it should still not
-	// be removed.
-	if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
-		t.Fatalf("got endpoints.Load(%d) = (_,false)", client.endpoint.key)
+	// DAD can't be skipped on a disabled interface, where it is performed once
+	// the interface is enabled.
+	down := addNoopEndpoint(t, ns, "")
+	t.Cleanup(down.RemoveByUser)
+	if status := addIPv6Address(ns, down.nicid, util.Parse("2001:db8::4"), true); status != zx.ErrBadState {
+		t.Errorf("got addIPv6Address on a disabled interface = %s, want = %s", status, zx.ErrBadState)
 	}
+}
 
-	timeWaitOpt := tcpip.TCPTimeWaitTimeoutOption(time.Duration(0))
-	if err := ns.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &timeWaitOpt); err != nil {
-		t.Fatalf("SetTransportProtocolOption(%d, &%T(%d)) = %s", tcp.ProtocolNumber, timeWaitOpt, timeWaitOpt, err)
+// Skipping DAD must restore the interface's own DAD configurations, rather
+// than the stack's: DAD stays disabled on loopback.
+func TestAddInterfaceAddressSkipDADLoopback(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{
+		dadConfigs: tcpipstack.DADConfigurations{
+			DupAddrDetectTransmits: 1,
+			RetransmitTimer:        time.Second,
+		},
+	})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+	var nicid tcpip.NICID
+	for id, info := range ns.stack.NICInfo() {
+		if info.Name == "lo" {
+			nicid = id
+		}
+	}
+	if nicid == 0 {
+		t.Fatal("no loopback interface")
 	}
 
-	// Trigger server close, so that client enters TIME_WAIT.
-	server.Close()
-
-	// gVisor stack notifies EventHUp on entering TIME_WAIT. Wait for some time
-	// for the EventHUp to be processed by netstack.
-	for {
-		// The client endpoint would be removed from the endpoints map as a result
-		// of processing EventHUp.
-		if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
-			break
+	for _, ex := range []struct {
+		addr    tcpip.Address
+		skipDAD bool
+	}{
+		{addr: util.Parse("2001:db8::1"), skipDAD: true},
+		{addr: util.Parse("2001:db8::2"), skipDAD: false},
+	} {
+		if status := addIPv6Address(ns, nicid, ex.addr, ex.skipDAD); status != zx.ErrOk {
+			t.Fatalf("addIPv6Address(_, %d, %s, %t) = %s", nicid, ex.addr, ex.skipDAD, status)
+		}
+		if !ipv6AddressAssigned(t, ns, nicid, ex.addr) {
+			t.Errorf("%s added with skipDAD=%t not assigned immediately on loopback", ex.addr, ex.skipDAD)
 		}
-		<-ticker.C
 	}
 }
 
-func TestEndpointsMapKey(t *testing.T) {
+func TestFlushDynamicRoutes(t *testing.T) {
 	ns, _ := newNetstack(t, netstackTestOptions{})
-	if ns.endpoints.nextKey != 0 {
-		t.Fatalf("got ns.endpoints.nextKey = %d, want 0", ns.endpoints.nextKey)
-	}
 
-	tcpipEP := func() (*waiter.Queue, tcpip.Endpoint) {
-		var wq waiter.Queue
-		ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
-		if err != nil {
-			t.Fatalf("NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, _) = %s", err)
+	var nicids []tcpip.NICID
+	for i := 0; i < 2; i++ {
+		ifs := addNoopEndpoint(t, ns, "")
+		t.Cleanup(ifs.RemoveByUser)
+		if err := ifs.Up(); err != nil {
+			t.Fatal("ifs.Up(): ", err)
 		}
-		t.Cleanup(ep.Close)
-		return &wq, ep
+		nicids = append(nicids, ifs.nicid)
 	}
-	// Test if we always skip key value 0 while adding to the map.
-	for _, key := range []uint64{0, math.MaxUint64} {
-		wq, ep := tcpipEP()
 
-		// Set a test value to nextKey which is used to compute the endpoint key.
-		ns.endpoints.nextKey = key
-		eps, err := newEndpointWithSocket(ep, wq, tcp.ProtocolNumber, ipv6.ProtocolNumber, ns)
-		if err != nil {
-			t.Fatal(err)
+	staticRoute := tcpip.Route{
+		Destination: util.PointSubnet("\x0a\x00\x00\x01"),
+		Gateway:     "\x01\x02\x03\x04",
+		NIC:         nicids[0],
+	}
+	if err := ns.AddRoute(staticRoute, metricNotSet, false /* dynamic */); err != nil {
+		t.Fatalf("AddRoute(%s, metricNotSet, false): %s", staticRoute, err)
+	}
+	for _, nicid := range nicids {
+		rs := []tcpip.Route{
+			{
+				Destination: header.IPv4EmptySubnet,
+				Gateway:     "\x01\x02\x03\x04",
+				NIC:         nicid,
+			},
+			{
+				Destination: util.PointSubnet("\x0a\x00\x00\x02"),
+				Gateway:     "\x01\x02\x03\x04",
+				NIC:         nicid,
+			},
 		}
-		t.Cleanup(eps.close)
-		if ns.endpoints.nextKey != 1 {
-			t.Fatalf("got ns.endpoints.nextKey = %d, want 1", ns.endpoints.nextKey)
+		if err := ns.AddRoutes(rs, metricNotSet, true /* dynamic */); err != nil {
+			t.Fatalf("AddRoutes(%s, metricNotSet, true): %s", rs, err)
 		}
-		if eps.endpoint.key != 1 {
-			t.Fatalf("got eps.endpoint.key = %d, want 1", eps.endpoint.key)
+	}
+
+	ns.FlushDynamicRoutes()
+
+	var staticFound bool
+	for _, er := range ns.GetExtendedRouteTable() {
+		if er.Dynamic {
+			t.Errorf("dynamic route %s remains after FlushDynamicRoutes", er.Route)
 		}
-		if _, ok := ns.endpoints.Load(eps.endpoint.key); !ok {
-			t.Fatalf("got endpoints.Load(%d) = (_,false)", eps.endpoint.key)
+		if er.Route == staticRoute {
+			staticFound = true
 		}
-		// Closing the endpoint should remove the endpoint with key value 1
-		// from the endpoints map. This lets the subsequent iteration to reuse
-		// key value 1 to add a new endpoint to the map.
-		eps.close()
 	}
-
-	// Key value 0 is not expected to be removed from the map.
-	_, ep := tcpipEP()
-	ns.endpoints.Store(0, ep)
-	if ns.onRemoveEndpoint(0) {
-		t.Errorf("got ns.onRemoveEndpoint(0) = true, want false")
+	if !staticFound {
+		t.Errorf("static route %s removed by FlushDynamicRoutes", staticRoute)
 	}
-	if _, ok := ns.endpoints.Load(0); !ok {
-		t.Fatal("got endpoints.Load(0) = (_,false)")
+	for _, nicid := range nicids {
+		if v4, v6 := ns.InterfaceHasDefaultRoute(nicid); v4 || v6 {
+			t.Errorf("got InterfaceHasDefaultRoute(%d) = (%t, %t), want = (false, false)", nicid, v4, v6)
+		}
+	}
+	var stackRoutes int
+	for _, r := range ns.stack.GetRouteTable() {
+		if r.NIC == nicids[0] || r.NIC == nicids[1] {
+			stackRoutes++
+		}
+	}
+	if stackRoutes != 1 {
+		t.Errorf("got %d routes for the NICs in the stack, want = 1: %s", stackRoutes, ns.stack.GetRouteTable())
 	}
 }
 
-func TestNICName(t *testing.T) {
+func TestInterfaceHasDefaultRoute(t *testing.T) {
 	ns, _ := newNetstack(t, netstackTestOptions{})
 
-	if want, got := "unknown(NICID=0)", ns.name(0); got != want {
-		t.Fatalf("got ns.name(0) = %q, want %q", got, want)
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
 	}
 
-	{
-		ifs := addNoopEndpoint(t, ns, "")
-		t.Cleanup(ifs.RemoveByUser)
-		if got, want := ifs.ns.name(ifs.nicid), t.Name()+"1"; got != want {
-			t.Fatalf("got ifs.mu.name = %q, want = %q", got, want)
+	checkDefaultRoute := func(wantV4, wantV6 bool) {
+		t.Helper()
+		if v4, v6 := ns.InterfaceHasDefaultRoute(ifs.nicid); v4 != wantV4 || v6 != wantV6 {
+			t.Errorf("got InterfaceHasDefaultRoute(%d) = (%t, %t), want = (%t, %t)", ifs.nicid, v4, v6, wantV4, wantV6)
 		}
 	}
 
-	{
-		const name = "VerySpecialName"
-		ifs := addNoopEndpoint(t, ns, name)
-		t.Cleanup(ifs.RemoveByUser)
-		if got, want := ifs.ns.name(ifs.nicid), name; got != want {
-			t.Fatalf("got ifs.mu.name = %q, want = %q", got, want)
-		}
+	v4Route := tcpip.Route{
+		Destination: header.IPv4EmptySubnet,
+		Gateway:     "\x01\x02\x03\x04",
+		NIC:         ifs.nicid,
+	}
+	v6Route := tcpip.Route{
+		Destination: header.IPv6EmptySubnet,
+		Gateway:     "\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01",
+		NIC:         ifs.nicid,
 	}
-}
-
-func TestNotStartedByDefault(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
 
-	startCalled := false
-	controller := noopController{
-		onUp: func() { startCalled = true },
+	checkDefaultRoute(false, false)
+	if err := ns.AddRoute(v4Route, metricNotSet, false); err != nil {
+		t.Fatalf("AddRoute(%s, metricNotSet, false): %s", v4Route, err)
 	}
-	if _, err := ns.addEndpoint(
-		func(tcpip.NICID) string { return t.Name() },
-		&noopEndpoint{},
-		&controller,
-		nil, /* observer */
-		0,   /* metric */
-	); err != nil {
-		t.Fatal(err)
+	checkDefaultRoute(true, false)
+	if err := ns.AddRoute(v6Route, metricNotSet, false); err != nil {
+		t.Fatalf("AddRoute(%s, metricNotSet, false): %s", v6Route, err)
 	}
-
-	if startCalled {
-		t.Error("unexpected call to Controller.Up")
+	checkDefaultRoute(true, true)
+	if v4, v6 := ns.InterfaceHasDefaultRoute(ifs.nicid + 1); v4 || v6 {
+		t.Errorf("got InterfaceHasDefaultRoute(%d) = (%t, %t), want = (false, false)", ifs.nicid+1, v4, v6)
+	}
+	if err := ns.DelRoute(v4Route); err != nil {
+		t.Fatalf("DelRoute(%s): %s", v4Route, err)
+	}
+	checkDefaultRoute(false, true)
+	if err := ns.DelRoute(v6Route); err != nil {
+		t.Fatalf("DelRoute(%s): %s", v6Route, err)
 	}
+	checkDefaultRoute(false, false)
 }
 
-type ndpDADEvent struct {
-	nicID  tcpip.NICID
-	addr   tcpip.Address
-	result tcpipstack.DADResult
-}
+// TestStackNICEnableDisable tests that the NIC in stack.Stack is enabled or
+// disabled when the underlying link is brought up or down, respectively.
+func TestStackNICEnableDisable(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
 
-var _ ipv6.NDPDispatcher = (*testNDPDispatcher)(nil)
+	// The NIC should initially be disabled in stack.Stack.
+	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
+		t.Fatalf("got ns.stack.CheckNIC(%d) = true, want = false", ifs.nicid)
+	}
 
-// testNDPDispatcher is a tcpip.NDPDispatcher that sends an NDP DAD event on
-// dadC when OnDuplicateAddressDetectionResult gets called.
-type testNDPDispatcher struct {
-	dadC chan ndpDADEvent
-}
+	isUp := func() bool {
+		ifs.mu.Lock()
+		defer ifs.mu.Unlock()
+		return ifs.IsUpLocked()
+	}
 
-// OnDuplicateAddressDetectionResult implements ipv6.NDPDispatcher.
-func (n *testNDPDispatcher) OnDuplicateAddressDetectionResult(nicID tcpip.NICID, addr tcpip.Address, result tcpipstack.DADResult) {
-	if c := n.dadC; c != nil {
-		c <- ndpDADEvent{
-			nicID:  nicID,
-			addr:   addr,
-			result: result,
-		}
+	if isUp() {
+		t.Fatal("got initial link state up, want down")
 	}
-}
 
-// OnDefaultRouterDiscovered implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnOffLinkRouteUpdated(tcpip.NICID, tcpip.Subnet, tcpip.Address, header.NDPRoutePreference) {
-}
+	// Bringing the link up should enable the NIC in stack.Stack.
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
+	}
+	if enabled := ns.stack.CheckNIC(ifs.nicid); !enabled {
+		t.Fatalf("got ns.stack.CheckNIC(%d) = false, want = true", ifs.nicid)
+	}
 
-// OnDefaultRouterInvalidated implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnOffLinkRouteInvalidated(tcpip.NICID, tcpip.Subnet, tcpip.Address) {
-}
+	if !isUp() {
+		t.Fatal("got post-up link state down, want up")
+	}
 
-// OnOnLinkPrefixDiscovered implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnOnLinkPrefixDiscovered(tcpip.NICID, tcpip.Subnet) {
-}
+	// Bringing the link down should disable the NIC in stack.Stack.
+	if err := ifs.Down(); err != nil {
+		t.Fatal("ifs.Down(): ", err)
+	}
+	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
+		t.Fatalf("got ns.stack.CheckNIC(%d) = true, want = false", ifs.nicid)
+	}
 
-// OnOnLinkPrefixInvalidated implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnOnLinkPrefixInvalidated(tcpip.NICID, tcpip.Subnet) {
+	if isUp() {
+		t.Fatal("got post-down link state up, want down")
+	}
 }
 
-// OnAutoGenAddress implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnAutoGenAddress(tcpip.NICID, tcpip.AddressWithPrefix) {
-}
+var _ NICRemovedHandler = (*testNicRemovedHandler)(nil)
 
-// OnAutoGenAddressDeprecated implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnAutoGenAddressDeprecated(tcpip.NICID, tcpip.AddressWithPrefix) {
+type testNicRemovedHandler struct {
+	removedNICID tcpip.NICID
 }
 
-// OnAutoGenAddressInvalidated implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnAutoGenAddressInvalidated(tcpip.NICID, tcpip.AddressWithPrefix) {
+func (h *testNicRemovedHandler) RemovedNIC(nicID tcpip.NICID) {
+	h.removedNICID = nicID
 }
 
-// OnRecursiveDNSServerOption implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnRecursiveDNSServerOption(tcpip.NICID, []tcpip.Address, time.Duration) {
-}
+// TestStackNICRemove tests that the NIC in stack.Stack is removed when the
+// underlying link is closed.
+func TestStackNICRemove(t *testing.T) {
+	nicRemovedHandler := testNicRemovedHandler{}
+	ns, _ := newNetstack(t, netstackTestOptions{nicRemovedHandler: &nicRemovedHandler})
+	var obs noopObserver
 
-// OnDNSSearchListOption implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnDNSSearchListOption(tcpip.NICID, []string, time.Duration) {
-}
-
-// OnDHCPv6Configuration implements ipv6.NDPDispatcher.
-func (*testNDPDispatcher) OnDHCPv6Configuration(tcpip.NICID, ipv6.DHCPv6ConfigurationFromNDPRA) {
-}
-
-func TestIpv6LinkLocalOnLinkRoute(t *testing.T) {
-	if got, want := ipv6LinkLocalOnLinkRoute(6), (tcpip.Route{Destination: header.IPv6LinkLocalPrefix.Subnet(), NIC: 6}); got != want {
-		t.Fatalf("got ipv6LinkLocalOnLinkRoute(6) = %s, want = %s", got, want)
-	}
-}
-
-// Test that NICs get an on-link route to the IPv6 link-local subnet when it is
-// brought up.
-func TestIpv6LinkLocalOnLinkRouteOnUp(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
-
-	ep := noopEndpoint{
-		linkAddress: tcpip.LinkAddress([]byte{2, 3, 4, 5, 6, 7}),
-	}
 	ifs, err := ns.addEndpoint(
 		func(tcpip.NICID) string { return t.Name() },
-		&ep,
+		&noopEndpoint{},
 		&noopController{},
-		nil, /* observer */
-		0,   /* metric */
+		&obs,
+		0, /* metric */
 	)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	linkLocalRoute := ipv6LinkLocalOnLinkRoute(ifs.nicid)
+	// The NIC should initially be disabled in stack.Stack.
+	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
+		t.Errorf("got ns.stack.CheckNIC(%d) = true, want = false", ifs.nicid)
+	}
+	if _, ok := ns.stack.NICInfo()[ifs.nicid]; !ok {
+		t.Errorf("missing NICInfo for NIC %d", ifs.nicid)
+	}
+	if _, err := ns.stack.GetMainNICAddress(ifs.nicid, header.IPv6ProtocolNumber); err != nil {
+		t.Errorf("GetMainNICAddress(%d, header.IPv6ProtocolNumber): %s", ifs.nicid, err)
+	}
 
-	// Initially should not have the link-local route.
-	rt := ns.stack.GetRouteTable()
-	if containsRoute(rt, linkLocalRoute) {
-		t.Fatalf("got GetRouteTable() = %+v, don't want = %s", rt, linkLocalRoute)
+	if t.Failed() {
+		t.FailNow()
 	}
 
-	// Bringing the ethernet device up should result in the link-local
-	// route being added.
-	if err := ifs.Up(); err != nil {
-		t.Fatalf("eth.Up(): %s", err)
+	// Closing the link should remove the NIC from stack.Stack.
+	obs.onLinkClosed()
+
+	if enabled := ns.stack.CheckNIC(ifs.nicid); enabled {
+		t.Errorf("got ns.stack.CheckNIC(%d) = false, want = true", ifs.nicid)
 	}
-	rt = ns.stack.GetRouteTable()
-	if !containsRoute(rt, linkLocalRoute) {
-		t.Fatalf("got GetRouteTable() = %+v, want = %s", rt, linkLocalRoute)
+	if nicInfo, ok := ns.stack.NICInfo()[ifs.nicid]; ok {
+		t.Errorf("unexpected NICInfo found for NIC %d = %+v", ifs.nicid, nicInfo)
 	}
-
-	// Bringing the ethernet device down should result in the link-local
-	// route being removed.
-	if err := ifs.Down(); err != nil {
-		t.Fatalf("eth.Down(): %s", err)
+	{
+		addr, err := ns.stack.GetMainNICAddress(ifs.nicid, header.IPv6ProtocolNumber)
+		if _, ok := err.(*tcpip.ErrUnknownNICID); !ok {
+			t.Errorf("got GetMainNICAddress(%d, header.IPv6ProtocolNumber) = (%s, %T), want = (_, *tcpip.ErrUnknownNICID)", ifs.nicid, addr, err)
+		}
 	}
-	rt = ns.stack.GetRouteTable()
-	if containsRoute(rt, linkLocalRoute) {
-		t.Fatalf("got GetRouteTable() = %+v, don't want = %s", rt, linkLocalRoute)
+	if nicRemovedHandler.removedNICID != ifs.nicid {
+		t.Errorf("got nicRemovedHandler.removedNICID = %d, want = %d", nicRemovedHandler.removedNICID, ifs.nicid)
 	}
+
+	// Wait for the controller to stop and free up its resources.
+	ifs.endpoint.Wait()
 }
 
-func TestOnLinkV6Route(t *testing.T) {
-	subAddr := util.Parse("abcd:1234::")
-	subMask := tcpip.AddressMask(util.Parse("ffff:ffff::"))
-	subnet, err := tcpip.NewSubnet(subAddr, subMask)
-	if err != nil {
-		t.Fatalf("NewSubnet(%s, %s): %s", subAddr, subMask, err)
+func containsRoute(rs []tcpip.Route, r tcpip.Route) bool {
+	for _, i := range rs {
+		if i == r {
+			return true
+		}
 	}
 
-	if got, want := onLinkV6Route(6, subnet), (tcpip.Route{Destination: subnet, NIC: 6}); got != want {
-		t.Fatalf("got onLinkV6Route(6, %s) = %s, want = %s", subnet, got, want)
-	}
+	return false
 }
 
-func TestMulticastPromiscuousModeEnabledByDefault(t *testing.T) {
+func TestEndpoint_Close(t *testing.T) {
 	ns, _ := newNetstack(t, netstackTestOptions{})
+	var wq waiter.Queue
+	// Avoid polluting everything with err of type tcpip.Error.
+	ep := func() tcpip.Endpoint {
+		ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, _) = %s", err)
+		}
+		return ep
+	}()
+	defer ep.Close()
 
-	multicastPromiscuousModeEnabled := false
-	eth, _ := testutil.MakeEthernetDevice(t, ethernet.Info{}, 1)
-	eth.ConfigMulticastSetPromiscuousModeImpl = func(enabled bool) (int32, error) {
-		multicastPromiscuousModeEnabled = enabled
-		return int32(zx.ErrOk), nil
-	}
-
-	if _, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: t.Name()}, &eth); err != nil {
+	eps, err := newEndpointWithSocket(ep, &wq, tcp.ProtocolNumber, ipv6.ProtocolNumber, ns)
+	if err != nil {
 		t.Fatal(err)
 	}
+	defer eps.close()
 
-	if !multicastPromiscuousModeEnabled {
-		t.Error("expected a call to ConfigMulticastSetPromiscuousMode(true) by addEth")
+	eps.mu.Lock()
+	channels := []struct {
+		ch   <-chan struct{}
+		name string
+	}{
+		{ch: eps.closing, name: "closing"},
+		{ch: eps.mu.loopReadDone, name: "loopReadDone"},
+		{ch: eps.mu.loopWriteDone, name: "loopWriteDone"},
 	}
-}
+	eps.mu.Unlock()
 
-func TestUniqueFallbackNICNames(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
+	// Check starting conditions.
+	for _, ch := range channels {
+		select {
+		case <-ch.ch:
+			t.Errorf("%s cleaned up prematurely", ch.name)
+		default:
+		}
+	}
 
-	ifs1 := addNoopEndpoint(t, ns, "")
-	t.Cleanup(ifs1.RemoveByUser)
-	ifs2 := addNoopEndpoint(t, ns, "")
-	t.Cleanup(ifs2.RemoveByUser)
+	if _, ok := eps.ns.endpoints.Load(eps.endpoint.key); !ok {
+		var keys []uint64
+		eps.ns.endpoints.Range(func(key uint64, _ tcpip.Endpoint) bool {
+			keys = append(keys, key)
+			return true
+		})
+		t.Errorf("got endpoints map = %d at creation, want %d", keys, eps.endpoint.key)
+	}
 
-	nicInfos := ns.stack.NICInfo()
+	if t.Failed() {
+		t.FailNow()
+	}
 
-	nicInfo1, ok := nicInfos[ifs1.nicid]
-	if !ok {
-		t.Fatalf("stack.NICInfo()[%d] = (_, false)", ifs1.nicid)
+	// Create a referent.
+	s, err := newStreamSocket(eps)
+	if err != nil {
+		t.Fatalf("newStreamSocket() = %s", err)
 	}
-	nicInfo2, ok := nicInfos[ifs2.nicid]
-	if !ok {
-		t.Fatalf("stack.NICInfo()[%d]: (_, false)", ifs2.nicid)
+	defer func() {
+		func() {
+			result, err := s.Close(context.Background())
+			if err, ok := err.(*zx.Error); ok && err.Status == zx.ErrPeerClosed {
+				return
+			}
+			t.Errorf("s.Close() = (%#v, %v)", result, err)
+		}()
+		if err := s.Channel.Close(); err != nil {
+			t.Errorf("s.Channel.Close() = %s", err)
+		}
+	}()
+
+	// Create another referent.
+	localC, peerC, err := zx.NewChannel(0)
+	if err != nil {
+		t.Fatalf("zx.NewChannel() = %s", err)
 	}
+	defer func() {
+		// Already closed below.
+		if err := localC.Close(); err != nil {
+			t.Errorf("localC.Close() = %s", err)
+		}
 
-	if nicInfo1.Name == nicInfo2.Name {
-		t.Fatalf("got (%+v).Name == (%+v).Name, want non-equal", nicInfo1, nicInfo2)
+		// By-value copy already closed by the server when we closed the peer.
+		err := peerC.Close()
+		if err, ok := err.(*zx.Error); ok && err.Status == zx.ErrBadHandle {
+			return
+		}
+		t.Errorf("peerC.Close() = %v", err)
+	}()
+
+	if err := s.Clone(context.Background(), 0, io.NodeWithCtxInterfaceRequest{Channel: peerC}); err != nil {
+		t.Fatalf("s.Clone() = %s", err)
 	}
-}
 
-func TestStaticIPConfiguration(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
+	// Close the original referent.
+	if result, err := s.Close(context.Background()); err != nil {
+		t.Fatalf("s.Close() = %s", err)
+	} else if result.Which() != io.Node2CloseResultResponse {
+		t.Fatalf("s.Close() = %s", zx.Status(result.Err))
+	}
 
-	addr := fidlconv.ToNetIpAddress(testV4Address)
-	ifAddr := fidlnet.Subnet{Addr: addr, PrefixLen: 32}
-	for _, test := range []struct {
-		name     string
-		features ethernet.Features
-	}{
-		{name: "default"},
-		{name: "wlan", features: ethernet.FeaturesWlan},
-	} {
-		t.Run(test.name, func(t *testing.T) {
-			d, _ := testutil.MakeEthernetDevice(t, ethernet.Info{
-				Features: test.features,
-				Mtu:      1400,
-			}, 1)
-			ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: t.Name()}, &d)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer ifs.RemoveByUser()
+	// There's still a referent.
+	for _, ch := range channels {
+		select {
+		case <-ch.ch:
+			t.Errorf("%s cleaned up prematurely", ch.name)
+		default:
+		}
+	}
 
-			onlineChanged := make(chan bool, 1)
-			ifs.observer.SetOnLinkOnlineChanged(func(linkOnline bool) {
-				ifs.onLinkOnlineChanged(linkOnline)
-				onlineChanged <- linkOnline
-			})
+	if _, ok := eps.ns.endpoints.Load(eps.endpoint.key); !ok {
+		var keys []uint64
+		eps.ns.endpoints.Range(func(key uint64, _ tcpip.Endpoint) bool {
+			keys = append(keys, key)
+			return true
+		})
+		t.Errorf("got endpoints map prematurely = %d, want %d", keys, eps.endpoint.key)
+	}
 
-			name := ifs.ns.name(ifs.nicid)
-			result := ns.addInterfaceAddr(uint64(ifs.nicid), ifAddr)
-			if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
-				t.Fatalf("got ns.addInterfaceAddr(%d, %#v) = %#v, want = Response()", ifs.nicid, ifAddr, result)
-			}
+	if t.Failed() {
+		t.FailNow()
+	}
 
-			if mainAddr, err := ns.stack.GetMainNICAddress(ifs.nicid, ipv4.ProtocolNumber); err != nil {
-				t.Errorf("stack.GetMainNICAddress(%d, ipv4.ProtocolNumber): %s", ifs.nicid, err)
-			} else if got := mainAddr.Address; got != testV4Address {
-				t.Errorf("got stack.GetMainNICAddress(%d, ipv4.ProtocolNumber).Addr = %s, want = %s", ifs.nicid, got, testV4Address)
-			}
+	// Close the last reference.
+	if err := localC.Close(); err != nil {
+		t.Fatalf("localC.Close() = %s", err)
+	}
 
-			ifs.mu.Lock()
-			if ifs.mu.dhcp.enabled {
-				t.Error("expected dhcp state to be disabled initially")
-			}
-			ifs.mu.Unlock()
-
-			if err := ifs.Down(); err != nil {
-				t.Fatal(err)
-			}
-
-			ifs.mu.Lock()
-			if ifs.mu.dhcp.enabled {
-				t.Error("expected dhcp state to remain disabled after bringing interface down")
-			}
-			if ifs.mu.dhcp.running() {
-				t.Error("expected dhcp state to remain stopped after bringing interface down")
-			}
-			ifs.mu.Unlock()
-
-			if err := ifs.Up(); err != nil {
-				t.Fatal(err)
-			}
-			if got, want := <-onlineChanged; got != want {
-				t.Errorf("got state = %t, want %t", got, want)
+	// Give a generous timeout for the closed channel to be detected.
+	timeout := make(chan struct{})
+	time.AfterFunc(5*time.Second, func() { close(timeout) })
+	for _, ch := range channels {
+		if ch.ch != nil {
+			select {
+			case <-ch.ch:
+			case <-timeout:
+				t.Errorf("%s not cleaned up", ch.name)
 			}
+		}
+	}
 
-			ifs.mu.Lock()
-			if ifs.mu.dhcp.enabled {
-				t.Error("expected dhcp state to remain disabled after restarting interface")
+	for {
+		if _, ok := eps.ns.endpoints.Load(eps.endpoint.key); ok {
+			select {
+			case <-timeout:
+				var keys []uint64
+				eps.ns.endpoints.Range(func(key uint64, _ tcpip.Endpoint) bool {
+					keys = append(keys, key)
+					return true
+				})
+				t.Errorf("got endpoints map = %d after closure, want *not* %d", keys, eps.endpoint.key)
+			default:
+				continue
 			}
-			ifs.mu.Unlock()
-
-			ifs.setDHCPStatus(name, true)
+		}
+		break
+	}
 
-			ifs.mu.Lock()
-			if !ifs.mu.dhcp.enabled {
-				t.Error("expected dhcp state to become enabled after manually enabling it")
-			}
-			if !ifs.mu.dhcp.running() {
-				t.Error("expected dhcp state running")
-			}
-			ifs.mu.Unlock()
-		})
+	if t.Failed() {
+		t.FailNow()
 	}
 }
 
-var _ NICRemovedHandler = (*noopNicRemovedHandler)(nil)
+// TestTCPEndpointMapAcceptAfterReset tests that an already-reset endpoint
+// isn't added to the endpoints map, since such an endpoint wouldn't receive a
+// hangup notification and its reference in the map would leak.
+func TestTCPEndpointMapAcceptAfterReset(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
 
-type noopNicRemovedHandler struct{}
+	listener := createEP(t, ns, new(waiter.Queue))
 
-func (*noopNicRemovedHandler) RemovedNIC(tcpip.NICID) {}
+	if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("Bind({}) = %s", err)
+	}
+	if err := listener.ep.Listen(1); err != nil {
+		t.Fatalf("Listen(1) = %s", err)
+	}
 
-type netstackTestOptions struct {
-	nicRemovedHandler NICRemovedHandler
-	ndpDisp           ipv6.NDPDispatcher
-}
+	client := createEP(t, ns, new(waiter.Queue))
 
-func newNetstack(t *testing.T, options netstackTestOptions) (*Netstack, *faketime.ManualClock) {
-	t.Helper()
+	// Connect and wait for the incoming connection.
+	func() {
+		connectAddr, err := listener.ep.GetLocalAddress()
+		if err != nil {
+			t.Fatalf("GetLocalAddress() = %s", err)
+		}
 
-	clock := faketime.NewManualClock()
+		waitEntry, notifyCh := waiter.NewChannelEntry(waiter.EventIn)
+		listener.wq.EventRegister(&waitEntry)
+		defer listener.wq.EventUnregister(&waitEntry)
 
-	stk := tcpipstack.New(tcpipstack.Options{
-		NetworkProtocols: []tcpipstack.NetworkProtocolFactory{
-			arp.NewProtocol,
-			ipv4.NewProtocol,
-			ipv6.NewProtocolWithOptions(ipv6.Options{
-				NDPDisp: options.ndpDisp,
-			}),
-		},
-		TransportProtocols: []tcpipstack.TransportProtocolFactory{
-			tcp.NewProtocol,
-			udp.NewProtocol,
-		},
-		Clock: clock,
+		switch err := client.ep.Connect(connectAddr); err.(type) {
+		case *tcpip.ErrConnectStarted:
+		default:
+			t.Fatalf("Connect(%#v) = %s", connectAddr, err)
+		}
+		<-notifyCh
+	}()
+
+	// Initiate a RST of the connection sitting in the accept queue.
+	client.ep.SocketOptions().SetLinger(tcpip.LingerOption{
+		Enabled: true,
+		Timeout: 0,
 	})
+	client.ep.Close()
 
-	ns := &Netstack{
-		stack: stk,
-		// Required initialization because adding/removing interfaces interacts with
-		// DNS configuration.
-		dnsConfig: dns.MakeServersConfig(stk.Clock()),
-		nicRemovedHandlers: []NICRemovedHandler{func() NICRemovedHandler {
-			if h := options.nicRemovedHandler; h != nil {
-				return h
-			}
-			return &noopNicRemovedHandler{}
+	// Wait for the RST to be processed by the stack.
+	time.Sleep(100 * time.Millisecond)
 
-		}()},
-	}
-	if ndpDisp, ok := options.ndpDisp.(*ndpDispatcher); ok {
-		ndpDisp.ns = ns
-		ndpDisp.dynamicAddressSourceTracker.init(ns)
+	_, _, eps, err := listener.Accept(false)
+	if err != nil {
+		t.Fatalf("ep.Accept(nil) = %s", err)
 	}
-	ns.interfaceWatchers.mu.watchers = make(map[*interfaceWatcherImpl]struct{})
-	ns.interfaceWatchers.mu.lastObserved = make(map[tcpip.NICID]interfaces.Properties)
+	defer eps.close()
 
-	t.Cleanup(func() {
-		for _, nic := range ns.stack.NICInfo() {
-			ifs := nic.Context.(*ifState)
-			ifs.RemoveByUser()
-			ifs.endpoint.Wait()
-		}
-	})
-	return ns, clock
-}
+	// Expect the `Accept` to have removed the endpoint from the map.
+	if _, ok := ns.endpoints.Load(eps.endpoint.key); ok {
+		t.Fatalf("got endpoints.Load(%d) = (_, true)", eps.endpoint.key)
+	}
 
-func getInterfaceAddresses(t *testing.T, ni *stackImpl, nicid tcpip.NICID) []tcpip.AddressWithPrefix {
-	t.Helper()
-	nicInfos := ni.ns.stack.NICInfo()
-	nicInfo, ok := nicInfos[nicid]
-	if !ok {
-		t.Fatalf("couldn't find NICID=%d in %#v", nicid, nicInfos)
+	eps.mu.Lock()
+	channels := []struct {
+		ch   <-chan struct{}
+		name string
+	}{
+		{ch: eps.closing, name: "closing"},
+		{ch: eps.mu.loopReadDone, name: "loopReadDone"},
+		{ch: eps.mu.loopWriteDone, name: "loopWriteDone"},
 	}
-	addrs := make([]tcpip.AddressWithPrefix, len(nicInfo.ProtocolAddresses))
-	for i := range nicInfo.ProtocolAddresses {
-		addrs[i] = nicInfo.ProtocolAddresses[i].AddressWithPrefix
+	eps.mu.Unlock()
+
+	// Give a generous timeout for the closed channel to be detected.
+	timeout := make(chan struct{})
+	time.AfterFunc(5*time.Second, func() { close(timeout) })
+	for _, ch := range channels {
+		if ch.ch != nil {
+			select {
+			case <-ch.ch:
+			case <-timeout:
+				t.Errorf("%s not cleaned up", ch.name)
+			}
+		}
 	}
-	return addrs
 }
 
-func compareInterfaceAddresses(t *testing.T, got, want []tcpip.AddressWithPrefix) {
-	t.Helper()
-	sort.Slice(got, func(i, j int) bool { return got[i].Address < got[j].Address })
-	sort.Slice(want, func(i, j int) bool { return want[i].Address < want[j].Address })
-	if diff := cmp.Diff(got, want); diff != "" {
-		t.Errorf("Interface addresses mismatch (-want +got):\n%s", diff)
+func createEP(t *testing.T, ns *Netstack, wq *waiter.Queue) *endpointWithSocket {
+	// Avoid polluting the scope with err of type tcpip.Error.
+	ep := func() tcpip.Endpoint {
+		ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", err)
+		}
+		return ep
+	}()
+	t.Cleanup(ep.Close)
+	eps, err := newEndpointWithSocket(ep, wq, tcp.ProtocolNumber, ipv4.ProtocolNumber, ns)
+	if err != nil {
+		t.Fatal(err)
 	}
+	t.Cleanup(eps.close)
+	return eps
 }
 
-// Test adding a list of both IPV4 and IPV6 addresses and then removing them
-// again one-by-one.
-func TestListInterfaceAddresses(t *testing.T) {
-	ndpDisp := testNDPDispatcher{
-		dadC: make(chan ndpDADEvent, 1),
+func TestWhoHoldsAddress(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
 	}
-	ns, clock := newNetstack(t, netstackTestOptions{ndpDisp: &ndpDisp})
-	ni := &stackImpl{ns: ns}
 
-	ep := noopEndpoint{
-		linkAddress: tcpip.LinkAddress([]byte{2, 3, 4, 5, 6, 7}),
+	const port = 8080
+	holder := createEP(t, ns, new(waiter.Queue))
+	holder.ep.SocketOptions().SetReuseAddress(true)
+	addr := tcpip.FullAddress{Addr: ipv4Loopback, Port: port}
+	if err := holder.ep.Bind(addr); err != nil {
+		t.Fatalf("Bind(%#v) = %s", addr, err)
 	}
-	ifState, err := ns.addEndpoint(
-		func(tcpip.NICID) string { return t.Name() },
-		&ep,
-		&noopController{},
-		nil, /* observer */
-		0,   /* metric */
-	)
-	if err != nil {
-		t.Fatal(err)
+	if err := holder.ep.Listen(1); err != nil {
+		t.Fatalf("Listen(1) = %s", err)
 	}
-	if err := ifState.Up(); err != nil {
-		t.Fatal("ifState.Up(): ", err)
+
+	other := createEP(t, ns, new(waiter.Queue))
+	otherAddr := tcpip.FullAddress{Addr: ipv4Loopback, Port: port + 1}
+	if err := other.ep.Bind(otherAddr); err != nil {
+		t.Fatalf("Bind(%#v) = %s", otherAddr, err)
 	}
 
-	// Wait for and account for any addresses added automatically.
-	clock.Advance(dadResolutionTimeout)
-	for {
-		select {
-		case d := <-ndpDisp.dadC:
-			t.Logf("startup DAD event: %#v", d)
-			continue
-		default:
-		}
-		break
+	// The conflicting bind fails despite SO_REUSEADDR, since the holder is
+	// listening.
+	conflicting := createEP(t, ns, new(waiter.Queue))
+	conflicting.ep.SocketOptions().SetReuseAddress(true)
+	if err := conflicting.ep.Bind(addr); err == nil {
+		t.Fatalf("Bind(%#v) = nil, want error", addr)
 	}
 
-	wantAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+	for _, addr := range []tcpip.Address{ipv4Loopback, ""} {
+		summaries := ns.WhoHoldsAddress(addr, port)
+		if len(summaries) != 1 {
+			t.Fatalf("got WhoHoldsAddress(%s, %d) = %+v, want 1 summary", addr, port, summaries)
+		}
+		got := summaries[0]
+		if got.Key != holder.endpoint.key {
+			t.Errorf("got WhoHoldsAddress(%s, %d)[0].Key = %d, want = %d", addr, port, got.Key, holder.endpoint.key)
+		}
+		if got.ID.LocalAddress != ipv4Loopback || got.ID.LocalPort != port {
+			t.Errorf("got WhoHoldsAddress(%s, %d)[0].ID = %+v, want local address %s:%d", addr, port, got.ID, ipv4Loopback, port)
+		}
+		if !got.ReuseAddress || got.ReusePort {
+			t.Errorf("got WhoHoldsAddress(%s, %d)[0] ReuseAddress = %t, ReusePort = %t, want = true, false", addr, port, got.ReuseAddress, got.ReusePort)
+		}
+		if got.TransProto != tcp.ProtocolNumber || got.State != tcp.StateListen.String() {
+			t.Errorf("got WhoHoldsAddress(%s, %d)[0] = %+v, want a listening TCP socket", addr, port, got)
+		}
+	}
 
-	testAddresses := []tcpip.AddressWithPrefix{
-		{"\x01\x01\x01\x01", 32},
-		{"\x02\x02\x02\x02", 24},
-		{"\x03\x03\x03\x03", 16},
-		{"\x04\x04\x04\x04", 8},
-		{"\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01", 128},
-		{"\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02", 64},
-		{"\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03", 32},
-		{"\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04", 8},
+	if summaries := ns.WhoHoldsAddress(ipv4Loopback, port+2); len(summaries) != 0 {
+		t.Errorf("got WhoHoldsAddress(%s, %d) = %+v, want none", ipv4Loopback, port+2, summaries)
 	}
+}
 
-	t.Run("Add", func(t *testing.T) {
-		for _, addr := range testAddresses {
-			t.Run(addr.String(), func(t *testing.T) {
-				ifAddr := fidlnet.Subnet{
-					Addr:      fidlconv.ToNetIpAddress(addr.Address),
-					PrefixLen: uint8(addr.PrefixLen),
-				}
+func TestTCPRepair(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
 
-				result, err := ni.AddInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
-				if err != nil {
-					t.Fatalf("ni.AddInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
-				}
-				if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
-					t.Fatalf("got ni.AddInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
-				}
-				expectDad := header.IsV6UnicastAddress(addr.Address)
-				clock.Advance(dadResolutionTimeout)
-				select {
-				case d := <-ndpDisp.dadC:
-					if !expectDad {
-						t.Fatalf("unexpected DAD event: %#v", d)
-					}
-					if diff := cmp.Diff(ndpDADEvent{nicID: ifState.nicid, addr: addr.Address, result: &tcpipstack.DADSucceeded{}}, d, cmp.AllowUnexported(d)); diff != "" {
-						t.Fatalf("ndp DAD event mismatch (-want +got):\n%s", diff)
-					}
-				default:
-					if expectDad {
-						t.Fatal("timed out waiting for DAD event")
-					}
-				}
-				wantAddrs = append(wantAddrs, addr)
-				gotAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+	listener := createEP(t, ns, new(waiter.Queue))
+	if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("ep.Bind({}) = %s", err)
+	}
+	if err := listener.ep.Listen(1); err != nil {
+		t.Fatalf("ep.Listen(1) = %s", err)
+	}
+	connectAddr, err := listener.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("ep.GetLocalAddress() = %s", err)
+	}
+	connectAddr.Addr = ipv4Loopback
 
-				compareInterfaceAddresses(t, gotAddrs, wantAddrs)
-			})
-		}
-	})
+	waitEntry, inCh := waiter.NewChannelEntry(waiter.EventIn)
+	listener.wq.EventRegister(&waitEntry)
+	defer listener.wq.EventUnregister(&waitEntry)
 
-	t.Run("Remove", func(t *testing.T) {
-		for _, addr := range testAddresses {
-			t.Run(addr.String(), func(t *testing.T) {
-				ifAddr := fidlnet.Subnet{
-					Addr:      fidlconv.ToNetIpAddress(addr.Address),
-					PrefixLen: uint8(addr.PrefixLen),
-				}
+	client := createEP(t, ns, new(waiter.Queue))
+	switch err := client.ep.Connect(connectAddr); err.(type) {
+	case *tcpip.ErrConnectStarted:
+	default:
+		t.Fatalf("ep.Connect(%#v) = %s", connectAddr, err)
+	}
+	<-inCh
 
-				result, err := ni.DelInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
-				if err != nil {
-					t.Fatalf("ni.DelInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
-				}
-				if result != stack.StackDelInterfaceAddressDeprecatedResultWithResponse(stack.StackDelInterfaceAddressDeprecatedResponse{}) {
-					t.Fatalf("got ni.DelInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
-				}
+	server, _, err := listener.ep.Accept(nil)
+	if err != nil {
+		t.Fatalf("ep.Accept(nil) = %s", err)
+	}
+	t.Cleanup(server.Close)
 
-				// Remove address from list.
-				for i, a := range wantAddrs {
-					if a == addr {
-						wantAddrs = append(wantAddrs[:i], wantAddrs[i+1:]...)
-						break
-					}
-				}
-				gotAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
-				compareInterfaceAddresses(t, gotAddrs, wantAddrs)
-			})
-		}
-	})
-}
+	s := streamSocketImpl{endpointWithSocket: client}
 
-// Test that adding an address with one prefix and then adding the same address
-// but with a different prefix will simply replace the first address.
-func TestAddAddressesThenChangePrefix(t *testing.T) {
-	ns, _ := newNetstack(t, netstackTestOptions{})
-	ni := &stackImpl{ns: ns}
-	ifState := addNoopEndpoint(t, ns, "")
-	t.Cleanup(ifState.RemoveByUser)
+	if got, errno := s.GetTcpRepair(); errno != 0 || got {
+		t.Errorf("got GetTcpRepair() = (%t, %s), want = (false, 0)", got, errno)
+	}
+	if _, errno := s.GetTcpRepairState(); errno != posix.ErrnoEperm {
+		t.Errorf("got GetTcpRepairState() = (_, %s) outside of repair mode, want = (_, %s)", errno, posix.ErrnoEperm)
+	}
 
-	// The call to ns.addEndpoint() added addresses to the stack. Make sure we include
-	// those in our want list.
-	initialAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+	if errno := s.SetTcpRepair(true); errno != 0 {
+		t.Fatalf("SetTcpRepair(true) = %s", errno)
+	}
+	if got, errno := s.GetTcpRepair(); errno != 0 || !got {
+		t.Errorf("got GetTcpRepair() = (%t, %s), want = (true, 0)", got, errno)
+	}
+	// The connection is idle, so the client has sent everything the server
+	// expects and vice versa.
+	peer := server.(tcpRepairEndpoint).CompleteState()
+	want := tcpRepairState{
+		SendUnacknowledged: uint32(peer.Receiver.RcvNxt),
+		SendNext:           uint32(peer.Receiver.RcvNxt),
+		ReceiveNext:        uint32(peer.Sender.SndNxt),
+	}
+	if got, errno := s.GetTcpRepairState(); errno != 0 || got != want {
+		t.Errorf("got GetTcpRepairState() = (%+v, %s), want = (%+v, 0)", got, errno, want)
+	}
 
-	// Add address.
-	addr := tcpip.AddressWithPrefix{Address: "\x01\x01\x01\x01", PrefixLen: 8}
-	ifAddr := fidlnet.Subnet{
-		Addr:      fidlconv.ToNetIpAddress(addr.Address),
-		PrefixLen: uint8(addr.PrefixLen),
+	if errno := s.SetTcpRepair(false); errno != 0 {
+		t.Fatalf("SetTcpRepair(false) = %s", errno)
 	}
+	if _, errno := s.GetTcpRepairState(); errno != posix.ErrnoEperm {
+		t.Errorf("got GetTcpRepairState() = (_, %s) after leaving repair mode, want = (_, %s)", errno, posix.ErrnoEperm)
+	}
+}
 
-	result, err := ni.AddInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
-	if err != nil {
-		t.Fatalf("ni.AddInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
+func TestLookupConnection(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
 	}
-	if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
-		t.Fatalf("got ni.AddInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
+
+	listener := createEP(t, ns, new(waiter.Queue))
+	bindAddr := tcpip.FullAddress{Addr: ipv4Loopback}
+	if err := listener.ep.Bind(bindAddr); err != nil {
+		t.Fatalf("ep.Bind(%#v) = %s", bindAddr, err)
+	}
+	if err := listener.ep.Listen(1); err != nil {
+		t.Fatalf("ep.Listen(1) = %s", err)
+	}
+	remote, err := listener.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("ep.GetLocalAddress() = %s", err)
 	}
 
-	wantAddrs := append(initialAddrs, addr)
-	gotAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
-	compareInterfaceAddresses(t, gotAddrs, wantAddrs)
+	waitEntry, inCh := waiter.NewChannelEntry(waiter.EventIn)
+	listener.wq.EventRegister(&waitEntry)
+	defer listener.wq.EventUnregister(&waitEntry)
 
-	// Add the same address with a different prefix.
-	addr.PrefixLen *= 2
-	ifAddr.PrefixLen *= 2
+	client := createEP(t, ns, new(waiter.Queue))
+	switch err := client.ep.Connect(remote); err.(type) {
+	case *tcpip.ErrConnectStarted:
+	default:
+		t.Fatalf("ep.Connect(%#v) = %s", remote, err)
+	}
+	<-inCh
 
-	result, err = ni.AddInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
+	local, err := client.ep.GetLocalAddress()
 	if err != nil {
-		t.Fatalf("ni.AddInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
+		t.Fatalf("ep.GetLocalAddress() = %s", err)
 	}
-	if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
-		t.Fatalf("got ni.AddInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
+
+	got, ok := ns.LookupConnection(local, remote)
+	if !ok {
+		t.Fatalf("got LookupConnection(%#v, %#v) = (_, false), want = (_, true)", local, remote)
+	}
+	if got.Key != client.endpoint.key {
+		t.Errorf("got LookupConnection(...).Key = %d, want = %d", got.Key, client.endpoint.key)
+	}
+	if got.TransProto != tcp.ProtocolNumber || got.State != tcp.StateEstablished.String() {
+		t.Errorf("got LookupConnection(...) = %+v, want an established TCP socket", got)
+	}
+	if got.ReceiveQueueSize != 0 || got.SendQueueSize != 0 {
+		t.Errorf("got LookupConnection(...) queue sizes = (%d, %d), want = (0, 0)", got.ReceiveQueueSize, got.SendQueueSize)
+	}
+	if got.LastError != nil {
+		t.Errorf("got LookupConnection(...).LastError = %s, want = nil", got.LastError)
 	}
 
-	wantAddrs = append(initialAddrs, addr)
-	gotAddrs = getInterfaceAddresses(t, ni, ifState.nicid)
+	// Looking a socket up must not take errors from its endpoint, but reports
+	// those already latched by the socket.
+	client.ep.SocketOptions().SetLastError(&tcpip.ErrHostUnreachable{})
+	if got, _ := ns.LookupConnection(local, remote); got.LastError != nil {
+		t.Errorf("got LookupConnection(...).LastError = %s before the error was latched, want = nil", got.LastError)
+	}
+	switch err := client.LatchLastError(); err.(type) {
+	case *tcpip.ErrHostUnreachable:
+	default:
+		t.Fatalf("got LatchLastError() = %v, want = %s", err, &tcpip.ErrHostUnreachable{})
+	}
+	got, _ = ns.LookupConnection(local, remote)
+	switch err := got.LastError; err.(type) {
+	case *tcpip.ErrHostUnreachable:
+	default:
+		t.Errorf("got LookupConnection(...).LastError = %v, want = %s", err, &tcpip.ErrHostUnreachable{})
+	}
 
-	compareInterfaceAddresses(t, gotAddrs, wantAddrs)
+	// The listener is bound to the remote address but has no remote, and the
+	// reversed tuple belongs to the accepted endpoint, which is not a socket.
+	if got, ok := ns.LookupConnection(remote, local); ok {
+		t.Errorf("got LookupConnection(%#v, %#v) = (%+v, true), want = (_, false)", remote, local, got)
+	}
+	if got, ok := ns.LookupConnection(remote, tcpip.FullAddress{}); !ok || got.Key != listener.endpoint.key {
+		t.Errorf("got LookupConnection(%#v, {}) = (%+v, %t), want the listener with key %d", remote, got, ok, listener.endpoint.key)
+	}
 }
 
-func TestAddRouteParameterValidation(t *testing.T) {
+func TestGetSocketMemoryUsage(t *testing.T) {
 	ns, _ := newNetstack(t, netstackTestOptions{})
-	addr := tcpip.ProtocolAddress{
-		Protocol: ipv4.ProtocolNumber,
-		AddressWithPrefix: tcpip.AddressWithPrefix{
-			Address:   tcpip.Address("\xf0\xf0\xf0\xf0"),
-			PrefixLen: 24,
-		},
+
+	if sendBytes, recvBytes := ns.GetSocketMemoryUsage(); sendBytes != 0 || recvBytes != 0 {
+		t.Errorf("got GetSocketMemoryUsage() = (%d, %d) without sockets, want = (0, 0)", sendBytes, recvBytes)
 	}
-	subnetLocalAddress := tcpip.Address("\xf0\xf0\xf0\xf1")
-	ifState := addNoopEndpoint(t, ns, "")
-	t.Cleanup(ifState.RemoveByUser)
 
-	if status := ns.addInterfaceAddress(ifState.nicid, addr, true /* addRoute */); status != zx.ErrOk {
-		t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", ifState.nicid, addr.AddressWithPrefix, status)
+	var wantSend, wantRecv uint64
+	for _, size := range []int64{1 << 16, 1 << 17} {
+		eps := createEP(t, ns, new(waiter.Queue))
+		opts := eps.ep.SocketOptions()
+		opts.SetSendBufferSize(size, true /* notify */)
+		opts.SetReceiveBufferSize(2*size, true /* notify */)
+		// The stack may adjust the requested sizes; count what it applied.
+		wantSend += uint64(opts.GetSendBufferSize())
+		wantRecv += uint64(opts.GetReceiveBufferSize())
+	}
+
+	sendBytes, recvBytes := ns.GetSocketMemoryUsage()
+	if sendBytes != wantSend || recvBytes != wantRecv {
+		t.Errorf("got GetSocketMemoryUsage() = (%d, %d), want = (%d, %d)", sendBytes, recvBytes, wantSend, wantRecv)
 	}
+}
+
+func TestSetBufferForce(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	eps := createEP(t, ns, new(waiter.Queue))
+	opts := eps.ep.SocketOptions()
 
 	tests := []struct {
-		name    string
-		route   tcpip.Route
-		metric  routes.Metric
-		dynamic bool
-		err     error
+		name     string
+		setForce func(uint64)
+		set      func(uint64)
+		get      func() int64
+		limits   func() (min, max int64)
 	}{
 		{
-			name: "IPv4 destination no NIC invalid gateway",
-			route: tcpip.Route{
-				Destination: util.PointSubnet(testV4Address),
-				Gateway:     testV4Address,
-				NIC:         0,
-			},
-			metric: routes.Metric(0),
-			err:    routes.ErrNoSuchNIC,
-		},
-		{
-			name: "IPv6 destination no NIC invalid gateway",
-			route: tcpip.Route{
-				Destination: util.PointSubnet(testV6Address),
-				Gateway:     testV6Address,
-				NIC:         0,
-			},
-			metric: routes.Metric(0),
-			err:    routes.ErrNoSuchNIC,
-		},
-		{
-			name: "IPv4 destination no NIC valid gateway",
-			route: tcpip.Route{
-				Destination: util.PointSubnet(testV4Address),
-				Gateway:     subnetLocalAddress,
-				NIC:         0,
+			name:     "send",
+			setForce: eps.setSendBufferForce,
+			set: func(size uint64) {
+				if _, err := eps.SetSendBuffer(context.Background(), size); err != nil {
+					t.Fatalf("eps.SetSendBuffer(_, %d): %s", size, err)
+				}
 			},
+			get:    opts.GetSendBufferSize,
+			limits: opts.SendBufferLimits,
 		},
 		{
-			name: "zero length gateway",
-			route: tcpip.Route{
-				Destination: util.PointSubnet(testV4Address),
-				NIC:         ifState.nicid,
+			name:     "receive",
+			setForce: eps.setReceiveBufferForce,
+			set: func(size uint64) {
+				if _, err := eps.SetReceiveBuffer(context.Background(), size); err != nil {
+					t.Fatalf("eps.SetReceiveBuffer(_, %d): %s", size, err)
+				}
 			},
+			get:    opts.GetReceiveBufferSize,
+			limits: opts.ReceiveBufferLimits,
 		},
 	}
-
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			if err := ns.AddRoute(test.route, test.metric, test.dynamic); !errors.Is(err, test.err) {
-				t.Errorf("got ns.AddRoute(...) = %v, want %v", err, test.err)
+			_, max := test.limits()
+			size := uint64(max)
+
+			test.set(size)
+			if got := test.get(); got != max {
+				t.Errorf("got size after regular set = %d, want = %d", got, max)
+			}
+
+			test.setForce(size)
+			if got := test.get(); got <= max {
+				t.Errorf("got size after forced set = %d, want > %d", got, max)
+			}
+
+			test.setForce(math.MaxUint64)
+			if got := test.get(); got > maxForcedBufferSize {
+				t.Errorf("got size after forced set = %d, want <= %d", got, maxForcedBufferSize)
 			}
 		})
 	}
 }
 
-func TestDHCPAcquired(t *testing.T) {
+func TestTCPEndpointMapClose(t *testing.T) {
 	ns, _ := newNetstack(t, netstackTestOptions{})
-	ifState := addNoopEndpoint(t, ns, "")
-	t.Cleanup(ifState.RemoveByUser)
+	eps := createEP(t, ns, new(waiter.Queue))
 
-	addressBytes := []byte(testV4Address)
-	nextAddress := func() tcpip.Address {
-		addressBytes[len(addressBytes)-1]++
-		return tcpip.Address(addressBytes)
+	// Closing the endpoint should remove it from the endpoints map.
+	if _, ok := ns.endpoints.Load(eps.endpoint.key); !ok {
+		t.Fatalf("got endpoints.Load(%d) = (_, false)", eps.endpoint.key)
+	}
+	eps.close()
+	if _, ok := ns.endpoints.Load(eps.endpoint.key); ok {
+		t.Fatalf("got endpoints.Load(%d) = (_, true)", eps.endpoint.key)
 	}
+}
 
-	serverAddress := nextAddress()
+func TestTCPEndpointMapConnect(t *testing.T) {
+	ns, clock := newNetstack(t, netstackTestOptions{})
+
+	var linkEP tcpipstack.LinkEndpoint = &noopEndpoint{
+		capabilities: tcpipstack.CapabilityResolutionRequired,
+	}
+	if testing.Verbose() {
+		linkEP = sniffer.New(linkEP)
+	}
+	ifs, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() },
+		linkEP,
+		&noopController{},
+		nil,
+		0, /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.stack.EnableNIC(ifs.nicid); err != nil {
+		t.Fatal(err)
+	}
+
+	address := tcpip.Address([]byte{1, 2, 3, 4})
+	destination := tcpip.FullAddress{
+		Addr: address,
+		Port: 1,
+	}
+	source := tcpip.Address([]byte{5, 6, 7, 8})
+	protocolAddress := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: source.WithPrefix(),
+	}
+	if err := ns.stack.AddProtocolAddress(ifs.nicid, protocolAddress, tcpipstack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %#v, {}) = %s", ifs.nicid, protocolAddress, err)
+	}
+
+	ns.stack.SetRouteTable([]tcpip.Route{
+		{
+			Destination: address.WithPrefix().Subnet(),
+			NIC:         ifs.nicid,
+		},
+	})
+
+	var wq waiter.Queue
+	eps := createEP(t, ns, &wq)
+
+	events := make(chan waiter.EventMask)
+	waitEntry := waiter.NewFunctionEntry(math.MaxUint64, func(m waiter.EventMask) {
+		events <- m
+	})
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	switch err := eps.ep.Connect(destination); err.(type) {
+	case *tcpip.ErrConnectStarted:
+	default:
+		t.Fatalf("got Connect(%#v) = %v, want %s", destination, err, &tcpip.ErrConnectStarted{})
+	}
+
+	{
+		nudConfig, err := ns.stack.NUDConfigurations(ifs.nicid, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatalf("stack.NUDConfigurations(): %s", err)
+		}
+		clock.Advance(time.Duration(nudConfig.MaxMulticastProbes) * nudConfig.RetransmitTimer)
+	}
+
+	if got, want := <-events, waiter.ReadableEvents|waiter.WritableEvents|waiter.EventErr|waiter.EventHUp; got != want {
+		t.Fatalf("got event = %b, want %b", got, want)
+	}
+
+	// The callback on HUp should have removed the endpoint from the map.
+	if _, ok := ns.endpoints.Load(eps.endpoint.key); ok {
+		t.Fatalf("got endpoints.Load(%d) = (_, true)", eps.endpoint.key)
+	}
+}
+
+// TestTCPEndpointMapClosing validates the endpoint in a closing state like
+// FIN_WAIT2 to be present in the endpoints map and is deleted when the
+// endpoint transitions to CLOSED state.
+func TestTCPEndpointMapClosing(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+	listener := createEP(t, ns, new(waiter.Queue))
+
+	if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("ep.Bind({}) = %s", err)
+	}
+	if err := listener.ep.Listen(1); err != nil {
+		t.Fatalf("ep.Listen(1) = %s", err)
+	}
+	connectAddr, err := listener.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("ep.GetLocalAddress() = %s", err)
+	}
+	client := createEP(t, ns, new(waiter.Queue))
+
+	waitEntry, inCh := waiter.NewChannelEntry(waiter.EventIn)
+	listener.wq.EventRegister(&waitEntry)
+	defer listener.wq.EventUnregister(&waitEntry)
+
+	switch err := client.ep.Connect(connectAddr); err.(type) {
+	case *tcpip.ErrConnectStarted:
+	default:
+		t.Fatalf("ep.Connect(%#v) = %s", connectAddr, err)
+	}
+	// Wait for the newly established connection to show up as acceptable by
+	// the peer.
+	<-inCh
+
+	server, _, err := listener.ep.Accept(nil)
+	if err != nil {
+		t.Fatalf("ep.Accept(nil) = %s", err)
+	}
+
+	// Ensure that the client endpoint is present in our internal map.
+	if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
+		t.Fatalf("got endpoints.Load(%d) = (_,false)", client.endpoint.key)
+	}
+
+	// Trigger an active close from the client.
+	client.close()
+
+	// The client endpoint should not be removed from endpoints map even after
+	// an endpoint close.
+	if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
+		t.Fatalf("got endpoints.Load(%d) = (_,false)", client.endpoint.key)
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	// Wait and check for the client active close to reach FIN_WAIT2 state.
+	for {
+		if tcp.EndpointState(client.ep.State()) == tcp.StateFinWait2 {
+			break
+		}
+		<-ticker.C
+	}
+
+	// Lookup for the client once more in the endpoints map, it should still not
+	// be removed.
+	if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
+		t.Fatalf("got endpoints.Load(%d) = (_,false)", client.endpoint.key)
+	}
+
+	timeWaitOpt := tcpip.TCPTimeWaitTimeoutOption(time.Duration(0))
+	if err := ns.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &timeWaitOpt); err != nil {
+		t.Fatalf("SetTransportProtocolOption(%d, &%T(%d)) = %s", tcp.ProtocolNumber, timeWaitOpt, timeWaitOpt, err)
+	}
+
+	// Trigger server close, so that client enters TIME_WAIT.
+	server.Close()
+
+	// gVisor stack notifies EventHUp on entering TIME_WAIT. Wait for some time
+	// for the EventHUp to be processed by netstack.
+	for {
+		// The client endpoint would be removed from the endpoints map as a result
+		// of processing EventHUp.
+		if _, ok := ns.endpoints.Load(client.endpoint.key); !ok {
+			break
+		}
+		<-ticker.C
+	}
+}
+
+func TestEndpointsMapKey(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if ns.endpoints.nextKey != 0 {
+		t.Fatalf("got ns.endpoints.nextKey = %d, want 0", ns.endpoints.nextKey)
+	}
+
+	tcpipEP := func() (*waiter.Queue, tcpip.Endpoint) {
+		var wq waiter.Queue
+		ep, err := ns.stack.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, _) = %s", err)
+		}
+		t.Cleanup(ep.Close)
+		return &wq, ep
+	}
+	// Test if we always skip key value 0 while adding to the map.
+	for _, key := range []uint64{0, math.MaxUint64} {
+		wq, ep := tcpipEP()
+
+		// Set a test value to nextKey which is used to compute the endpoint key.
+		ns.endpoints.nextKey = key
+		eps, err := newEndpointWithSocket(ep, wq, tcp.ProtocolNumber, ipv6.ProtocolNumber, ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(eps.close)
+		if ns.endpoints.nextKey != 1 {
+			t.Fatalf("got ns.endpoints.nextKey = %d, want 1", ns.endpoints.nextKey)
+		}
+		if eps.endpoint.key != 1 {
+			t.Fatalf("got eps.endpoint.key = %d, want 1", eps.endpoint.key)
+		}
+		if _, ok := ns.endpoints.Load(eps.endpoint.key); !ok {
+			t.Fatalf("got endpoints.Load(%d) = (_,false)", eps.endpoint.key)
+		}
+		// Closing the endpoint should remove the endpoint with key value 1
+		// from the endpoints map. This lets the subsequent iteration to reuse
+		// key value 1 to add a new endpoint to the map.
+		eps.close()
+	}
+
+	// Key value 0 is not expected to be removed from the map.
+	_, ep := tcpipEP()
+	ns.endpoints.Store(0, ep)
+	if ns.onRemoveEndpoint(0) {
+		t.Errorf("got ns.onRemoveEndpoint(0) = true, want false")
+	}
+	if _, ok := ns.endpoints.Load(0); !ok {
+		t.Fatal("got endpoints.Load(0) = (_,false)")
+	}
+}
+
+func TestNICName(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	if want, got := "unknown(NICID=0)", ns.name(0); got != want {
+		t.Fatalf("got ns.name(0) = %q, want %q", got, want)
+	}
+
+	{
+		ifs := addNoopEndpoint(t, ns, "")
+		t.Cleanup(ifs.RemoveByUser)
+		if got, want := ifs.ns.name(ifs.nicid), t.Name()+"1"; got != want {
+			t.Fatalf("got ifs.mu.name = %q, want = %q", got, want)
+		}
+	}
+
+	{
+		const name = "VerySpecialName"
+		ifs := addNoopEndpoint(t, ns, name)
+		t.Cleanup(ifs.RemoveByUser)
+		if got, want := ifs.ns.name(ifs.nicid), name; got != want {
+			t.Fatalf("got ifs.mu.name = %q, want = %q", got, want)
+		}
+	}
+}
+
+func TestNotStartedByDefault(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	startCalled := false
+	controller := noopController{
+		onUp: func() { startCalled = true },
+	}
+	if _, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() },
+		&noopEndpoint{},
+		&controller,
+		nil, /* observer */
+		0,   /* metric */
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if startCalled {
+		t.Error("unexpected call to Controller.Up")
+	}
+}
+
+type ndpDADEvent struct {
+	nicID  tcpip.NICID
+	addr   tcpip.Address
+	result tcpipstack.DADResult
+}
+
+var _ ipv6.NDPDispatcher = (*testNDPDispatcher)(nil)
+
+// testNDPDispatcher is a tcpip.NDPDispatcher that sends an NDP DAD event on
+// dadC when OnDuplicateAddressDetectionResult gets called.
+type testNDPDispatcher struct {
+	dadC chan ndpDADEvent
+}
+
+// OnDuplicateAddressDetectionResult implements ipv6.NDPDispatcher.
+func (n *testNDPDispatcher) OnDuplicateAddressDetectionResult(nicID tcpip.NICID, addr tcpip.Address, result tcpipstack.DADResult) {
+	if c := n.dadC; c != nil {
+		c <- ndpDADEvent{
+			nicID:  nicID,
+			addr:   addr,
+			result: result,
+		}
+	}
+}
+
+// OnDefaultRouterDiscovered implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnOffLinkRouteUpdated(tcpip.NICID, tcpip.Subnet, tcpip.Address, header.NDPRoutePreference) {
+}
+
+// OnDefaultRouterInvalidated implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnOffLinkRouteInvalidated(tcpip.NICID, tcpip.Subnet, tcpip.Address) {
+}
+
+// OnOnLinkPrefixDiscovered implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnOnLinkPrefixDiscovered(tcpip.NICID, tcpip.Subnet) {
+}
+
+// OnOnLinkPrefixInvalidated implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnOnLinkPrefixInvalidated(tcpip.NICID, tcpip.Subnet) {
+}
+
+// OnAutoGenAddress implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnAutoGenAddress(tcpip.NICID, tcpip.AddressWithPrefix) {
+}
+
+// OnAutoGenAddressDeprecated implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnAutoGenAddressDeprecated(tcpip.NICID, tcpip.AddressWithPrefix) {
+}
+
+// OnAutoGenAddressInvalidated implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnAutoGenAddressInvalidated(tcpip.NICID, tcpip.AddressWithPrefix) {
+}
+
+// OnRecursiveDNSServerOption implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnRecursiveDNSServerOption(tcpip.NICID, []tcpip.Address, time.Duration) {
+}
+
+// OnDNSSearchListOption implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnDNSSearchListOption(tcpip.NICID, []string, time.Duration) {
+}
+
+// OnDHCPv6Configuration implements ipv6.NDPDispatcher.
+func (*testNDPDispatcher) OnDHCPv6Configuration(tcpip.NICID, ipv6.DHCPv6ConfigurationFromNDPRA) {
+}
+
+func TestIpv6LinkLocalOnLinkRoute(t *testing.T) {
+	if got, want := ipv6LinkLocalOnLinkRoute(6), (tcpip.Route{Destination: header.IPv6LinkLocalPrefix.Subnet(), NIC: 6}); got != want {
+		t.Fatalf("got ipv6LinkLocalOnLinkRoute(6) = %s, want = %s", got, want)
+	}
+}
+
+// Test that NICs get an on-link route to the IPv6 link-local subnet when it is
+// brought up.
+func TestIpv6LinkLocalOnLinkRouteOnUp(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	ep := noopEndpoint{
+		linkAddress: tcpip.LinkAddress([]byte{2, 3, 4, 5, 6, 7}),
+	}
+	ifs, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() },
+		&ep,
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linkLocalRoute := ipv6LinkLocalOnLinkRoute(ifs.nicid)
+
+	// Initially should not have the link-local route.
+	rt := ns.stack.GetRouteTable()
+	if containsRoute(rt, linkLocalRoute) {
+		t.Fatalf("got GetRouteTable() = %+v, don't want = %s", rt, linkLocalRoute)
+	}
+
+	// Bringing the ethernet device up should result in the link-local
+	// route being added.
+	if err := ifs.Up(); err != nil {
+		t.Fatalf("eth.Up(): %s", err)
+	}
+	rt = ns.stack.GetRouteTable()
+	if !containsRoute(rt, linkLocalRoute) {
+		t.Fatalf("got GetRouteTable() = %+v, want = %s", rt, linkLocalRoute)
+	}
+
+	// Bringing the ethernet device down should result in the link-local
+	// route being removed.
+	if err := ifs.Down(); err != nil {
+		t.Fatalf("eth.Down(): %s", err)
+	}
+	rt = ns.stack.GetRouteTable()
+	if containsRoute(rt, linkLocalRoute) {
+		t.Fatalf("got GetRouteTable() = %+v, don't want = %s", rt, linkLocalRoute)
+	}
+}
+
+func TestOnLinkV6Route(t *testing.T) {
+	subAddr := util.Parse("abcd:1234::")
+	subMask := tcpip.AddressMask(util.Parse("ffff:ffff::"))
+	subnet, err := tcpip.NewSubnet(subAddr, subMask)
+	if err != nil {
+		t.Fatalf("NewSubnet(%s, %s): %s", subAddr, subMask, err)
+	}
+
+	if got, want := onLinkV6Route(6, subnet), (tcpip.Route{Destination: subnet, NIC: 6}); got != want {
+		t.Fatalf("got onLinkV6Route(6, %s) = %s, want = %s", subnet, got, want)
+	}
+}
+
+func TestMulticastPromiscuousModeEnabledByDefault(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	multicastPromiscuousModeEnabled := false
+	eth, _ := testutil.MakeEthernetDevice(t, fidlethernet.Info{}, 1)
+	eth.ConfigMulticastSetPromiscuousModeImpl = func(enabled bool) (int32, error) {
+		multicastPromiscuousModeEnabled = enabled
+		return int32(zx.ErrOk), nil
+	}
+
+	if _, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: t.Name()}, &eth); err != nil {
+		t.Fatal(err)
+	}
+
+	if !multicastPromiscuousModeEnabled {
+		t.Error("expected a call to ConfigMulticastSetPromiscuousMode(true) by addEth")
+	}
+}
+
+func TestUniqueFallbackNICNames(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	ifs1 := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs1.RemoveByUser)
+	ifs2 := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs2.RemoveByUser)
+
+	nicInfos := ns.stack.NICInfo()
+
+	nicInfo1, ok := nicInfos[ifs1.nicid]
+	if !ok {
+		t.Fatalf("stack.NICInfo()[%d] = (_, false)", ifs1.nicid)
+	}
+	nicInfo2, ok := nicInfos[ifs2.nicid]
+	if !ok {
+		t.Fatalf("stack.NICInfo()[%d]: (_, false)", ifs2.nicid)
+	}
+
+	if nicInfo1.Name == nicInfo2.Name {
+		t.Fatalf("got (%+v).Name == (%+v).Name, want non-equal", nicInfo1, nicInfo2)
+	}
+}
+
+func TestStaticIPConfiguration(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	addr := fidlconv.ToNetIpAddress(testV4Address)
+	ifAddr := fidlnet.Subnet{Addr: addr, PrefixLen: 32}
+	for _, test := range []struct {
+		name     string
+		features fidlethernet.Features
+	}{
+		{name: "default"},
+		{name: "wlan", features: fidlethernet.FeaturesWlan},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d, _ := testutil.MakeEthernetDevice(t, fidlethernet.Info{
+				Features: test.features,
+				Mtu:      1400,
+			}, 1)
+			ifs, err := ns.addEth(testTopoPath, netstack.InterfaceConfig{Name: t.Name()}, &d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ifs.RemoveByUser()
+
+			onlineChanged := make(chan bool, 1)
+			ifs.observer.SetOnLinkOnlineChanged(func(linkOnline bool) {
+				ifs.onLinkOnlineChanged(linkOnline)
+				onlineChanged <- linkOnline
+			})
+
+			name := ifs.ns.name(ifs.nicid)
+			result := ns.addInterfaceAddr(uint64(ifs.nicid), ifAddr)
+			if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
+				t.Fatalf("got ns.addInterfaceAddr(%d, %#v) = %#v, want = Response()", ifs.nicid, ifAddr, result)
+			}
+
+			if mainAddr, err := ns.stack.GetMainNICAddress(ifs.nicid, ipv4.ProtocolNumber); err != nil {
+				t.Errorf("stack.GetMainNICAddress(%d, ipv4.ProtocolNumber): %s", ifs.nicid, err)
+			} else if got := mainAddr.Address; got != testV4Address {
+				t.Errorf("got stack.GetMainNICAddress(%d, ipv4.ProtocolNumber).Addr = %s, want = %s", ifs.nicid, got, testV4Address)
+			}
+
+			ifs.mu.Lock()
+			if ifs.mu.dhcp.enabled {
+				t.Error("expected dhcp state to be disabled initially")
+			}
+			ifs.mu.Unlock()
+
+			if err := ifs.Down(); err != nil {
+				t.Fatal(err)
+			}
+
+			ifs.mu.Lock()
+			if ifs.mu.dhcp.enabled {
+				t.Error("expected dhcp state to remain disabled after bringing interface down")
+			}
+			if ifs.mu.dhcp.running() {
+				t.Error("expected dhcp state to remain stopped after bringing interface down")
+			}
+			ifs.mu.Unlock()
+
+			if err := ifs.Up(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := <-onlineChanged; got != want {
+				t.Errorf("got state = %t, want %t", got, want)
+			}
+
+			ifs.mu.Lock()
+			if ifs.mu.dhcp.enabled {
+				t.Error("expected dhcp state to remain disabled after restarting interface")
+			}
+			ifs.mu.Unlock()
+
+			ifs.setDHCPStatus(name, true)
+
+			ifs.mu.Lock()
+			if !ifs.mu.dhcp.enabled {
+				t.Error("expected dhcp state to become enabled after manually enabling it")
+			}
+			if !ifs.mu.dhcp.running() {
+				t.Error("expected dhcp state running")
+			}
+			ifs.mu.Unlock()
+		})
+	}
+}
+
+var _ NICRemovedHandler = (*noopNicRemovedHandler)(nil)
+
+type noopNicRemovedHandler struct{}
+
+func (*noopNicRemovedHandler) RemovedNIC(tcpip.NICID) {}
+
+type netstackTestOptions struct {
+	nicRemovedHandler NICRemovedHandler
+	ndpDisp           ipv6.NDPDispatcher
+	dadConfigs        tcpipstack.DADConfigurations
+}
+
+func newNetstack(t *testing.T, options netstackTestOptions) (*Netstack, *faketime.ManualClock) {
+	t.Helper()
+
+	clock := faketime.NewManualClock()
+
+	stk := tcpipstack.New(tcpipstack.Options{
+		NetworkProtocols: []tcpipstack.NetworkProtocolFactory{
+			arp.NewProtocol,
+			ipv4.NewProtocol,
+			ipv6.NewProtocolWithOptions(ipv6.Options{
+				NDPDisp:    options.ndpDisp,
+				DADConfigs: options.dadConfigs,
+			}),
+		},
+		TransportProtocols: []tcpipstack.TransportProtocolFactory{
+			tcp.NewProtocol,
+			udp.NewProtocol,
+		},
+		Clock: clock,
+	})
+
+	ns := &Netstack{
+		stack:      stk,
+		dadConfigs: options.dadConfigs,
+		// Required initialization because adding/removing interfaces interacts with
+		// DNS configuration.
+		dnsConfig: dns.MakeServersConfig(stk.Clock()),
+		nicRemovedHandlers: []NICRemovedHandler{func() NICRemovedHandler {
+			if h := options.nicRemovedHandler; h != nil {
+				return h
+			}
+			return &noopNicRemovedHandler{}
+
+		}()},
+	}
+	if ndpDisp, ok := options.ndpDisp.(*ndpDispatcher); ok {
+		ndpDisp.ns = ns
+		ndpDisp.dynamicAddressSourceTracker.init(ns)
+	}
+	ns.interfaceWatchers.mu.watchers = make(map[*interfaceWatcherImpl]struct{})
+	ns.interfaceWatchers.mu.lastObserved = make(map[tcpip.NICID]interfaces.Properties)
+
+	t.Cleanup(func() {
+		for _, nic := range ns.stack.NICInfo() {
+			ifs := nic.Context.(*ifState)
+			ifs.RemoveByUser()
+			ifs.endpoint.Wait()
+		}
+	})
+	return ns, clock
+}
+
+func getInterfaceAddresses(t *testing.T, ni *stackImpl, nicid tcpip.NICID) []tcpip.AddressWithPrefix {
+	t.Helper()
+	nicInfos := ni.ns.stack.NICInfo()
+	nicInfo, ok := nicInfos[nicid]
+	if !ok {
+		t.Fatalf("couldn't find NICID=%d in %#v", nicid, nicInfos)
+	}
+	addrs := make([]tcpip.AddressWithPrefix, len(nicInfo.ProtocolAddresses))
+	for i := range nicInfo.ProtocolAddresses {
+		addrs[i] = nicInfo.ProtocolAddresses[i].AddressWithPrefix
+	}
+	return addrs
+}
+
+func compareInterfaceAddresses(t *testing.T, got, want []tcpip.AddressWithPrefix) {
+	t.Helper()
+	sort.Slice(got, func(i, j int) bool { return got[i].Address < got[j].Address })
+	sort.Slice(want, func(i, j int) bool { return want[i].Address < want[j].Address })
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Interface addresses mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// Test adding a list of both IPV4 and IPV6 addresses and then removing them
+// again one-by-one.
+func TestListInterfaceAddresses(t *testing.T) {
+	ndpDisp := testNDPDispatcher{
+		dadC: make(chan ndpDADEvent, 1),
+	}
+	ns, clock := newNetstack(t, netstackTestOptions{ndpDisp: &ndpDisp})
+	ni := &stackImpl{ns: ns}
+
+	ep := noopEndpoint{
+		linkAddress: tcpip.LinkAddress([]byte{2, 3, 4, 5, 6, 7}),
+	}
+	ifState, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() },
+		&ep,
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ifState.Up(); err != nil {
+		t.Fatal("ifState.Up(): ", err)
+	}
+
+	// Wait for and account for any addresses added automatically.
+	clock.Advance(dadResolutionTimeout)
+	for {
+		select {
+		case d := <-ndpDisp.dadC:
+			t.Logf("startup DAD event: %#v", d)
+			continue
+		default:
+		}
+		break
+	}
+
+	wantAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+
+	testAddresses := []tcpip.AddressWithPrefix{
+		{"\x01\x01\x01\x01", 32},
+		{"\x02\x02\x02\x02", 24},
+		{"\x03\x03\x03\x03", 16},
+		{"\x04\x04\x04\x04", 8},
+		{"\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01\x01", 128},
+		{"\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02\x02", 64},
+		{"\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03\x03", 32},
+		{"\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04\x04", 8},
+	}
+
+	t.Run("Add", func(t *testing.T) {
+		for _, addr := range testAddresses {
+			t.Run(addr.String(), func(t *testing.T) {
+				ifAddr := fidlnet.Subnet{
+					Addr:      fidlconv.ToNetIpAddress(addr.Address),
+					PrefixLen: uint8(addr.PrefixLen),
+				}
+
+				result, err := ni.AddInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
+				if err != nil {
+					t.Fatalf("ni.AddInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
+				}
+				if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
+					t.Fatalf("got ni.AddInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
+				}
+				expectDad := header.IsV6UnicastAddress(addr.Address)
+				clock.Advance(dadResolutionTimeout)
+				select {
+				case d := <-ndpDisp.dadC:
+					if !expectDad {
+						t.Fatalf("unexpected DAD event: %#v", d)
+					}
+					if diff := cmp.Diff(ndpDADEvent{nicID: ifState.nicid, addr: addr.Address, result: &tcpipstack.DADSucceeded{}}, d, cmp.AllowUnexported(d)); diff != "" {
+						t.Fatalf("ndp DAD event mismatch (-want +got):\n%s", diff)
+					}
+				default:
+					if expectDad {
+						t.Fatal("timed out waiting for DAD event")
+					}
+				}
+				wantAddrs = append(wantAddrs, addr)
+				gotAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+
+				compareInterfaceAddresses(t, gotAddrs, wantAddrs)
+			})
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		for _, addr := range testAddresses {
+			t.Run(addr.String(), func(t *testing.T) {
+				ifAddr := fidlnet.Subnet{
+					Addr:      fidlconv.ToNetIpAddress(addr.Address),
+					PrefixLen: uint8(addr.PrefixLen),
+				}
+
+				result, err := ni.DelInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
+				if err != nil {
+					t.Fatalf("ni.DelInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
+				}
+				if result != stack.StackDelInterfaceAddressDeprecatedResultWithResponse(stack.StackDelInterfaceAddressDeprecatedResponse{}) {
+					t.Fatalf("got ni.DelInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
+				}
+
+				// Remove address from list.
+				for i, a := range wantAddrs {
+					if a == addr {
+						wantAddrs = append(wantAddrs[:i], wantAddrs[i+1:]...)
+						break
+					}
+				}
+				gotAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+				compareInterfaceAddresses(t, gotAddrs, wantAddrs)
+			})
+		}
+	})
+}
+
+// Test that adding an address with one prefix and then adding the same address
+// but with a different prefix will simply replace the first address.
+func TestAddAddressesThenChangePrefix(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ni := &stackImpl{ns: ns}
+	ifState := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifState.RemoveByUser)
+
+	// The call to ns.addEndpoint() added addresses to the stack. Make sure we include
+	// those in our want list.
+	initialAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+
+	// Add address.
+	addr := tcpip.AddressWithPrefix{Address: "\x01\x01\x01\x01", PrefixLen: 8}
+	ifAddr := fidlnet.Subnet{
+		Addr:      fidlconv.ToNetIpAddress(addr.Address),
+		PrefixLen: uint8(addr.PrefixLen),
+	}
+
+	result, err := ni.AddInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
+	if err != nil {
+		t.Fatalf("ni.AddInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
+	}
+	if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
+		t.Fatalf("got ni.AddInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
+	}
+
+	wantAddrs := append(initialAddrs, addr)
+	gotAddrs := getInterfaceAddresses(t, ni, ifState.nicid)
+	compareInterfaceAddresses(t, gotAddrs, wantAddrs)
+
+	// Add the same address with a different prefix.
+	addr.PrefixLen *= 2
+	ifAddr.PrefixLen *= 2
+
+	result, err = ni.AddInterfaceAddressDeprecated(context.Background(), uint64(ifState.nicid), ifAddr)
+	if err != nil {
+		t.Fatalf("ni.AddInterfaceAddressDeprecated(%d, %#v): %s", ifState.nicid, ifAddr, err)
+	}
+	if result != stack.StackAddInterfaceAddressDeprecatedResultWithResponse(stack.StackAddInterfaceAddressDeprecatedResponse{}) {
+		t.Fatalf("got ni.AddInterfaceAddressDeprecated(%d, %#v) = %#v, want = Response()", ifState.nicid, ifAddr, result)
+	}
+
+	wantAddrs = append(initialAddrs, addr)
+	gotAddrs = getInterfaceAddresses(t, ni, ifState.nicid)
+
+	compareInterfaceAddresses(t, gotAddrs, wantAddrs)
+}
+
+func TestAddRouteParameterValidation(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	addr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address("\xf0\xf0\xf0\xf0"),
+			PrefixLen: 24,
+		},
+	}
+	subnetLocalAddress := tcpip.Address("\xf0\xf0\xf0\xf1")
+	ifState := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifState.RemoveByUser)
+
+	if status := ns.addInterfaceAddress(ifState.nicid, addr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+		t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", ifState.nicid, addr.AddressWithPrefix, status)
+	}
+
+	tests := []struct {
+		name    string
+		route   tcpip.Route
+		metric  routes.Metric
+		dynamic bool
+		err     error
+	}{
+		{
+			name: "IPv4 destination no NIC invalid gateway",
+			route: tcpip.Route{
+				Destination: util.PointSubnet(testV4Address),
+				Gateway:     testV4Address,
+				NIC:         0,
+			},
+			metric: routes.Metric(0),
+			err:    routes.ErrNoSuchNIC,
+		},
+		{
+			name: "IPv6 destination no NIC invalid gateway",
+			route: tcpip.Route{
+				Destination: util.PointSubnet(testV6Address),
+				Gateway:     testV6Address,
+				NIC:         0,
+			},
+			metric: routes.Metric(0),
+			err:    routes.ErrNoSuchNIC,
+		},
+		{
+			name: "IPv4 destination no NIC valid gateway",
+			route: tcpip.Route{
+				Destination: util.PointSubnet(testV4Address),
+				Gateway:     subnetLocalAddress,
+				NIC:         0,
+			},
+		},
+		{
+			name: "zero length gateway",
+			route: tcpip.Route{
+				Destination: util.PointSubnet(testV4Address),
+				NIC:         ifState.nicid,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ns.AddRoute(test.route, test.metric, test.dynamic); !errors.Is(err, test.err) {
+				t.Errorf("got ns.AddRoute(...) = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDHCPAcquired(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifState := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifState.RemoveByUser)
+
+	addressBytes := []byte(testV4Address)
+	nextAddress := func() tcpip.Address {
+		addressBytes[len(addressBytes)-1]++
+		return tcpip.Address(addressBytes)
+	}
+
+	serverAddress := nextAddress()
 	router1Address := nextAddress()
 	router2Address := nextAddress()
 	multicastAddress := net.IPv4(0xe8, 0x2b, 0xd3, 0xea)
@@ -1390,170 +2553,1214 @@ func TestDHCPAcquired(t *testing.T) {
 		t.Fatalf("%s is not a multicast address", multicastAddress)
 	}
 
-	defaultMask := net.IP(testV4Address).DefaultMask()
-	prefixLen, _ := defaultMask.Size()
+	defaultMask := net.IP(testV4Address).DefaultMask()
+	prefixLen, _ := defaultMask.Size()
+
+	destination1, err := tcpip.NewSubnet(util.Parse("192.168.42.0"), tcpip.AddressMask(util.Parse("255.255.255.0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination2, err := tcpip.NewSubnet(util.Parse("0.0.0.0"), tcpip.AddressMask(util.Parse("0.0.0.0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		oldAddr, newAddr   tcpip.AddressWithPrefix
+		config             dhcp.Config
+		expectedRouteTable []routes.ExtendedRoute
+	}{
+		{
+			name:    "subnet mask provided",
+			oldAddr: tcpip.AddressWithPrefix{},
+			newAddr: tcpip.AddressWithPrefix{
+				Address:   testV4Address,
+				PrefixLen: prefixLen,
+			},
+			config: dhcp.Config{
+				ServerAddress: serverAddress,
+				Router: []tcpip.Address{
+					router1Address,
+					router2Address,
+					header.IPv4Any,
+					header.IPv4Broadcast,
+					tcpip.Address(multicastAddress),
+				},
+				SubnetMask: tcpip.AddressMask(defaultMask),
+				DNS: []tcpip.Address{
+					router1Address,
+					router2Address,
+				},
+				LeaseLength: dhcp.Seconds(60),
+			},
+			expectedRouteTable: []routes.ExtendedRoute{
+				{
+					Route: tcpip.Route{
+						Destination: destination1,
+						NIC:         1,
+					},
+					Prf:                   routes.MediumPreference,
+					Metric:                0,
+					MetricTracksInterface: true,
+					Dynamic:               true,
+					Enabled:               false,
+				},
+				{
+					Route: tcpip.Route{
+						Destination: destination2,
+						Gateway:     util.Parse("192.168.42.18"),
+						NIC:         1,
+					},
+					Prf:                   routes.MediumPreference,
+					Metric:                0,
+					MetricTracksInterface: true,
+					Dynamic:               true,
+					Enabled:               false,
+				},
+				{
+					Route: tcpip.Route{
+						Destination: destination2,
+						Gateway:     util.Parse("192.168.42.19"),
+						NIC:         1,
+					},
+					Prf:                   routes.MediumPreference,
+					Metric:                0,
+					MetricTracksInterface: true,
+					Dynamic:               true,
+					Enabled:               false,
+				},
+			},
+		},
+		{
+			name:    "no routers",
+			oldAddr: tcpip.AddressWithPrefix{},
+			newAddr: tcpip.AddressWithPrefix{
+				Address:   testV4Address,
+				PrefixLen: prefixLen,
+			},
+			config: dhcp.Config{},
+			expectedRouteTable: []routes.ExtendedRoute{
+				{
+					Route: tcpip.Route{
+						Destination: destination1,
+						NIC:         1,
+					},
+					Prf:                   routes.MediumPreference,
+					Metric:                0,
+					MetricTracksInterface: true,
+					Dynamic:               true,
+					Enabled:               false,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// save current route table for later
+			originalRouteTable := ifState.ns.GetExtendedRouteTable()
+
+			// Update the DHCP address to the given test values and verify it took
+			// effect.
+			ifState.dhcpAcquired(test.oldAddr, test.newAddr, test.config)
+
+			if diff := cmp.Diff(ifState.dns.mu.servers, test.config.DNS); diff != "" {
+				t.Errorf("ifState.mu.dnsServers mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(ifState.ns.GetExtendedRouteTable(), test.expectedRouteTable, cmp.AllowUnexported(tcpip.Subnet{})); diff != "" {
+				t.Errorf("GetExtendedRouteTable() mismatch (-want +got):\n%s", diff)
+			}
+
+			infoMap := ns.stack.NICInfo()
+			if info, ok := infoMap[ifState.nicid]; ok {
+				found := false
+				for _, address := range info.ProtocolAddresses {
+					if address.Protocol == ipv4.ProtocolNumber {
+						switch address.AddressWithPrefix {
+						case test.oldAddr:
+							t.Errorf("expired address %s was not removed from NIC addresses %v", test.oldAddr, info.ProtocolAddresses)
+						case test.newAddr:
+							found = true
+						}
+					}
+				}
+
+				if !found {
+					t.Errorf("new address %s was not added to NIC addresses %v", test.newAddr, info.ProtocolAddresses)
+				}
+			} else {
+				t.Errorf("NIC %d not found in %v", ifState.nicid, infoMap)
+			}
+
+			// Remove the address and verify everything is cleaned up correctly.
+			remAddr := test.newAddr
+			ifState.dhcpAcquired(remAddr, tcpip.AddressWithPrefix{}, dhcp.Config{})
+
+			if diff := cmp.Diff(ifState.dns.mu.servers, ifState.dns.mu.servers[:0]); diff != "" {
+				t.Errorf("ifState.mu.dnsServers mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(ifState.ns.GetExtendedRouteTable(), originalRouteTable); diff != "" {
+				t.Errorf("GetExtendedRouteTable() mismatch (-want +got):\n%s", diff)
+			}
+
+			infoMap = ns.stack.NICInfo()
+			if info, ok := infoMap[ifState.nicid]; ok {
+				for _, address := range info.ProtocolAddresses {
+					if address.Protocol == ipv4.ProtocolNumber {
+						if address.AddressWithPrefix == remAddr {
+							t.Errorf("address %s/%d was not removed from NIC addresses %v", remAddr.Address, remAddr.PrefixLen, info.ProtocolAddresses)
+						}
+					}
+				}
+			} else {
+				t.Errorf("NIC %d not found in %v", ifState.nicid, infoMap)
+			}
+		})
+	}
+}
+
+func TestDHCPAcquiredSearchDomains(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifState := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifState.RemoveByUser)
+
+	if err := ns.dnsConfig.SetDefaultSearchDomains([]string{"static.example"}); err != nil {
+		t.Fatalf("SetDefaultSearchDomains(...) = %s", err)
+	}
+
+	defaultMask := net.IP(testV4Address).DefaultMask()
+	prefixLen, _ := defaultMask.Size()
+	addr := tcpip.AddressWithPrefix{
+		Address:   testV4Address,
+		PrefixLen: prefixLen,
+	}
+	config := dhcp.Config{
+		SubnetMask:   tcpip.AddressMask(defaultMask),
+		DomainSearch: []string{"eng.example", "static.example"},
+		LeaseLength:  dhcp.Seconds(60),
+	}
+
+	checkSearchDomains := func(want []string) {
+		t.Helper()
+		if diff := cmp.Diff(want, ns.dnsConfig.GetSearchDomains()); diff != "" {
+			t.Errorf("GetSearchDomains() mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	ifState.dhcpAcquired(tcpip.AddressWithPrefix{}, addr, config)
+	checkSearchDomains([]string{"eng.example", "static.example"})
+
+	// Renewing the lease keeps the search domains.
+	ifState.dhcpAcquired(addr, addr, config)
+	checkSearchDomains([]string{"eng.example", "static.example"})
+
+	// Losing the lease removes them.
+	ifState.dhcpAcquired(addr, tcpip.AddressWithPrefix{}, dhcp.Config{})
+	checkSearchDomains([]string{"static.example"})
+}
+
+func TestSetMinRTO(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+
+	// Larger than the initial RTO, so that connections only reach it through
+	// the minimum.
+	const want = 3 * time.Second
+	if err := ns.SetMinRTO(want); err != nil {
+		t.Fatalf("SetMinRTO(%s) = %s", want, err)
+	}
+	got, err := ns.GetMinRTO()
+	if err != nil {
+		t.Fatalf("GetMinRTO() = %s", err)
+	}
+	if got != want {
+		t.Errorf("got GetMinRTO() = %s, want = %s", got, want)
+	}
+
+	var maxRTO tcpip.TCPMaxRTOOption
+	if err := ns.stack.TransportProtocolOption(tcp.ProtocolNumber, &maxRTO); err != nil {
+		t.Fatalf("TransportProtocolOption(%d, &%T) = %s", tcp.ProtocolNumber, maxRTO, err)
+	}
+	for _, d := range []time.Duration{
+		0,
+		minTCPMinRTO - 1,
+		time.Duration(maxRTO) + 1,
+	} {
+		err := ns.SetMinRTO(d)
+		if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Errorf("got SetMinRTO(%s) = %v, want = %s", d, err, &tcpip.ErrInvalidOptionValue{})
+		}
+	}
+
+	// Rejected values must not clobber the previously configured value.
+	got, err = ns.GetMinRTO()
+	if err != nil {
+		t.Fatalf("GetMinRTO() = %s", err)
+	}
+	if got != want {
+		t.Errorf("got GetMinRTO() = %s, want = %s", got, want)
+	}
+
+	// The RTO of a new connection is measured on loopback during the
+	// handshake and raised to the minimum.
+	listener := createEP(t, ns, new(waiter.Queue))
+	if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("ep.Bind({}) = %s", err)
+	}
+	if err := listener.ep.Listen(1); err != nil {
+		t.Fatalf("ep.Listen(1) = %s", err)
+	}
+	connectAddr, err := listener.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("ep.GetLocalAddress() = %s", err)
+	}
+	connectAddr.Addr = ipv4Loopback
+
+	waitEntry, inCh := waiter.NewChannelEntry(waiter.EventIn)
+	listener.wq.EventRegister(&waitEntry)
+	defer listener.wq.EventUnregister(&waitEntry)
+
+	client := createEP(t, ns, new(waiter.Queue))
+	switch err := client.ep.Connect(connectAddr); err.(type) {
+	case *tcpip.ErrConnectStarted:
+	default:
+		t.Fatalf("ep.Connect(%#v) = %s", connectAddr, err)
+	}
+	<-inCh
+
+	s := streamSocketImpl{endpointWithSocket: client}
+	result, fidlErr := s.GetTcpInfo(context.Background())
+	if fidlErr != nil {
+		t.Fatalf("GetTcpInfo() = %s", fidlErr)
+	}
+	if result.Which() != socket.StreamSocketGetTcpInfoResultResponse {
+		t.Fatalf("got GetTcpInfo() = %#v, want response", result)
+	}
+	if info := result.Response.Info; !info.HasRtoUsec() || time.Duration(info.GetRtoUsec())*time.Microsecond < want {
+		t.Errorf("got GetTcpInfo().RtoUsec = %d, want >= %d", info.GetRtoUsec(), want.Microseconds())
+	}
+}
+
+func TestGetMulticastMemberships(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+
+	ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, new(waiter.Queue))
+	if err != nil {
+		t.Fatalf("NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", err)
+	}
+	t.Cleanup(ep.Close)
+	s := endpoint{ep: ep, ns: ns, transProto: udp.ProtocolNumber, netProto: ipv4.ProtocolNumber}
+
+	groups := []fidlnet.Ipv4Address{
+		{Addr: [4]uint8{224, 0, 1, 1}},
+		{Addr: [4]uint8{239, 1, 2, 3}},
+	}
+	for _, group := range groups {
+		membership := socket.IpMulticastMembership{
+			Iface:     uint64(ifs.nicid),
+			McastAddr: group,
+		}
+		result, err := s.AddIpMembership(context.Background(), membership)
+		if err != nil {
+			t.Fatalf("AddIpMembership(_, %#v) = %s", membership, err)
+		}
+		if result.Which() != socket.BaseNetworkSocketAddIpMembershipResultResponse {
+			t.Fatalf("got AddIpMembership(_, %#v) = %#v, want response", membership, result)
+		}
+	}
+
+	got, err := ns.GetMulticastMemberships(ifs.nicid)
+	if err != nil {
+		t.Fatalf("GetMulticastMemberships(%d) = %s", ifs.nicid, err)
+	}
+	for _, group := range groups {
+		want := tcpip.Address(group.Addr[:])
+		found := false
+		for _, addr := range got {
+			if addr == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("got GetMulticastMemberships(%d) = %s, want to contain %s", ifs.nicid, got, want)
+		}
+	}
+
+	if _, err := ns.GetMulticastMemberships(ifs.nicid + 1); err == nil {
+		t.Errorf("got GetMulticastMemberships(%d) = nil error, want %s", ifs.nicid+1, &tcpip.ErrUnknownNICID{})
+	}
+}
+
+func TestMulticastGroupRefs(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+
+	newEndpoint := func() *endpoint {
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, new(waiter.Queue))
+		if err != nil {
+			t.Fatalf("NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", err)
+		}
+		t.Cleanup(ep.Close)
+		return &endpoint{ep: ep, ns: ns, transProto: udp.ProtocolNumber, netProto: ipv4.ProtocolNumber}
+	}
+	group := fidlnet.Ipv4Address{Addr: [4]uint8{239, 1, 2, 3}}
+	membership := socket.IpMulticastMembership{
+		Iface:     uint64(ifs.nicid),
+		McastAddr: group,
+	}
+	addr := tcpip.Address(group.Addr[:])
+	checkRefs := func(want int) {
+		t.Helper()
+		ns.multicastGroups.mu.Lock()
+		got, ok := ns.multicastGroups.refs[addr]
+		ns.multicastGroups.mu.Unlock()
+		if want == 0 && ok {
+			t.Errorf("got multicastGroups.refs[%s] = %d, want no entry", addr, got)
+		} else if got != want {
+			t.Errorf("got multicastGroups.refs[%s] = %d, want = %d", addr, got, want)
+		}
+	}
+
+	first, second := newEndpoint(), newEndpoint()
+	for _, s := range []*endpoint{first, second} {
+		result, err := s.AddIpMembership(context.Background(), membership)
+		if err != nil {
+			t.Fatalf("AddIpMembership(_, %#v) = %s", membership, err)
+		}
+		if result.Which() != socket.BaseNetworkSocketAddIpMembershipResultResponse {
+			t.Fatalf("got AddIpMembership(_, %#v) = %#v, want response", membership, result)
+		}
+	}
+	checkRefs(2)
+
+	for i := 0; i < 2; i++ {
+		// Only the first drop succeeds, as the socket is no longer a member
+		// afterwards.
+		if _, err := first.DropIpMembership(context.Background(), membership); err != nil {
+			t.Fatalf("DropIpMembership(_, %#v) #%d = %s", membership, i, err)
+		}
+		checkRefs(1)
+	}
+
+	// Closed sockets leave their groups.
+	ns.leaveMulticastGroups(second)
+	checkRefs(0)
+}
+
+func TestTCPKeepaliveDefaults(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	const (
+		idle     = 30 * time.Second
+		interval = 5 * time.Second
+		count    = 3
+	)
+	if err := ns.SetTCPKeepaliveDefaults(idle, interval, count); err != nil {
+		t.Fatalf("SetTCPKeepaliveDefaults(%s, %s, %d) = %s", idle, interval, count, err)
+	}
+	for _, test := range []struct {
+		idle, interval time.Duration
+		count          int
+	}{
+		{idle: 0, interval: interval, count: count},
+		{idle: (maxTCPKeepIdle + 1) * time.Second, interval: interval, count: count},
+		{idle: idle, interval: 0, count: count},
+		{idle: idle, interval: (maxTCPKeepIntvl + 1) * time.Second, count: count},
+		{idle: idle, interval: interval, count: 0},
+		{idle: idle, interval: interval, count: maxTCPKeepCnt + 1},
+	} {
+		err := ns.SetTCPKeepaliveDefaults(test.idle, test.interval, test.count)
+		if _, ok := err.(*tcpip.ErrInvalidOptionValue); !ok {
+			t.Errorf("got SetTCPKeepaliveDefaults(%s, %s, %d) = %v, want = %s", test.idle, test.interval, test.count, err, &tcpip.ErrInvalidOptionValue{})
+		}
+	}
+	// Rejected values must not clobber the previously configured defaults.
+	if gotIdle, gotInterval, gotCount := ns.GetTCPKeepaliveDefaults(); gotIdle != idle || gotInterval != interval || gotCount != count {
+		t.Errorf("got GetTCPKeepaliveDefaults() = (%s, %s, %d), want = (%s, %s, %d)", gotIdle, gotInterval, gotCount, idle, interval, count)
+	}
+
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+	accept := func(listener *endpointWithSocket) *endpointWithSocket {
+		t.Helper()
+
+		if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
+			t.Fatalf("ep.Bind({}) = %s", err)
+		}
+		if err := listener.ep.Listen(1); err != nil {
+			t.Fatalf("ep.Listen(1) = %s", err)
+		}
+		connectAddr, err := listener.ep.GetLocalAddress()
+		if err != nil {
+			t.Fatalf("ep.GetLocalAddress() = %s", err)
+		}
+		connectAddr.Addr = ipv4Loopback
+
+		waitEntry, inCh := waiter.NewChannelEntry(waiter.EventIn)
+		listener.wq.EventRegister(&waitEntry)
+		defer listener.wq.EventUnregister(&waitEntry)
+
+		client := createEP(t, ns, new(waiter.Queue))
+		switch err := client.ep.Connect(connectAddr); err.(type) {
+		case *tcpip.ErrConnectStarted:
+		default:
+			t.Fatalf("ep.Connect(%#v) = %s", connectAddr, err)
+		}
+		<-inCh
+
+		code, _, accepted, fidlErr := listener.Accept(false)
+		if fidlErr != nil {
+			t.Fatalf("Accept(false) = %s", fidlErr)
+		}
+		if code != 0 {
+			t.Fatalf("Accept(false) = %s", code)
+		}
+		t.Cleanup(accepted.close)
+		return accepted
+	}
+	keepalive := func(ep tcpip.Endpoint) (time.Duration, time.Duration, int) {
+		t.Helper()
+
+		var idle tcpip.KeepaliveIdleOption
+		if err := ep.GetSockOpt(&idle); err != nil {
+			t.Fatalf("GetSockOpt(&%T) = %s", idle, err)
+		}
+		var interval tcpip.KeepaliveIntervalOption
+		if err := ep.GetSockOpt(&interval); err != nil {
+			t.Fatalf("GetSockOpt(&%T) = %s", interval, err)
+		}
+		count, err := ep.GetSockOptInt(tcpip.KeepaliveCountOption)
+		if err != nil {
+			t.Fatalf("GetSockOptInt(KeepaliveCountOption) = %s", err)
+		}
+		return time.Duration(idle), time.Duration(interval), count
+	}
+
+	// The listener predates the defaults, as it is not created by the
+	// provider; connections it accepts still get them.
+	ep := accept(createEP(t, ns, new(waiter.Queue))).ep
+	if gotIdle, gotInterval, gotCount := keepalive(ep); gotIdle != idle || gotInterval != interval || gotCount != count {
+		t.Errorf("got accepted keepalive = (%s, %s, %d), want = (%s, %s, %d)", gotIdle, gotInterval, gotCount, idle, interval, count)
+	}
+
+	// Options set on the listener are inherited by the connections it
+	// accepts, rather than replaced by the defaults.
+	const listenerIdleSecs = 120
+	listener := createEP(t, ns, new(waiter.Queue))
+	s := streamSocketImpl{endpointWithSocket: listener}
+	result, fidlErr := s.SetTcpKeepAliveIdle(context.Background(), listenerIdleSecs)
+	if fidlErr != nil {
+		t.Fatalf("SetTcpKeepAliveIdle(%d) = %s", listenerIdleSecs, fidlErr)
+	}
+	if result.Which() != socket.StreamSocketSetTcpKeepAliveIdleResultResponse {
+		t.Fatalf("got SetTcpKeepAliveIdle(%d) = %#v, want response", listenerIdleSecs, result)
+	}
+	if gotIdle, gotInterval, gotCount := keepalive(accept(listener).ep); gotIdle != listenerIdleSecs*time.Second || gotInterval != interval || gotCount != count {
+		t.Errorf("got accepted keepalive = (%s, %s, %d), want = (%s, %s, %d)", gotIdle, gotInterval, gotCount, listenerIdleSecs*time.Second, interval, count)
+	}
+
+	// Per-socket options override the defaults.
+	override := tcpip.KeepaliveIdleOption(time.Minute)
+	if err := ep.SetSockOpt(&override); err != nil {
+		t.Fatalf("SetSockOpt(&%T(%s)) = %s", override, time.Duration(override), err)
+	}
+	var gotIdle tcpip.KeepaliveIdleOption
+	if err := ep.GetSockOpt(&gotIdle); err != nil {
+		t.Fatalf("GetSockOpt(&%T) = %s", gotIdle, err)
+	}
+	if gotIdle != override {
+		t.Errorf("got KeepaliveIdleOption = %s, want = %s", time.Duration(gotIdle), time.Duration(override))
+	}
+}
+
+func TestEndpointLatchAndClearLastError(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	eps := createEP(t, ns, new(waiter.Queue))
+
+	if err := eps.LatchLastError(); err != nil {
+		t.Fatalf("got LatchLastError() = %s, want = nil", err)
+	}
+
+	// A non-terminal error is replaced by the next one, whether or not it was
+	// latched.
+	eps.ep.SocketOptions().SetLastError(&tcpip.ErrHostUnreachable{})
+	switch err := eps.LatchLastError(); err.(type) {
+	case *tcpip.ErrHostUnreachable:
+	default:
+		t.Fatalf("got LatchLastError() = %v, want = %s", err, &tcpip.ErrHostUnreachable{})
+	}
+	// The error moved from the endpoint to the socket.
+	if err := eps.ep.LastError(); err != nil {
+		t.Fatalf("got eps.ep.LastError() = %s after LatchLastError(), want = nil", err)
+	}
+	eps.ep.SocketOptions().SetLastError(&tcpip.ErrMessageTooLong{})
+	switch err := eps.LatchLastError(); err.(type) {
+	case *tcpip.ErrMessageTooLong:
+	default:
+		t.Fatalf("got LatchLastError() = %v, want = %s", err, &tcpip.ErrMessageTooLong{})
+	}
+	eps.ep.SocketOptions().SetLastError(&tcpip.ErrHostUnreachable{})
+	switch err := eps.ClearLastError(); err.(type) {
+	case *tcpip.ErrHostUnreachable:
+	default:
+		t.Fatalf("got ClearLastError() = %v, want = %s", err, &tcpip.ErrHostUnreachable{})
+	}
+	// Consuming the error also consumes the one latched before it.
+	if err := eps.LatchLastError(); err != nil {
+		t.Fatalf("got LatchLastError() = %s after ClearLastError(), want = nil", err)
+	}
+	if err := eps.ClearLastError(); err != nil {
+		t.Fatalf("got ClearLastError() = %s after ClearLastError(), want = nil", err)
+	}
+
+	eps.terminal.mu.Lock()
+	eps.terminal.setLocked(&tcpip.ErrConnectionReset{})
+	eps.terminal.mu.Unlock()
+
+	// Latching must not consume the error.
+	for i := 0; i < 2; i++ {
+		switch err := eps.LatchLastError(); err.(type) {
+		case *tcpip.ErrConnectionReset:
+		default:
+			t.Fatalf("got LatchLastError() = %v, want = %s", err, &tcpip.ErrConnectionReset{})
+		}
+	}
+
+	switch err := eps.ClearLastError(); err.(type) {
+	case *tcpip.ErrConnectionReset:
+	default:
+		t.Fatalf("got ClearLastError() = %v, want = %s", err, &tcpip.ErrConnectionReset{})
+	}
+	if err := eps.LatchLastError(); err != nil {
+		t.Errorf("got LatchLastError() = %s, want = nil", err)
+	}
+	if err := eps.ClearLastError(); err != nil {
+		t.Errorf("got ClearLastError() = %s, want = nil", err)
+	}
+}
+
+func TestEndpointBindWithDevice(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	ifs := addNoopEndpoint(t, ns, "")
+	if err := ns.stack.EnableNIC(ifs.nicid); err != nil {
+		t.Fatalf("EnableNIC(%d) = %s", ifs.nicid, err)
+	}
+	protocolAddress := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: testV4Address.WithPrefix(),
+	}
+	if err := ns.stack.AddProtocolAddress(ifs.nicid, protocolAddress, tcpipstack.AddressProperties{}); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %#v, {}) = %s", ifs.nicid, protocolAddress, err)
+	}
+
+	eps := createEP(t, ns, new(waiter.Queue))
+	want := tcpip.FullAddress{Addr: testV4Address, Port: 8080}
+	sockaddr := toNetSocketAddress(ipv4.ProtocolNumber, want)
+
+	if errno := eps.BindWithDevice(sockaddr, "unknown-device"); errno != posix.ErrnoEnodev {
+		t.Fatalf("got BindWithDevice(%#v, %q) = %s, want = %s", sockaddr, "unknown-device", errno, posix.ErrnoEnodev)
+	}
+	if got := eps.ep.SocketOptions().GetBindToDevice(); got != 0 {
+		t.Errorf("got GetBindToDevice() = %d, want = 0", got)
+	}
+
+	name := ns.name(ifs.nicid)
+	if errno := eps.BindWithDevice(sockaddr, name); errno != 0 {
+		t.Fatalf("BindWithDevice(%#v, %q) = %s", sockaddr, name, errno)
+	}
+	if got := eps.ep.SocketOptions().GetBindToDevice(); got != int32(ifs.nicid) {
+		t.Errorf("got GetBindToDevice() = %d, want = %d", got, ifs.nicid)
+	}
+	got, err := eps.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress() = %s", err)
+	}
+	if got.Addr != want.Addr || got.Port != want.Port {
+		t.Errorf("got GetLocalAddress() = %#v, want = %#v", got, want)
+	}
+}
+
+func TestGetInterfacesByHardwareType(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+	eth, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return "eth" },
+		ethernet.New(&noopEndpoint{}),
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networkOnly := addNoopEndpoint(t, ns, "")
+
+	var loopbackID tcpip.NICID
+	for id, info := range ns.stack.NICInfo() {
+		if info.Flags.Loopback {
+			loopbackID = id
+		}
+	}
+
+	sp := &packetProviderImpl{ns: ns}
+	for _, test := range []struct {
+		hwType packetsocket.HardwareType
+		want   []interfaceIdentity
+	}{
+		{
+			hwType: packetsocket.HardwareTypeLoopback,
+			want:   []interfaceIdentity{{id: loopbackID, name: ns.name(loopbackID)}},
+		},
+		{
+			hwType: packetsocket.HardwareTypeEthernet,
+			want:   []interfaceIdentity{{id: eth.nicid, name: "eth"}},
+		},
+		{
+			hwType: packetsocket.HardwareTypeNetworkOnly,
+			want:   []interfaceIdentity{{id: networkOnly.nicid, name: ns.name(networkOnly.nicid)}},
+		},
+	} {
+		got := sp.GetInterfacesByHardwareType(test.hwType)
+		if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(interfaceIdentity{})); diff != "" {
+			t.Errorf("GetInterfacesByHardwareType(%s) mismatch (-want +got):\n%s", test.hwType, diff)
+		}
+	}
+}
+
+func TestIPForwarding(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs1 := addNoopEndpoint(t, ns, "1")
+	ifs2 := addNoopEndpoint(t, ns, "2")
+
+	checkNICForwarding := func(ifs *ifState, protocol tcpip.NetworkProtocolNumber, want bool) {
+		t.Helper()
+		got, err := ifs.forwarding(protocol)
+		if err != nil {
+			t.Fatalf("forwarding(%d) = %s", protocol, err)
+		}
+		if got != want {
+			t.Errorf("got NIC %d forwarding(%d) = %t, want = %t", ifs.nicid, protocol, got, want)
+		}
+	}
+
+	if err := ns.SetIPForwarding(ipv4.ProtocolNumber, true); err != nil {
+		t.Fatalf("SetIPForwarding(%d, true) = %s", ipv4.ProtocolNumber, err)
+	}
+	if got, err := ns.GetIPForwarding(ipv4.ProtocolNumber); err != nil || !got {
+		t.Errorf("got GetIPForwarding(%d) = (%t, %v), want = (true, nil)", ipv4.ProtocolNumber, got, err)
+	}
+	if got, err := ns.GetIPForwarding(ipv6.ProtocolNumber); err != nil || got {
+		t.Errorf("got GetIPForwarding(%d) = (%t, %v), want = (false, nil)", ipv6.ProtocolNumber, got, err)
+	}
+	checkNICForwarding(ifs1, ipv4.ProtocolNumber, true)
+	checkNICForwarding(ifs2, ipv4.ProtocolNumber, true)
+	checkNICForwarding(ifs1, ipv6.ProtocolNumber, false)
+
+	// Override the stack-wide configuration on a single interface.
+	if err := ifs2.setForwarding(ipv4.ProtocolNumber, false); err != nil {
+		t.Fatalf("setForwarding(%d, false) = %s", ipv4.ProtocolNumber, err)
+	}
+	checkNICForwarding(ifs1, ipv4.ProtocolNumber, true)
+	checkNICForwarding(ifs2, ipv4.ProtocolNumber, false)
+	if got, err := ns.GetIPForwarding(ipv4.ProtocolNumber); err != nil || !got {
+		t.Errorf("got GetIPForwarding(%d) = (%t, %v), want = (true, nil)", ipv4.ProtocolNumber, got, err)
+	}
+
+	// Only IPv4 and IPv6 may be forwarded.
+	switch err := ns.SetIPForwarding(arp.ProtocolNumber, true); err.(type) {
+	case *tcpip.ErrUnknownProtocol:
+	default:
+		t.Errorf("got SetIPForwarding(%d, true) = %v, want = %s", arp.ProtocolNumber, err, &tcpip.ErrUnknownProtocol{})
+	}
+	switch err := ifs1.setForwarding(arp.ProtocolNumber, true); err.(type) {
+	case *tcpip.ErrUnknownProtocol:
+	default:
+		t.Errorf("got setForwarding(%d, true) = %v, want = %s", arp.ProtocolNumber, err, &tcpip.ErrUnknownProtocol{})
+	}
+}
+
+func TestRawSocketGetProtocol(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto rawsocket.ProtocolAssociation
+		want  uint8
+	}{
+		{
+			name:  "unassociated",
+			proto: rawsocket.ProtocolAssociationWithUnassociated(rawsocket.Empty{}),
+			want:  unassociatedRawProtocol,
+		},
+		{
+			name:  "associated",
+			proto: rawsocket.ProtocolAssociationWithAssociated(uint8(header.ICMPv4ProtocolNumber)),
+			want:  uint8(header.ICMPv4ProtocolNumber),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := rawSocketImpl{proto: test.proto}
+			if got := s.GetProtocol(); got != test.want {
+				t.Errorf("got GetProtocol() = %d, want = %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBindReusePortGroupFull(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	const maxSize = 4
+	if err := ns.SetMaxReusePortGroupSize(maxSize); err != nil {
+		t.Fatalf("ns.SetMaxReusePortGroupSize(%d) = %s", maxSize, err)
+	}
+
+	bind := func(addr tcpip.FullAddress, reusePort bool) (*endpointWithSocket, tcpip.Error) {
+		eps := createEP(t, ns, new(waiter.Queue))
+		eps.ep.SocketOptions().SetReusePort(reusePort)
+		eps.mu.Lock()
+		defer eps.mu.Unlock()
+		return eps, eps.bindLocked(addr)
+	}
+
+	addr := tcpip.FullAddress{Port: 8080}
+	var group []*endpointWithSocket
+	for i := 0; i < maxSize; i++ {
+		eps, err := bind(addr, true)
+		if err != nil {
+			t.Fatalf("bind(%#v, true) #%d = %s", addr, i, err)
+		}
+		group = append(group, eps)
+	}
+
+	// The group is full.
+	if _, err := bind(addr, true); err == nil {
+		t.Errorf("got bind(%#v, true) = nil, want = %s", addr, posix.ErrnoEaddrinuse)
+	} else if got := tcpipErrorToCode(err); got != posix.ErrnoEaddrinuse {
+		t.Errorf("got bind(%#v, true) = %s, want = %s", addr, got, posix.ErrnoEaddrinuse)
+	}
+	// The conflicting endpoints do not share the address with this one.
+	if _, err := bind(addr, false); err == nil {
+		t.Errorf("got bind(%#v, false) = nil, want = %s", addr, posix.ErrnoEaddrinuse)
+	} else if got := tcpipErrorToCode(err); got != posix.ErrnoEaddrinuse {
+		t.Errorf("got bind(%#v, false) = %s, want = %s", addr, got, posix.ErrnoEaddrinuse)
+	}
+
+	// Other groups are unaffected.
+	other := tcpip.FullAddress{Port: 8081}
+	if _, err := bind(other, true); err != nil {
+		t.Errorf("bind(%#v, true) = %s", other, err)
+	}
+
+	// Removing a member makes room in the group.
+	group[0].HUp()
+	if _, err := bind(addr, true); err != nil {
+		t.Errorf("bind(%#v, true) after removing a member = %s", addr, err)
+	}
+
+	// Lifting the limit allows the group to grow.
+	if err := ns.SetMaxReusePortGroupSize(0); err != nil {
+		t.Fatalf("ns.SetMaxReusePortGroupSize(0) = %s", err)
+	}
+	if _, err := bind(addr, true); err != nil {
+		t.Errorf("bind(%#v, true) with no limit = %s", addr, err)
+	}
+}
+
+func TestGetSocketStats(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+	listener := createEP(t, ns, new(waiter.Queue))
+
+	if err := listener.ep.Bind(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("ep.Bind({}) = %s", err)
+	}
+	if err := listener.ep.Listen(1); err != nil {
+		t.Fatalf("ep.Listen(1) = %s", err)
+	}
+	connectAddr, err := listener.ep.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("ep.GetLocalAddress() = %s", err)
+	}
+	client := createEP(t, ns, new(waiter.Queue))
+	s := streamSocketImpl{endpointWithSocket: client}
+
+	before, err := s.GetSocketStats(context.Background())
+	if err != nil {
+		t.Fatalf("GetSocketStats() = %s", err)
+	}
+	if !before.PacketsSentPresent || !before.PacketsReceivedPresent || !before.RetransmitsPresent {
+		t.Fatalf("got GetSocketStats() = %#v, want all TCP counters present", before)
+	}
+	if before.PacketsSent != 0 || before.PacketsReceived != 0 {
+		t.Errorf("got GetSocketStats() = %#v before connecting, want no packets", before)
+	}
+
+	waitEntry, inCh := waiter.NewChannelEntry(waiter.EventIn)
+	listener.wq.EventRegister(&waitEntry)
+	defer listener.wq.EventUnregister(&waitEntry)
+
+	switch err := client.ep.Connect(connectAddr); err.(type) {
+	case *tcpip.ErrConnectStarted:
+	default:
+		t.Fatalf("ep.Connect(%#v) = %s", connectAddr, err)
+	}
+	// Wait for the newly established connection to show up as acceptable by
+	// the peer.
+	<-inCh
+
+	// The client has sent a SYN and an ACK, and received a SYN-ACK.
+	after, err := s.GetSocketStats(context.Background())
+	if err != nil {
+		t.Fatalf("GetSocketStats() = %s", err)
+	}
+	if after.PacketsSent < 2 {
+		t.Errorf("got PacketsSent = %d, want >= 2", after.PacketsSent)
+	}
+	if after.PacketsReceived < 1 {
+		t.Errorf("got PacketsReceived = %d, want >= 1", after.PacketsReceived)
+	}
+}
+
+func TestDatagramShutdownReadWakesRecv(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+
+	wq := new(waiter.Queue)
+	ep, tcpipErr := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if tcpipErr != nil {
+		t.Fatalf("NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", tcpipErr)
+	}
+	addr := tcpip.FullAddress{Addr: util.Parse("127.0.0.1")}
+	if err := ep.Bind(addr); err != nil {
+		t.Fatalf("ep.Bind(%#v) = %s", addr, err)
+	}
+	// Shutdown requires a connected endpoint; connect it to itself.
+	addr, tcpipErr = ep.GetLocalAddress()
+	if tcpipErr != nil {
+		t.Fatalf("ep.GetLocalAddress() = %s", tcpipErr)
+	}
+	if err := ep.Connect(addr); err != nil {
+		t.Fatalf("ep.Connect(%#v) = %s", addr, err)
+	}
 
-	destination1, err := tcpip.NewSubnet(util.Parse("192.168.42.0"), tcpip.AddressMask(util.Parse("255.255.255.0")))
+	ds, err := makeDatagramSocket(ep, ipv4.ProtocolNumber, udp.ProtocolNumber, wq, ns)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("makeDatagramSocket(...) = %s", err)
 	}
-	destination2, err := tcpip.NewSubnet(util.Parse("0.0.0.0"), tcpip.AddressMask(util.Parse("0.0.0.0")))
+	s := networkDatagramSocket{datagramSocket: ds}
+	t.Cleanup(func() {
+		s.wq.EventUnregister(&s.entry)
+		s.ep.Close()
+		if err := s.local.Close(); err != nil {
+			t.Errorf("s.local.Close() = %s", err)
+		}
+		if err := s.peer.Close(); err != nil {
+			t.Errorf("s.peer.Close() = %s", err)
+		}
+	})
+
+	// Clients block waiting for incoming data before reading.
+	if status := zx.Sys_object_wait_one(*s.peer.Handle(), zxsocket.SignalDatagramIncoming, 0, nil); status != zx.ErrTimedOut {
+		t.Fatalf("got zx.Sys_object_wait_one(_, SignalDatagramIncoming, 0, _) = %s before shutdown, want = %s", status, zx.ErrTimedOut)
+	}
+
+	if errno, err := s.shutdown(socket.ShutdownModeRead); err != nil || errno != 0 {
+		t.Fatalf("s.shutdown(ShutdownModeRead) = (%s, %v)", errno, err)
+	}
+
+	if status := zx.Sys_object_wait_one(*s.peer.Handle(), zxsocket.SignalDatagramIncoming, 0, nil); status != zx.ErrOk {
+		t.Fatalf("got zx.Sys_object_wait_one(_, SignalDatagramIncoming, 0, _) = %s after shutdown, want = %s", status, zx.ErrOk)
+	}
+	// The endpoint reports EOF...
+	switch _, _, _, _, err := s.recvMsg(false, math.MaxUint16, false); err.(type) {
+	case *tcpip.ErrClosedForReceive:
+	default:
+		t.Fatalf("got recvMsg(...) = %v, want = %s", err, &tcpip.ErrClosedForReceive{})
+	}
+	// ...which clients see as a zero-length read.
+	impl := datagramSocketImpl{networkDatagramSocket: s}
+	result, err := impl.RecvMsg(context.Background(), false, math.MaxUint16, false, 0)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("RecvMsg(...) = %s", err)
+	}
+	switch result.Which() {
+	case socket.DatagramSocketRecvMsgResultResponse:
+		if data := result.Response.Data; len(data) != 0 {
+			t.Errorf("got RecvMsg(...) = %x, want empty", data)
+		}
+	case socket.DatagramSocketRecvMsgResultErr:
+		t.Errorf("got RecvMsg(...) = %s, want empty response", result.Err)
+	}
+}
+
+func TestDatagramRecvErr(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	if err := ns.addLoopback(); err != nil {
+		t.Fatalf("ns.addLoopback() = %s", err)
+	}
+
+	// Find a port nothing listens on.
+	unbound, tcpipErr := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, new(waiter.Queue))
+	if tcpipErr != nil {
+		t.Fatalf("NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", tcpipErr)
+	}
+	dst := tcpip.FullAddress{Addr: util.Parse("127.0.0.1")}
+	if err := unbound.Bind(dst); err != nil {
+		t.Fatalf("unbound.Bind(%#v) = %s", dst, err)
+	}
+	dst, tcpipErr = unbound.GetLocalAddress()
+	if tcpipErr != nil {
+		t.Fatalf("unbound.GetLocalAddress() = %s", tcpipErr)
+	}
+	unbound.Close()
+
+	wq := new(waiter.Queue)
+	ep, tcpipErr := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if tcpipErr != nil {
+		t.Fatalf("NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", tcpipErr)
+	}
+	if err := ep.Connect(dst); err != nil {
+		t.Fatalf("ep.Connect(%#v) = %s", dst, err)
+	}
+
+	ds, err := makeDatagramSocket(ep, ipv4.ProtocolNumber, udp.ProtocolNumber, wq, ns)
+	if err != nil {
+		t.Fatalf("makeDatagramSocket(...) = %s", err)
+	}
+	s := networkDatagramSocket{datagramSocket: ds}
+	t.Cleanup(func() {
+		s.wq.EventUnregister(&s.entry)
+		s.ep.Close()
+		if err := s.local.Close(); err != nil {
+			t.Errorf("s.local.Close() = %s", err)
+		}
+		if err := s.peer.Close(); err != nil {
+			t.Errorf("s.peer.Close() = %s", err)
+		}
+	})
+
+	payload := []byte("hello")
+	// send writes payload to the unbound port, which triggers an ICMP port
+	// unreachable error over loopback.
+	send := func() {
+		t.Helper()
+		if _, err := s.ep.Write(bytes.NewReader(payload), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("s.ep.Write(_, _) = %s", err)
+		}
+		// Consume the error reported to regular reads.
+		_ = s.ep.LastError()
+	}
+	expectEmpty := func() {
+		t.Helper()
+		if _, _, _, _, err := s.recvErr(false, math.MaxUint16, false); err != (&tcpip.ErrWouldBlock{}) {
+			t.Fatalf("got s.recvErr(...) = %s, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+
+	if s.GetIpReceiveErr() {
+		t.Fatal("got s.GetIpReceiveErr() = true, want = false")
+	}
+	send()
+	expectEmpty()
+
+	s.SetIpReceiveErr(true)
+	if !s.GetIpReceiveErr() {
+		t.Fatal("got s.GetIpReceiveErr() = false, want = true")
+	}
+	send()
+
+	// Peeking leaves the error queued.
+	if _, _, _, _, err := s.recvErr(false, math.MaxUint16, true); err != nil {
+		t.Fatalf("s.recvErr(_, _, true) = %s", err)
+	}
+	addr, data, truncated, sockErr, tcpipErr := s.recvErr(true, math.MaxUint16, false)
+	if tcpipErr != nil {
+		t.Fatalf("s.recvErr(...) = %s", tcpipErr)
+	}
+	if want := toNetSocketAddress(ipv4.ProtocolNumber, dst); addr != want {
+		t.Errorf("got addr = %#v, want = %#v", addr, want)
+	}
+	if !bytes.Equal(data, payload) || truncated != 0 {
+		t.Errorf("got (data, truncated) = (%q, %d), want = (%q, 0)", data, truncated, payload)
+	}
+	wantErr := sockExtendedError{
+		Errno:    posix.ErrnoEconnrefused,
+		Origin:   tcpip.SockExtErrorOriginICMP,
+		Type:     uint8(header.ICMPv4DstUnreachable),
+		Code:     uint8(header.ICMPv4PortUnreachable),
+		Offender: toNetSocketAddress(ipv4.ProtocolNumber, tcpip.FullAddress{Addr: dst.Addr}),
+	}
+	if sockErr != wantErr {
+		t.Errorf("got sock error = %#v, want = %#v", sockErr, wantErr)
 	}
+	expectEmpty()
+
+	// Truncation to the requested length.
+	send()
+	if _, data, truncated, _, err := s.recvErr(false, 2, false); err != nil {
+		t.Fatalf("s.recvErr(false, 2, false) = %s", err)
+	} else if !bytes.Equal(data, payload[:2]) || truncated != uint32(len(payload)-2) {
+		t.Errorf("got (data, truncated) = (%q, %d), want = (%q, %d)", data, truncated, payload[:2], len(payload)-2)
+	}
+
+	// Disabling the option clears the queue.
+	send()
+	s.SetIpReceiveErr(false)
+	expectEmpty()
+}
+
+func TestSelectSourceAddress(t *testing.T) {
+	ns, clock := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
+	if err := ifs.Up(); err != nil {
+		t.Fatalf("ifs.Up() = %s", err)
+	}
+
+	addr1 := util.Parse("fd00:1::1")
+	addr2 := util.Parse("fd00:2::1")
+	for _, addr := range []tcpip.Address{addr1, addr2} {
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{Address: addr, PrefixLen: 64},
+		}
+		if status := ns.addInterfaceAddress(ifs.nicid, protocolAddr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+			t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", ifs.nicid, protocolAddr.AddressWithPrefix, status)
+		}
+	}
+	defaultRoute := tcpip.Route{
+		Destination: header.IPv6EmptySubnet,
+		Gateway:     util.Parse("fd00:1::fe"),
+		NIC:         ifs.nicid,
+	}
+	if err := ns.AddRoute(defaultRoute, metricNotSet, false); err != nil {
+		t.Fatalf("AddRoute(%s, metricNotSet, false): %s", defaultRoute, err)
+	}
+
+	// Wait for DAD to resolve so that the addresses are usable as sources.
+	clock.Advance(dadResolutionTimeout)
 
 	tests := []struct {
-		name               string
-		oldAddr, newAddr   tcpip.AddressWithPrefix
-		config             dhcp.Config
-		expectedRouteTable []routes.ExtendedRoute
+		name string
+		dest tcpip.Address
+		want tcpip.Address
 	}{
-		{
-			name:    "subnet mask provided",
-			oldAddr: tcpip.AddressWithPrefix{},
-			newAddr: tcpip.AddressWithPrefix{
-				Address:   testV4Address,
-				PrefixLen: prefixLen,
-			},
-			config: dhcp.Config{
-				ServerAddress: serverAddress,
-				Router: []tcpip.Address{
-					router1Address,
-					router2Address,
-					header.IPv4Any,
-					header.IPv4Broadcast,
-					tcpip.Address(multicastAddress),
-				},
-				SubnetMask: tcpip.AddressMask(defaultMask),
-				DNS: []tcpip.Address{
-					router1Address,
-					router2Address,
-				},
-				LeaseLength: dhcp.Seconds(60),
-			},
-			expectedRouteTable: []routes.ExtendedRoute{
-				{
-					Route: tcpip.Route{
-						Destination: destination1,
-						NIC:         1,
-					},
-					Prf:                   routes.MediumPreference,
-					Metric:                0,
-					MetricTracksInterface: true,
-					Dynamic:               true,
-					Enabled:               false,
-				},
-				{
-					Route: tcpip.Route{
-						Destination: destination2,
-						Gateway:     util.Parse("192.168.42.18"),
-						NIC:         1,
-					},
-					Prf:                   routes.MediumPreference,
-					Metric:                0,
-					MetricTracksInterface: true,
-					Dynamic:               true,
-					Enabled:               false,
-				},
-				{
-					Route: tcpip.Route{
-						Destination: destination2,
-						Gateway:     util.Parse("192.168.42.19"),
-						NIC:         1,
-					},
-					Prf:                   routes.MediumPreference,
-					Metric:                0,
-					MetricTracksInterface: true,
-					Dynamic:               true,
-					Enabled:               false,
-				},
-			},
-		},
-		{
-			name:    "no routers",
-			oldAddr: tcpip.AddressWithPrefix{},
-			newAddr: tcpip.AddressWithPrefix{
-				Address:   testV4Address,
-				PrefixLen: prefixLen,
-			},
-			config: dhcp.Config{},
-			expectedRouteTable: []routes.ExtendedRoute{
-				{
-					Route: tcpip.Route{
-						Destination: destination1,
-						NIC:         1,
-					},
-					Prf:                   routes.MediumPreference,
-					Metric:                0,
-					MetricTracksInterface: true,
-					Dynamic:               true,
-					Enabled:               false,
-				},
-			},
-		},
+		{name: "on-link", dest: util.Parse("fd00:2::5"), want: addr2},
+		{name: "off-link", dest: util.Parse("fd00:1:ffff::1"), want: addr1},
 	}
-
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			// save current route table for later
-			originalRouteTable := ifState.ns.GetExtendedRouteTable()
+			got, nicid, err := ns.SelectSourceAddress(test.dest)
+			if err != nil {
+				t.Fatalf("SelectSourceAddress(%s) = %s", test.dest, err)
+			}
+			if got != test.want || nicid != ifs.nicid {
+				t.Errorf("got SelectSourceAddress(%s) = (%s, %d), want = (%s, %d)", test.dest, got, nicid, test.want, ifs.nicid)
+			}
+		})
+	}
 
-			// Update the DHCP address to the given test values and verify it took
-			// effect.
-			ifState.dhcpAcquired(test.oldAddr, test.newAddr, test.config)
+	if _, _, err := ns.SelectSourceAddress("\x01\x02"); err == nil {
+		t.Error("got SelectSourceAddress(invalid) = nil, want error")
+	}
+}
 
-			if diff := cmp.Diff(ifState.dns.mu.servers, test.config.DNS); diff != "" {
-				t.Errorf("ifState.mu.dnsServers mismatch (-want +got):\n%s", diff)
-			}
+// multiQueueEndpoint is a noopEndpoint with numQueues receive queues, across
+// which flows are spread by local port.
+type multiQueueEndpoint struct {
+	noopEndpoint
+	numQueues int32
+}
 
-			if diff := cmp.Diff(ifState.ns.GetExtendedRouteTable(), test.expectedRouteTable, cmp.AllowUnexported(tcpip.Subnet{})); diff != "" {
-				t.Errorf("GetExtendedRouteTable() mismatch (-want +got):\n%s", diff)
-			}
+var _ rxQueueReporter = (*multiQueueEndpoint)(nil)
 
-			infoMap := ns.stack.NICInfo()
-			if info, ok := infoMap[ifState.nicid]; ok {
-				found := false
-				for _, address := range info.ProtocolAddresses {
-					if address.Protocol == ipv4.ProtocolNumber {
-						switch address.AddressWithPrefix {
-						case test.oldAddr:
-							t.Errorf("expired address %s was not removed from NIC addresses %v", test.oldAddr, info.ProtocolAddresses)
-						case test.newAddr:
-							found = true
-						}
-					}
-				}
+func (ep *multiQueueEndpoint) RxQueueIndex(id tcpipstack.TransportEndpointID) int32 {
+	return int32(id.LocalPort) % ep.numQueues
+}
 
-				if !found {
-					t.Errorf("new address %s was not added to NIC addresses %v", test.newAddr, info.ProtocolAddresses)
-				}
-			} else {
-				t.Errorf("NIC %d not found in %v", ifState.nicid, infoMap)
-			}
+func TestGetIncomingCpu(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
 
-			// Remove the address and verify everything is cleaned up correctly.
-			remAddr := test.newAddr
-			ifState.dhcpAcquired(remAddr, tcpip.AddressWithPrefix{}, dhcp.Config{})
+	multiQueue, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return "multiqueue" },
+		&multiQueueEndpoint{numQueues: 4},
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleQueue := addNoopEndpoint(t, ns, "")
 
-			if diff := cmp.Diff(ifState.dns.mu.servers, ifState.dns.mu.servers[:0]); diff != "" {
-				t.Errorf("ifState.mu.dnsServers mismatch (-want +got):\n%s", diff)
-			}
+	for _, nic := range []struct {
+		ifs  *ifState
+		addr tcpip.AddressWithPrefix
+	}{
+		{ifs: multiQueue, addr: tcpip.AddressWithPrefix{Address: testV4Address, PrefixLen: 24}},
+		{ifs: singleQueue, addr: tcpip.AddressWithPrefix{Address: "\x0a\x00\x00\x01", PrefixLen: 24}},
+	} {
+		if err := nic.ifs.Up(); err != nil {
+			t.Fatalf("ifs.Up() = %s", err)
+		}
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: nic.addr,
+		}
+		if status := ns.addInterfaceAddress(nic.ifs.nicid, protocolAddr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+			t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", nic.ifs.nicid, protocolAddr.AddressWithPrefix, status)
+		}
+	}
 
-			if diff := cmp.Diff(ifState.ns.GetExtendedRouteTable(), originalRouteTable); diff != "" {
-				t.Errorf("GetExtendedRouteTable() mismatch (-want +got):\n%s", diff)
-			}
+	newUDPEndpoint := func(port uint16) *endpoint {
+		ep, err := ns.stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, new(waiter.Queue))
+		if err != nil {
+			t.Fatalf("NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, _) = %s", err)
+		}
+		t.Cleanup(ep.Close)
+		addr := tcpip.FullAddress{Port: port}
+		if err := ep.Bind(addr); err != nil {
+			t.Fatalf("Bind(%#v) = %s", addr, err)
+		}
+		return &endpoint{ep: ep, ns: ns, transProto: udp.ProtocolNumber, netProto: ipv4.ProtocolNumber}
+	}
 
-			infoMap = ns.stack.NICInfo()
-			if info, ok := infoMap[ifState.nicid]; ok {
-				for _, address := range info.ProtocolAddresses {
-					if address.Protocol == ipv4.ProtocolNumber {
-						if address.AddressWithPrefix == remAddr {
-							t.Errorf("address %s/%d was not removed from NIC addresses %v", remAddr.Address, remAddr.PrefixLen, info.ProtocolAddresses)
-						}
-					}
+	tests := []struct {
+		name string
+		port uint16
+		peer tcpip.Address
+		want int32
+	}{
+		{name: "unconnected", port: 5001, want: -1},
+		{name: "multi-queue", port: 5003, peer: "\xc0\xa8\x2a\x11", want: 5003 % 4},
+		{name: "single-queue", port: 5004, peer: "\x0a\x00\x00\x02", want: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ep := newUDPEndpoint(test.port)
+			if len(test.peer) != 0 {
+				addr := tcpip.FullAddress{Addr: test.peer, Port: 9}
+				if err := ep.ep.Connect(addr); err != nil {
+					t.Fatalf("Connect(%#v) = %s", addr, err)
 				}
-			} else {
-				t.Errorf("NIC %d not found in %v", ifState.nicid, infoMap)
+			}
+			if got := ep.incomingCPU(); got != test.want {
+				t.Errorf("got incomingCPU() = %d, want = %d", got, test.want)
 			}
 		})
 	}
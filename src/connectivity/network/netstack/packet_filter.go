@@ -0,0 +1,223 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build !build_with_native_toolchain
+// +build !build_with_native_toolchain
+
+package netstack
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// Classic BPF instruction classes, sizes, modes and operations, as defined in
+// Linux's include/uapi/linux/filter.h.
+const (
+	bpfLD   = 0x00
+	bpfLDX  = 0x01
+	bpfALU  = 0x04
+	bpfJMP  = 0x05
+	bpfRET  = 0x06
+	bpfMISC = 0x07
+
+	bpfW = 0x00
+	bpfH = 0x08
+	bpfB = 0x10
+
+	bpfIMM = 0x00
+	bpfABS = 0x20
+	bpfIND = 0x40
+	bpfMSH = 0xa0
+
+	bpfAND = 0x50
+	bpfRSH = 0x70
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJGE  = 0x30
+	bpfJSET = 0x40
+
+	bpfK = 0x00
+	bpfA = 0x10
+
+	bpfTAX = 0x00
+	bpfTXA = 0x80
+
+	// bpfMaxInstructions is the maximum length of a classic BPF program
+	// accepted by Linux (BPF_MAXINSNS).
+	bpfMaxInstructions = 4096
+
+	// bpfAncillaryProtocol is the offset used by absolute loads to read the
+	// packet's link-layer protocol (SKF_AD_OFF + SKF_AD_PROTOCOL).
+	bpfAncillaryProtocol = 0xfffff000
+)
+
+// bpfInstruction is a single classic BPF instruction, laid out as Linux's
+// struct sock_filter.
+type bpfInstruction struct {
+	OpCode      uint16
+	JumpIfTrue  uint8
+	JumpIfFalse uint8
+	K           uint32
+}
+
+// bpfProgram is a validated classic BPF program.
+//
+// Only the subset of classic BPF commonly used to match on link-layer
+// protocol, addresses and ports is supported; programs using other opcodes
+// are rejected by newBPFProgram.
+type bpfProgram struct {
+	instructions []bpfInstruction
+}
+
+func isSupportedBPFOpCode(op uint16) bool {
+	switch op {
+	case bpfLD | bpfW | bpfABS, bpfLD | bpfH | bpfABS, bpfLD | bpfB | bpfABS,
+		bpfLD | bpfW | bpfIND, bpfLD | bpfH | bpfIND, bpfLD | bpfB | bpfIND,
+		bpfLD | bpfIMM,
+		bpfLDX | bpfIMM, bpfLDX | bpfB | bpfMSH,
+		bpfALU | bpfAND | bpfK, bpfALU | bpfRSH | bpfK,
+		bpfJMP | bpfJA,
+		bpfJMP | bpfJEQ | bpfK, bpfJMP | bpfJGT | bpfK, bpfJMP | bpfJGE | bpfK, bpfJMP | bpfJSET | bpfK,
+		bpfRET | bpfK, bpfRET | bpfA,
+		bpfMISC | bpfTAX, bpfMISC | bpfTXA:
+		return true
+	default:
+		return false
+	}
+}
+
+// newBPFProgram validates a classic BPF program.
+//
+// A program is valid if it is non-empty, no longer than bpfMaxInstructions,
+// uses only supported opcodes, has all jumps landing within the program and
+// ends with a return instruction.
+func newBPFProgram(instructions []bpfInstruction) (bpfProgram, error) {
+	if len(instructions) == 0 || len(instructions) > bpfMaxInstructions {
+		return bpfProgram{}, fmt.Errorf("invalid program length %d", len(instructions))
+	}
+	for i, ins := range instructions {
+		if !isSupportedBPFOpCode(ins.OpCode) {
+			return bpfProgram{}, fmt.Errorf("unsupported opcode %#x at instruction %d", ins.OpCode, i)
+		}
+		if ins.OpCode&0x07 != bpfJMP {
+			continue
+		}
+		remaining := uint64(len(instructions) - i - 1)
+		if ins.OpCode == bpfJMP|bpfJA {
+			if uint64(ins.K) >= remaining {
+				return bpfProgram{}, fmt.Errorf("jump out of bounds at instruction %d", i)
+			}
+			continue
+		}
+		if uint64(ins.JumpIfTrue) >= remaining || uint64(ins.JumpIfFalse) >= remaining {
+			return bpfProgram{}, fmt.Errorf("jump out of bounds at instruction %d", i)
+		}
+	}
+	if last := instructions[len(instructions)-1]; last.OpCode&0x07 != bpfRET {
+		return bpfProgram{}, fmt.Errorf("program does not end with a return instruction")
+	}
+	return bpfProgram{instructions: append([]bpfInstruction(nil), instructions...)}, nil
+}
+
+// run executes the program over a packet whose link-layer protocol is
+// protocol.
+//
+// It returns the number of bytes of the packet to accept; a return value of
+// 0 means that the packet must be dropped. Out-of-bounds loads terminate the
+// program and drop the packet.
+func (p *bpfProgram) run(pkt []byte, protocol tcpip.NetworkProtocolNumber) uint32 {
+	load := func(offset uint32, size uint32) (uint32, bool) {
+		if offset == bpfAncillaryProtocol && size == 2 {
+			return uint32(protocol), true
+		}
+		end := uint64(offset) + uint64(size)
+		if end > uint64(len(pkt)) {
+			return 0, false
+		}
+		switch size {
+		case 4:
+			return binary.BigEndian.Uint32(pkt[offset:]), true
+		case 2:
+			return uint32(binary.BigEndian.Uint16(pkt[offset:])), true
+		default:
+			return uint32(pkt[offset]), true
+		}
+	}
+	loadSize := func(op uint16) uint32 {
+		switch op & 0x18 {
+		case bpfW:
+			return 4
+		case bpfH:
+			return 2
+		default:
+			return 1
+		}
+	}
+
+	var a, x uint32
+	for pc := 0; pc < len(p.instructions); pc++ {
+		ins := p.instructions[pc]
+		switch ins.OpCode {
+		case bpfLD | bpfW | bpfABS, bpfLD | bpfH | bpfABS, bpfLD | bpfB | bpfABS:
+			v, ok := load(ins.K, loadSize(ins.OpCode))
+			if !ok {
+				return 0
+			}
+			a = v
+		case bpfLD | bpfW | bpfIND, bpfLD | bpfH | bpfIND, bpfLD | bpfB | bpfIND:
+			v, ok := load(x+ins.K, loadSize(ins.OpCode))
+			if !ok {
+				return 0
+			}
+			a = v
+		case bpfLD | bpfIMM:
+			a = ins.K
+		case bpfLDX | bpfIMM:
+			x = ins.K
+		case bpfLDX | bpfB | bpfMSH:
+			v, ok := load(ins.K, 1)
+			if !ok {
+				return 0
+			}
+			x = (v & 0xf) << 2
+		case bpfALU | bpfAND | bpfK:
+			a &= ins.K
+		case bpfALU | bpfRSH | bpfK:
+			a >>= ins.K
+		case bpfJMP | bpfJA:
+			pc += int(ins.K)
+		case bpfJMP | bpfJEQ | bpfK:
+			pc += jumpOffset(a == ins.K, ins)
+		case bpfJMP | bpfJGT | bpfK:
+			pc += jumpOffset(a > ins.K, ins)
+		case bpfJMP | bpfJGE | bpfK:
+			pc += jumpOffset(a >= ins.K, ins)
+		case bpfJMP | bpfJSET | bpfK:
+			pc += jumpOffset(a&ins.K != 0, ins)
+		case bpfRET | bpfK:
+			return ins.K
+		case bpfRET | bpfA:
+			return a
+		case bpfMISC | bpfTAX:
+			x = a
+		case bpfMISC | bpfTXA:
+			a = x
+		default:
+			panic(fmt.Sprintf("unsupported opcode %#x in validated program", ins.OpCode))
+		}
+	}
+	panic("validated program did not return")
+}
+
+func jumpOffset(cond bool, ins bpfInstruction) int {
+	if cond {
+		return int(ins.JumpIfTrue)
+	}
+	return int(ins.JumpIfFalse)
+}
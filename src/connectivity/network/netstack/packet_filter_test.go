@@ -0,0 +1,285 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build !build_with_native_toolchain
+// +build !build_with_native_toolchain
+
+package netstack
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	packetsocket "fidl/fuchsia/posix/socket/packet"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+func ethernetFrame(proto tcpip.NetworkProtocolNumber) []byte {
+	b := make([]byte, header.EthernetMinimumSize+4)
+	header.Ethernet(b).Encode(&header.EthernetFields{
+		SrcAddr: "\x02\x00\x00\x00\x00\x01",
+		DstAddr: "\x02\x00\x00\x00\x00\x02",
+		Type:    proto,
+	})
+	return b
+}
+
+func TestBPFProgramFilterByEtherType(t *testing.T) {
+	const acceptAll = 0xffffffff
+
+	tests := []struct {
+		name         string
+		instructions []bpfInstruction
+	}{
+		{
+			// Equivalent to `tcpdump -dd ip` on a link-layer packet socket.
+			name: "link header",
+			instructions: []bpfInstruction{
+				{OpCode: bpfLD | bpfH | bpfABS, K: 12},
+				{OpCode: bpfJMP | bpfJEQ | bpfK, JumpIfTrue: 0, JumpIfFalse: 1, K: uint32(ipv4.ProtocolNumber)},
+				{OpCode: bpfRET | bpfK, K: acceptAll},
+				{OpCode: bpfRET | bpfK, K: 0},
+			},
+		},
+		{
+			// Matches on the protocol reported alongside the packet, as used by
+			// network-layer packet sockets.
+			name: "ancillary protocol",
+			instructions: []bpfInstruction{
+				{OpCode: bpfLD | bpfH | bpfABS, K: bpfAncillaryProtocol},
+				{OpCode: bpfJMP | bpfJEQ | bpfK, JumpIfTrue: 0, JumpIfFalse: 1, K: uint32(ipv4.ProtocolNumber)},
+				{OpCode: bpfRET | bpfK, K: acceptAll},
+				{OpCode: bpfRET | bpfK, K: 0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, err := newBPFProgram(test.instructions)
+			if err != nil {
+				t.Fatalf("newBPFProgram(_) = %s", err)
+			}
+			for _, proto := range []tcpip.NetworkProtocolNumber{
+				ipv4.ProtocolNumber,
+				ipv6.ProtocolNumber,
+				arp.ProtocolNumber,
+			} {
+				want := uint32(0)
+				if proto == ipv4.ProtocolNumber {
+					want = acceptAll
+				}
+				if got := program.run(ethernetFrame(proto), proto); got != want {
+					t.Errorf("got run(_, %d) = %d, want = %d", proto, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBPFProgramShortPacket(t *testing.T) {
+	program, err := newBPFProgram([]bpfInstruction{
+		{OpCode: bpfLD | bpfH | bpfABS, K: 12},
+		{OpCode: bpfRET | bpfK, K: 0xffffffff},
+	})
+	if err != nil {
+		t.Fatalf("newBPFProgram(_) = %s", err)
+	}
+	if got := program.run(make([]byte, 13), ipv4.ProtocolNumber); got != 0 {
+		t.Errorf("got run(_, _) = %d, want = 0", got)
+	}
+}
+
+func TestBPFProgramValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions []bpfInstruction
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "unsupported opcode",
+			instructions: []bpfInstruction{
+				// BPF_ALU | BPF_DIV | BPF_X.
+				{OpCode: 0x3c},
+				{OpCode: bpfRET | bpfK},
+			},
+		},
+		{
+			name: "jump out of bounds",
+			instructions: []bpfInstruction{
+				{OpCode: bpfJMP | bpfJEQ | bpfK, JumpIfTrue: 1, JumpIfFalse: 0},
+				{OpCode: bpfRET | bpfK},
+			},
+		},
+		{
+			name: "unconditional jump out of bounds",
+			instructions: []bpfInstruction{
+				{OpCode: bpfJMP | bpfJA, K: 1},
+				{OpCode: bpfRET | bpfK},
+			},
+		},
+		{
+			name: "no return",
+			instructions: []bpfInstruction{
+				{OpCode: bpfLD | bpfIMM, K: 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newBPFProgram(test.instructions); err == nil {
+				t.Errorf("newBPFProgram(%#v) succeeded, want error", test.instructions)
+			}
+		})
+	}
+}
+
+var _ stack.LinkEndpoint = (*injectableEndpoint)(nil)
+
+// injectableEndpoint allows injecting incoming packets.
+type injectableEndpoint struct {
+	noopEndpoint
+	dispatcher stack.NetworkDispatcher
+}
+
+func (ep *injectableEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	ep.dispatcher = dispatcher
+	ep.noopEndpoint.Attach(dispatcher)
+}
+
+// newFilteredPacketSocket returns a network-layer packet socket bound to all
+// protocols on nicid, which only accepts IPv4 packets.
+func newFilteredPacketSocket(t *testing.T, ns *Netstack, nicid tcpip.NICID) *packetSocketImpl {
+	t.Helper()
+
+	wq := new(waiter.Queue)
+	ep, tcpipErr := ns.stack.NewPacketEndpoint(true /* cooked */, 0 /* netProto */, wq)
+	if tcpipErr != nil {
+		t.Fatalf("NewPacketEndpoint(true, 0, _) = %s", tcpipErr)
+	}
+	addr := tcpip.FullAddress{NIC: nicid, Port: uint16(header.EthernetProtocolAll)}
+	if err := ep.Bind(addr); err != nil {
+		t.Fatalf("ep.Bind(%#v) = %s", addr, err)
+	}
+	ds, err := makeDatagramSocket(ep, 0 /* netProto */, 0 /* transProto */, wq, ns)
+	if err != nil {
+		t.Fatalf("makeDatagramSocket(...) = %s", err)
+	}
+	s := &packetSocketImpl{
+		datagramSocket: ds,
+		kind:           packetsocket.KindNetwork,
+		filter:         &packetSocketFilter{},
+	}
+	t.Cleanup(func() {
+		s.wq.EventUnregister(&s.entry)
+		s.ep.Close()
+		if err := s.local.Close(); err != nil {
+			t.Errorf("s.local.Close() = %s", err)
+		}
+		if err := s.peer.Close(); err != nil {
+			t.Errorf("s.peer.Close() = %s", err)
+		}
+	})
+
+	if errno := s.SetBpfFilter([]bpfInstruction{
+		{OpCode: bpfLD | bpfH | bpfABS, K: bpfAncillaryProtocol},
+		{OpCode: bpfJMP | bpfJEQ | bpfK, JumpIfTrue: 0, JumpIfFalse: 1, K: uint32(ipv4.ProtocolNumber)},
+		{OpCode: bpfRET | bpfK, K: 0xffffffff},
+		{OpCode: bpfRET | bpfK, K: 0},
+	}); errno != 0 {
+		t.Fatalf("SetBpfFilter(_) = %s", errno)
+	}
+	return s
+}
+
+func TestPacketSocketRecvMsgFilter(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	linkEP := &injectableEndpoint{}
+	ifs, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() },
+		linkEP,
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ifs.RemoveByUser)
+	if err := ifs.Up(); err != nil {
+		t.Fatal("ifs.Up(): ", err)
+	}
+
+	s := newFilteredPacketSocket(t, ns, ifs.nicid)
+
+	deliver := func(proto tcpip.NetworkProtocolNumber, payload []byte) {
+		t.Helper()
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Data: buffer.View(payload).ToVectorisedView(),
+		})
+		defer pkt.DecRef()
+		linkEP.dispatcher.DeliverNetworkPacket(proto, pkt)
+	}
+	rejected := []byte{6, 6, 6, 6}
+	accepted := []byte{4, 4, 4, 4}
+
+	for _, peek := range []bool{false, true} {
+		deliver(ipv6.ProtocolNumber, rejected)
+		deliver(ipv4.ProtocolNumber, accepted)
+
+		// Peeking leaves the accepted packet in place, but not the rejected one.
+		reads := 1
+		if peek {
+			reads = 2
+		}
+		for i := 0; i < reads; i++ {
+			b, _, err := s.recvMsg(tcpip.ReadOptions{Peek: peek}, math.MaxUint16)
+			if err != nil {
+				t.Fatalf("recvMsg(Peek: %t) #%d = %s", peek, i, err)
+			}
+			if !bytes.Equal(b, accepted) {
+				t.Errorf("got recvMsg(Peek: %t) #%d = %x, want = %x", peek, i, b, accepted)
+			}
+		}
+		if peek {
+			if _, _, err := s.recvMsg(tcpip.ReadOptions{}, math.MaxUint16); err != nil {
+				t.Fatalf("recvMsg(Peek: false) = %s", err)
+			}
+		}
+
+		if b, _, err := s.recvMsg(tcpip.ReadOptions{}, math.MaxUint16); err == nil {
+			t.Errorf("got recvMsg(Peek: false) = %x after reading the accepted packet, want = %s", b, &tcpip.ErrWouldBlock{})
+		} else if _, ok := err.(*tcpip.ErrWouldBlock); !ok {
+			t.Errorf("got recvMsg(Peek: false) = %s after reading the accepted packet, want = %s", err, &tcpip.ErrWouldBlock{})
+		}
+	}
+}
+
+func TestPacketSocketRecvMsgFilterAfterClose(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+
+	s := newFilteredPacketSocket(t, ns, ifs.nicid)
+	s.ep.Close()
+
+	// The filter loop returns the endpoint's terminal error rather than
+	// retrying the read.
+	if b, _, err := s.recvMsg(tcpip.ReadOptions{}, math.MaxUint16); err == nil {
+		t.Errorf("got recvMsg(_) = %x after Close(), want = %s", b, &tcpip.ErrClosedForReceive{})
+	} else if _, ok := err.(*tcpip.ErrClosedForReceive); !ok {
+		t.Errorf("got recvMsg(_) = %s after Close(), want = %s", err, &tcpip.ErrClosedForReceive{})
+	}
+}
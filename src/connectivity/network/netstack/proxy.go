@@ -0,0 +1,231 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build !build_with_native_toolchain
+// +build !build_with_native_toolchain
+
+package netstack
+
+import (
+	"sort"
+
+	"go.fuchsia.dev/fuchsia/src/connectivity/network/netstack/sync"
+	syslog "go.fuchsia.dev/fuchsia/src/lib/syslog/go"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var _ stack.LinkEndpoint = (*proxyEndpoint)(nil)
+var _ stack.GSOEndpoint = (*proxyEndpoint)(nil)
+var _ stack.NetworkDispatcher = (*proxyEndpoint)(nil)
+
+// proxyEndpoint answers ARP requests and NDP neighbor solicitations on behalf
+// of addresses that are not assigned to its NIC.
+//
+// gVisor does not support proxy ARP or NDP, so requests are intercepted as they
+// are delivered and answered directly on the link. Requests are still
+// delivered to the stack, which ignores those for addresses it does not own.
+type proxyEndpoint struct {
+	nested.Endpoint
+	stack *stack.Stack
+	nicid tcpip.NICID
+	mu    struct {
+		sync.RWMutex
+		// arp is whether ARP requests for IPv4 addresses routed through another
+		// NIC are answered.
+		arp bool
+		// ndp is the set of IPv6 addresses for which neighbor solicitations are
+		// answered.
+		ndp map[tcpip.Address]struct{}
+	}
+}
+
+func newProxyEndpoint(s *stack.Stack, nicid tcpip.NICID, lower stack.LinkEndpoint) *proxyEndpoint {
+	ep := &proxyEndpoint{stack: s, nicid: nicid}
+	ep.mu.ndp = make(map[tcpip.Address]struct{})
+	ep.Endpoint.Init(lower, ep)
+	return ep
+}
+
+func (e *proxyEndpoint) setARP(enabled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mu.arp = enabled
+}
+
+func (e *proxyEndpoint) arp() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.mu.arp
+}
+
+func (e *proxyEndpoint) setNDP(addr tcpip.Address, enabled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if enabled {
+		e.mu.ndp[addr] = struct{}{}
+	} else {
+		delete(e.mu.ndp, addr)
+	}
+}
+
+// ndp returns the proxied IPv6 addresses, sorted.
+func (e *proxyEndpoint) ndp() []tcpip.Address {
+	e.mu.RLock()
+	addrs := make([]tcpip.Address, 0, len(e.mu.ndp))
+	for addr := range e.mu.ndp {
+		addrs = append(addrs, addr)
+	}
+	e.mu.RUnlock()
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+func (e *proxyEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	switch protocol {
+	case header.ARPProtocolNumber:
+		e.handleARP(pkt)
+	case header.IPv6ProtocolNumber:
+		e.handleNDP(pkt)
+	}
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+func (e *proxyEndpoint) handleARP(pkt *stack.PacketBuffer) {
+	if !e.arp() {
+		return
+	}
+	req := header.ARP(pkt.Data().AsRange().ToOwnedView())
+	if !req.IsValid() || req.Op() != header.ARPRequest {
+		return
+	}
+	target := tcpip.Address(req.ProtocolAddressTarget())
+	if !e.routedElsewhere(target) {
+		return
+	}
+
+	reply := header.ARP(make(buffer.View, header.ARPSize))
+	reply.SetIPv4OverEthernet()
+	reply.SetOp(header.ARPReply)
+	copy(reply.HardwareAddressSender(), e.LinkAddress())
+	copy(reply.ProtocolAddressSender(), req.ProtocolAddressTarget())
+	copy(reply.HardwareAddressTarget(), req.HardwareAddressSender())
+	copy(reply.ProtocolAddressTarget(), req.ProtocolAddressSender())
+	e.writeReply(header.ARPProtocolNumber, tcpip.LinkAddress(req.HardwareAddressSender()), buffer.View(reply))
+}
+
+// routedElsewhere returns whether addr is not assigned to the NIC and is
+// routed through a different NIC.
+func (e *proxyEndpoint) routedElsewhere(addr tcpip.Address) bool {
+	if e.stack.CheckLocalAddress(e.nicid, header.IPv4ProtocolNumber, addr) != 0 {
+		return false
+	}
+	route, err := e.stack.FindRoute(0, "", addr, header.IPv4ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		return false
+	}
+	defer route.Release()
+	return route.NICID() != e.nicid
+}
+
+func (e *proxyEndpoint) handleNDP(pkt *stack.PacketBuffer) {
+	e.mu.RLock()
+	empty := len(e.mu.ndp) == 0
+	e.mu.RUnlock()
+	if empty {
+		return
+	}
+
+	ip := header.IPv6(pkt.Data().AsRange().ToOwnedView())
+	if !ip.IsValid(len(ip)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber || ip.HopLimit() != header.NDPHopLimit {
+		return
+	}
+	icmp := header.ICMPv6(ip.Payload())
+	if len(icmp) < header.ICMPv6NeighborSolicitMinimumSize || icmp.Type() != header.ICMPv6NeighborSolicit {
+		return
+	}
+	ns := header.NDPNeighborSolicit(icmp.MessageBody())
+	target := ns.TargetAddress()
+	e.mu.RLock()
+	_, ok := e.mu.ndp[target]
+	e.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	// Solicitations for duplicate address detection are not answered, and a
+	// solicitation without a source link-layer address cannot be answered on
+	// the link.
+	src := ip.SourceAddress()
+	if src == header.IPv6Any {
+		return
+	}
+	var remoteLinkAddr tcpip.LinkAddress
+	it, err := ns.Options().Iter(false /* check */)
+	if err != nil {
+		return
+	}
+	for {
+		opt, done, err := it.Next()
+		if err != nil || done {
+			break
+		}
+		if sllao, ok := opt.(header.NDPSourceLinkLayerAddressOption); ok {
+			remoteLinkAddr = sllao.EthernetAddress()
+		}
+	}
+	if len(remoteLinkAddr) == 0 {
+		return
+	}
+
+	opts := header.NDPOptionsSerializer{
+		header.NDPTargetLinkLayerAddressOption(e.LinkAddress()),
+	}
+	icmpSize := header.ICMPv6NeighborAdvertMinimumSize + opts.Length()
+	reply := make(buffer.View, header.IPv6MinimumSize+icmpSize)
+	header.IPv6(reply).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(icmpSize),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          header.NDPHopLimit,
+		SrcAddr:           target,
+		DstAddr:           src,
+	})
+	na := header.ICMPv6(reply[header.IPv6MinimumSize:])
+	na.SetType(header.ICMPv6NeighborAdvert)
+	adv := header.NDPNeighborAdvert(na.MessageBody())
+	adv.SetSolicitedFlag(true)
+	// Proxies must not override existing cache entries (RFC 4861 section
+	// 7.2.8).
+	adv.SetOverrideFlag(false)
+	adv.SetTargetAddress(target)
+	adv.Options().Serialize(opts)
+	na.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: na,
+		Src:    target,
+		Dst:    src,
+	}))
+	e.writeReply(header.IPv6ProtocolNumber, remoteLinkAddr, reply)
+}
+
+func (e *proxyEndpoint) writeReply(protocol tcpip.NetworkProtocolNumber, remoteLinkAddr tcpip.LinkAddress, hdr buffer.View) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: int(e.MaxHeaderLength()) + len(hdr),
+	})
+	copy(pkt.NetworkHeader().Push(len(hdr)), hdr)
+	pkt.NetworkProtocolNumber = protocol
+	pkt.EgressRoute.LocalLinkAddress = e.LinkAddress()
+	pkt.EgressRoute.RemoteLinkAddress = remoteLinkAddr
+	e.AddHeader(pkt)
+
+	var pkts stack.PacketBufferList
+	defer pkts.DecRef()
+	pkts.PushBack(pkt)
+	if _, err := e.Endpoint.WritePackets(pkts); err != nil {
+		_ = syslog.Warnf("NIC %d: failed to write proxy %s reply: %s", e.nicid, networkProtocolToString(protocol), err)
+	}
+}
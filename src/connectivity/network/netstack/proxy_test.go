@@ -0,0 +1,185 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build !build_with_native_toolchain
+// +build !build_with_native_toolchain
+
+package netstack
+
+import (
+	"syscall/zx"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var _ stack.LinkEndpoint = (*arpRecordingEndpoint)(nil)
+
+// arpRecordingEndpoint records outgoing ARP packets and allows injecting
+// incoming packets.
+type arpRecordingEndpoint struct {
+	noopEndpoint
+	dispatcher stack.NetworkDispatcher
+	arp        chan header.ARP
+}
+
+func (ep *arpRecordingEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	ep.dispatcher = dispatcher
+	ep.noopEndpoint.Attach(dispatcher)
+}
+
+func (ep *arpRecordingEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		if pkt.NetworkProtocolNumber == header.ARPProtocolNumber {
+			ep.arp <- header.ARP(append(buffer.View(nil), pkt.NetworkHeader().View()...))
+		}
+	}
+	return pkts.Len(), nil
+}
+
+func TestProxyARP(t *testing.T) {
+	const (
+		proxyLinkAddr     = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+		requesterLinkAddr = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+		requesterAddr     = tcpip.Address("\xc0\xa8\x2a\x02")
+		localAddr         = tcpip.Address("\xc0\xa8\x2a\x01")
+		otherAddr         = tcpip.Address("\x0a\x00\x01\x01")
+		// Routed through the other interface.
+		proxiedAddr = tcpip.Address("\x0a\x00\x01\x05")
+		// Routed through the proxying interface.
+		onLinkAddr = tcpip.Address("\xc0\xa8\x2a\x07")
+	)
+
+	ns, _ := newNetstack(t, netstackTestOptions{})
+
+	linkEP := &arpRecordingEndpoint{
+		noopEndpoint: noopEndpoint{linkAddress: proxyLinkAddr},
+		arp:          make(chan header.ARP, 1),
+	}
+	ifs, err := ns.addEndpoint(
+		func(tcpip.NICID) string { return t.Name() },
+		linkEP,
+		&noopController{},
+		nil, /* observer */
+		0,   /* metric */
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ifs.RemoveByUser)
+	other := addNoopEndpoint(t, ns, "")
+	t.Cleanup(other.RemoveByUser)
+
+	for _, nic := range []struct {
+		ifs  *ifState
+		addr tcpip.Address
+	}{
+		{ifs: ifs, addr: localAddr},
+		{ifs: other, addr: otherAddr},
+	} {
+		if err := nic.ifs.Up(); err != nil {
+			t.Fatal("ifs.Up(): ", err)
+		}
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{Address: nic.addr, PrefixLen: 24},
+		}
+		if status := ns.addInterfaceAddress(nic.ifs.nicid, protocolAddr, true /* addRoute */, false /* skipDAD */); status != zx.ErrOk {
+			t.Fatalf("ns.addInterfaceAddress(%d, %s) = %s", nic.ifs.nicid, protocolAddr.AddressWithPrefix, status)
+		}
+	}
+
+	// request delivers an ARP request for target to the proxying interface and
+	// returns the reply, if any.
+	request := func(target tcpip.Address) header.ARP {
+		t.Helper()
+		req := header.ARP(make(buffer.View, header.ARPSize))
+		req.SetIPv4OverEthernet()
+		req.SetOp(header.ARPRequest)
+		copy(req.HardwareAddressSender(), requesterLinkAddr)
+		copy(req.ProtocolAddressSender(), requesterAddr)
+		copy(req.ProtocolAddressTarget(), target)
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Data: buffer.View(req).ToVectorisedView(),
+		})
+		defer pkt.DecRef()
+		linkEP.dispatcher.DeliverNetworkPacket(header.ARPProtocolNumber, pkt)
+		select {
+		case reply := <-linkEP.arp:
+			return reply
+		default:
+			return nil
+		}
+	}
+
+	if ifs.proxyARP() {
+		t.Fatal("got ifs.proxyARP() = true, want = false")
+	}
+	if reply := request(proxiedAddr); reply != nil {
+		t.Fatalf("got reply to ARP request for %s with proxy ARP disabled", proxiedAddr)
+	}
+
+	ifs.setProxyARP(true)
+	if !ifs.proxyARP() {
+		t.Fatal("got ifs.proxyARP() = false, want = true")
+	}
+	reply := request(proxiedAddr)
+	if reply == nil {
+		t.Fatalf("got no reply to ARP request for %s", proxiedAddr)
+	}
+	if !reply.IsValid() {
+		t.Fatalf("got invalid ARP reply %x", []byte(reply))
+	}
+	if got, want := reply.Op(), header.ARPReply; got != want {
+		t.Errorf("got reply.Op() = %d, want = %d", got, want)
+	}
+	for _, check := range []struct {
+		name      string
+		got, want string
+	}{
+		{name: "sender hardware address", got: string(reply.HardwareAddressSender()), want: string(proxyLinkAddr)},
+		{name: "sender protocol address", got: string(reply.ProtocolAddressSender()), want: string(proxiedAddr)},
+		{name: "target hardware address", got: string(reply.HardwareAddressTarget()), want: string(requesterLinkAddr)},
+		{name: "target protocol address", got: string(reply.ProtocolAddressTarget()), want: string(requesterAddr)},
+	} {
+		if check.got != check.want {
+			t.Errorf("got %s = %x, want = %x", check.name, check.got, check.want)
+		}
+	}
+
+	if reply := request(onLinkAddr); reply != nil {
+		t.Errorf("got reply to ARP request for %s, which is routed through the proxying interface", onLinkAddr)
+	}
+
+	ifs.setProxyARP(false)
+	if reply := request(proxiedAddr); reply != nil {
+		t.Errorf("got reply to ARP request for %s after disabling proxy ARP", proxiedAddr)
+	}
+}
+
+func TestSetProxyNDP(t *testing.T) {
+	ns, _ := newNetstack(t, netstackTestOptions{})
+	ifs := addNoopEndpoint(t, ns, "")
+	t.Cleanup(ifs.RemoveByUser)
+
+	if err := ifs.setProxyNDP(testV4Address, true); err == nil {
+		t.Errorf("got ifs.setProxyNDP(%s, true) = nil, want error", testV4Address)
+	}
+	if err := ifs.setProxyNDP(testV6Address, true); err != nil {
+		t.Fatalf("ifs.setProxyNDP(%s, true) = %s", testV6Address, err)
+	}
+	if got := ifs.proxyNDPAddresses(); len(got) != 1 || got[0] != testV6Address {
+		t.Errorf("got ifs.proxyNDPAddresses() = %s, want = [%s]", got, testV6Address)
+	}
+	if err := ifs.setProxyNDP(testV6Address, false); err != nil {
+		t.Fatalf("ifs.setProxyNDP(%s, false) = %s", testV6Address, err)
+	}
+	if got := ifs.proxyNDPAddresses(); len(got) != 0 {
+		t.Errorf("got ifs.proxyNDPAddresses() = %s, want = []", got)
+	}
+}
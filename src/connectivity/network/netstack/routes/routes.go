@@ -38,6 +38,9 @@ const tag = "routes"
 var (
 	ErrNoSuchRoute = errors.New("no such route")
 	ErrNoSuchNIC   = errors.New("no such NIC")
+	// ErrTooManyRoutes is returned when adding routes would grow the route
+	// table past its configured maximum.
+	ErrTooManyRoutes = errors.New("too many routes")
 )
 
 // Metric is the metric used for sorting the route table. It acts as a
@@ -5,26 +5,33 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"debug/elf"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.fuchsia.dev/fuchsia/tools/debug/covargs"
-	"go.fuchsia.dev/fuchsia/tools/debug/covargs/api/llvm"
 	"go.fuchsia.dev/fuchsia/tools/debug/symbolize"
 	"go.fuchsia.dev/fuchsia/tools/lib/cache"
 	"go.fuchsia.dev/fuchsia/tools/lib/color"
@@ -32,7 +39,9 @@ import (
 	"go.fuchsia.dev/fuchsia/tools/lib/logger"
 	"go.fuchsia.dev/fuchsia/tools/lib/retry"
 	"go.fuchsia.dev/fuchsia/tools/testing/runtests"
+	"golang.org/x/oauth2"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/option"
 )
 
 const (
@@ -41,31 +50,54 @@ const (
 	cloudFetchMaxAttempts  = 2
 	cloudFetchRetryBackoff = 500 * time.Millisecond
 	cloudFetchTimeout      = 60 * time.Second
+	mergeRetryBackoff      = time.Second
 )
 
 var (
-	colors          color.EnableColor
-	level           logger.LogLevel
-	summaryFile     flagmisc.StringsValue
-	buildIDDirPaths flagmisc.StringsValue
-	symbolServers   flagmisc.StringsValue
-	symbolCache     string
-	dryRun          bool
-	skipFunctions   bool
-	outputDir       string
-	llvmCov         string
-	llvmProfdata    flagmisc.StringsValue
-	outputFormat    string
-	jsonOutput      string
-	reportDir       string
-	saveTemps       string
-	basePath        string
-	diffMappingFile string
-	compilationDir  string
-	pathRemapping   flagmisc.StringsValue
-	srcFiles        flagmisc.StringsValue
-	numThreads      int
-	jobs            int
+	colors            color.EnableColor
+	level             logger.LogLevel
+	summaryFile       flagmisc.StringsValue
+	buildIDDirPaths   flagmisc.StringsValue
+	symbolServers     flagmisc.StringsValue
+	symbolCache       string
+	gcsTokenFile      string
+	dryRun            bool
+	planOutput        string
+	skipExpansions    bool
+	skipFunctions     bool
+	skipRegions       bool
+	outputDir         string
+	llvmCov           string
+	llvmProfdata      flagmisc.StringsValue
+	outputFormat      string
+	jsonOutput        string
+	reportDir         string
+	perTestDir        string
+	saveTemps         string
+	basePath          string
+	diffMappingFile   string
+	excludePrefixFile string
+	keepOriginalPaths bool
+	compilationDir    string
+	pathRemapping     flagmisc.StringsValue
+	srcFiles          flagmisc.StringsValue
+	numThreads        int
+	jobs              int
+	maxMalformed      int
+	instrProfMagics   flagmisc.StringsValue
+	sinkTypes         flagmisc.StringsValue
+	reuseMerged       string
+	mergeOnly         bool
+	failureMode       string
+	badgeOutput       string
+	lcovOutput        string
+	fetchCachePath    string
+	mergeAttempts     int
+	malformedOutput   string
+	malformedText     bool
+	deadline          time.Duration
+	badgeGreen        float64
+	badgeYellow       float64
 )
 
 func init() {
@@ -74,12 +106,16 @@ func init() {
 
 	flag.Var(&colors, "color", "can be never, auto, always")
 	flag.Var(&level, "level", "can be fatal, error, warning, info, debug or trace")
-	flag.Var(&summaryFile, "summary", "path to summary.json file")
+	flag.Var(&summaryFile, "summary", "path to summary.json file, or to a .tar, .tar.gz or .tgz archive containing summary.json files and their data sinks")
 	flag.Var(&buildIDDirPaths, "build-id-dir", "path to .build-id directory")
 	flag.Var(&symbolServers, "symbol-server", "a GCS URL or bucket name that contains debug binaries indexed by build ID")
 	flag.StringVar(&symbolCache, "symbol-cache", "", "path to directory to store cached debug binaries in")
-	flag.BoolVar(&dryRun, "dry-run", false, "if set the system prints out commands that would be run instead of running them")
+	flag.StringVar(&gcsTokenFile, "gcs-token-file", "", "path to a file containing an OAuth2 access token used to authenticate with symbol servers; if unset, ambient credentials are used")
+	flag.BoolVar(&dryRun, "dry-run", false, "if set the system prints out commands that would be run instead of running them; since build IDs are not read, every profile in the summary is partitioned, and the llvm-cov export is recorded but not run")
+	flag.StringVar(&planOutput, "plan-output", "", "writes a JSON plan of the partitions, modules and commands to the specified file; implies -dry-run")
+	flag.BoolVar(&skipExpansions, "skip-expansions", true, "if set, the coverage report enabled by the `report-dir` flag will not include macro expansions")
 	flag.BoolVar(&skipFunctions, "skip-functions", true, "if set, the coverage report enabled by the `report-dir` flag will not include function coverage")
+	flag.BoolVar(&skipRegions, "skip-regions", false, "if set, the coverage report enabled by the `report-dir` flag will not include region coverage, leaving only segments")
 	flag.StringVar(&outputDir, "output-dir", "", "the directory to output results to")
 	flag.Var(&llvmProfdata, "llvm-profdata", "the location of llvm-profdata")
 	flag.StringVar(&llvmCov, "llvm-cov", "llvm-cov", "the location of llvm-cov")
@@ -87,49 +123,228 @@ func init() {
 	flag.StringVar(&jsonOutput, "json-output", "", "outputs profile information to the specified file")
 	flag.StringVar(&saveTemps, "save-temps", "", "save temporary artifacts in a directory")
 	flag.StringVar(&reportDir, "report-dir", "", "the directory to save the report to")
+	flag.StringVar(&badgeOutput, "badge-output", "", "writes a shields.io endpoint badge JSON with the aggregate line coverage of the report enabled by the `report-dir` flag to the specified file")
+	flag.Float64Var(&badgeGreen, "badge-green-threshold", 80, "the minimum line coverage percentage for a green badge")
+	flag.Float64Var(&badgeYellow, "badge-yellow-threshold", 50, "the minimum line coverage percentage for a yellow badge; coverage below it is red")
+	flag.StringVar(&lcovOutput, "lcov-output", "", "writes the line coverage of the report enabled by the `report-dir` flag in the lcov tracefile format to the specified file")
+	flag.StringVar(&perTestDir, "per-test-dir", "", "if set, the profiles of each test are also merged and exported separately into a subdirectory of this directory, indexed by tests.json")
 	flag.StringVar(&basePath, "base", "", "base path for source tree")
 	flag.StringVar(&diffMappingFile, "diff-mapping", "", "path to diff mapping file")
+	flag.StringVar(&excludePrefixFile, "exclude-prefix-file", "", "path to a file listing source path prefixes, one per line, to exclude from the coverage report")
+	flag.BoolVar(&keepOriginalPaths, "preserve-original-paths", false, "if set, the original path of each file in the coverage report enabled by the `report-dir` flag is recorded in paths.json alongside the report")
 	flag.StringVar(&compilationDir, "compilation-dir", "", "the directory used as a base for relative coverage mapping paths, passed through to llvm-cov")
 	flag.Var(&pathRemapping, "path-equivalence", "<from>,<to> remapping of source file paths passed through to llvm-cov")
 	flag.Var(&srcFiles, "src-file", "path to a source file to generate coverage for. If provided, only coverage for these files will be generated.\n"+
 		"Multiple files can be specified with multiple instances of this flag.")
 	flag.IntVar(&numThreads, "num-threads", 0, "number of processing threads")
 	flag.IntVar(&jobs, "jobs", runtime.NumCPU(), "number of parallel jobs")
+	flag.Var(&instrProfMagics, "instrprof-magic", "hex magic accepted in raw profile headers; may be repeated to accept several magics, defaults to the LLVM raw profile magic")
+	flag.Var(&sinkTypes, "sink-type", "name of a data sink type whose sinks are processed; may be repeated to process several types, defaults to "+llvmProfileSinkType)
+	flag.StringVar(&malformedOutput, "malformed-output", "", "writes a JSON array of the modules rejected by llvm-cov, with their build ID, binary and llvm-cov output, to the specified file")
+	flag.BoolVar(&malformedText, "malformed-binaries-txt", true, "if set, the build IDs of the modules rejected by llvm-cov are written to malformed_binaries.txt in the temporary directory")
+	flag.IntVar(&maxMalformed, "max-malformed", -1, "fail if more than this many modules are malformed; a negative value disables the check")
+	flag.StringVar(&reuseMerged, "reuse-merged", "", "path to an indexed profile merged by a previous run; if set, profiles are not merged again, and the modules are read from the entries in the `json-output` file written by that run")
+	flag.BoolVar(&mergeOnly, "merge-only", false, "if set, only the profiles are merged, and the merged profile is written to merged.profdata in the `output-dir` directory; llvm-cov is not run")
+	flag.IntVar(&mergeAttempts, "merge-attempts", 3, "maximum number of times llvm-profdata merge is run when it fails for lack of memory")
+	flag.StringVar(&fetchCachePath, "fetch-cache", "", "path to a JSON file caching the versions and build IDs read from profiles across invocations, keyed by profile path and invalidated when the size or modification time of a profile changes")
+	flag.DurationVar(&deadline, "deadline", 0, "if positive, the maximum duration of the whole run, after which running commands are killed and covargs fails")
+	flag.StringVar(&failureMode, "profdata-failure-mode", "all", "the --failure-mode passed to llvm-profdata merge: all, warn or any; with warn or any, profiles dropped by the merge are recorded in profile_dispositions.json")
 }
 
 const llvmProfileSinkType = "llvm-profile"
 
+// parseSinkTypes returns the set of data sink types to process.
+func parseSinkTypes(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		values = []string{llvmProfileSinkType}
+	}
+	types := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		types[v] = struct{}{}
+	}
+	return types
+}
+
+const summaryFilename = "summary.json"
+
+// isTarArchive reports whether path names a tar archive, possibly compressed
+// with gzip.
+func isTarArchive(path string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractTar extracts the tar archive at path into dir and returns the paths
+// of the extracted summary files.
+func extractTar(path, dir string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %w", path, err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if !strings.HasSuffix(path, ".tar") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress %q: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var summaries []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %q: %w", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("entry %q of %q is outside the archive", hdr.Name, path)
+		}
+		dst := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(dst)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot extract %q from %q: %w", hdr.Name, path, err)
+		}
+		if filepath.Base(name) == summaryFilename {
+			summaries = append(summaries, dst)
+		}
+	}
+	return summaries, nil
+}
+
+// gzipMagic are the first bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressedFile reads a file through an optional decompressor.
+type decompressedFile struct {
+	io.Reader
+	file *os.File
+	gz   *gzip.Reader
+}
+
+func (f *decompressedFile) Close() error {
+	if f.gz != nil {
+		f.gz.Close()
+	}
+	return f.file.Close()
+}
+
+// openDecompressed opens the file at path, transparently decompressing it if
+// it is compressed with gzip, as detected from its leading bytes.
+func openDecompressed(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %w", path, err)
+	}
+	br := bufio.NewReader(file)
+	if magic, _ := br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return &decompressedFile{Reader: br, file: file}, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot decompress %q: %w", path, err)
+	}
+	return &decompressedFile{Reader: gz, file: file, gz: gz}, nil
+}
+
+// testProfiles maps each test to the raw profiles it produced.
+type testProfiles map[string][]string
+
 // Output is indexed by dump name
-func readSummary(summaryFiles []string) (runtests.DataSinkMap, error) {
+//
+// Summary files that are tar archives are extracted under extractDir, and the
+// summaries they contain are read with sink paths resolved relative to their
+// location within the archive. Only sinks whose type is in sinkTypes are
+// collected.
+func readSummary(summaryFiles []string, extractDir string, sinkTypes map[string]struct{}) (runtests.DataSinkMap, testProfiles, error) {
 	sinks := make(runtests.DataSinkMap)
+	tests := make(testProfiles)
 
-	for _, summaryFile := range summaryFiles {
-		// TODO(phosek): process these in parallel using goroutines.
-		file, err := os.Open(summaryFile)
+	var expanded []string
+	for i, summaryFile := range summaryFiles {
+		if !isTarArchive(summaryFile) {
+			expanded = append(expanded, summaryFile)
+			continue
+		}
+		summaries, err := extractTar(summaryFile, filepath.Join(extractDir, fmt.Sprintf("summary%d", i)))
 		if err != nil {
-			return nil, fmt.Errorf("cannot open %q: %w", summaryFile, err)
+			return nil, nil, err
 		}
-		defer file.Close()
+		expanded = append(expanded, summaries...)
+	}
 
-		var summary runtests.TestSummary
-		if err := json.NewDecoder(file).Decode(&summary); err != nil {
-			return nil, fmt.Errorf("cannot decode %q: %w", summaryFile, err)
-		}
+	// Decode the summaries in parallel, but merge them in order so that the
+	// sinks are listed in the same order regardless of scheduling.
+	summaries := make([]runtests.TestSummary, len(expanded))
+	sems := make(chan struct{}, jobs)
+	var eg errgroup.Group
+	for i, summaryFile := range expanded {
+		i, summaryFile := i, summaryFile // capture range variables.
+		sems <- struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sems }()
+
+			file, err := openDecompressed(summaryFile)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
 
-		dir := filepath.Dir(summaryFile)
+			if err := json.NewDecoder(file).Decode(&summaries[i]); err != nil {
+				return fmt.Errorf("cannot decode %q: %w", summaryFile, err)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, nil, err
+	}
+
+	for i, summary := range summaries {
+		dir := filepath.Dir(expanded[i])
 		for _, detail := range summary.Tests {
 			for name, data := range detail.DataSinks {
+				if _, ok := sinkTypes[name]; !ok {
+					continue
+				}
 				for _, sink := range data {
+					file := filepath.Join(dir, sink.File)
 					sinks[name] = append(sinks[name], runtests.DataSink{
 						Name: sink.Name,
-						File: filepath.Join(dir, sink.File),
+						File: file,
 					})
+					tests[detail.Name] = append(tests[detail.Name], file)
 				}
 			}
 		}
 	}
 
-	return sinks, nil
+	return sinks, tests, nil
 }
 
 type Action struct {
@@ -139,12 +354,24 @@ type Action struct {
 
 func (a Action) Run(ctx context.Context) ([]byte, error) {
 	logger.Debugf(ctx, "%s\n", a.String())
+	commands.record(a)
 	if !dryRun {
-		return exec.Command(a.Path, a.Args...).CombinedOutput()
+		output, err := exec.CommandContext(ctx, a.Path, a.Args...).CombinedOutput()
+		return output, interruptedError(ctx, a.Path, err)
 	}
 	return nil, nil
 }
 
+// interruptedError returns err, the result of running the command at path
+// under ctx, or an error wrapping ctx.Err() if the command failed because it
+// was killed once ctx was done.
+func interruptedError(ctx context.Context, path string, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%s was interrupted: %w", path, ctx.Err())
+	}
+	return err
+}
+
 func (a Action) String() string {
 	var buf bytes.Buffer
 	fmt.Fprint(&buf, a.Path)
@@ -154,17 +381,262 @@ func (a Action) String() string {
 	return buf.String()
 }
 
+// commandLog records the commands run, in order, so that they can be saved
+// alongside the temporary artifacts for manual reproduction.
+type commandLog struct {
+	mu       sync.Mutex
+	commands []Action
+}
+
+var commands commandLog
+
+func (l *commandLog) record(a Action) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commands = append(l.commands, a)
+}
+
+func (l *commandLog) actions() []Action {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Action(nil), l.commands...)
+}
+
+func (l *commandLog) writeFile(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buf bytes.Buffer
+	for _, command := range l.commands {
+		fmt.Fprintf(&buf, "%s\n", command.String())
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// plan describes the work done by process, as written by -plan-output. Its
+// keys are snake_case; commands use the keys of Action, "cmd" and "args".
+type plan struct {
+	Partitions []partitionPlan `json:"partitions"`
+	// Entries is the number of profiles whose module is known.
+	Entries  int      `json:"entries"`
+	Modules  []string `json:"modules"`
+	Commands []Action `json:"commands"`
+}
+
+type partitionPlan struct {
+	Version      uint64   `json:"version"`
+	Tool         string   `json:"tool"`
+	ProfileCount int      `json:"profile_count"`
+	Profiles     []string `json:"profiles"`
+}
+
+func makePlan(partitions map[uint64]*partition, entries []profileEntry) plan {
+	var p plan
+	for version, partition := range partitions {
+		p.Partitions = append(p.Partitions, partitionPlan{
+			Version:      version,
+			Tool:         partition.tool,
+			ProfileCount: len(partition.profiles),
+			Profiles:     partition.profiles,
+		})
+	}
+	sort.Slice(p.Partitions, func(i, j int) bool {
+		return p.Partitions[i].Version < p.Partitions[j].Version
+	})
+	p.Entries = len(entries)
+	modules := make(map[string]struct{})
+	for _, entry := range entries {
+		if _, ok := modules[entry.Module]; !ok {
+			modules[entry.Module] = struct{}{}
+			p.Modules = append(p.Modules, entry.Module)
+		}
+	}
+	sort.Strings(p.Modules)
+	p.Commands = commands.actions()
+	return p
+}
+
+func writePlan(path string, p plan) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
 const instrProfRawMagic = uint64(255)<<56 | uint64('l')<<48 |
 	uint64('p')<<40 | uint64('r')<<32 | uint64('o')<<24 |
 	uint64('f')<<16 | uint64('r')<<8 | uint64(129)
 
+// parseMagics parses hex raw profile magics, returning instrProfRawMagic if
+// none are given.
+func parseMagics(values []string) ([]uint64, error) {
+	if len(values) == 0 {
+		return []uint64{instrProfRawMagic}, nil
+	}
+	var magics []uint64
+	for _, v := range values {
+		magic, err := strconv.ParseUint(strings.TrimPrefix(v, "0x"), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magic %q: %w", v, err)
+		}
+		magics = append(magics, magic)
+	}
+	return magics, nil
+}
+
+const indexedProfMagic = uint64(255)<<56 | uint64('l')<<48 |
+	uint64('p')<<40 | uint64('r')<<32 | uint64('o')<<24 |
+	uint64('f')<<16 | uint64('i')<<8 | uint64(129)
+
+// checkIndexedProfile verifies that path holds an indexed profile, as written
+// by llvm-profdata merge, and returns its version.
+func checkIndexedProfile(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var header struct {
+		Magic   uint64
+		Version uint64
+	}
+	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+		return 0, fmt.Errorf("failed to read header of %q: %w", path, err)
+	}
+	if header.Magic != indexedProfMagic {
+		return 0, fmt.Errorf("invalid magic in %q: %x", path, header.Magic)
+	}
+	// The upper half of the version holds flags describing the profile.
+	version := header.Version & 0xffffffff
+	if version == 0 {
+		return 0, fmt.Errorf("invalid version in %q: %x", path, header.Version)
+	}
+	return version, nil
+}
+
+// readProfileEntries reads the entries written to the -json-output file.
+func readProfileEntries(path string) ([]profileEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []profileEntry
+	if err := json.NewDecoder(file).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("cannot decode %q: %w", path, err)
+	}
+	return entries, nil
+}
+
+// fetchCacheEntry is what is known about a profile, valid for as long as the
+// size and modification time of the profile are unchanged.
+type fetchCacheEntry struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod_time"`
+	// Magic and Version are the raw profile header, if it has been read.
+	Magic   uint64  `json:"magic,omitempty"`
+	Version *uint64 `json:"version,omitempty"`
+	// BuildID is the build ID embedded in the profile, if it has been read.
+	BuildID string `json:"build_id,omitempty"`
+}
+
+// fetchCache persists the versions and build IDs read from profiles across
+// invocations, so that the profiles need not be opened again. A nil
+// fetchCache caches nothing.
+type fetchCache struct {
+	mu      sync.Mutex
+	entries map[string]fetchCacheEntry
+}
+
+// loadFetchCache reads the fetch cache at path. A missing file is an empty
+// cache.
+func loadFetchCache(path string) (*fetchCache, error) {
+	c := &fetchCache{entries: make(map[string]fetchCacheEntry)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, fmt.Errorf("cannot decode %q: %w", path, err)
+	}
+	return c, nil
+}
+
+// save writes the cache to path, replacing it atomically.
+func (c *fetchCache) save(path string) error {
+	c.mu.Lock()
+	b, err := json.MarshalIndent(c.entries, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// get returns the cache entry of profile. If the profile changed since the
+// entry was recorded, the returned entry only has its size and modification
+// time set.
+func (c *fetchCache) get(profile string) (fetchCacheEntry, error) {
+	info, err := os.Stat(profile)
+	if err != nil {
+		return fetchCacheEntry{}, err
+	}
+	entry := fetchCacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if c == nil {
+		return entry, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.entries[profile]; ok && cached.Size == entry.Size && cached.ModTime == entry.ModTime {
+		return cached, nil
+	}
+	return entry, nil
+}
+
+// put records entry for profile, as returned by get and then filled in,
+// keeping what was already recorded for the same size and modification time.
+func (c *fetchCache) put(profile string, entry fetchCacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.entries[profile]; ok && cached.Size == entry.Size && cached.ModTime == entry.ModTime {
+		if entry.Version == nil {
+			entry.Magic, entry.Version = cached.Magic, cached.Version
+		}
+		if entry.BuildID == "" {
+			entry.BuildID = cached.BuildID
+		}
+	}
+	c.entries[profile] = entry
+}
+
 type versionFetcher struct {
-	mu    sync.RWMutex
-	cache map[string]uint64
+	mu     sync.RWMutex
+	cache  map[string]uint64
+	magics map[uint64]struct{}
+	// fetchCache, if set, is consulted before reading a profile.
+	fetchCache *fetchCache
 }
 
-func newVersionFetcher() *versionFetcher {
-	return &versionFetcher{cache: make(map[string]uint64)}
+// newVersionFetcher returns a versionFetcher accepting profiles whose header
+// starts with any of magics.
+func newVersionFetcher(magics []uint64) *versionFetcher {
+	f := &versionFetcher{
+		cache:  make(map[string]uint64),
+		magics: make(map[uint64]struct{}),
+	}
+	for _, magic := range magics {
+		f.magics[magic] = struct{}{}
+	}
+	return f
 }
 
 func (f *versionFetcher) getVersion(filepath string) (uint64, error) {
@@ -175,6 +647,20 @@ func (f *versionFetcher) getVersion(filepath string) (uint64, error) {
 		return v, nil
 	}
 
+	var entry fetchCacheEntry
+	if f.fetchCache != nil {
+		var err error
+		if entry, err = f.fetchCache.get(filepath); err != nil {
+			return 0, err
+		}
+		if _, ok := f.magics[entry.Magic]; ok && entry.Version != nil {
+			f.mu.Lock()
+			f.cache[filepath] = *entry.Version
+			f.mu.Unlock()
+			return *entry.Version, nil
+		}
+	}
+
 	file, err := os.Open(filepath)
 	if err != nil {
 		return 0, err
@@ -185,7 +671,7 @@ func (f *versionFetcher) getVersion(filepath string) (uint64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("failed to read magic: %w", err)
 	}
-	if magic != instrProfRawMagic {
+	if _, ok := f.magics[magic]; !ok {
 		return 0, fmt.Errorf("invalid magic: %x", magic)
 	}
 	var version uint64
@@ -198,6 +684,11 @@ func (f *versionFetcher) getVersion(filepath string) (uint64, error) {
 	f.cache[filepath] = version
 	f.mu.Unlock()
 
+	if f.fetchCache != nil {
+		entry.Magic, entry.Version = magic, &version
+		f.fetchCache.put(filepath, entry)
+	}
+
 	return version, nil
 }
 
@@ -234,7 +725,19 @@ func (e *profileReadingError) Error() string {
 
 // Returns the embedded build id read from a profile by invoking llvm-profdata tool.
 // llvm-profdata show --binary-ids
-func readEmbeddedBuildId(ctx context.Context, tool string, profile string) (string, error) {
+// If cache is not nil, it is consulted first and updated with the build id.
+func readEmbeddedBuildId(ctx context.Context, cache *fetchCache, tool string, profile string) (string, error) {
+	var entry fetchCacheEntry
+	if cache != nil {
+		var err error
+		if entry, err = cache.get(profile); err != nil {
+			return "", err
+		}
+		if entry.BuildID != "" {
+			return entry.BuildID, nil
+		}
+	}
+
 	args := []string{
 		"show",
 		"--binary-ids",
@@ -261,6 +764,11 @@ func readEmbeddedBuildId(ctx context.Context, tool string, profile string) (stri
 		return "", fmt.Errorf("invalid build id in profile %q: %w", profile, err)
 	}
 
+	if cache != nil {
+		entry.BuildID = embeddedBuildId
+		cache.put(profile, entry)
+	}
+
 	return embeddedBuildId, nil
 }
 
@@ -273,75 +781,269 @@ type partition struct {
 type profileEntry struct {
 	Profile string `json:"profile"`
 	Module  string `json:"module"`
+	// Error describes why the profile could not be mapped to a module. It
+	// starts with one of the profileError* kinds.
+	Error string `json:"error,omitempty"`
 }
 
-// mergeEntries combines data from runtests and build ids embedded in profiles
-// returning a sequence of entries, where each entry contains
-// a raw profile and module specified by build ID present in that profile.
-func mergeEntries(ctx context.Context, vf *versionFetcher, summary runtests.DataSinkMap, partitions map[uint64]*partition) ([]profileEntry, error) {
-	// Dedupe profiles so we only fetch build IDs once for each.
-	profiles := make(map[string]struct{})
-	for _, sink := range summary[llvmProfileSinkType] {
-		profiles[sink.File] = struct{}{}
+// The kinds of errors reported in profileEntry.Error.
+const (
+	profileErrorVersion   = "cannot read version"
+	profileErrorMalformed = "malformed profile"
+	profileErrorBuildID   = "cannot read build ID"
+)
+
+// moduleEntries returns the entries whose profile was mapped to a module.
+func moduleEntries(entries []profileEntry) []profileEntry {
+	var res []profileEntry
+	for _, entry := range entries {
+		if entry.Error == "" {
+			res = append(res, entry)
+		}
 	}
+	return res
+}
+
+// profileDisposition records what became of a raw profile, as written to
+// profile_dispositions.json.
+type profileDisposition struct {
+	Profile string `json:"profile"`
+	// Version is the raw profile version, if it could be read.
+	Version uint64 `json:"version,omitempty"`
+	// Module is the build ID embedded in the profile, if it could be read.
+	Module string `json:"module,omitempty"`
+	// Partition is the version key of the partition the profile was merged
+	// into, where 0 is the default partition. It is unset for skipped profiles.
+	Partition *uint64 `json:"partition,omitempty"`
+	Skipped   bool    `json:"skipped"`
+	Reason    string  `json:"reason,omitempty"`
+}
 
-	profileEntryChan := make(chan profileEntry, len(profiles))
+const profileDispositionsFilename = "profile_dispositions.json"
+
+func writeProfileDispositions(path string, dispositions []profileDisposition) error {
+	b, err := json.MarshalIndent(dispositions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// summaryProfiles returns the deduplicated raw profiles of every sink type in
+// summary, sorted.
+func summaryProfiles(summary runtests.DataSinkMap) []string {
+	seen := make(map[string]struct{})
+	var profiles []string
+	for _, sinks := range summary {
+		for _, sink := range sinks {
+			if _, ok := seen[sink.File]; !ok {
+				seen[sink.File] = struct{}{}
+				profiles = append(profiles, sink.File)
+			}
+		}
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+// mergeEntries combines data from runtests and build ids embedded in profiles
+// returning a sequence of entries, where each entry contains
+// a raw profile and module specified by build ID present in that profile,
+// or the error that prevented reading the build ID.
+// It also returns the disposition of every profile in summary, sorted by
+// profile.
+func mergeEntries(ctx context.Context, vf *versionFetcher, summary runtests.DataSinkMap, partitions map[uint64]*partition) ([]profileEntry, []profileDisposition, error) {
+	profiles := summaryProfiles(summary)
+
+	dispositions := make([]profileDisposition, len(profiles))
 	sems := make(chan struct{}, jobs)
-	var eg errgroup.Group
-	for profile := range profiles {
-		profile := profile // capture range variable.
+	eg, ctx := errgroup.WithContext(ctx)
+	for i, profile := range profiles {
+		i, profile := i, profile // capture range variables.
 		sems <- struct{}{}
 		eg.Go(func() error {
 			defer func() { <-sems }()
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			d := &dispositions[i]
+			d.Profile = profile
 
 			version, err := vf.getVersion(profile)
 			if err != nil {
 				// TODO(fxbug.dev/83504): Known issue causes occasional failures on host tests.
 				// Once resolved, return an error.
 				logger.Warningf(ctx, "cannot read version from profile %q: %w", profile, err)
+				d.Skipped = true
+				d.Reason = fmt.Sprintf("%s: %s", profileErrorVersion, err)
 				return nil
 			}
+			d.Version = version
 
 			// Find the associated llvm-profdata tool.
-			partition, ok := partitions[version]
+			key := version
+			partition, ok := partitions[key]
 			if !ok {
-				partition = partitions[0]
+				key = 0
+				partition = partitions[key]
 			}
 
 			// Read embedded build ids, which are enabled for profile versions 7 and above.
-			embeddedBuildId, err := readEmbeddedBuildId(ctx, partition.tool, profile)
+			embeddedBuildId, err := readEmbeddedBuildId(ctx, vf.fetchCache, partition.tool, profile)
 			if err != nil {
-				switch err.(type) {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					// The profile isn't at fault if llvm-profdata was interrupted.
+					return ctxErr
+				}
 				// TODO(fxbug.dev/83504): Known issue causes occasional malformed profiles on host tests.
-				// Only log the warning for such cases now. Once resolved, return an error.
-				case *profileReadingError:
-					logger.Warningf(ctx, err.Error())
-					return nil
-				default:
-					return err
+				// Errors are specific to a single profile, so only log the warning and skip it.
+				logger.Warningf(ctx, err.Error())
+				kind := profileErrorBuildID
+				var readErr *profileReadingError
+				if errors.As(err, &readErr) {
+					kind = profileErrorMalformed
 				}
+				d.Skipped = true
+				d.Reason = fmt.Sprintf("%s: %s", kind, err)
+				return nil
 			}
-			profileEntryChan <- profileEntry{
-				Profile: profile,
-				Module:  embeddedBuildId,
-			}
+			d.Module = embeddedBuildId
+			d.Partition = &key
 			return nil
 		})
 	}
 
 	if err := eg.Wait(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	close(profileEntryChan)
 
-	var entries []profileEntry
-	for pe := range profileEntryChan {
-		entries = append(entries, pe)
+	// Skipped profiles are included with the reason they were skipped, so that
+	// they can be told apart in the JSON output.
+	entries := make([]profileEntry, 0, len(dispositions))
+	for _, d := range dispositions {
+		entry := profileEntry{
+			Profile: d.Profile,
+			Module:  d.Module,
+		}
+		if d.Skipped {
+			entry.Error = d.Reason
+		}
+		entries = append(entries, entry)
 	}
-	return entries, nil
+	return entries, dispositions, nil
+}
+
+// malformedModule is a module rejected because llvm-cov could not read its
+// coverage, as written by -malformed-output.
+type malformedModule struct {
+	BuildID string `json:"build_id"`
+	// Binary is the path of the debug binary of the module.
+	Binary string `json:"binary"`
+	// Stderr is the end of the llvm-cov output that rejected the module.
+	Stderr string `json:"stderr"`
+}
+
+// maxStderrSnippet is the maximum length of malformedModule.Stderr.
+const maxStderrSnippet = 4096
+
+// stderrSnippet returns the last maxStderrSnippet bytes of output.
+func stderrSnippet(output []byte) string {
+	if len(output) > maxStderrSnippet {
+		output = output[len(output)-maxStderrSnippet:]
+	}
+	return string(output)
+}
+
+func writeMalformedModules(path string, modules []malformedModule) error {
+	if modules == nil {
+		modules = []malformedModule{}
+	}
+	b, err := json.MarshalIndent(modules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// checkMalformed returns an error if more than max modules are malformed. A
+// negative max disables the check.
+func checkMalformed(malformed []string, max int) error {
+	if max >= 0 && len(malformed) > max {
+		return fmt.Errorf("%d modules are malformed, more than the maximum of %d: %s", len(malformed), max, strings.Join(malformed, ", "))
+	}
+	return nil
+}
+
+// validateFailureMode returns an error if mode is not a failure mode accepted
+// by llvm-profdata merge.
+func validateFailureMode(mode string) error {
+	switch mode {
+	case "all", "warn", "any":
+		return nil
+	}
+	return fmt.Errorf("invalid llvm-profdata failure mode %q, must be one of all, warn or any", mode)
+}
+
+// droppedProfiles returns the profiles, sorted, that llvm-profdata merge warned
+// about in output. Unless the failure mode is all, such profiles are left out
+// of the merge rather than failing it.
+func droppedProfiles(output []byte, profiles []string) []string {
+	known := make(map[string]struct{}, len(profiles))
+	for _, profile := range profiles {
+		known[profile] = struct{}{}
+	}
+	seen := make(map[string]struct{})
+	var dropped []string
+	for _, line := range strings.Split(string(output), "\n") {
+		rest := strings.TrimPrefix(line, "warning: ")
+		if rest == line {
+			continue
+		}
+		i := strings.Index(rest, ": ")
+		if i < 0 {
+			continue
+		}
+		profile := rest[:i]
+		if _, ok := known[profile]; !ok {
+			continue
+		}
+		if _, ok := seen[profile]; !ok {
+			seen[profile] = struct{}{}
+			dropped = append(dropped, profile)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
 }
 
 func process(ctx context.Context, repo symbolize.Repository) error {
+	if err := validateFailureMode(failureMode); err != nil {
+		return err
+	}
+	if badgeOutput != "" && reportDir == "" {
+		return fmt.Errorf("-badge-output requires -report-dir")
+	}
+	if lcovOutput != "" && reportDir == "" {
+		return fmt.Errorf("-lcov-output requires -report-dir")
+	}
+	if reuseMerged != "" {
+		if jsonOutput == "" {
+			return fmt.Errorf("-reuse-merged requires -json-output")
+		}
+		if perTestDir != "" {
+			return fmt.Errorf("-per-test-dir cannot be used with -reuse-merged")
+		}
+	}
+	if mergeOnly {
+		if outputDir == "" {
+			return fmt.Errorf("-merge-only requires -output-dir")
+		}
+		if reuseMerged != "" {
+			return fmt.Errorf("-merge-only cannot be used with -reuse-merged")
+		}
+	}
+
 	partitions := make(map[uint64]*partition)
 	var err error
 
@@ -361,21 +1063,6 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 		return fmt.Errorf("missing default llvm-profdata tool path")
 	}
 
-	// Read in all the data in summary file
-	summary, err := readSummary(summaryFile)
-	if err != nil {
-		return fmt.Errorf("parsing info: %w", err)
-	}
-
-	vf := newVersionFetcher()
-
-	// Merge all the information
-	entries, err := mergeEntries(ctx, vf, summary, partitions)
-
-	if err != nil {
-		return fmt.Errorf("merging info: %w", err)
-	}
-
 	tempDir := saveTemps
 	if saveTemps == "" {
 		tempDir, err = ioutil.TempDir(saveTemps, "covargs")
@@ -384,91 +1071,122 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 		}
 		defer os.RemoveAll(tempDir)
 	}
-
-	if jsonOutput != "" {
-		file, err := os.Create(jsonOutput)
-		if err != nil {
-			return fmt.Errorf("creating profile output file: %w", err)
+	defer func() {
+		commandsFilename := filepath.Join(tempDir, "commands.txt")
+		if err := commands.writeFile(commandsFilename); err != nil {
+			logger.Warningf(ctx, "writing commands %q: %v", commandsFilename, err)
 		}
-		defer file.Close()
-		if err := json.NewEncoder(file).Encode(entries); err != nil {
-			return fmt.Errorf("writing profile information: %w", err)
+	}()
+
+	magics, err := parseMagics(instrProfMagics)
+	if err != nil {
+		return err
+	}
+	vf := newVersionFetcher(magics)
+	if fetchCachePath != "" {
+		if vf.fetchCache, err = loadFetchCache(fetchCachePath); err != nil {
+			return fmt.Errorf("loading fetch cache: %w", err)
 		}
+		defer func() {
+			if err := vf.fetchCache.save(fetchCachePath); err != nil {
+				logger.Warningf(ctx, "saving fetch cache %q: %v", fetchCachePath, err)
+			}
+		}()
 	}
 
-	for _, entry := range entries {
-		version, err := vf.getVersion(entry.Profile)
+	var (
+		entries    []profileEntry
+		mergedFile string
+		tests      testProfiles
+		// versions holds the version of each partitioned profile, so that
+		// per-test coverage does not read them again.
+		versions map[string]uint64
+	)
+	if reuseMerged != "" {
+		version, err := checkIndexedProfile(reuseMerged)
 		if err != nil {
-			// TODO(fxbug.dev/83504): Known issue causes occasional failures on host tests.
-			// Once resolved, return error below.
-			logger.Warningf(ctx, "cannot read version from profile %q: %w", entry.Profile, err)
-			continue
+			return fmt.Errorf("reusing merged profile: %w", err)
 		}
-		partition, ok := partitions[version]
-		if !ok {
-			partition = partitions[0]
+		logger.Debugf(ctx, "reusing merged profile %q of version %d\n", reuseMerged, version)
+		if entries, err = readProfileEntries(jsonOutput); err != nil {
+			return fmt.Errorf("reading profile information: %w", err)
 		}
-		partition.profiles = append(partition.profiles, entry.Profile)
-	}
-
-	profdataFiles := []string{}
-	for version, partition := range partitions {
-		if len(partition.profiles) == 0 {
-			continue
+		entries = moduleEntries(entries)
+		mergedFile = reuseMerged
+	} else {
+		// Read in all the data in summary file
+		var summary runtests.DataSinkMap
+		summary, tests, err = readSummary(summaryFile, tempDir, parseSinkTypes(sinkTypes))
+		if err != nil {
+			return fmt.Errorf("parsing info: %w", err)
 		}
 
-		// Make the llvm-profdata response file
-		profdataFile, err := os.Create(filepath.Join(tempDir, "llvm-profdata.rsp"))
+		// Merge all the information
+		var dispositions []profileDisposition
+		entries, dispositions, err = mergeEntries(ctx, vf, summary, partitions)
+
 		if err != nil {
-			return fmt.Errorf("creating llvm-profdata.rsp file: %w", err)
+			return fmt.Errorf("merging info: %w", err)
 		}
 
-		for _, profile := range partition.profiles {
-			fmt.Fprintf(profdataFile, "%s\n", profile)
+		if jsonOutput != "" {
+			file, err := os.Create(jsonOutput)
+			if err != nil {
+				return fmt.Errorf("creating profile output file: %w", err)
+			}
+			defer file.Close()
+			if err := json.NewEncoder(file).Encode(entries); err != nil {
+				return fmt.Errorf("writing profile information: %w", err)
+			}
 		}
-		profdataFile.Close()
+		entries = moduleEntries(entries)
 
-		// Merge all raw profiles
-		mergedFile := filepath.Join(tempDir, fmt.Sprintf("merged%d.profdata", version))
-		args := []string{
-			"merge",
-			"--failure-mode=all",
-			"--sparse",
-			"--output", mergedFile,
-		}
-		if numThreads != 0 {
-			args = append(args, "--num-threads", strconv.Itoa(numThreads))
+		var profiles []string
+		if dryRun {
+			// Build IDs are not read when tools are not run, so partition every
+			// profile in the summary instead of only those with a known module.
+			profiles = summaryProfiles(summary)
+		} else {
+			for _, entry := range entries {
+				profiles = append(profiles, entry.Profile)
+			}
 		}
-		args = append(args, "@"+profdataFile.Name())
-		mergeCmd := Action{Path: partition.tool, Args: args}
-		data, err := mergeCmd.Run(ctx)
+		versions = readVersions(ctx, vf, profiles)
+		partitionProfiles(partitions, versions, profiles)
+		var dropped []string
+		mergedFile, dropped, err = mergePartitions(ctx, partitions, tempDir)
 		if err != nil {
-			return fmt.Errorf("%s failed with %v:\n%s", mergeCmd.String(), err, string(data))
+			return err
+		}
+		if len(dropped) > 0 {
+			logger.Warningf(ctx, "llvm-profdata dropped %d profiles: %s", len(dropped), strings.Join(dropped, ", "))
+			markDropped(dispositions, dropped)
 		}
-		profdataFiles = append(profdataFiles, mergedFile)
-	}
 
-	mergedFile := filepath.Join(tempDir, "merged.profdata")
-	args := []string{
-		"merge",
-		"--failure-mode=all",
-		"--sparse",
-		"--output", mergedFile,
-	}
-	if numThreads != 0 {
-		args = append(args, "--num-threads", strconv.Itoa(numThreads))
+		dispositionsFilename := filepath.Join(tempDir, profileDispositionsFilename)
+		if err := writeProfileDispositions(dispositionsFilename, dispositions); err != nil {
+			return fmt.Errorf("writing profile dispositions %q: %w", dispositionsFilename, err)
+		}
 	}
-	args = append(args, profdataFiles...)
-	mergeCmd := Action{Path: partitions[0].tool, Args: args}
-	data, err := mergeCmd.Run(ctx)
-	if err != nil {
-		return fmt.Errorf("%s failed with %v:\n%s", mergeCmd.String(), err, string(data))
+
+	if mergeOnly {
+		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
+			return fmt.Errorf("creating output dir %s: %w", outputDir, err)
+		}
+		// The merge commands are only recorded in a dry run.
+		if !dryRun {
+			dst := filepath.Join(outputDir, "merged.profdata")
+			if err := copyFile(mergedFile, dst); err != nil {
+				return fmt.Errorf("copying merged profile to %q: %w", dst, err)
+			}
+		}
+		return finishPlan(partitions, entries)
 	}
 
 	// Gather the set of modules and coverage files
 	modules := []symbolize.FileCloser{}
 	files := make(chan symbolize.FileCloser)
-	malformedModules := make(chan string)
+	malformedModules := make(chan malformedModule)
 	s := make(chan struct{}, jobs)
 	var wg sync.WaitGroup
 	for _, entry := range entries {
@@ -502,7 +1220,11 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 				if err != nil {
 					logger.Warningf(ctx, "module %s returned err %v:\n%s", module, err, string(data))
 					file.Close()
-					malformedModules <- module
+					malformedModules <- malformedModule{
+						BuildID: module,
+						Binary:  file.String(),
+						Stderr:  stderrSnippet(data),
+					}
 				} else {
 					files <- file
 				}
@@ -516,8 +1238,10 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 		close(malformedModules)
 		close(files)
 	}()
-	var malformed []string
+	var malformed []malformedModule
+	malformedDone := make(chan struct{})
 	go func() {
+		defer close(malformedDone)
 		for m := range malformedModules {
 			malformed = append(malformed, m)
 		}
@@ -527,10 +1251,26 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 		// Make sure we close all modules in the case of error
 		defer f.Close()
 	}
+	<-malformedDone
+	sort.Slice(malformed, func(i, j int) bool { return malformed[i].BuildID < malformed[j].BuildID })
+	var malformedIDs []string
+	for _, m := range malformed {
+		malformedIDs = append(malformedIDs, m.BuildID)
+	}
 
 	// Write the malformed modules to a file in order to keep track of the tests affected by fxbug.dev/74189.
-	if err := ioutil.WriteFile(filepath.Join(tempDir, "malformed_binaries.txt"), []byte(strings.Join(malformed, "\n")), os.ModePerm); err != nil {
-		return fmt.Errorf("failed to write malformed binaries to a file: %w", err)
+	if malformedText {
+		if err := ioutil.WriteFile(filepath.Join(tempDir, "malformed_binaries.txt"), []byte(strings.Join(malformedIDs, "\n")), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to write malformed binaries to a file: %w", err)
+		}
+	}
+	if malformedOutput != "" {
+		if err := writeMalformedModules(malformedOutput, malformed); err != nil {
+			return fmt.Errorf("writing malformed modules %q: %w", malformedOutput, err)
+		}
+	}
+	if err := checkMalformed(malformedIDs, maxMalformed); err != nil {
+		return err
 	}
 
 	// Make the llvm-cov response file
@@ -554,6 +1294,20 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 	}
 	covFile.Close()
 
+	if perTestDir != "" {
+		// Without build IDs there are no entries, so don't filter profiles.
+		var known map[string]struct{}
+		if !dryRun {
+			known = make(map[string]struct{})
+			for _, entry := range entries {
+				known[entry.Profile] = struct{}{}
+			}
+		}
+		if err := writePerTestCoverage(ctx, partitions, versions, tests, known, covFile.Name(), perTestDir); err != nil {
+			return err
+		}
+	}
+
 	if outputDir != "" {
 		// Make the output directory
 		err := os.MkdirAll(outputDir, os.ModePerm)
@@ -578,7 +1332,7 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 		showCmd := Action{Path: llvmCov, Args: args}
 		data, err := showCmd.Run(ctx)
 		if err != nil {
-			return fmt.Errorf("%v:\n%s", err, string(data))
+			return fmt.Errorf("%w:\n%s", err, string(data))
 		}
 		logger.Debugf(ctx, "%s\n", string(data))
 	}
@@ -598,67 +1352,454 @@ func process(ctx context.Context, repo symbolize.Repository) error {
 		defer stderrFile.Close()
 
 		// Export data in machine readable format.
-		var b bytes.Buffer
-		args := []string{
-			"export",
-			"-instr-profile", mergedFile,
-			"-skip-expansions",
-		}
-		if skipFunctions {
-			args = append(args, "-skip-functions")
-		}
-		for _, remapping := range pathRemapping {
-			args = append(args, "-path-equivalence", remapping)
-		}
-		args = append(args, "@"+covFile.Name())
-		cmd := exec.Command(llvmCov, args...)
-		cmd.Stdout = &b
-		cmd.Stderr = stderrFile
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to export: %w", err)
+		args := exportArgs(mergedFile, covFile.Name())
+		commands.record(Action{Path: llvmCov, Args: args})
+		if dryRun {
+			return finishPlan(partitions, entries)
 		}
 
+		// Stream the export straight to disk rather than buffering it in
+		// memory; it can be several gigabytes for a full build.
 		coverageFilename := filepath.Join(tempDir, "coverage.json")
-		if err := ioutil.WriteFile(coverageFilename, b.Bytes(), 0644); err != nil {
-			return fmt.Errorf("writing coverage %q: %w", coverageFilename, err)
+		coverageFile, err := os.Create(coverageFilename)
+		if err != nil {
+			return fmt.Errorf("creating coverage %q: %w", coverageFilename, err)
 		}
+		defer coverageFile.Close()
 
-		var export llvm.Export
-		if err := json.NewDecoder(&b).Decode(&export); err != nil {
-			return fmt.Errorf("failed to load the exported file: %w", err)
+		cmd := exec.CommandContext(ctx, llvmCov, args...)
+		cmd.Stdout = coverageFile
+		cmd.Stderr = stderrFile
+		if err := interruptedError(ctx, llvmCov, cmd.Run()); err != nil {
+			return fmt.Errorf("failed to export: %w", err)
+		}
+		if _, err := coverageFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("rewinding coverage %q: %w", coverageFilename, err)
 		}
 
 		var mapping *covargs.DiffMapping
 		if diffMappingFile != "" {
-			file, err := os.Open(diffMappingFile)
-			if err != nil {
-				return fmt.Errorf("cannot open %q: %w", diffMappingFile, err)
+			if mapping, err = readDiffMapping(diffMappingFile); err != nil {
+				return fmt.Errorf("failed to load the diff mapping file: %w", err)
 			}
-			defer file.Close()
+		}
 
-			if err := json.NewDecoder(file).Decode(mapping); err != nil {
-				return fmt.Errorf("failed to load the diff mapping file: %w", err)
+		var excludePrefixes []string
+		if excludePrefixFile != "" {
+			if excludePrefixes, err = covargs.ReadPathPrefixes(excludePrefixFile); err != nil {
+				return fmt.Errorf("failed to load the exclude prefix file: %w", err)
 			}
 		}
 
-		files, err := covargs.ConvertFiles(&export, basePath, mapping)
+		var originalPaths map[string]string
+		if keepOriginalPaths {
+			originalPaths = make(map[string]string)
+		}
+
+		files, err := covargs.ConvertExport(coverageFile, basePath, mapping, excludePrefixes, originalPaths)
 		if err != nil {
 			return fmt.Errorf("failed to convert files: %w", err)
 		}
 
-		if _, err := covargs.SaveReport(files, shardSize, reportDir); err != nil {
+		report, err := covargs.SaveReport(files, shardSize, jobs, reportDir)
+		if err != nil {
 			return fmt.Errorf("failed to save report: %w", err)
 		}
+
+		if keepOriginalPaths {
+			if err := covargs.SaveOriginalPaths(originalPaths, reportDir); err != nil {
+				return fmt.Errorf("failed to save original paths: %w", err)
+			}
+		}
+
+		if badgeOutput != "" {
+			badge := covargs.LineCoverageBadge(report.Summaries, covargs.BadgeThresholds{Green: badgeGreen, Yellow: badgeYellow})
+			if err := covargs.WriteBadge(badgeOutput, badge); err != nil {
+				return fmt.Errorf("writing badge %q: %w", badgeOutput, err)
+			}
+		}
+
+		if lcovOutput != "" {
+			if _, err := coverageFile.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("rewinding coverage %q: %w", coverageFilename, err)
+			}
+			if err := writeLCOV(coverageFile, lcovOutput); err != nil {
+				return err
+			}
+		}
+	}
+
+	return finishPlan(partitions, entries)
+}
+
+// writeLCOV converts the LLVM coverage export read from r to an lcov
+// tracefile at path.
+func writeLCOV(r io.Reader, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating lcov output %q: %w", path, err)
+	}
+	defer f.Close()
+	if err := covargs.WriteLCOV(r, f); err != nil {
+		return fmt.Errorf("writing lcov output %q: %w", path, err)
 	}
+	return f.Close()
+}
 
+// readDiffMapping reads the diff mapping file at path, which may be
+// compressed with gzip.
+func readDiffMapping(path string) (*covargs.DiffMapping, error) {
+	file, err := openDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mapping := &covargs.DiffMapping{}
+	if err := json.NewDecoder(file).Decode(mapping); err != nil {
+		return nil, fmt.Errorf("cannot decode %q: %w", path, err)
+	}
+	return mapping, nil
+}
+
+// copyFile copies the contents of the file at src to a new file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// readVersions returns the version of each profile, leaving out those whose
+// version cannot be read.
+func readVersions(ctx context.Context, vf *versionFetcher, profiles []string) map[string]uint64 {
+	versions := make(map[string]uint64, len(profiles))
+	for _, profile := range profiles {
+		version, err := vf.getVersion(profile)
+		if err != nil {
+			// TODO(fxbug.dev/83504): Known issue causes occasional failures on host tests.
+			// Once resolved, return error below.
+			logger.Warningf(ctx, "cannot read version from profile %q: %w", profile, err)
+			continue
+		}
+		versions[profile] = version
+	}
+	return versions
+}
+
+// partitionProfiles adds each profile to the partition for its version in
+// versions, falling back to the default partition. Profiles without a version
+// are left out.
+func partitionProfiles(partitions map[uint64]*partition, versions map[string]uint64, profiles []string) {
+	for _, profile := range profiles {
+		version, ok := versions[profile]
+		if !ok {
+			continue
+		}
+		partition, ok := partitions[version]
+		if !ok {
+			partition = partitions[0]
+		}
+		partition.profiles = append(partition.profiles, profile)
+	}
+}
+
+// markDropped marks the dispositions of the dropped profiles as skipped.
+func markDropped(dispositions []profileDisposition, dropped []string) {
+	set := make(map[string]struct{}, len(dropped))
+	for _, profile := range dropped {
+		set[profile] = struct{}{}
+	}
+	for i := range dispositions {
+		d := &dispositions[i]
+		if _, ok := set[d.Profile]; ok && !d.Skipped {
+			d.Skipped = true
+			d.Partition = nil
+			d.Reason = fmt.Sprintf("dropped by llvm-profdata merge with --failure-mode=%s", failureMode)
+		}
+	}
+}
+
+// mergeArgs returns the arguments to llvm-profdata to merge profiles into
+// mergedFile, without the profiles themselves.
+func mergeArgs(mergedFile string) []string {
+	args := []string{
+		"merge",
+		"--failure-mode=" + failureMode,
+		"--sparse",
+		"--output", mergedFile,
+	}
+	if numThreads != 0 {
+		args = append(args, "--num-threads", strconv.Itoa(numThreads))
+	}
+	return args
+}
+
+// mergeOutOfMemoryMessages are the messages printed by llvm-profdata when it
+// runs out of memory.
+var mergeOutOfMemoryMessages = []string{
+	"out of memory",
+	"Cannot allocate memory",
+	"std::bad_alloc",
+}
+
+// isRetryableMergeFailure returns whether the merge that failed with err and
+// printed output ran out of memory, either failing to allocate or being
+// killed, so that it might succeed when run again.
+func isRetryableMergeFailure(err error, output []byte) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGKILL {
+		return true
+	}
+	for _, msg := range mergeOutOfMemoryMessages {
+		if bytes.Contains(output, []byte(msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// runMerge runs the llvm-profdata merge a, running it again up to
+// mergeAttempts times in total if it fails for lack of memory. It returns the
+// output of the last attempt.
+func runMerge(ctx context.Context, a Action) ([]byte, error) {
+	attempts := mergeAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var data []byte
+	var err error
+	attempt := 0
+	if rerr := retry.Retry(ctx, retry.WithMaxAttempts(retry.NewConstantBackoff(mergeRetryBackoff), uint64(attempts)), func() error {
+		attempt++
+		data, err = a.Run(ctx)
+		if err != nil && isRetryableMergeFailure(err, data) {
+			logger.Warningf(ctx, "%s failed with %v on attempt %d of %d:\n%s", a.String(), err, attempt, attempts, string(data))
+			return err
+		}
+		return nil
+	}, nil); rerr != nil && err == nil {
+		err = rerr
+	}
+	if err != nil && attempt > 1 {
+		err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+	}
+	return data, err
+}
+
+// mergePartitions merges the raw profiles of each partition with its tool,
+// then merges the partial results into merged.profdata in dir, returning its
+// path. It also returns the raw profiles that llvm-profdata dropped, which can
+// only happen if the failure mode is not all.
+func mergePartitions(ctx context.Context, partitions map[uint64]*partition, dir string) (string, []string, error) {
+	var dropped []string
+	profdataFiles := []string{}
+	for version, partition := range partitions {
+		if len(partition.profiles) == 0 {
+			continue
+		}
+
+		// Make the llvm-profdata response file
+		profdataFile, err := os.Create(filepath.Join(dir, "llvm-profdata.rsp"))
+		if err != nil {
+			return "", nil, fmt.Errorf("creating llvm-profdata.rsp file: %w", err)
+		}
+
+		for _, profile := range partition.profiles {
+			fmt.Fprintf(profdataFile, "%s\n", profile)
+		}
+		profdataFile.Close()
+
+		// Merge all raw profiles
+		mergedFile := filepath.Join(dir, fmt.Sprintf("merged%d.profdata", version))
+		args := append(mergeArgs(mergedFile), "@"+profdataFile.Name())
+		mergeCmd := Action{Path: partition.tool, Args: args}
+		data, err := runMerge(ctx, mergeCmd)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s failed with %w:\n%s", mergeCmd.String(), err, string(data))
+		}
+		if failureMode != "all" {
+			dropped = append(dropped, droppedProfiles(data, partition.profiles)...)
+		}
+		profdataFiles = append(profdataFiles, mergedFile)
+	}
+
+	mergedFile := filepath.Join(dir, "merged.profdata")
+	args := append(mergeArgs(mergedFile), profdataFiles...)
+	mergeCmd := Action{Path: partitions[0].tool, Args: args}
+	data, err := runMerge(ctx, mergeCmd)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s failed with %w:\n%s", mergeCmd.String(), err, string(data))
+	}
+	sort.Strings(dropped)
+	return mergedFile, dropped, nil
+}
+
+// perTestIndexFilename is the name of the file in -per-test-dir mapping each
+// test to the subdirectory holding its coverage.
+const perTestIndexFilename = "tests.json"
+
+// writePerTestCoverage merges the profiles of each test on its own and exports
+// its coverage of the modules listed in covFilename, writing the results to a
+// subdirectory of dir per test. Profiles are partitioned by their version in
+// versions. If known is non-nil, profiles not in it are ignored.
+func writePerTestCoverage(ctx context.Context, tools map[uint64]*partition, versions map[string]uint64, tests testProfiles, known map[string]struct{}, covFilename, dir string) error {
+	var names []string
+	for name := range tests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	index := make(map[string]string)
+	for i, name := range names {
+		var profiles []string
+		for _, profile := range tests[name] {
+			if _, ok := known[profile]; known == nil || ok {
+				profiles = append(profiles, profile)
+			}
+		}
+		if len(profiles) == 0 {
+			continue
+		}
+
+		// Test names are arbitrary strings, so number the directories instead.
+		subdir := fmt.Sprintf("test%d", i)
+		testDir := filepath.Join(dir, subdir)
+		if err := os.MkdirAll(testDir, os.ModePerm); err != nil {
+			return fmt.Errorf("creating per-test dir %s: %w", testDir, err)
+		}
+
+		partitions := make(map[uint64]*partition)
+		for version, p := range tools {
+			partitions[version] = &partition{tool: p.tool}
+		}
+		partitionProfiles(partitions, versions, profiles)
+		mergedFile, _, err := mergePartitions(ctx, partitions, testDir)
+		if err != nil {
+			return fmt.Errorf("merging profiles of test %q: %w", name, err)
+		}
+		if err := exportCoverage(ctx, mergedFile, covFilename, testDir); err != nil {
+			return fmt.Errorf("exporting coverage of test %q: %w", name, err)
+		}
+		index[name] = subdir
+	}
+
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, perTestIndexFilename), b, 0644)
+}
+
+// exportCoverage exports the coverage of the modules listed in covFilename
+// under the profile in mergedFile to coverage.json in dir.
+func exportCoverage(ctx context.Context, mergedFile, covFilename, dir string) error {
+	args := exportArgs(mergedFile, covFilename)
+	commands.record(Action{Path: llvmCov, Args: args})
+	if dryRun {
+		return nil
+	}
+
+	stderrFilename := filepath.Join(dir, "llvm-cov.stderr.log")
+	stderrFile, err := os.Create(stderrFilename)
+	if err != nil {
+		return fmt.Errorf("creating export %q: %w", stderrFilename, err)
+	}
+	defer stderrFile.Close()
+
+	coverageFilename := filepath.Join(dir, "coverage.json")
+	coverageFile, err := os.Create(coverageFilename)
+	if err != nil {
+		return fmt.Errorf("creating coverage %q: %w", coverageFilename, err)
+	}
+	defer coverageFile.Close()
+
+	cmd := exec.CommandContext(ctx, llvmCov, args...)
+	cmd.Stdout = coverageFile
+	cmd.Stderr = stderrFile
+	if err := interruptedError(ctx, llvmCov, cmd.Run()); err != nil {
+		return fmt.Errorf("failed to export: %w", err)
+	}
+	return coverageFile.Close()
+}
+
+// exportArgs returns the llvm-cov arguments used to export the coverage of
+// the binaries listed in covFilename from the profile in mergedFile.
+func exportArgs(mergedFile, covFilename string) []string {
+	args := []string{
+		"export",
+		"-instr-profile", mergedFile,
+	}
+	if skipExpansions {
+		args = append(args, "-skip-expansions")
+	}
+	if skipFunctions {
+		args = append(args, "-skip-functions")
+	}
+	if skipRegions {
+		args = append(args, "-skip-regions")
+	}
+	for _, remapping := range pathRemapping {
+		args = append(args, "-path-equivalence", remapping)
+	}
+	return append(args, "@"+covFilename)
+}
+
+// finishPlan writes the plan to planOutput, if set.
+func finishPlan(partitions map[uint64]*partition, entries []profileEntry) error {
+	if planOutput == "" {
+		return nil
+	}
+	if err := writePlan(planOutput, makePlan(partitions, entries)); err != nil {
+		return fmt.Errorf("writing plan %q: %w", planOutput, err)
+	}
 	return nil
 }
 
+// newTokenHTTPClient returns an HTTP client that sends requests through base,
+// authenticated with the OAuth2 access token stored in tokenFile.
+func newTokenHTTPClient(tokenFile string, base http.RoundTripper) (*http.Client, error) {
+	b, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCS token file: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return nil, fmt.Errorf("GCS token file %q is empty", tokenFile)
+	}
+	return &http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+			Base:   base,
+		},
+	}, nil
+}
+
 func main() {
 	flag.Parse()
+	if planOutput != "" {
+		dryRun = true
+	}
 
 	log := logger.NewLogger(level, color.NewColor(colors), os.Stdout, os.Stderr, "")
 	ctx := logger.WithLogger(context.Background(), log)
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
 
 	var repo symbolize.CompositeRepo
 	for _, dir := range buildIDDirPaths {
@@ -674,12 +1815,20 @@ func main() {
 			log.Fatalf("%v\n", err)
 		}
 	}
+	var cloudRepoOpts []option.ClientOption
+	if len(symbolServers) > 0 && gcsTokenFile != "" {
+		client, err := newTokenHTTPClient(gcsTokenFile, http.DefaultTransport)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		cloudRepoOpts = append(cloudRepoOpts, option.WithHTTPClient(client))
+	}
 	for _, symbolServer := range symbolServers {
 		// TODO(atyfto): Remove when all consumers are passing GCS URLs.
 		if !strings.HasPrefix(symbolServer, "gs://") {
 			symbolServer = "gs://" + symbolServer
 		}
-		cloudRepo, err := symbolize.NewCloudRepo(ctx, symbolServer, fileCache)
+		cloudRepo, err := symbolize.NewCloudRepo(ctx, symbolServer, fileCache, cloudRepoOpts...)
 		if err != nil {
 			log.Fatalf("%v\n", err)
 		}
@@ -688,7 +1837,11 @@ func main() {
 	}
 
 	if err := process(ctx, &repo); err != nil {
-		log.Errorf("%v\n", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Errorf("covargs did not finish within the deadline of %s: %v\n", deadline, err)
+		} else {
+			log.Errorf("%v\n", err)
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,1245 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/api/option"
+
+	"go.fuchsia.dev/fuchsia/tools/debug/covargs"
+	"go.fuchsia.dev/fuchsia/tools/debug/symbolize"
+	"go.fuchsia.dev/fuchsia/tools/lib/cache"
+	"go.fuchsia.dev/fuchsia/tools/testing/runtests"
+)
+
+func TestCheckMalformed(t *testing.T) {
+	malformed := []string{"0123", "4567", "89ab"}
+	tests := []struct {
+		name    string
+		max     int
+		wantErr bool
+	}{
+		{name: "disabled", max: -1},
+		{name: "above count", max: 4},
+		{name: "at count", max: 3},
+		{name: "exceeded", max: 2, wantErr: true},
+		{name: "none allowed", max: 0, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkMalformed(malformed, test.max)
+			if (err != nil) != test.wantErr {
+				t.Errorf("checkMalformed(%q, %d) = %v, wantErr = %t", malformed, test.max, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteMalformedModules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "malformed.json")
+	long := strings.Repeat("x", maxStderrSnippet) + "error: malformed coverage data"
+	modules := []malformedModule{
+		{BuildID: "0123", Binary: "/build-id/01/23.debug", Stderr: stderrSnippet([]byte("error: no coverage data"))},
+		{BuildID: "4567", Binary: "/build-id/45/67.debug", Stderr: stderrSnippet([]byte(long))},
+	}
+	if err := writeMalformedModules(path, modules); err != nil {
+		t.Fatalf("writeMalformedModules failed: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []malformedModule
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to decode %q: %s", path, err)
+	}
+	want := []malformedModule{
+		modules[0],
+		{BuildID: "4567", Binary: "/build-id/45/67.debug", Stderr: long[len(long)-maxStderrSnippet:]},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected malformed modules (-want +got):\n%s", diff)
+	}
+
+	// No malformed modules is an empty array rather than null.
+	if err := writeMalformedModules(path, nil); err != nil {
+		t.Fatalf("writeMalformedModules failed: %s", err)
+	}
+	if b, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != "[]" {
+		t.Errorf("got %q, want []", got)
+	}
+}
+
+func TestProcessWritesCommands(t *testing.T) {
+	tempDir := t.TempDir()
+	defer func(dryRunOld bool, llvmProfdataOld []string, saveTempsOld, outputDirOld string) {
+		dryRun = dryRunOld
+		llvmProfdata = llvmProfdataOld
+		saveTemps = saveTempsOld
+		outputDir = outputDirOld
+		commands = commandLog{}
+	}(dryRun, llvmProfdata, saveTemps, outputDir)
+	dryRun = true
+	llvmProfdata = []string{"llvm-profdata"}
+	saveTemps = tempDir
+	outputDir = filepath.Join(tempDir, "out")
+
+	if err := process(context.Background(), &symbolize.CompositeRepo{}); err != nil {
+		t.Fatalf("process failed: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(tempDir, "commands.txt"))
+	if err != nil {
+		t.Fatalf("failed to read commands: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d commands, want 2:\n%s", len(lines), b)
+	}
+	if want := "llvm-profdata merge "; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("got first command %q, want prefix %q", lines[0], want)
+	}
+	if want := "llvm-cov show "; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("got second command %q, want prefix %q", lines[1], want)
+	}
+}
+
+func TestProcessFailureMode(t *testing.T) {
+	tempDir := t.TempDir()
+	defer func(dryRunOld bool, llvmProfdataOld []string, saveTempsOld, outputDirOld, failureModeOld string) {
+		dryRun = dryRunOld
+		llvmProfdata = llvmProfdataOld
+		saveTemps = saveTempsOld
+		outputDir = outputDirOld
+		failureMode = failureModeOld
+		commands = commandLog{}
+	}(dryRun, llvmProfdata, saveTemps, outputDir, failureMode)
+	dryRun = true
+	llvmProfdata = []string{"llvm-profdata"}
+	saveTemps = tempDir
+	outputDir = filepath.Join(tempDir, "out")
+
+	failureMode = "bogus"
+	if err := process(context.Background(), &symbolize.CompositeRepo{}); err == nil {
+		t.Errorf("process succeeded with failure mode %q, want error", failureMode)
+	}
+
+	failureMode = "warn"
+	if err := process(context.Background(), &symbolize.CompositeRepo{}); err != nil {
+		t.Fatalf("process failed: %s", err)
+	}
+	var merges int
+	for _, a := range commands.actions() {
+		if len(a.Args) == 0 || a.Args[0] != "merge" {
+			continue
+		}
+		merges++
+		if !contains(a.Args, "--failure-mode=warn") {
+			t.Errorf("got merge command %q, want it to include --failure-mode=warn", a.String())
+		}
+	}
+	if merges == 0 {
+		t.Errorf("got no merge commands, want at least one")
+	}
+}
+
+func TestDroppedProfiles(t *testing.T) {
+	profiles := []string{"/out/a.profraw", "/out/b.profraw", "/out/c.profraw"}
+	output := []byte(`warning: /out/c.profraw: invalid instrumentation profile data (file header is corrupt)
+warning: /out/a.profraw: empty raw profile file
+warning: /out/a.profraw: empty raw profile file
+warning: /out/unknown.profraw: empty raw profile file
+error: no profile can be merged
+`)
+	want := []string{"/out/a.profraw", "/out/c.profraw"}
+	if diff := cmp.Diff(want, droppedProfiles(output, profiles)); diff != "" {
+		t.Errorf("droppedProfiles mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExportArgs(t *testing.T) {
+	defer func(skipExpansionsOld, skipFunctionsOld, skipRegionsOld bool) {
+		skipExpansions = skipExpansionsOld
+		skipFunctions = skipFunctionsOld
+		skipRegions = skipRegionsOld
+	}(skipExpansions, skipFunctions, skipRegions)
+
+	for _, tc := range []struct {
+		name                                       string
+		skipExpansions, skipFunctions, skipRegions bool
+		want                                       []string
+	}{
+		{
+			name:           "defaults",
+			skipExpansions: true,
+			skipFunctions:  true,
+			want:           []string{"export", "-instr-profile", "merged.profdata", "-skip-expansions", "-skip-functions", "@cov.txt"},
+		},
+		{
+			name: "none",
+			want: []string{"export", "-instr-profile", "merged.profdata", "@cov.txt"},
+		},
+		{
+			name:           "expansions",
+			skipExpansions: true,
+			want:           []string{"export", "-instr-profile", "merged.profdata", "-skip-expansions", "@cov.txt"},
+		},
+		{
+			name:          "functions",
+			skipFunctions: true,
+			want:          []string{"export", "-instr-profile", "merged.profdata", "-skip-functions", "@cov.txt"},
+		},
+		{
+			name:        "regions",
+			skipRegions: true,
+			want:        []string{"export", "-instr-profile", "merged.profdata", "-skip-regions", "@cov.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			skipExpansions = tc.skipExpansions
+			skipFunctions = tc.skipFunctions
+			skipRegions = tc.skipRegions
+			if diff := cmp.Diff(tc.want, exportArgs("merged.profdata", "cov.txt")); diff != "" {
+				t.Errorf("exportArgs() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessWritesPlan(t *testing.T) {
+	tempDir := t.TempDir()
+	defer func(dryRunOld bool, llvmProfdataOld, summaryFileOld []string, saveTempsOld, planOutputOld string) {
+		dryRun = dryRunOld
+		llvmProfdata = llvmProfdataOld
+		summaryFile = summaryFileOld
+		saveTemps = saveTempsOld
+		planOutput = planOutputOld
+		commands = commandLog{}
+	}(dryRun, llvmProfdata, summaryFile, saveTemps, planOutput)
+
+	// Write two raw profiles of different versions, referenced by a summary.
+	profiles := map[string]uint64{
+		"v5.profraw": 5,
+		"v7.profraw": 7,
+	}
+	var summary runtests.TestSummary
+	for name, version := range profiles {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, []uint64{instrProfRawMagic, version}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tempDir, name), buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		summary.Tests = append(summary.Tests, runtests.TestDetails{
+			Name: name,
+			DataSinks: runtests.DataSinkMap{
+				llvmProfileSinkType: {{Name: name, File: name}},
+			},
+		})
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaryPath := filepath.Join(tempDir, "summary.json")
+	if err := ioutil.WriteFile(summaryPath, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dryRun = true
+	llvmProfdata = []string{"llvm-profdata", "llvm-profdata-7=7"}
+	summaryFile = []string{summaryPath}
+	saveTemps = tempDir
+	planOutput = filepath.Join(tempDir, "plan.json")
+
+	if err := process(context.Background(), &symbolize.CompositeRepo{}); err != nil {
+		t.Fatalf("process failed: %s", err)
+	}
+
+	b, err = ioutil.ReadFile(planOutput)
+	if err != nil {
+		t.Fatalf("failed to read plan: %s", err)
+	}
+	var got plan
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to decode plan: %s", err)
+	}
+
+	want := []partitionPlan{
+		{
+			Version:      0,
+			Tool:         "llvm-profdata",
+			ProfileCount: 1,
+			Profiles:     []string{filepath.Join(tempDir, "v5.profraw")},
+		},
+		{
+			Version:      7,
+			Tool:         "llvm-profdata-7",
+			ProfileCount: 1,
+			Profiles:     []string{filepath.Join(tempDir, "v7.profraw")},
+		},
+	}
+	if diff := cmp.Diff(want, got.Partitions); diff != "" {
+		t.Errorf("plan partitions mismatch (-want +got):\n%s", diff)
+	}
+
+	// Each partition is merged, then the partial results are merged together.
+	var merges []string
+	for _, command := range got.Commands {
+		if len(command.Args) > 0 && command.Args[0] == "merge" {
+			merges = append(merges, command.Path)
+		}
+	}
+	if diff := cmp.Diff([]string{"llvm-profdata", "llvm-profdata-7", "llvm-profdata"}, merges, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("planned merge commands mismatch (-want +got):\n%s", diff)
+	}
+
+	// The plan is read by other tools, so its keys are part of its format.
+	var (
+		rawPlan       map[string]json.RawMessage
+		rawPartitions []map[string]json.RawMessage
+		rawCommands   []map[string]json.RawMessage
+	)
+	if err := json.Unmarshal(b, &rawPlan); err != nil {
+		t.Fatalf("failed to decode plan: %s", err)
+	}
+	if err := json.Unmarshal(rawPlan["partitions"], &rawPartitions); err != nil {
+		t.Fatalf("failed to decode plan partitions: %s", err)
+	}
+	if err := json.Unmarshal(rawPlan["commands"], &rawCommands); err != nil {
+		t.Fatalf("failed to decode plan commands: %s", err)
+	}
+	for _, keys := range []struct {
+		name string
+		got  map[string]json.RawMessage
+		want []string
+	}{
+		{name: "plan", got: rawPlan, want: []string{"commands", "entries", "modules", "partitions"}},
+		{name: "partition", got: rawPartitions[0], want: []string{"profile_count", "profiles", "tool", "version"}},
+		{name: "command", got: rawCommands[0], want: []string{"args", "cmd"}},
+	} {
+		var got []string
+		for key := range keys.got {
+			got = append(got, key)
+		}
+		if diff := cmp.Diff(keys.want, got, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+			t.Errorf("%s keys mismatch (-want +got):\n%s", keys.name, diff)
+		}
+	}
+}
+
+func TestProcessReuseMerged(t *testing.T) {
+	tempDir := t.TempDir()
+	defer func(dryRunOld bool, llvmProfdataOld []string, saveTempsOld, outputDirOld, jsonOutputOld, reuseMergedOld string) {
+		dryRun = dryRunOld
+		llvmProfdata = llvmProfdataOld
+		saveTemps = saveTempsOld
+		outputDir = outputDirOld
+		jsonOutput = jsonOutputOld
+		reuseMerged = reuseMergedOld
+		commands = commandLog{}
+	}(dryRun, llvmProfdata, saveTemps, outputDir, jsonOutput, reuseMerged)
+
+	writeProfile := func(name string, header ...uint64) string {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(tempDir, name)
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	merged := writeProfile("merged.profdata", indexedProfMagic, 8)
+	entries := filepath.Join(tempDir, "entries.json")
+	if err := ioutil.WriteFile(entries, []byte("[]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dryRun = true
+	llvmProfdata = []string{"llvm-profdata"}
+	saveTemps = tempDir
+	outputDir = filepath.Join(tempDir, "out")
+	jsonOutput = entries
+	reuseMerged = merged
+
+	if err := process(context.Background(), &symbolize.CompositeRepo{}); err != nil {
+		t.Fatalf("process failed: %s", err)
+	}
+	var shows int
+	for _, a := range commands.actions() {
+		if len(a.Args) == 0 {
+			continue
+		}
+		switch a.Args[0] {
+		case "merge":
+			t.Errorf("got merge command %q, want none", a.String())
+		case "show":
+			shows++
+			if !contains(a.Args, merged) {
+				t.Errorf("got show command %q, want it to use %s", a.String(), merged)
+			}
+		}
+	}
+	if shows != 1 {
+		t.Errorf("got %d show commands, want 1", shows)
+	}
+
+	for _, header := range [][]uint64{
+		// A raw profile rather than an indexed one.
+		{instrProfRawMagic, 8},
+		// An indexed profile without a version.
+		{indexedProfMagic, 0},
+		// A truncated header.
+		{indexedProfMagic},
+	} {
+		reuseMerged = writeProfile("invalid.profdata", header...)
+		if err := process(context.Background(), &symbolize.CompositeRepo{}); err == nil {
+			t.Errorf("process succeeded reusing a profile with header %x, want error", header)
+		}
+	}
+}
+
+func TestProcessMergeOnly(t *testing.T) {
+	tempDir := t.TempDir()
+	defer func(llvmProfdataOld []string, saveTempsOld, outputDirOld, jsonOutputOld string, mergeOnlyOld bool) {
+		llvmProfdata = llvmProfdataOld
+		saveTemps = saveTempsOld
+		outputDir = outputDirOld
+		jsonOutput = jsonOutputOld
+		mergeOnly = mergeOnlyOld
+		commands = commandLog{}
+	}(llvmProfdata, saveTemps, outputDir, jsonOutput, mergeOnly)
+
+	// A stand-in for llvm-profdata which writes its --output argument.
+	tool := filepath.Join(tempDir, "llvm-profdata")
+	script := `#!/bin/sh
+while [ $# -gt 0 ]; do
+  if [ "$1" = --output ]; then echo merged > "$2"; fi
+  shift
+done
+`
+	if err := ioutil.WriteFile(tool, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	llvmProfdata = []string{tool}
+	saveTemps = filepath.Join(tempDir, "temps")
+	if err := os.Mkdir(saveTemps, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	outputDir = filepath.Join(tempDir, "out")
+	jsonOutput = filepath.Join(tempDir, "entries.json")
+	mergeOnly = true
+
+	if err := process(context.Background(), &symbolize.CompositeRepo{}); err != nil {
+		t.Fatalf("process failed: %s", err)
+	}
+	for _, a := range commands.actions() {
+		if a.Path == llvmCov {
+			t.Errorf("got llvm-cov command %q, want none", a.String())
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(outputDir, "merged.profdata"))
+	if err != nil {
+		t.Fatalf("failed to read merged profile: %s", err)
+	}
+	if got, want := string(b), "merged\n"; got != want {
+		t.Errorf("got merged profile %q, want %q", got, want)
+	}
+	if _, err := readProfileEntries(jsonOutput); err != nil {
+		t.Errorf("failed to read JSON output: %s", err)
+	}
+}
+
+func TestRunMerge(t *testing.T) {
+	defer func(mergeAttemptsOld int) {
+		mergeAttempts = mergeAttemptsOld
+		commands = commandLog{}
+	}(mergeAttempts)
+	mergeAttempts = 3
+
+	tests := []struct {
+		name string
+		// message is printed by every failing attempt.
+		message string
+		// failures is the number of attempts that fail before one succeeds.
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "success", wantAttempts: 1},
+		{name: "out of memory once", message: "LLVM ERROR: out of memory", failures: 1, wantAttempts: 2},
+		{name: "out of memory always", message: "LLVM ERROR: out of memory", failures: 3, wantAttempts: 3, wantErr: true},
+		{name: "malformed profile", message: "error: default.profraw: malformed instrumentation profile data", failures: 1, wantAttempts: 1, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// A stand-in for llvm-profdata which counts its runs and fails the
+			// first failures of them.
+			tool := filepath.Join(dir, "llvm-profdata")
+			count := filepath.Join(dir, "count")
+			script := fmt.Sprintf(`#!/bin/sh
+echo run >> %s
+if [ $(wc -l < %s) -le %d ]; then echo %q >&2; exit 1; fi
+`, count, count, tc.failures, tc.message)
+			if err := ioutil.WriteFile(tool, []byte(script), 0o700); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := runMerge(context.Background(), Action{Path: tool})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("got runMerge error %v, want error %t", err, tc.wantErr)
+			}
+			if tc.wantErr && !strings.Contains(string(data), tc.message) {
+				t.Errorf("got output %q, want it to contain %q", data, tc.message)
+			}
+			b, err := ioutil.ReadFile(count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(b), "run"); got != tc.wantAttempts {
+				t.Errorf("got %d attempts, want %d", got, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestProcessPerTestDir(t *testing.T) {
+	tempDir := t.TempDir()
+	defer func(dryRunOld bool, llvmProfdataOld, summaryFileOld []string, saveTempsOld, perTestDirOld string) {
+		dryRun = dryRunOld
+		llvmProfdata = llvmProfdataOld
+		summaryFile = summaryFileOld
+		saveTemps = saveTempsOld
+		perTestDir = perTestDirOld
+		commands = commandLog{}
+	}(dryRun, llvmProfdata, summaryFile, saveTemps, perTestDir)
+
+	// Two tests, each contributing its own raw profile.
+	testNames := []string{"test-a", "test-b"}
+	var summary runtests.TestSummary
+	for _, name := range testNames {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, []uint64{instrProfRawMagic, 7}); err != nil {
+			t.Fatal(err)
+		}
+		profile := name + ".profraw"
+		if err := ioutil.WriteFile(filepath.Join(tempDir, profile), buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		summary.Tests = append(summary.Tests, runtests.TestDetails{
+			Name: name,
+			DataSinks: runtests.DataSinkMap{
+				llvmProfileSinkType: {{Name: profile, File: profile}},
+			},
+		})
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaryPath := filepath.Join(tempDir, "summary.json")
+	if err := ioutil.WriteFile(summaryPath, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dryRun = true
+	llvmProfdata = []string{"llvm-profdata"}
+	summaryFile = []string{summaryPath}
+	saveTemps = tempDir
+	perTestDir = filepath.Join(tempDir, "per-test")
+
+	if err := process(context.Background(), &symbolize.CompositeRepo{}); err != nil {
+		t.Fatalf("process failed: %s", err)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(perTestDir, perTestIndexFilename))
+	if err != nil {
+		t.Fatalf("failed to read per-test index: %s", err)
+	}
+	var index map[string]string
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatalf("failed to decode per-test index: %s", err)
+	}
+	if len(index) != len(testNames) {
+		t.Fatalf("got per-test index %v, want an entry for each of %v", index, testNames)
+	}
+
+	var exports []string
+	for _, command := range commands.actions() {
+		if len(command.Args) > 0 && command.Args[0] == "export" {
+			exports = append(exports, command.Args[2])
+		}
+	}
+	var wantExports []string
+	for _, name := range testNames {
+		subdir, ok := index[name]
+		if !ok {
+			t.Errorf("test %q missing from per-test index %v", name, index)
+			continue
+		}
+		testDir := filepath.Join(perTestDir, subdir)
+		rsp, err := ioutil.ReadFile(filepath.Join(testDir, "llvm-profdata.rsp"))
+		if err != nil {
+			t.Errorf("failed to read response file of test %q: %s", name, err)
+			continue
+		}
+		if got, want := strings.TrimSpace(string(rsp)), filepath.Join(tempDir, name+".profraw"); got != want {
+			t.Errorf("got profiles %q merged for test %q, want %q", got, name, want)
+		}
+		wantExports = append(wantExports, filepath.Join(testDir, "merged.profdata"))
+	}
+	if diff := cmp.Diff(wantExports, exports, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("exported profiles mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestActionRunDeadline(t *testing.T) {
+	defer func() { commands = commandLog{} }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Action{Path: "sleep", Args: []string{"60"}}.Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got Run error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Run returned after %s, want the command to be killed at the deadline", elapsed)
+	}
+}
+
+func TestExportCoverageDeadline(t *testing.T) {
+	defer func(llvmCovOld string) {
+		llvmCov = llvmCovOld
+		commands = commandLog{}
+	}(llvmCov)
+
+	dir := t.TempDir()
+	// A stand-in for llvm-cov which hangs.
+	llvmCov = filepath.Join(dir, "llvm-cov")
+	if err := ioutil.WriteFile(llvmCov, []byte("#!/bin/sh\nexec sleep 60\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := exportCoverage(ctx, filepath.Join(dir, "merged.profdata"), filepath.Join(dir, "cov.rsp"), dir)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got exportCoverage error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("exportCoverage returned after %s, want llvm-cov to be killed at the deadline", elapsed)
+	}
+}
+
+func TestMergeEntriesCanceled(t *testing.T) {
+	defer func() { commands = commandLog{} }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	summary := runtests.DataSinkMap{
+		llvmProfileSinkType: {{Name: "test", File: filepath.Join(t.TempDir(), "test.profraw")}},
+	}
+	partitions := map[uint64]*partition{0: {tool: "llvm-profdata"}}
+	if _, _, err := mergeEntries(ctx, newVersionFetcher([]uint64{instrProfRawMagic}), summary, partitions); !errors.Is(err, context.Canceled) {
+		t.Errorf("got mergeEntries error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMergeEntriesDispositions(t *testing.T) {
+	tempDir := t.TempDir()
+	defer func() { commands = commandLog{} }()
+
+	// The fake llvm-profdata reports a build ID for every profile except
+	// those named "nobuildid".
+	tool := filepath.Join(tempDir, "llvm-profdata")
+	script := `#!/bin/sh
+case "$3" in
+*nobuildid*) echo "malformed profile" >&2; exit 1;;
+esac
+printf 'Binary IDs:\n0123abcd\n'
+`
+	if err := ioutil.WriteFile(tool, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	writeProfile := func(name string, magic, version uint64) string {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, []uint64{magic, version}); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(tempDir, name)
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := writeProfile("good.profraw", instrProfRawMagic, 7)
+	fallback := writeProfile("fallback.profraw", instrProfRawMagic, 8)
+	badMagic := writeProfile("badmagic.profraw", 0x1234, 7)
+	noBuildID := writeProfile("nobuildid.profraw", instrProfRawMagic, 7)
+
+	summary := runtests.DataSinkMap{
+		llvmProfileSinkType: {
+			{Name: "good", File: good},
+			{Name: "fallback", File: fallback},
+			{Name: "badmagic", File: badMagic},
+			{Name: "nobuildid", File: noBuildID},
+		},
+	}
+	partitions := map[uint64]*partition{
+		0: {tool: tool},
+		7: {tool: tool},
+	}
+
+	entries, dispositions, err := mergeEntries(context.Background(), newVersionFetcher([]uint64{instrProfRawMagic}), summary, partitions)
+	if err != nil {
+		t.Fatalf("mergeEntries failed: %s", err)
+	}
+
+	wantEntries := []profileEntry{
+		{Profile: badMagic, Error: profileErrorVersion},
+		{Profile: fallback, Module: "0123abcd"},
+		{Profile: good, Module: "0123abcd"},
+		{Profile: noBuildID, Error: profileErrorMalformed},
+	}
+	// Only compare the kind of each error.
+	errorKind := cmp.Transformer("errorKind", func(e profileEntry) profileEntry {
+		if i := strings.Index(e.Error, ":"); i != -1 {
+			e.Error = e.Error[:i]
+		}
+		return e
+	})
+	if diff := cmp.Diff(wantEntries, entries, errorKind); diff != "" {
+		t.Errorf("entries mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantEntries[1:3], moduleEntries(entries)); diff != "" {
+		t.Errorf("module entries mismatch (-want +got):\n%s", diff)
+	}
+
+	partitionKey := func(key uint64) *uint64 { return &key }
+	wantDispositions := []profileDisposition{
+		{Profile: badMagic, Skipped: true},
+		{Profile: fallback, Version: 8, Module: "0123abcd", Partition: partitionKey(0)},
+		{Profile: good, Version: 7, Module: "0123abcd", Partition: partitionKey(7)},
+		{Profile: noBuildID, Version: 7, Skipped: true},
+	}
+	if diff := cmp.Diff(wantDispositions, dispositions, cmpopts.IgnoreFields(profileDisposition{}, "Reason")); diff != "" {
+		t.Errorf("dispositions mismatch (-want +got):\n%s", diff)
+	}
+	for _, d := range dispositions {
+		if d.Skipped && d.Reason == "" {
+			t.Errorf("skipped profile %q has no reason", d.Profile)
+		}
+	}
+
+	path := filepath.Join(tempDir, profileDispositionsFilename)
+	if err := writeProfileDispositions(path, dispositions); err != nil {
+		t.Fatalf("writeProfileDispositions failed: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []profileDisposition
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to decode dispositions: %s", err)
+	}
+	if diff := cmp.Diff(dispositions, got); diff != "" {
+		t.Errorf("written dispositions mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadSummaryTar(t *testing.T) {
+	tempDir := t.TempDir()
+
+	summary := runtests.TestSummary{
+		Tests: []runtests.TestDetails{
+			{
+				Name: "test",
+				DataSinks: runtests.DataSinkMap{
+					llvmProfileSinkType: {{Name: "test", File: "llvm-profile/test.profraw"}},
+				},
+			},
+		},
+	}
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string][]byte{
+		"shard/summary.json":              summaryJSON,
+		"shard/llvm-profile/test.profraw": []byte("profile"),
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range entries {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o600,
+			Size:     int64(len(data)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(tempDir, "summaries.tar.gz")
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	extractDir := filepath.Join(tempDir, "extracted")
+	sinks, tests, err := readSummary([]string{archive}, extractDir, parseSinkTypes(nil))
+	if err != nil {
+		t.Fatalf("readSummary(%q) failed: %s", archive, err)
+	}
+	got := sinks[llvmProfileSinkType]
+	if len(got) != 1 {
+		t.Fatalf("got %d %s sinks, want 1: %v", len(got), llvmProfileSinkType, got)
+	}
+	want := filepath.Join(extractDir, "summary0", "shard", "llvm-profile", "test.profraw")
+	if got[0].File != want {
+		t.Errorf("got sink file %q, want %q", got[0].File, want)
+	}
+	if diff := cmp.Diff(testProfiles{"test": {want}}, tests); diff != "" {
+		t.Errorf("test profiles mismatch (-want +got):\n%s", diff)
+	}
+	b, err := ioutil.ReadFile(got[0].File)
+	if err != nil {
+		t.Fatalf("failed to read extracted sink: %s", err)
+	}
+	if string(b) != "profile" {
+		t.Errorf("got extracted sink contents %q, want %q", b, "profile")
+	}
+}
+
+func TestReadSummaryMultiple(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var summaryFiles []string
+	var want []runtests.DataSink
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("test%d", i)
+		summary := runtests.TestSummary{
+			Tests: []runtests.TestDetails{
+				{
+					Name: name,
+					DataSinks: runtests.DataSinkMap{
+						llvmProfileSinkType: {{Name: name, File: name + ".profraw"}},
+					},
+				},
+			},
+		}
+		b, err := json.Marshal(summary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(tempDir, fmt.Sprintf("shard%d", i))
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		summaryPath := filepath.Join(dir, summaryFilename)
+		if err := ioutil.WriteFile(summaryPath, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		summaryFiles = append(summaryFiles, summaryPath)
+		want = append(want, runtests.DataSink{Name: name, File: filepath.Join(dir, name+".profraw")})
+	}
+
+	sinks, _, err := readSummary(summaryFiles, tempDir, parseSinkTypes(nil))
+	if err != nil {
+		t.Fatalf("readSummary failed: %s", err)
+	}
+	if diff := cmp.Diff(want, sinks[llvmProfileSinkType]); diff != "" {
+		t.Errorf("sinks mismatch (-want +got):\n%s", diff)
+	}
+
+	malformed := filepath.Join(tempDir, "malformed.json")
+	if err := ioutil.WriteFile(malformed, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readSummary(append(summaryFiles, malformed), tempDir, parseSinkTypes(nil)); err == nil || !strings.Contains(err.Error(), malformed) {
+		t.Errorf("got readSummary error %v, want it to mention %q", err, malformed)
+	}
+}
+
+func TestReadSummaryGzip(t *testing.T) {
+	tempDir := t.TempDir()
+
+	summary := runtests.TestSummary{
+		Tests: []runtests.TestDetails{
+			{
+				Name: "test",
+				DataSinks: runtests.DataSinkMap{
+					llvmProfileSinkType: {{Name: "test", File: "test.profraw"}},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The compression is detected from the content rather than the name.
+	summaryPath := filepath.Join(tempDir, "summary.json")
+	if err := ioutil.WriteFile(summaryPath, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sinks, _, err := readSummary([]string{summaryPath}, tempDir, parseSinkTypes(nil))
+	if err != nil {
+		t.Fatalf("readSummary failed: %s", err)
+	}
+	want := []runtests.DataSink{{Name: "test", File: filepath.Join(tempDir, "test.profraw")}}
+	if diff := cmp.Diff(want, sinks[llvmProfileSinkType]); diff != "" {
+		t.Errorf("sinks mismatch (-want +got):\n%s", diff)
+	}
+
+	truncated := filepath.Join(tempDir, "truncated.json.gz")
+	if err := ioutil.WriteFile(truncated, buf.Bytes()[:buf.Len()/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readSummary([]string{truncated}, tempDir, parseSinkTypes(nil)); err == nil || !strings.Contains(err.Error(), truncated) {
+		t.Errorf("got readSummary error %v, want it to mention %q", err, truncated)
+	}
+}
+
+func TestReadDiffMappingGzip(t *testing.T) {
+	want := covargs.DiffMapping{"src/foo.cc": {1: 2, 3: 5}}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{"mapping.json": b, "mapping.json.gz": buf.Bytes()} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readDiffMapping(path)
+		if err != nil {
+			t.Fatalf("readDiffMapping(%q) failed: %s", path, err)
+		}
+		if diff := cmp.Diff(want, *got); diff != "" {
+			t.Errorf("readDiffMapping(%q) mismatch (-want +got):\n%s", path, diff)
+		}
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json.gz")
+	if err := ioutil.WriteFile(corrupt, append(append([]byte(nil), gzipMagic...), "garbage"...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readDiffMapping(corrupt); err == nil || !strings.Contains(err.Error(), corrupt) {
+		t.Errorf("got readDiffMapping error %v, want it to mention %q", err, corrupt)
+	}
+}
+
+func TestReadSummarySinkTypes(t *testing.T) {
+	tempDir := t.TempDir()
+
+	const otherSinkType = "other-profile"
+	summary := runtests.TestSummary{
+		Tests: []runtests.TestDetails{
+			{
+				Name: "test",
+				DataSinks: runtests.DataSinkMap{
+					llvmProfileSinkType: {{Name: "llvm", File: "llvm-profile/test.profraw"}},
+					otherSinkType:       {{Name: "other", File: "other-profile/test.profile"}},
+				},
+			},
+		},
+	}
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaryPath := filepath.Join(tempDir, summaryFilename)
+	if err := ioutil.WriteFile(summaryPath, summaryJSON, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	llvmProfile := filepath.Join(tempDir, "llvm-profile", "test.profraw")
+	otherProfile := filepath.Join(tempDir, "other-profile", "test.profile")
+
+	for _, tc := range []struct {
+		name      string
+		sinkTypes []string
+		want      []string
+	}{
+		{
+			name: "default",
+			want: []string{llvmProfile},
+		},
+		{
+			name:      "other",
+			sinkTypes: []string{otherSinkType},
+			want:      []string{otherProfile},
+		},
+		{
+			name:      "both",
+			sinkTypes: []string{llvmProfileSinkType, otherSinkType},
+			want:      []string{llvmProfile, otherProfile},
+		},
+		{
+			name:      "unknown",
+			sinkTypes: []string{"unknown"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sinks, tests, err := readSummary([]string{summaryPath}, tempDir, parseSinkTypes(tc.sinkTypes))
+			if err != nil {
+				t.Fatalf("readSummary(%q) failed: %s", summaryPath, err)
+			}
+			if diff := cmp.Diff(tc.want, summaryProfiles(sinks)); diff != "" {
+				t.Errorf("profiles mismatch (-want +got):\n%s", diff)
+			}
+			var wantTests testProfiles
+			if len(tc.want) > 0 {
+				wantTests = testProfiles{"test": tc.want}
+			}
+			if diff := cmp.Diff(wantTests, tests, cmpopts.EquateEmpty(), cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("test profiles mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// fakeTransport records the Authorization header of every request and
+// responds with 404 Not Found.
+type fakeTransport struct {
+	mu             sync.Mutex
+	authorizations []string
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.authorizations = append(f.authorizations, req.Header.Get("Authorization"))
+	f.mu.Unlock()
+	return &http.Response{
+		Status:     http.StatusText(http.StatusNotFound),
+		StatusCode: http.StatusNotFound,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func TestGCSTokenFile(t *testing.T) {
+	tempDir := t.TempDir()
+	tokenFile := filepath.Join(tempDir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fileCache, err := cache.GetFileCache(filepath.Join(tempDir, "cache"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &fakeTransport{}
+	client, err := newTokenHTTPClient(tokenFile, transport)
+	if err != nil {
+		t.Fatalf("newTokenHTTPClient(%q) failed: %s", tokenFile, err)
+	}
+	repo, err := symbolize.NewCloudRepo(context.Background(), "gs://bucket/namespace", fileCache, option.WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("NewCloudRepo failed: %s", err)
+	}
+	if _, err := repo.GetBuildObject("0123456789abcdef"); err == nil {
+		t.Fatal("GetBuildObject succeeded, want a not found error")
+	}
+
+	if len(transport.authorizations) == 0 {
+		t.Fatal("no requests were sent")
+	}
+	for _, got := range transport.authorizations {
+		if want := "Bearer secret-token"; got != want {
+			t.Errorf("got Authorization = %q, want = %q", got, want)
+		}
+	}
+}
+
+func TestGCSTokenFileEmpty(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTokenHTTPClient(tokenFile, &fakeTransport{}); err == nil {
+		t.Errorf("newTokenHTTPClient(%q) succeeded, want error", tokenFile)
+	}
+}
+
+func TestFetchCache(t *testing.T) {
+	const version = uint64(7)
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "default.profraw")
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, []uint64{instrProfRawMagic, version}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(profile, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cachePath := filepath.Join(dir, "fetch_cache.json")
+	cache, err := loadFetchCache(cachePath)
+	if err != nil {
+		t.Fatalf("loadFetchCache(%q) failed: %s", cachePath, err)
+	}
+	vf := newVersionFetcher([]uint64{instrProfRawMagic})
+	vf.fetchCache = cache
+	if got, err := vf.getVersion(profile); err != nil || got != version {
+		t.Fatalf("got getVersion(%q) = %d, %v, want %d", profile, got, err, version)
+	}
+	entry, err := cache.get(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.BuildID = "1696251c"
+	cache.put(profile, entry)
+	if err := cache.save(cachePath); err != nil {
+		t.Fatalf("save(%q) failed: %s", cachePath, err)
+	}
+
+	// Corrupt the profile without changing its size or modification time, so
+	// that a cache hit is the only way to get the version and build ID back.
+	if err := ioutil.WriteFile(profile, make([]byte, buf.Len()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(profile, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err = loadFetchCache(cachePath); err != nil {
+		t.Fatalf("loadFetchCache(%q) failed: %s", cachePath, err)
+	}
+	vf = newVersionFetcher([]uint64{instrProfRawMagic})
+	vf.fetchCache = cache
+	if got, err := vf.getVersion(profile); err != nil || got != version {
+		t.Errorf("got getVersion(%q) = %d, %v, want cached %d", profile, got, err, version)
+	}
+	tool := filepath.Join(dir, "does-not-exist")
+	if got, err := readEmbeddedBuildId(context.Background(), cache, tool, profile); err != nil || got != entry.BuildID {
+		t.Errorf("got readEmbeddedBuildId(%q) = %q, %v, want cached %q", profile, got, err, entry.BuildID)
+	}
+
+	// Once the modification time changes, the profile must be read again.
+	if err := os.Chtimes(profile, info.ModTime(), info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	vf = newVersionFetcher([]uint64{instrProfRawMagic})
+	vf.fetchCache = cache
+	if _, err := vf.getVersion(profile); err == nil {
+		t.Errorf("getVersion(%q) succeeded on a stale cache entry, want error", profile)
+	}
+	if _, err := readEmbeddedBuildId(context.Background(), cache, tool, profile); err == nil {
+		t.Errorf("readEmbeddedBuildId(%q) succeeded on a stale cache entry, want error", profile)
+	}
+}
+
+func TestGetVersionMagic(t *testing.T) {
+	const (
+		altMagic = uint64(0xff6c70726f667282)
+		version  = uint64(7)
+	)
+	profile := filepath.Join(t.TempDir(), "alt.profraw")
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, []uint64{altMagic, version}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(profile, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultMagics, err := parseMagics(nil)
+	if err != nil {
+		t.Fatalf("parseMagics(nil) failed: %s", err)
+	}
+	if _, err := newVersionFetcher(defaultMagics).getVersion(profile); err == nil {
+		t.Errorf("getVersion(%q) succeeded with the default magic, want error", profile)
+	}
+
+	flags := []string{"ff6c70726f667281", "0xff6c70726f667282"}
+	magics, err := parseMagics(flags)
+	if err != nil {
+		t.Fatalf("parseMagics(%q) failed: %s", flags, err)
+	}
+	got, err := newVersionFetcher(magics).getVersion(profile)
+	if err != nil {
+		t.Fatalf("getVersion(%q) failed: %s", profile, err)
+	}
+	if got != version {
+		t.Errorf("got getVersion(%q) = %d, want %d", profile, got, version)
+	}
+
+	if _, err := parseMagics([]string{"not-hex"}); err == nil {
+		t.Error("parseMagics succeeded on an invalid magic, want error")
+	}
+}
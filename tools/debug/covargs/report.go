@@ -5,9 +5,12 @@
 package covargs
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"os/exec"
@@ -205,7 +208,7 @@ func getRevision(path string) (string, int64, error) {
 	return hash, timestamp, nil
 }
 
-func convertFile(file llvm.File, base string, mapping *DiffMapping) (*codecoverage.File, error) {
+func convertFile(file llvm.File, base string, mapping *DiffMapping, excludePrefixes []string) (*codecoverage.File, error) {
 	if file.Segments == nil {
 		return nil, nil
 	}
@@ -221,6 +224,11 @@ func convertFile(file llvm.File, base string, mapping *DiffMapping) (*codecovera
 	if err != nil {
 		return nil, err
 	}
+	for _, prefix := range excludePrefixes {
+		if strings.HasPrefix(rel, prefix) {
+			return nil, nil
+		}
+	}
 
 	ld, bd := extractData(file.Segments)
 	sort.Slice(ld, func(i, j int) bool {
@@ -355,9 +363,29 @@ func ComputeSummaries(files []*codecoverage.File) ([]*codecoverage.GroupCoverage
 	return groupSummaries, summaries["//"]
 }
 
+// ReadPathPrefixes reads a list of path prefixes, one per line, from the file at
+// path. Blank lines are ignored and a leading "//" is stripped, so prefixes may
+// be written either relative to the source tree or as they appear in reports.
+func ReadPathPrefixes(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			prefixes = append(prefixes, strings.TrimPrefix(line, "//"))
+		}
+	}
+	return prefixes, nil
+}
+
 // ConvertFiles converts the data in LLVM coverage JSON format into the
-// compressed coverage format used by Chromium coverage service.
-func ConvertFiles(export *llvm.Export, base string, mapping *DiffMapping) ([]*codecoverage.File, error) {
+// compressed coverage format used by Chromium coverage service. Files whose
+// path relative to base starts with any of excludePrefixes are dropped. If
+// originalPaths is not nil, it is filled with the original path of each
+// converted file, keyed by its path in the report.
+func ConvertFiles(export *llvm.Export, base string, mapping *DiffMapping, excludePrefixes []string, originalPaths map[string]string) ([]*codecoverage.File, error) {
 	var files []*codecoverage.File
 	var g errgroup.Group
 	var mu sync.Mutex
@@ -368,12 +396,18 @@ func ConvertFiles(export *llvm.Export, base string, mapping *DiffMapping) ([]*co
 			s <- struct{}{}
 			g.Go(func() error {
 				defer func() { <-s }()
-				file, err := convertFile(f, base, mapping)
+				file, err := convertFile(f, base, mapping, excludePrefixes)
 				if err != nil {
 					return err
 				}
+				if file == nil {
+					return nil
+				}
 				mu.Lock()
 				files = append(files, file)
+				if originalPaths != nil {
+					originalPaths[file.Path] = f.Filename
+				}
 				mu.Unlock()
 				return nil
 			})
@@ -385,6 +419,177 @@ func ConvertFiles(export *llvm.Export, base string, mapping *DiffMapping) ([]*co
 	return files, nil
 }
 
+// ConvertExport is like ConvertFiles, but reads the LLVM coverage JSON
+// export from r and decodes it one file at a time, so that memory use is
+// bounded by the size of the largest file rather than the whole export.
+func ConvertExport(r io.Reader, base string, mapping *DiffMapping, excludePrefixes []string, originalPaths map[string]string) ([]*codecoverage.File, error) {
+	var files []*codecoverage.File
+	var g errgroup.Group
+	var mu sync.Mutex
+	s := make(chan struct{}, runtime.NumCPU())
+	convert := func(f llvm.File) {
+		s <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-s }()
+			file, err := convertFile(f, base, mapping, excludePrefixes)
+			if err != nil {
+				return err
+			}
+			if file == nil {
+				return nil
+			}
+			mu.Lock()
+			files = append(files, file)
+			if originalPaths != nil {
+				originalPaths[file.Path] = f.Filename
+			}
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	err := decodeExportFiles(r, convert)
+	if werr := g.Wait(); werr != nil {
+		return nil, werr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding export: %w", err)
+	}
+	return files, nil
+}
+
+// decodeExportFiles reads the LLVM coverage JSON export from r, calling fn
+// for each file of each data entry as soon as it has been decoded.
+func decodeExportFiles(r io.Reader, fn func(f llvm.File)) error {
+	dec := json.NewDecoder(r)
+	return decodeObject(dec, func(key string) error {
+		if key != "data" {
+			return skipValue(dec)
+		}
+		return decodeArray(dec, func() error {
+			return decodeObject(dec, func(key string) error {
+				if key != "files" {
+					return skipValue(dec)
+				}
+				return decodeArray(dec, func() error {
+					var f llvm.File
+					if err := dec.Decode(&f); err != nil {
+						return err
+					}
+					fn(f)
+					return nil
+				})
+			})
+		})
+	})
+}
+
+// WriteLCOV reads the LLVM coverage JSON export from r and writes the line
+// coverage of each file to w in the lcov tracefile format. Line hit counts
+// are derived from the region segments of the export the same way as for
+// the report, and files are written in order of their path so that the
+// output is stable across runs.
+func WriteLCOV(r io.Reader, w io.Writer) error {
+	type lcovFile struct {
+		path  string
+		lines lineData
+	}
+	var files []lcovFile
+	err := decodeExportFiles(r, func(f llvm.File) {
+		if len(f.Segments) == 0 {
+			return
+		}
+		ld, _ := extractData(f.Segments)
+		files = append(files, lcovFile{path: f.Filename, lines: ld})
+	})
+	if err != nil {
+		return fmt.Errorf("decoding export: %w", err)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].path < files[j].path })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range files {
+		fmt.Fprintf(bw, "SF:%s\n", f.path)
+		hit := 0
+		for _, l := range f.lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", l.line, l.count)
+			if l.count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(bw, "LH:%d\nLF:%d\nend_of_record\n", hit, len(f.lines))
+	}
+	return bw.Flush()
+}
+
+// expectDelim consumes the next token from dec and checks that it is want.
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("got %v, want %v", tok, want)
+	}
+	return nil
+}
+
+// decodeObject consumes a JSON object from dec, calling fn for each key with
+// the decoder positioned at the corresponding value. fn must consume the value.
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("got %v, want object key", tok)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeArray consumes a JSON array from dec, calling fn once per element with
+// the decoder positioned at that element. fn must consume the element.
+func decodeArray(dec *json.Decoder, fn func() error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// skipValue consumes the next JSON value from dec without retaining it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
 func saveReport(report *codecoverage.CoverageReport, filename string) error {
 	f, err := os.Create(filename)
 	if err != nil {
@@ -407,31 +612,49 @@ func saveReport(report *codecoverage.CoverageReport, filename string) error {
 }
 
 // SaveReport saves compresses coverage data to disk, optionally sharding the
-// data into multiple files each of the same size.
-func SaveReport(files []*codecoverage.File, shardSize int, dir string) (*codecoverage.CoverageReport, error) {
+// data into multiple files each of the same size. Up to jobs shards are
+// written concurrently. Files are assigned to shards in path order, so the
+// shards do not depend on the order of files.
+func SaveReport(files []*codecoverage.File, shardSize int, jobs int, dir string) (*codecoverage.CoverageReport, error) {
 	dirs, summaries := ComputeSummaries(files)
 	report := &codecoverage.CoverageReport{
 		Dirs:      dirs,
 		Summaries: summaries,
 	}
 	if numFiles := len(files); numFiles > shardSize {
+		files = append([]*codecoverage.File(nil), files...)
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
 		const filename = "files%0*d.json.gz"
 		numShards := int(math.Ceil(float64(numFiles) / float64(shardSize)))
 		width := 1 + int(math.Log10(float64(numShards)))
 		fileShards := make([]string, numShards)
-		// TODO(phosek): Use goroutines to process slices in parallel.
+		if jobs < 1 {
+			jobs = 1
+		}
+		var g errgroup.Group
+		s := make(chan struct{}, jobs)
 		for i := 0; i < numShards; i++ {
+			i := i
 			from := i * shardSize
 			to := (i + 1) * shardSize
 			if to > numFiles {
 				to = numFiles
 			}
-			report := codecoverage.CoverageReport{Files: files[from:to]}
-			filename := fmt.Sprintf(filename, width, i+1)
-			if err := saveReport(&report, filepath.Join(dir, filename)); err != nil {
-				return nil, fmt.Errorf("failed to save report %q: %w", filename, err)
-			}
-			fileShards[i] = filename
+			s <- struct{}{}
+			g.Go(func() error {
+				defer func() { <-s }()
+				report := codecoverage.CoverageReport{Files: files[from:to]}
+				filename := fmt.Sprintf(filename, width, i+1)
+				if err := saveReport(&report, filepath.Join(dir, filename)); err != nil {
+					return fmt.Errorf("failed to save report %q: %w", filename, err)
+				}
+				fileShards[i] = filename
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
 		}
 		report.FileShards = fileShards
 	} else {
@@ -443,3 +666,80 @@ func SaveReport(files []*codecoverage.File, shardSize int, dir string) (*codecov
 	}
 	return report, nil
 }
+
+// OriginalPath is an entry of the original paths index, relating the path of
+// a file in the report to the path it had in the LLVM coverage export.
+type OriginalPath struct {
+	Path         string `json:"path"`
+	OriginalPath string `json:"original_path"`
+}
+
+// SaveOriginalPaths saves the index of original paths collected by
+// ConvertFiles or ConvertExport to paths.json in dir, sorted by report path.
+func SaveOriginalPaths(originalPaths map[string]string, dir string) error {
+	index := make([]OriginalPath, 0, len(originalPaths))
+	for path, original := range originalPaths {
+		index = append(index, OriginalPath{Path: path, OriginalPath: original})
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].Path < index[j].Path })
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	const filename = "paths.json"
+	if err := os.WriteFile(filepath.Join(dir, filename), b, 0644); err != nil {
+		return fmt.Errorf("failed to save %q: %w", filename, err)
+	}
+	return nil
+}
+
+// Badge is a coverage badge in the shields.io endpoint schema, see
+// https://shields.io/endpoint.
+type Badge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+}
+
+// BadgeThresholds are the minimum line coverage percentages for which a badge
+// is green and yellow, respectively. Coverage below Yellow is red.
+type BadgeThresholds struct {
+	Green, Yellow float64
+}
+
+// LineCoverageBadge returns a badge showing the aggregate line coverage in
+// summaries, as returned by ComputeSummaries.
+func LineCoverageBadge(summaries []*codecoverage.Metric, thresholds BadgeThresholds) Badge {
+	badge := Badge{
+		SchemaVersion: 1,
+		Label:         "coverage",
+		Message:       "unknown",
+		Color:         "lightgrey",
+	}
+	for _, m := range summaries {
+		if m.Name != "line" || m.Total == 0 {
+			continue
+		}
+		percent := 100 * float64(m.Covered) / float64(m.Total)
+		badge.Message = fmt.Sprintf("%.1f%%", percent)
+		switch {
+		case percent >= thresholds.Green:
+			badge.Color = "green"
+		case percent >= thresholds.Yellow:
+			badge.Color = "yellow"
+		default:
+			badge.Color = "red"
+		}
+	}
+	return badge
+}
+
+// WriteBadge writes the badge as JSON to the file at path.
+func WriteBadge(path string, badge Badge) error {
+	b, err := json.Marshal(badge)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
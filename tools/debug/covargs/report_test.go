@@ -5,13 +5,21 @@
 package covargs
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"testing"
 
 	"go.fuchsia.dev/fuchsia/tools/debug/covargs/api/llvm"
 	"go.fuchsia.dev/fuchsia/tools/debug/covargs/api/third_party/codecoverage"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // The data below were collected from the following program which is the
@@ -196,7 +204,7 @@ func TestConversion(t *testing.T) {
 	}
 
 	// We pass an empty diff mapping to avoid invoking Git.
-	files, err := ConvertFiles(testExport, "/path/to/fuchsia", &DiffMapping{})
+	files, err := ConvertFiles(testExport, "/path/to/fuchsia", &DiffMapping{}, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -206,6 +214,182 @@ func TestConversion(t *testing.T) {
 	}
 }
 
+func TestConvertExportStreaming(t *testing.T) {
+	const numFiles = 5000
+	segments := []llvm.Segment{
+		{1, 1, 1, true, true, false},
+		{2, 1, 0, true, true, false},
+		{3, 1, 0, false, false, false},
+	}
+	var filesData []llvm.File
+	for i := 0; i < numFiles; i++ {
+		filesData = append(filesData, llvm.File{
+			Filename: fmt.Sprintf("/path/to/fuchsia/src/file%d.cc", i),
+			Segments: segments,
+		})
+	}
+	testExport := &llvm.Export{Data: []llvm.Data{{Files: filesData}}}
+
+	// Surround the files with the other top-level and per-data keys that
+	// llvm-cov emits so that the streaming decoder has to skip over them.
+	b, err := json.Marshal(filesData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"type":"llvm.coverage.json.export","version":"2.0.1","data":[{"functions":[{"name":"main","regions":[[1,1,2,2,1,0,0,0]]}],"files":`)
+	buf.Write(b)
+	buf.WriteString(`,"totals":{"lines":{"count":1,"covered":1,"percent":100}}}]}`)
+
+	// We pass an empty diff mapping to avoid invoking Git.
+	want, err := ConvertFiles(testExport, "/path/to/fuchsia", &DiffMapping{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ConvertExport(&buf, "/path/to/fuchsia", &DiffMapping{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != numFiles {
+		t.Fatalf("got %d files, want %d", len(got), numFiles)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Path < want[j].Path })
+	sort.Slice(got, func(i, j int) bool { return got[i].Path < got[j].Path })
+	if !reflect.DeepEqual(got, want) {
+		t.Error("streaming conversion differs from ConvertFiles")
+	}
+
+	if _, err := ConvertExport(bytes.NewBufferString(`{"data":[{"files":[`), "/path/to/fuchsia", &DiffMapping{}, nil, nil); err == nil {
+		t.Error("expected error for truncated export")
+	}
+}
+
+func TestWriteLCOV(t *testing.T) {
+	segments := []llvm.Segment{
+		{1, 1, 3, true, true, false},
+		{2, 1, 0, true, true, false},
+		{3, 1, 0, false, false, false},
+	}
+	export := &llvm.Export{Data: []llvm.Data{{Files: []llvm.File{
+		{Filename: "src/b.cc", Segments: segments},
+		{Filename: "src/empty.cc"},
+		{Filename: "src/a.cc", Segments: segments},
+	}}}}
+	b, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	if err := WriteLCOV(bytes.NewReader(b), &got); err != nil {
+		t.Fatal(err)
+	}
+	const record = "DA:1,3\nDA:2,3\nDA:3,0\nLH:2\nLF:3\nend_of_record\n"
+	want := "SF:src/a.cc\n" + record + "SF:src/b.cc\n" + record
+	if got.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got.String(), want)
+	}
+
+	if err := WriteLCOV(bytes.NewBufferString(`{"data":[{"files":[`), io.Discard); err == nil {
+		t.Error("expected error for truncated export")
+	}
+}
+
+func TestConversionExcludePrefixes(t *testing.T) {
+	segments := []llvm.Segment{
+		{1, 1, 1, true, true, false},
+		{1, 2, 0, false, false, false},
+	}
+	testExport := &llvm.Export{
+		Data: []llvm.Data{
+			{
+				Files: []llvm.File{
+					{Filename: "/path/to/fuchsia/src/test.cc", Segments: segments},
+					{Filename: "/path/to/fuchsia/third_party/lib/lib.cc", Segments: segments},
+					{Filename: "/path/to/fuchsia/out/gen/proto.pb.cc", Segments: segments},
+					{Filename: "/path/to/fuchsia/third_party_test.cc", Segments: segments},
+				},
+			},
+		},
+	}
+
+	prefixFile := filepath.Join(t.TempDir(), "exclude.txt")
+	if err := os.WriteFile(prefixFile, []byte("third_party/\n\n//out/gen/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prefixes, err := ReadPathPrefixes(prefixFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"third_party/", "out/gen/"}; !reflect.DeepEqual(prefixes, want) {
+		t.Fatalf("got prefixes %q, want %q", prefixes, want)
+	}
+
+	// We pass an empty diff mapping to avoid invoking Git.
+	files, err := ConvertFiles(testExport, "/path/to/fuchsia", &DiffMapping{}, prefixes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, file := range files {
+		got = append(got, file.Path)
+	}
+	sort.Strings(got)
+	if want := []string{"//src/test.cc", "//third_party_test.cc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+func TestConversionOriginalPaths(t *testing.T) {
+	segments := []llvm.Segment{
+		{1, 1, 1, true, true, false},
+		{1, 2, 0, false, false, false},
+	}
+	testExport := &llvm.Export{
+		Data: []llvm.Data{
+			{
+				Files: []llvm.File{
+					{Filename: "/path/to/fuchsia/src/test.cc", Segments: segments},
+					{Filename: "/path/to/fuchsia/out/gen/proto.pb.cc", Segments: segments},
+				},
+			},
+		},
+	}
+
+	// We pass an empty diff mapping to avoid invoking Git.
+	originalPaths := map[string]string{}
+	if _, err := ConvertFiles(testExport, "/path/to/fuchsia", &DiffMapping{}, nil, originalPaths); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"//src/test.cc":         "/path/to/fuchsia/src/test.cc",
+		"//out/gen/proto.pb.cc": "/path/to/fuchsia/out/gen/proto.pb.cc",
+	}
+	if !reflect.DeepEqual(originalPaths, want) {
+		t.Fatalf("got original paths %q, want %q", originalPaths, want)
+	}
+
+	dir := t.TempDir()
+	if err := SaveOriginalPaths(originalPaths, dir); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "paths.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index []OriginalPath
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	wantIndex := []OriginalPath{
+		{Path: "//out/gen/proto.pb.cc", OriginalPath: "/path/to/fuchsia/out/gen/proto.pb.cc"},
+		{Path: "//src/test.cc", OriginalPath: "/path/to/fuchsia/src/test.cc"},
+	}
+	if !reflect.DeepEqual(index, wantIndex) {
+		t.Errorf("got index %+v, want %+v", index, wantIndex)
+	}
+}
+
 func TestSummary(t *testing.T) {
 	var testFiles = []*codecoverage.File{
 		{
@@ -524,7 +708,7 @@ func TestSave(t *testing.T) {
 				})
 			}
 
-			report, err := SaveReport(files, tt.shardSize, testDir)
+			report, err := SaveReport(files, tt.shardSize, 1, testDir)
 			if err != nil {
 				t.Error("unexpected error", err)
 			}
@@ -544,3 +728,134 @@ func TestSave(t *testing.T) {
 		})
 	}
 }
+
+func TestSaveParallel(t *testing.T) {
+	const (
+		numFiles  = 50
+		shardSize = 7
+		jobs      = 4
+	)
+	var files []*codecoverage.File
+	for i := 0; i < numFiles; i++ {
+		files = append(files, &codecoverage.File{
+			Path: fmt.Sprintf("//src/test%02d.cc", i),
+			Lines: []*codecoverage.LineRange{
+				{First: 1, Last: 1, Count: int64(i)},
+			},
+		})
+	}
+	// The same files in a different order, as produced by a concurrent
+	// conversion.
+	reversed := make([]*codecoverage.File, numFiles)
+	for i, file := range files {
+		reversed[numFiles-1-i] = file
+	}
+
+	var dirs []string
+	for _, files := range [][]*codecoverage.File{files, reversed} {
+		dir := t.TempDir()
+		report, err := SaveReport(files, shardSize, jobs, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(report.FileShards), 8; got != want {
+			t.Fatalf("got %d shards, want %d", got, want)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	// readShard returns the contents of a shard and the paths of its files.
+	readShard := func(path string) ([]byte, []string) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report codecoverage.CoverageReport
+		if err := protojson.Unmarshal(data, &report); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, file := range report.Files {
+			paths = append(paths, file.Path)
+		}
+		return b, paths
+	}
+
+	var got []string
+	for i := 1; i <= 8; i++ {
+		filename := fmt.Sprintf("files%d.json.gz", i)
+		b0, paths := readShard(filepath.Join(dirs[0], filename))
+		b1, _ := readShard(filepath.Join(dirs[1], filename))
+		if !bytes.Equal(b0, b1) {
+			t.Errorf("shard %s differs between runs", filename)
+		}
+		if !sort.StringsAreSorted(paths) {
+			t.Errorf("shard %s files are not sorted: %q", filename, paths)
+		}
+		got = append(got, paths...)
+	}
+	var want []string
+	for _, file := range files {
+		want = append(want, file.Path)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+func TestLineCoverageBadge(t *testing.T) {
+	thresholds := BadgeThresholds{Green: 80, Yellow: 50}
+	line := func(covered, total int32) []*codecoverage.Metric {
+		return []*codecoverage.Metric{
+			{Name: "function", Covered: 1, Total: 1},
+			{Name: "line", Covered: covered, Total: total},
+		}
+	}
+	tests := []struct {
+		name        string
+		summaries   []*codecoverage.Metric
+		wantMessage string
+		wantColor   string
+	}{
+		{name: "full", summaries: line(10, 10), wantMessage: "100.0%", wantColor: "green"},
+		{name: "at green threshold", summaries: line(80, 100), wantMessage: "80.0%", wantColor: "green"},
+		{name: "below green threshold", summaries: line(799, 1000), wantMessage: "79.9%", wantColor: "yellow"},
+		{name: "at yellow threshold", summaries: line(1, 2), wantMessage: "50.0%", wantColor: "yellow"},
+		{name: "below yellow threshold", summaries: line(1, 3), wantMessage: "33.3%", wantColor: "red"},
+		{name: "no lines", summaries: line(0, 0), wantMessage: "unknown", wantColor: "lightgrey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LineCoverageBadge(tt.summaries, thresholds)
+			want := Badge{SchemaVersion: 1, Label: "coverage", Message: tt.wantMessage, Color: tt.wantColor}
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteBadge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badge.json")
+	badge := Badge{SchemaVersion: 1, Label: "coverage", Message: "42.0%", Color: "red"}
+	if err := WriteBadge(path, badge); err != nil {
+		t.Fatalf("WriteBadge failed: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"schemaVersion":1,"label":"coverage","message":"42.0%","color":"red"}`
+	if got := string(b); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
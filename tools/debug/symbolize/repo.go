@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
 
 	"go.fuchsia.dev/fuchsia/tools/debug/elflib"
 	"go.fuchsia.dev/fuchsia/tools/lib/cache"
@@ -70,11 +71,12 @@ type CloudRepo struct {
 
 // NewCloudRepo creates a CloudRepo using gcsURL. The connection to the bucket
 // will be ended when ctx is canceled. No timeout on GetBuildObject is set until
-// SetTimeout is called.
-func NewCloudRepo(ctx context.Context, gcsURL string, cache *cache.FileCache) (*CloudRepo, error) {
+// SetTimeout is called. Any opts are passed through to the GCS client; if none
+// are given, ambient credentials are used.
+func NewCloudRepo(ctx context.Context, gcsURL string, cache *cache.FileCache, opts ...option.ClientOption) (*CloudRepo, error) {
 	var out CloudRepo
 	var err error
-	if out.client, err = storage.NewClient(ctx); err != nil {
+	if out.client, err = storage.NewClient(ctx, opts...); err != nil {
 		return nil, err
 	}
 	u, err := url.Parse(gcsURL)
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
 )
@@ -19,6 +20,14 @@ type Documented struct {
 	Doc []string
 }
 
+// Deprecated is embedded in structs for declarations that may be marked
+// deprecated with @available(deprecated=...).
+type Deprecated struct {
+	// DeprecationMessage is the Dart string literal passed to the @Deprecated
+	// annotation, or empty if the declaration is not deprecated.
+	DeprecationMessage string
+}
+
 // Type represents a FIDL datatype.
 type Type struct {
 	Decl          string // type in traditional bindings
@@ -111,6 +120,7 @@ type Struct struct {
 	TypeExpr         string
 	HasNullableField bool
 	Documented
+	Deprecated
 	isEmptyStruct bool
 }
 
@@ -166,6 +176,26 @@ type Protocol struct {
 	Documented
 }
 
+// Service represents a service declaration.
+type Service struct {
+	fidlgen.Attributes
+	Name        string
+	ServiceName string
+	Members     []ServiceMember
+	Documented
+}
+
+// ServiceMember represents a member of a service, which is a connection to a
+// protocol.
+type ServiceMember struct {
+	// Name is the name of the accessor connecting to the member.
+	Name string
+	// MemberName is the name of the member in the FIDL declaration.
+	MemberName string
+	ProxyName  string
+	Documented
+}
+
 type MethodResponse struct {
 	// WireParameters represent the parameters of the top level response struct
 	// that is sent on the wire
@@ -200,6 +230,7 @@ type Method struct {
 	TypeExpr           string
 	Transitional       bool
 	Documented
+	Deprecated
 }
 
 // ResponseMessageType is the Dart type returned by the "DecodeResponse" template.
@@ -228,6 +259,7 @@ type Root struct {
 	Enums           []Enum
 	Bits            []Bits
 	Protocols       []Protocol
+	Services        []Service
 	Structs         []Struct
 	Tables          []Table
 	Unions          []Union
@@ -376,6 +408,60 @@ func docString(node Annotated) Documented {
 	return Documented{docs}
 }
 
+// deprecation returns the @Deprecated annotation details for a declaration
+// with the given attributes and documentation. The documentation is used as
+// the message, falling back to the version at which it was deprecated.
+func deprecation(attributes fidlgen.Attributes, doc Documented) Deprecated {
+	_, deprecated, _, ok := attributes.Availability()
+	if !ok || deprecated == nil {
+		return Deprecated{}
+	}
+	var lines []string
+	for _, line := range doc.Doc {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	message := strings.Join(lines, " ")
+	if message == "" {
+		version := strconv.FormatUint(*deprecated, 10)
+		if *deprecated == fidlgen.VersionHead {
+			version = "HEAD"
+		}
+		message = fmt.Sprintf("Deprecated at version %s", version)
+	}
+	return Deprecated{dartStringLiteral(message)}
+}
+
+// dartStringLiteral returns s as a single-quoted Dart string literal. Unlike
+// Go's %q, it escapes $, which Dart interpolates, and only uses escape
+// sequences Dart supports.
+func dartStringLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\\', '\'', '$':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if unicode.IsPrint(r) {
+				b.WriteRune(r)
+			} else {
+				fmt.Fprintf(&b, `\u{%x}`, r)
+			}
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
 func formatBool(val bool) string {
 	return strconv.FormatBool(val)
 }
@@ -953,6 +1039,7 @@ func (c *compiler) compileMethod(val fidlgen.Method, protocol Protocol, fidlProt
 	}
 
 	_, transitional := val.LookupAttribute("transitional")
+	doc := docString(val)
 	return Method{
 		Ordinal:            val.Ordinal,
 		OrdinalName:        fmt.Sprintf("_k%s_%s_Ordinal", protocol.Name, val.Name),
@@ -967,7 +1054,8 @@ func (c *compiler) compileMethod(val fidlgen.Method, protocol Protocol, fidlProt
 		TypeSymbol:         fmt.Sprintf("_k%s_%s_Type", protocol.Name, val.Name),
 		TypeExpr:           c.typeExprForMethod(val, request, response.WireParameters, fmt.Sprintf("%s.%s", protocol.Name, val.Name)),
 		Transitional:       transitional,
-		Documented:         docString(val),
+		Documented:         doc,
+		Deprecated:         deprecation(val.Attributes, doc),
 	}
 }
 
@@ -997,6 +1085,48 @@ func (c *compiler) compileProtocol(val fidlgen.Protocol) Protocol {
 	return r
 }
 
+// compileService compiles a service. Members whose protocol has no Dart proxy,
+// because it does not use the Channel transport, are left out.
+func (c *compiler) compileService(val fidlgen.Service) Service {
+	r := Service{
+		Attributes:  val.Attributes,
+		Name:        c.compileUpperCamelCompoundIdentifier(val.Name.Parse(), "", declarationContext),
+		ServiceName: val.GetServiceName(),
+		Documented:  docString(val),
+	}
+	for _, v := range val.Members {
+		protocol := v.Type.Identifier
+		if v.Type.Kind == fidlgen.RequestType {
+			protocol = v.Type.RequestSubtype
+		}
+		if !c.isChannelProtocol(v.Type, protocol) {
+			continue
+		}
+		r.Members = append(r.Members, ServiceMember{
+			Name:       c.compileLowerCamelIdentifier(v.Name, methodContext),
+			MemberName: string(v.Name),
+			ProxyName:  c.compileUpperCamelCompoundIdentifier(protocol.Parse(), "Proxy", declarationContext),
+			Documented: docString(v),
+		})
+	}
+	return r
+}
+
+// isChannelProtocol returns true if protocol, the protocol of an endpoint of
+// type t, uses the Channel transport.
+func (c *compiler) isChannelProtocol(t fidlgen.Type, protocol fidlgen.EncodedCompoundIdentifier) bool {
+	// Protocols declared in other libraries are not in typesRoot, so their
+	// transport is only known from the type of their endpoints.
+	if t.ProtocolTransport != "" {
+		return t.ProtocolTransport == "Channel"
+	}
+	if p, ok := c.typesRoot.LookupDecl(protocol).(*fidlgen.Protocol); ok {
+		_, ok := p.Transports()["Channel"]
+		return ok
+	}
+	return true
+}
+
 func (c *compiler) compileStructMember(val fidlgen.StructMember) StructMember {
 	t := c.compileType(val.Type)
 
@@ -1021,6 +1151,7 @@ func (c *compiler) compileStructMember(val fidlgen.StructMember) StructMember {
 func (c *compiler) compileStruct(val fidlgen.Struct) Struct {
 	ci := val.Name.Parse()
 	name := c.compileUpperCamelCompoundIdentifier(ci, "", declarationContext)
+	doc := docString(val)
 	r := Struct{
 		Identifier: val.Name,
 		Name:       name,
@@ -1028,7 +1159,8 @@ func (c *compiler) compileStruct(val fidlgen.Struct) Struct {
 		TypeExpr: fmt.Sprintf(
 			`$fidl.StructType<%s>(inlineSizeV1: %v, inlineSizeV2: %v, structDecode: %s._structDecode)`,
 			name, val.TypeShapeV1.InlineSize, val.TypeShapeV2.InlineSize, name),
-		Documented: docString(val),
+		Documented: doc,
+		Deprecated: deprecation(val.Attributes, doc),
 	}
 
 	// Early exit for empty struct case.
@@ -1224,6 +1356,10 @@ func Compile(r fidlgen.Root) Root {
 		c.Root.Protocols = append(c.Root.Protocols, c.compileProtocol(v))
 	}
 
+	for _, v := range r.Services {
+		c.Root.Services = append(c.Root.Services, c.compileService(v))
+	}
+
 	for _, l := range r.Libraries {
 		if l.Name == r.Name {
 			// We don't need to import our own package.
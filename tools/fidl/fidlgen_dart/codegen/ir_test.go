@@ -0,0 +1,196 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgentest"
+)
+
+func TestCompileService(t *testing.T) {
+	root := Compile(fidlgentest.EndToEndTest{T: t}.Single(`library example;
+
+	protocol First {};
+	protocol Second {};
+
+	/// A service.
+	service Both {
+		/// The first member.
+		first_member client_end:First;
+		second_member client_end:Second;
+	};`))
+
+	if len(root.Services) != 1 {
+		t.Fatalf("got %d services, want 1", len(root.Services))
+	}
+	service := root.Services[0]
+	if service.Name != "Both" {
+		t.Errorf("got Name = %q, want = %q", service.Name, "Both")
+	}
+	if service.ServiceName != "example.Both" {
+		t.Errorf("got ServiceName = %q, want = %q", service.ServiceName, "example.Both")
+	}
+	if diff := cmp.Diff(Documented{Doc: []string{" A service."}}, service.Documented); diff != "" {
+		t.Errorf("Documented (-want +got):\n%s", diff)
+	}
+	wantMembers := []ServiceMember{
+		{
+			Name:       "firstMember",
+			MemberName: "first_member",
+			ProxyName:  "FirstProxy",
+			Documented: Documented{Doc: []string{" The first member."}},
+		},
+		{
+			Name:       "secondMember",
+			MemberName: "second_member",
+			ProxyName:  "SecondProxy",
+		},
+	}
+	if diff := cmp.Diff(wantMembers, service.Members); diff != "" {
+		t.Errorf("Members (-want +got):\n%s", diff)
+	}
+
+	out, err := NewFidlGenerator("").ExecuteTemplate("ServiceDeclaration", service)
+	if err != nil {
+		t.Fatalf("ExecuteTemplate(ServiceDeclaration, _) = %s", err)
+	}
+	for _, want := range []string{
+		"/// A service.\nclass Both {",
+		"static const String $serviceName = 'example.Both';",
+		"/// The first member.\n  FirstProxy firstMember() {",
+		"_connect('first_member', proxy.ctrl.request().passChannel()!);",
+		"SecondProxy secondMember() {",
+		"_connect('second_member', proxy.ctrl.request().passChannel()!);",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("generated service does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestCompileServiceSkipsNonChannelMembers(t *testing.T) {
+	for _, ex := range []struct {
+		name string
+		dep  string
+		fidl string
+	}{
+		{
+			name: "same library",
+			fidl: `library example;
+
+			protocol Echo {};
+
+			@transport("Driver")
+			protocol Driver {};
+
+			service MixedService {
+				echo client_end:Echo;
+				driver client_end:Driver;
+			};`,
+		},
+		{
+			name: "other library",
+			dep: `library dependency;
+
+			@transport("Driver")
+			protocol Driver {};`,
+			fidl: `library example;
+
+			using dependency;
+
+			protocol Echo {};
+
+			service MixedService {
+				echo client_end:Echo;
+				driver client_end:dependency.Driver;
+			};`,
+		},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			test := fidlgentest.EndToEndTest{T: t}
+			if ex.dep != "" {
+				test = test.WithDependency(ex.dep)
+			}
+			root := Compile(test.Single(ex.fidl))
+			if len(root.Services) != 1 {
+				t.Fatalf("got %d services, want 1", len(root.Services))
+			}
+			want := []ServiceMember{
+				{
+					Name:       "echo",
+					MemberName: "echo",
+					ProxyName:  "EchoProxy",
+				},
+			}
+			if diff := cmp.Diff(want, root.Services[0].Members); diff != "" {
+				t.Errorf("Members (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	available := func(deprecated string) fidlgen.Attributes {
+		return fidlgen.Attributes{Attributes: []fidlgen.Attribute{{
+			Name: "available",
+			Args: []fidlgen.AttributeArg{
+				{Name: "added", Value: fidlgen.Constant{Value: "1"}},
+				{Name: "deprecated", Value: fidlgen.Constant{Value: deprecated}},
+			},
+		}}}
+	}
+	for _, ex := range []struct {
+		name       string
+		attributes fidlgen.Attributes
+		doc        []string
+		want       string
+	}{
+		{
+			name: "not deprecated",
+			doc:  []string{" Not deprecated."},
+			want: "",
+		},
+		{
+			name:       "undocumented",
+			attributes: available("2"),
+			want:       "'Deprecated at version 2'",
+		},
+		{
+			name:       "undocumented at HEAD",
+			attributes: available("HEAD"),
+			want:       "'Deprecated at version HEAD'",
+		},
+		{
+			name:       "documented",
+			attributes: available("2"),
+			doc:        []string{" Use |Bar| instead,", "", " it's faster."},
+			want:       `'Use |Bar| instead, it\'s faster.'`,
+		},
+		{
+			name:       "dollar",
+			attributes: available("2"),
+			doc:        []string{" Costs $5 or ${price}."},
+			want:       `'Costs \$5 or \${price}.'`,
+		},
+		{
+			name:       "escapes",
+			attributes: available("2"),
+			doc:        []string{" a\\b \a\v\U0001F600"},
+			want:       "'a\\\\b \\u{7}\\u{b}\U0001F600'",
+		},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			got := deprecation(ex.attributes, Documented{Doc: ex.doc})
+			if got.DeprecationMessage != ex.want {
+				t.Errorf("got DeprecationMessage = %s, want = %s", got.DeprecationMessage, ex.want)
+			}
+		})
+	}
+}
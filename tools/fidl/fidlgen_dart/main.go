@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 
 	"go.fuchsia.dev/fuchsia/tools/fidl/fidlgen_dart/codegen"
 	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
@@ -20,6 +21,8 @@ type flagsDef struct {
 	outAsyncPath *string
 	outTestPath  *string
 	dart         *string
+	depfile      *string
+	only         fidlgen.ListOfStrings
 
 	deprecatedOutputBase  *string
 	deprecatedIncludeBase *string
@@ -34,6 +37,8 @@ var flags = flagsDef{
 		"output path for the test bindings."),
 	dart: flag.String("dart", "",
 		"path to the dart tool"),
+	depfile: flag.String("depfile", "",
+		"output path for a Make-style depfile listing the inputs of the generated files."),
 }
 
 // valid returns true if the parsed flags are valid.
@@ -41,6 +46,26 @@ func (f flagsDef) valid() bool {
 	return *f.jsonPath != ""
 }
 
+// escapeDepfilePath escapes the characters in path that are significant in a
+// Make-style depfile.
+func escapeDepfilePath(path string) string {
+	return strings.NewReplacer(`\`, `\\`, " ", `\ `, "#", `\#`, "$", "$$").Replace(path)
+}
+
+// writeDepfile writes a Make-style depfile at depfilePath that records the
+// dependency of each of outputs on all of inputs.
+func writeDepfile(depfilePath string, outputs, inputs []string) error {
+	var targets, prereqs []string
+	for _, output := range outputs {
+		targets = append(targets, escapeDepfilePath(output))
+	}
+	for _, input := range inputs {
+		prereqs = append(prereqs, escapeDepfilePath(input))
+	}
+	contents := fmt.Sprintf("%s: %s\n", strings.Join(targets, " "), strings.Join(prereqs, " "))
+	return os.WriteFile(depfilePath, []byte(contents), 0o644)
+}
+
 func printUsage() {
 	program := path.Base(os.Args[0])
 	message := `Usage: ` + program + ` [flags]
@@ -55,6 +80,10 @@ Flags:
 }
 
 func main() {
+	flag.Var(&flags.only, "only",
+		"fully-qualified name of a declaration to generate, e.g. fuchsia.foo/Bar. "+
+			"May be repeated. When set, only these declarations and the ones they "+
+			"depend on are generated.")
 	flag.Parse()
 	if !flag.Parsed() || !flags.valid() {
 		printUsage()
@@ -65,16 +94,28 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(flags.only) > 0 {
+		var names []fidlgen.EncodedCompoundIdentifier
+		for _, name := range flags.only {
+			names = append(names, fidlgen.EncodedCompoundIdentifier(name))
+		}
+		if fidl, err = fidl.Subset(names...); err != nil {
+			log.Fatalf("Error: invalid -only: %v", err)
+		}
+	}
 	tree := codegen.Compile(fidl)
 
 	generator := codegen.NewFidlGenerator(*flags.dart)
 
+	var outputs []string
+
 	outAsyncPath := *flags.outAsyncPath
 	if outAsyncPath != "" {
 		err := generator.GenerateAsyncFile(tree, outAsyncPath)
 		if err != nil {
 			log.Fatalf("Error: %v", err)
 		}
+		outputs = append(outputs, outAsyncPath)
 	}
 
 	outTestPath := *flags.outTestPath
@@ -83,5 +124,14 @@ func main() {
 		if err != nil {
 			log.Fatalf("Error: %v", err)
 		}
+		outputs = append(outputs, outTestPath)
+	}
+
+	// The JSON IR is the only file read to produce the bindings: it already
+	// contains everything needed from the library's dependencies.
+	if *flags.depfile != "" && len(outputs) > 0 {
+		if err := writeDepfile(*flags.depfile, outputs, []string{*flags.jsonPath}); err != nil {
+			log.Fatalf("Error writing depfile: %v", err)
+		}
 	}
 }
@@ -0,0 +1,45 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapeDepfilePath(t *testing.T) {
+	for _, ex := range []struct {
+		path, want string
+	}{
+		{path: "gen/fidl_async.dart", want: "gen/fidl_async.dart"},
+		{path: "my dir/a b.json", want: `my\ dir/a\ b.json`},
+		{path: "gen/$out.dart", want: "gen/$$out.dart"},
+		{path: "gen/#1.dart", want: `gen/\#1.dart`},
+		{path: `gen\a.dart`, want: `gen\\a.dart`},
+		{path: "$a b#c", want: `$$a\ b\#c`},
+	} {
+		if got := escapeDepfilePath(ex.path); got != ex.want {
+			t.Errorf("got escapeDepfilePath(%q) = %q, want = %q", ex.path, got, ex.want)
+		}
+	}
+}
+
+func TestWriteDepfile(t *testing.T) {
+	depfile := filepath.Join(t.TempDir(), "out.d")
+	outputs := []string{"gen/fidl_async.dart", "gen/fidl test.dart"}
+	inputs := []string{"ir.json", "$dep.json"}
+	if err := writeDepfile(depfile, outputs, inputs); err != nil {
+		t.Fatalf("writeDepfile(_, %q, %q) = %s", outputs, inputs, err)
+	}
+	got, err := os.ReadFile(depfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "gen/fidl_async.dart gen/fidl\\ test.dart: ir.json $$dep.json\n"
+	if string(got) != want {
+		t.Errorf("got depfile %q, want %q", got, want)
+	}
+}
@@ -6,6 +6,7 @@ package codegen
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
@@ -18,6 +19,7 @@ const (
 	ResponseSuffix  = "Response"
 	EventSuffix     = "Event"
 	HandlesSuffix   = "Handles"
+	EnvelopeSuffix  = "Envelope"
 )
 
 // Type represents a syzkaller type including type-options.
@@ -56,6 +58,15 @@ type Union struct {
 	VarLen  bool
 }
 
+// Resource represents a syzkaller resource derived from another resource.
+// Handles of the resource are produced by replacing a handle of the base
+// resource with one that only has the given rights.
+type Resource struct {
+	Name   string
+	Base   string
+	Rights string
+}
+
 // Protocol represents a FIDL protocol in terms of syzkaller structures.
 type Protocol struct {
 	Name string
@@ -119,6 +130,9 @@ type Root struct {
 
 	// Bits correspond to syzkaller flags.
 	Bits []Bits
+
+	// Resources correspond to syzkaller resources for handles with restricted rights.
+	Resources []Resource
 }
 
 type StructMap map[fidlgen.EncodedCompoundIdentifier]fidlgen.Struct
@@ -147,6 +161,9 @@ type compiler struct {
 
 	// anonymous structs used only as method request/response messageBodyStructs
 	messageBodyStructs map[fidlgen.EncodedCompoundIdentifier]*fidlgen.Struct
+
+	// resources contain the resources for handles with restricted rights, by name.
+	resources map[string]Resource
 }
 
 var reservedWords = map[string]struct{}{
@@ -217,6 +234,32 @@ var handleSubtypes = map[fidlgen.HandleSubtype]string{
 	fidlgen.Vmo:          "zx_vmo",
 }
 
+var handleRights = []struct {
+	right fidlgen.HandleRights
+	name  string
+}{
+	{fidlgen.HandleRightsDuplicate, "duplicate"},
+	{fidlgen.HandleRightsTransfer, "transfer"},
+	{fidlgen.HandleRightsRead, "read"},
+	{fidlgen.HandleRightsWrite, "write"},
+	{fidlgen.HandleRightsExecute, "execute"},
+	{fidlgen.HandleRightsMap, "map"},
+	{fidlgen.HandleRightsGetProperty, "get_property"},
+	{fidlgen.HandleRightsSetProperty, "set_property"},
+	{fidlgen.HandleRightsEnumerate, "enumerate"},
+	{fidlgen.HandleRightsDestroy, "destroy"},
+	{fidlgen.HandleRightsSetPolicy, "set_policy"},
+	{fidlgen.HandleRightsGetPolicy, "get_policy"},
+	{fidlgen.HandleRightsSignal, "signal"},
+	{fidlgen.HandleRightsSignalPeer, "signal_peer"},
+	{fidlgen.HandleRightsWait, "wait"},
+	{fidlgen.HandleRightsInspect, "inspect"},
+	{fidlgen.HandleRightsManageJob, "manage_job"},
+	{fidlgen.HandleRightsManageProcess, "manage_process"},
+	{fidlgen.HandleRightsManageThread, "manage_thread"},
+	{fidlgen.HandleRightsApplyProfile, "apply_profile"},
+}
+
 func isReservedWord(str string) bool {
 	_, ok := reservedWords[str]
 	return ok
@@ -277,6 +320,44 @@ func (c *compiler) compileHandleSubtype(val fidlgen.HandleSubtype) Type {
 	panic(fmt.Sprintf("unknown handle type: %v", val))
 }
 
+// compileHandleType returns the resource for a handle with the given subtype
+// and rights. A handle with restricted rights gets a resource derived from the
+// one of its subtype, so that it is only given handles with matching rights.
+func (c *compiler) compileHandleType(subtype fidlgen.HandleSubtype, rights fidlgen.HandleRights) Type {
+	base := c.compileHandleSubtype(subtype)
+	if rights&fidlgen.HandleRightsSameRights != 0 {
+		return base
+	}
+
+	var names []string
+	remaining := rights
+	for _, r := range handleRights {
+		if remaining&r.right != 0 {
+			names = append(names, r.name)
+			remaining &^= r.right
+		}
+	}
+	if remaining != 0 {
+		names = append(names, fmt.Sprintf("unknown%x", uint32(remaining)))
+	}
+	if len(names) == 0 {
+		names = append(names, "none")
+	}
+
+	name := fmt.Sprintf("%s_%s_%s", base, formatLibrary(c.library, "_"), strings.Join(names, "_"))
+	c.resources[name] = Resource{Name: name, Base: string(base), Rights: fmt.Sprintf("%#x", uint32(rights))}
+	return Type(name)
+}
+
+// compileOutOfLineHandle returns the type of a handle in the handles of a
+// message. A nullable handle may be absent, in which case it takes no space.
+func compileOutOfLineHandle(t Type, nullable bool) Type {
+	if nullable {
+		return Type(fmt.Sprintf("array[%s, 0:1]", t))
+	}
+	return t
+}
+
 func (c *compiler) compileEnum(val fidlgen.Enum) Enum {
 	e := Enum{
 		Name: c.compileCompoundIdentifier(val.Name, ""),
@@ -322,7 +403,7 @@ func (c *compiler) compileStructMember(p fidlgen.StructMember) (StructMember, *S
 
 		// Out-of-line handles
 		h = &StructMember{
-			Type: c.compileHandleSubtype(p.Type.HandleSubtype),
+			Type: compileOutOfLineHandle(c.compileHandleType(p.Type.HandleSubtype, p.Type.HandleRights), p.Type.Nullable),
 			Name: c.compileIdentifier(p.Name, ""),
 		}
 	case fidlgen.RequestType:
@@ -333,7 +414,7 @@ func (c *compiler) compileStructMember(p fidlgen.StructMember) (StructMember, *S
 
 		// Out-of-line handles
 		h = &StructMember{
-			Type: Type(fmt.Sprintf("zx_chan_%s_server", c.compileCompoundIdentifier(p.Type.RequestSubtype, ""))),
+			Type: compileOutOfLineHandle(Type(fmt.Sprintf("zx_chan_%s_server", c.compileCompoundIdentifier(p.Type.RequestSubtype, ""))), p.Type.Nullable),
 			Name: c.compileIdentifier(p.Name, ""),
 		}
 	case fidlgen.ArrayType:
@@ -430,7 +511,7 @@ func (c *compiler) compileStructMember(p fidlgen.StructMember) (StructMember, *S
 
 			// Out-of-line handles
 			h = &StructMember{
-				Type: Type(fmt.Sprintf("zx_chan_%s_client", c.compileCompoundIdentifier(p.Type.Identifier, ""))),
+				Type: compileOutOfLineHandle(Type(fmt.Sprintf("zx_chan_%s_client", c.compileCompoundIdentifier(p.Type.Identifier, ""))), p.Type.Nullable),
 				Name: c.compileIdentifier(p.Name, ""),
 			}
 		case fidlgen.UnionDeclType:
@@ -460,6 +541,24 @@ func (c *compiler) compileStructMember(p fidlgen.StructMember) (StructMember, *S
 					Name: c.compileIdentifier(p.Name, ""),
 				}
 			}
+		case fidlgen.TableDeclType:
+			// Constant-size, in-line data
+			i = StructMember{
+				Type: Type("fidl_vector"),
+				Name: c.compileIdentifier(p.Name, InLineSuffix),
+			}
+
+			// Variable-size, out-of-line envelopes and data
+			o = &StructMember{
+				Type: Type(c.compileCompoundIdentifier(p.Type.Identifier, OutOfLineSuffix)),
+				Name: c.compileIdentifier(p.Name, OutOfLineSuffix),
+			}
+
+			// Out-of-line handles
+			h = &StructMember{
+				Type: Type(c.compileCompoundIdentifier(p.Type.Identifier, HandlesSuffix)),
+				Name: c.compileIdentifier(p.Name, ""),
+			}
 		case fidlgen.StructDeclType:
 			// Fixed-size, in-line data.
 			i = StructMember{
@@ -566,6 +665,151 @@ func (c *compiler) compileUnion(p fidlgen.Union) ([]StructMember, []StructMember
 	return i, o, h
 }
 
+// envelopeName returns the name of the absent envelope, which is declared
+// once per library that has tables.
+func (c *compiler) envelopeName(ext string) string {
+	return formatLibrary(c.library, "_") + "_fidl_envelope" + ext
+}
+
+// compileEnvelope returns the declaration of the absent envelope named by
+// envelopeName. Present envelopes are declared for each table member by
+// compileTable, since their sizes refer to the data of the member.
+func (c *compiler) compileEnvelope() Struct {
+	return Struct{
+		Name: c.envelopeName("_absent"),
+		Members: []StructMember{
+			{Name: "num_bytes", Type: Type(fmt.Sprintf("const[0, %s]", primitiveTypes[fidlgen.Uint32]))},
+			{Name: "num_handles", Type: Type(fmt.Sprintf("const[0, %s]", primitiveTypes[fidlgen.Uint32]))},
+			{Name: "presence", Type: Type(fmt.Sprintf("const[0, %s]", primitiveTypes[fidlgen.Uint64]))},
+		},
+	}
+}
+
+// tableMemberName returns the name of a declaration generated for the given
+// member of the table.
+func (c *compiler) tableMemberName(table fidlgen.EncodedCompoundIdentifier, member fidlgen.Identifier, ext string) string {
+	return c.compileCompoundIdentifier(table, "_"+c.compileIdentifier(member, ext))
+}
+
+// optional returns a union of t and void, named after the given member of
+// the table.
+func (c *compiler) optional(table fidlgen.EncodedCompoundIdentifier, member fidlgen.Identifier, ext string, t Type) Union {
+	return Union{
+		Name: c.tableMemberName(table, member, ext),
+		Members: []StructMember{
+			{Name: "present", Type: t},
+			{Name: "void", Type: "void"},
+		},
+		VarLen: true,
+	}
+}
+
+// compileTable returns the members of the out-of-line and handles structs of
+// a table, and the structs and unions they use. The out-of-line data starts
+// with an envelope for every ordinal up to the largest one, reserved or not,
+// since a flexible table may hold unknown members. It is followed by the data
+// of each member, which may be absent.
+//
+// The envelope of a member is either absent or present. A present envelope
+// records the size of the member's data, and at most as many handles as the
+// member can hold. Envelopes of reserved ordinals are always absent, since no
+// data is described for them.
+func (c *compiler) compileTable(p fidlgen.Table) (members, members, []Struct, []Union) {
+	var envelopes, data, handles members
+	var structs []Struct
+	var unions []Union
+
+	byOrdinal := make(map[int]fidlgen.TableMember)
+	maxOrdinal := 0
+	for _, m := range p.Members {
+		byOrdinal[m.Ordinal] = m
+		if m.Ordinal > maxOrdinal {
+			maxOrdinal = m.Ordinal
+		}
+	}
+
+	outOfLineName := c.compileCompoundIdentifier(p.Name, OutOfLineSuffix)
+	for ordinal := 1; ordinal <= maxOrdinal; ordinal++ {
+		m, ok := byOrdinal[ordinal]
+		if !ok || m.Reserved {
+			envelopes = append(envelopes, StructMember{
+				Type: Type(c.envelopeName("_absent")),
+				Name: fmt.Sprintf("reserved%d%s", ordinal, EnvelopeSuffix),
+			})
+			continue
+		}
+
+		inLine, outOfLine, handle := c.compileStructMember(fidlgen.StructMember{
+			Type: m.Type,
+			Name: m.Name,
+		})
+
+		// The data of a member is its in-line part, aligned to 8 bytes,
+		// followed by its out-of-line part.
+		content := Struct{
+			Name: c.tableMemberName(p.Name, m.Name, "Content"),
+			Members: []StructMember{
+				{Type: Type(fmt.Sprintf("fidl_aligned[%s]", inLine.Type)), Name: inLine.Name},
+			},
+		}
+		if outOfLine != nil {
+			content.Members = append(content.Members, *outOfLine)
+		}
+		structs = append(structs, content)
+		dataName := c.compileIdentifier(m.Name, "Data")
+		u := c.optional(p.Name, m.Name, "Data", Type(content.Name))
+		unions = append(unions, u)
+		data = append(data, StructMember{Type: Type(u.Name), Name: dataName})
+
+		numHandles := fmt.Sprintf("const[0, %s]", primitiveTypes[fidlgen.Uint32])
+		if handle != nil {
+			numHandles = fmt.Sprintf("%s[0:%d]", primitiveTypes[fidlgen.Uint32], m.Type.TypeShapeV1.MaxHandles)
+			u := c.optional(p.Name, m.Name, HandlesSuffix, handle.Type)
+			unions = append(unions, u)
+			handles = append(handles, StructMember{Type: Type(u.Name), Name: handle.Name})
+		}
+
+		present := Struct{
+			Name: c.tableMemberName(p.Name, m.Name, EnvelopeSuffix) + "_present",
+			Members: []StructMember{
+				{Name: "num_bytes", Type: Type(fmt.Sprintf("bytesize[%s:%s, %s]", outOfLineName, dataName, primitiveTypes[fidlgen.Uint32]))},
+				{Name: "num_handles", Type: Type(numHandles)},
+				{Name: "presence", Type: Type(fmt.Sprintf("const[0xffffffffffffffff, %s]", primitiveTypes[fidlgen.Uint64]))},
+			},
+		}
+		structs = append(structs, present)
+		envelope := Union{
+			Name: c.tableMemberName(p.Name, m.Name, EnvelopeSuffix),
+			Members: []StructMember{
+				{Name: "present", Type: Type(present.Name)},
+				{Name: "absent", Type: Type(c.envelopeName("_absent"))},
+			},
+		}
+		unions = append(unions, envelope)
+		envelopes = append(envelopes, StructMember{
+			Type: Type(envelope.Name),
+			Name: c.compileIdentifier(m.Name, EnvelopeSuffix),
+		})
+	}
+
+	return append(envelopes, data...), handles, structs, unions
+}
+
+// messageBody returns the struct laid out in a message body for the given
+// payload. A table payload is laid out like a struct whose only member is the
+// table.
+func (c *compiler) messageBody(payloadID fidlgen.EncodedCompoundIdentifier) *fidlgen.Struct {
+	if info, ok := c.decls[payloadID]; ok && info.Type == fidlgen.TableDeclType {
+		return &fidlgen.Struct{
+			Members: []fidlgen.StructMember{{
+				Name: "payload",
+				Type: fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: payloadID},
+			}},
+		}
+	}
+	return c.messageBodyStructs[payloadID]
+}
+
 func (c *compiler) compileParameters(name string, ordinal uint64, payload *fidlgen.Struct) (Struct, Struct) {
 	result := c.compileStruct(fidlgen.Struct{})
 	if payload != nil {
@@ -590,7 +834,7 @@ func (c *compiler) compileMethod(protocolName fidlgen.EncodedCompoundIdentifier,
 	if val.HasRequest {
 		var payload *fidlgen.Struct
 		if payloadID, ok := val.GetRequestPayloadIdentifier(); ok {
-			payload = c.messageBodyStructs[payloadID]
+			payload = c.messageBody(payloadID)
 		}
 		request, requestHandles := c.compileParameters(r.Name+RequestSuffix, r.Ordinal, payload)
 		r.Request = &request
@@ -601,7 +845,7 @@ func (c *compiler) compileMethod(protocolName fidlgen.EncodedCompoundIdentifier,
 	if val.HasResponse {
 		var payload *fidlgen.Struct
 		if payloadID, ok := val.GetResponsePayloadIdentifier(); ok {
-			payload = c.messageBodyStructs[payloadID]
+			payload = c.messageBody(payloadID)
 		}
 		suffix := ResponseSuffix
 		if !val.HasRequest {
@@ -638,6 +882,7 @@ func compile(fidlData fidlgen.Root) Root {
 		bits:               make(BitsMap),
 		library:            libraryName,
 		messageBodyStructs: make(map[fidlgen.EncodedCompoundIdentifier]*fidlgen.Struct),
+		resources:          make(map[string]Resource),
 	}
 
 	// Do a first pass of the protocols, creating a set of all names of types that are used as a
@@ -692,6 +937,26 @@ func compile(fidlData fidlgen.Root) Root {
 		}
 	}
 
+	if len(fidlData.Tables) > 0 {
+		root.Structs = append(root.Structs, c.compileEnvelope())
+	}
+
+	for _, v := range fidlData.Tables {
+		outOfLine, handles, structs, unions := c.compileTable(v)
+		root.Structs = append(root.Structs, structs...)
+		root.Structs = append(root.Structs, Struct{
+			Name:    c.compileCompoundIdentifier(v.Name, OutOfLineSuffix),
+			Members: outOfLine.voidIfEmpty(),
+		})
+
+		root.Structs = append(root.Structs, Struct{
+			Name:    c.compileCompoundIdentifier(v.Name, HandlesSuffix),
+			Members: handles.voidIfEmpty(),
+		})
+
+		root.Unions = append(root.Unions, unions...)
+	}
+
 	for _, v := range fidlData.Unions {
 		c.unions[v.Name] = v
 
@@ -750,5 +1015,12 @@ func compile(fidlData fidlgen.Root) Root {
 		}
 	}
 
+	for _, r := range c.resources {
+		root.Resources = append(root.Resources, r)
+	}
+	sort.Slice(root.Resources, func(i, j int) bool {
+		return root.Resources[i].Name < root.Resources[j].Name
+	})
+
 	return root
 }
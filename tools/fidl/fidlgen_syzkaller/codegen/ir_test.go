@@ -0,0 +1,156 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgentest"
+)
+
+func TestHandleRights(t *testing.T) {
+	root := compile(fidlgentest.EndToEndTest{T: t}.Single(`library example;
+
+	type obj_type = strict enum : uint32 {
+		NONE = 0;
+		VMO = 3;
+		CHANNEL = 4;
+	};
+
+	type rights = strict bits : uint32 {
+		READ = 0x04;
+		WRITE = 0x08;
+	};
+
+	resource_definition handle : uint32 {
+		properties {
+			subtype obj_type;
+			rights rights;
+		};
+	};
+
+	type Handles = resource struct {
+		channel handle:<CHANNEL, rights.READ | rights.WRITE>;
+		vmo handle:<VMO, optional>;
+	};`))
+
+	wantResources := []Resource{
+		{Name: "zx_chan_example_read_write", Base: "zx_chan", Rights: "0xc"},
+	}
+	if diff := cmp.Diff(wantResources, root.Resources); diff != "" {
+		t.Errorf("Resources mismatch (-want +got):\n%s", diff)
+	}
+
+	var handles *Struct
+	for i, s := range root.Structs {
+		if s.Name == "example_HandlesHandles" {
+			handles = &root.Structs[i]
+		}
+	}
+	if handles == nil {
+		t.Fatalf("no example_HandlesHandles struct in %+v", root.Structs)
+	}
+	wantMembers := []StructMember{
+		{Name: "channel", Type: "zx_chan_example_read_write"},
+		{Name: "vmo", Type: "array[zx_vmo, 0:1]"},
+	}
+	if diff := cmp.Diff(wantMembers, handles.Members); diff != "" {
+		t.Errorf("example_HandlesHandles members mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTableEnvelopes(t *testing.T) {
+	root := compile(fidlgentest.EndToEndTest{T: t}.Single(`library example;
+
+	type obj_type = strict enum : uint32 {
+		NONE = 0;
+		VMO = 3;
+	};
+
+	resource_definition handle : uint32 {
+		properties {
+			subtype obj_type;
+		};
+	};
+
+	type Table = resource table {
+		1: value uint32;
+		2: reserved;
+		3: vmo handle:VMO;
+	};`))
+
+	structs := make(map[string][]StructMember)
+	for _, s := range root.Structs {
+		structs[s.Name] = s.Members
+	}
+	unions := make(map[string][]StructMember)
+	for _, u := range root.Unions {
+		unions[u.Name] = u.Members
+	}
+
+	for _, ex := range []struct {
+		name string
+		got  map[string][]StructMember
+		want []StructMember
+	}{
+		{
+			name: "example_TableOutOfLine",
+			got:  structs,
+			want: []StructMember{
+				{Name: "valueEnvelope", Type: "example_Table_valueEnvelope"},
+				{Name: "reserved2Envelope", Type: "example_fidl_envelope_absent"},
+				{Name: "vmoEnvelope", Type: "example_Table_vmoEnvelope"},
+				{Name: "valueData", Type: "example_Table_valueData"},
+				{Name: "vmoData", Type: "example_Table_vmoData"},
+			},
+		},
+		{
+			name: "example_Table_valueEnvelope",
+			got:  unions,
+			want: []StructMember{
+				{Name: "present", Type: "example_Table_valueEnvelope_present"},
+				{Name: "absent", Type: "example_fidl_envelope_absent"},
+			},
+		},
+		{
+			name: "example_Table_valueEnvelope_present",
+			got:  structs,
+			want: []StructMember{
+				{Name: "num_bytes", Type: "bytesize[example_TableOutOfLine:valueData, int32]"},
+				{Name: "num_handles", Type: "const[0, int32]"},
+				{Name: "presence", Type: "const[0xffffffffffffffff, int64]"},
+			},
+		},
+		{
+			name: "example_Table_vmoEnvelope_present",
+			got:  structs,
+			want: []StructMember{
+				{Name: "num_bytes", Type: "bytesize[example_TableOutOfLine:vmoData, int32]"},
+				{Name: "num_handles", Type: "int32[0:1]"},
+				{Name: "presence", Type: "const[0xffffffffffffffff, int64]"},
+			},
+		},
+		{
+			name: "example_fidl_envelope_absent",
+			got:  structs,
+			want: []StructMember{
+				{Name: "num_bytes", Type: "const[0, int32]"},
+				{Name: "num_handles", Type: "const[0, int32]"},
+				{Name: "presence", Type: "const[0, int64]"},
+			},
+		},
+	} {
+		got, ok := ex.got[ex.name]
+		if !ok {
+			t.Errorf("%s is not declared", ex.name)
+			continue
+		}
+		if diff := cmp.Diff(ex.want, got); diff != "" {
+			t.Errorf("%s members mismatch (-want +got):\n%s", ex.name, diff)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 type flagsDef struct {
 	jsonPath   *string
 	outputPath *string
+	protocols  fidlgen.ListOfStrings
 }
 
 var flags = flagsDef{
@@ -45,8 +46,25 @@ Flags:
 	flag.PrintDefaults()
 }
 
+// subsetForProtocols returns the subset of root containing the named protocols
+// and the declarations they transitively reference.
+func subsetForProtocols(root fidlgen.Root, names []string) (fidlgen.Root, error) {
+	var protocols []fidlgen.EncodedCompoundIdentifier
+	for _, name := range names {
+		name := fidlgen.EncodedCompoundIdentifier(name)
+		if _, ok := root.LookupDecl(name).(*fidlgen.Protocol); !ok {
+			return fidlgen.Root{}, fmt.Errorf("%s is not a protocol declared in library %s", name, root.Name)
+		}
+		protocols = append(protocols, name)
+	}
+	return root.Subset(protocols...)
+}
+
 func main() {
 	flag.Usage = printUsage
+	flag.Var(&flags.protocols, "protocol",
+		"fully-qualified name of a protocol to generate descriptions for, e.g. "+
+			"fuchsia.foo/Bar. May be repeated. Defaults to every protocol of the library.")
 	flag.Parse()
 	if !flag.Parsed() || !flags.valid() {
 		printUsage()
@@ -57,6 +75,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to read JSON: %v", err)
 	}
+	if len(flags.protocols) > 0 {
+		if root, err = subsetForProtocols(root, flags.protocols); err != nil {
+			log.Fatalf("Invalid -protocol: %v", err)
+		}
+	}
 
 	generator := codegen.NewGenerator()
 	err = generator.GenerateSyscallDescription(*flags.outputPath, root)
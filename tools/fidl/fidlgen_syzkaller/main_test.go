@@ -0,0 +1,51 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+func TestSubsetForProtocols(t *testing.T) {
+	input := `{
+		"name": "example",
+		"interface_declarations": [
+			{"name": "example/Empty", "methods": []}
+		],
+		"struct_declarations": [
+			{"name": "example/Point", "members": []}
+		],
+		"declaration_order": ["example/Empty", "example/Point"],
+		"declarations": {
+			"example/Empty": "interface",
+			"example/Point": "struct"
+		}
+	}`
+	root, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+
+	subset, err := subsetForProtocols(root, []string{"example/Empty"})
+	if err != nil {
+		t.Fatalf("subsetForProtocols(_, [example/Empty]) = %s", err)
+	}
+	if len(subset.Protocols) != 1 || len(subset.Structs) != 0 {
+		t.Errorf("got subset with protocols %+v and structs %+v, want only example/Empty", subset.Protocols, subset.Structs)
+	}
+
+	for _, names := range [][]string{
+		{"example/Point"},
+		{"example/Missing"},
+		{"example/Empty", "example/Point"},
+	} {
+		if _, err := subsetForProtocols(root, names); err == nil {
+			t.Errorf("got subsetForProtocols(_, %s) = nil, want an error", names)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen
+
+import "strings"
+
+// ListOfStrings is a flag.Value which collects the values of a flag that may
+// be repeated.
+type ListOfStrings []string
+
+func (l *ListOfStrings) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *ListOfStrings) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
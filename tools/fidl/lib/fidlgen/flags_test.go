@@ -0,0 +1,27 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestListOfStrings(t *testing.T) {
+	var l ListOfStrings
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&l, "value", "")
+	if err := fs.Parse([]string{"-value", "a", "-value=b c"}); err != nil {
+		t.Fatalf("Parse(_) = %s", err)
+	}
+	if diff := cmp.Diff(ListOfStrings{"a", "b c"}, l); diff != "" {
+		t.Errorf("values mismatch (-want +got):\n%s", diff)
+	}
+	if got, want := l.String(), "a b c"; got != want {
+		t.Errorf("got String() = %q, want = %q", got, want)
+	}
+}
@@ -4,6 +4,8 @@
 
 package fidlgen
 
+import "unicode"
+
 type NameContext struct {
 	names map[string]struct{}
 }
@@ -22,3 +24,110 @@ func (nc NameContext) ReserveNames(names []string) {
 		nc.names[n] = struct{}{}
 	}
 }
+
+// languageKeywords holds the keywords of each target language, keyed by the
+// language name accepted by IsReservedKeyword.
+var languageKeywords = map[string]map[string]struct{}{
+	// https://dart.dev/guides/language/language-tour#keywords
+	"dart": toSet([]string{
+		"abstract", "as", "assert", "async", "await", "break", "case",
+		"catch", "class", "const", "continue", "covariant", "default",
+		"deferred", "do", "dynamic", "else", "enum", "export", "extends",
+		"extension", "external", "factory", "false", "final", "finally",
+		"for", "Function", "get", "hide", "if", "implements", "import", "in",
+		"interface", "is", "late", "library", "mixin", "new", "null", "on",
+		"operator", "part", "required", "rethrow", "return", "set", "show",
+		"static", "super", "switch", "sync", "this", "throw", "true", "try",
+		"typedef", "var", "void", "while", "with", "yield"}),
+	// https://doc.rust-lang.org/reference/keywords.html
+	"rust": toSet([]string{
+		"as", "async", "await", "break", "const", "continue", "crate", "dyn",
+		"else", "enum", "extern", "false", "fn", "for", "if", "impl", "in",
+		"let", "loop", "match", "mod", "move", "mut", "pub", "ref", "return",
+		"self", "Self", "static", "struct", "super", "trait", "true", "type",
+		"unsafe", "use", "where", "while", "abstract", "become", "box", "do",
+		"final", "macro", "override", "priv", "try", "typeof", "unsized",
+		"virtual", "yield"}),
+	// https://go.dev/ref/spec#Keywords
+	"go": toSet([]string{
+		"break", "case", "chan", "const", "continue", "default", "defer",
+		"else", "fallthrough", "for", "func", "go", "goto", "if", "import",
+		"interface", "map", "package", "range", "return", "select", "struct",
+		"switch", "type", "var"}),
+	// https://en.cppreference.com/w/cpp/keyword
+	"cpp": toSet([]string{
+		"alignas", "alignof", "and_eq", "and", "asm", "atomic_cancel",
+		"atomic_commit", "atomic_noexcept", "auto", "bitand", "bitor",
+		"bool", "break", "case", "catch", "char", "char8_t", "char16_t",
+		"char32_t", "class", "co_await", "co_return", "co_yield", "compl",
+		"concept", "const_cast", "const", "consteval", "constexpr",
+		"constinit", "continue", "decltype", "default", "delete", "do",
+		"double", "dynamic_cast", "else", "enum", "explicit", "export",
+		"extern", "false", "float", "for", "friend", "goto", "if", "inline",
+		"int", "long", "mutable", "namespace", "new", "noexcept", "not_eq",
+		"not", "nullptr", "operator", "or_eq", "or", "private", "protected",
+		"public", "reflexpr", "register", "reinterpret_cast", "requires",
+		"return", "short", "signed", "sizeof", "static_assert",
+		"static_cast", "static", "struct", "switch", "synchronized",
+		"template", "this", "thread_local", "throw", "true", "try", "typedef",
+		"typeid", "typename", "union", "unsigned", "using", "virtual", "void",
+		"volatile", "wchar_t", "while", "xor_eq", "xor"}),
+}
+
+// identifierEscapeSuffixes holds the suffix each target language's bindings
+// append to identifiers colliding with a keyword.
+var identifierEscapeSuffixes = map[string]string{
+	"dart": "$",
+	"rust": "_",
+	"go":   "_",
+	"cpp":  "_",
+}
+
+// nonASCIIIdentifierLanguages holds the target languages that allow non-ASCII
+// letters in identifiers. Dart identifiers are limited to ASCII, and support
+// for non-ASCII identifiers varies across C++ compilers.
+var nonASCIIIdentifierLanguages = toSet([]string{"rust", "go"})
+
+func toSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		set[n] = struct{}{}
+	}
+	return set
+}
+
+// IsReservedKeyword returns true if name is a keyword of the target language,
+// one of "dart", "rust", "go" or "cpp". It returns false for any other
+// language.
+func IsReservedKeyword(name string, language string) bool {
+	_, ok := languageKeywords[language][name]
+	return ok
+}
+
+// EscapeIdentifier returns name escaped following the convention of the target
+// language's bindings if it is a keyword of the language, and name otherwise.
+func EscapeIdentifier(name string, language string) string {
+	if IsReservedKeyword(name, language) {
+		return name + identifierEscapeSuffixes[language]
+	}
+	return name
+}
+
+// IsUnsupportedIdentifier returns true if name contains non-ASCII characters
+// and the target language, one of "dart", "rust", "go" or "cpp", does not allow
+// them in identifiers. Such names cannot be escaped. It returns false for any
+// other language.
+func IsUnsupportedIdentifier(name string, language string) bool {
+	if _, ok := languageKeywords[language]; !ok {
+		return false
+	}
+	if _, ok := nonASCIIIdentifierLanguages[language]; ok {
+		return false
+	}
+	for _, r := range name {
+		if r > unicode.MaxASCII {
+			return true
+		}
+	}
+	return false
+}
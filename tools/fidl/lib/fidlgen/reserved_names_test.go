@@ -0,0 +1,65 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen
+
+import (
+	"testing"
+)
+
+func TestReservedKeywords(t *testing.T) {
+	type testCase struct {
+		name     string
+		language string
+		reserved bool
+		escaped  string
+	}
+	tests := []testCase{
+		{name: "await", language: "dart", reserved: true, escaped: "await$"},
+		{name: "required", language: "dart", reserved: true, escaped: "required$"},
+		{name: "fn", language: "dart", reserved: false, escaped: "fn"},
+		{name: "fn", language: "rust", reserved: true, escaped: "fn_"},
+		{name: "Self", language: "rust", reserved: true, escaped: "Self_"},
+		{name: "self", language: "rust", reserved: true, escaped: "self_"},
+		{name: "func", language: "rust", reserved: false, escaped: "func"},
+		{name: "func", language: "go", reserved: true, escaped: "func_"},
+		{name: "chan", language: "go", reserved: true, escaped: "chan_"},
+		{name: "class", language: "go", reserved: false, escaped: "class"},
+		{name: "class", language: "cpp", reserved: true, escaped: "class_"},
+		{name: "co_await", language: "cpp", reserved: true, escaped: "co_await_"},
+		{name: "chan", language: "cpp", reserved: false, escaped: "chan"},
+		{name: "class", language: "unknown", reserved: false, escaped: "class"},
+	}
+	for _, tc := range tests {
+		if got := IsReservedKeyword(tc.name, tc.language); got != tc.reserved {
+			t.Errorf("IsReservedKeyword(%q, %q): expected %t, got %t", tc.name, tc.language, tc.reserved, got)
+		}
+		if got := EscapeIdentifier(tc.name, tc.language); got != tc.escaped {
+			t.Errorf("EscapeIdentifier(%q, %q): expected %q, got %q", tc.name, tc.language, tc.escaped, got)
+		}
+	}
+}
+
+func TestUnsupportedIdentifiers(t *testing.T) {
+	type testCase struct {
+		name        string
+		language    string
+		unsupported bool
+	}
+	tests := []testCase{
+		{name: "café", language: "dart", unsupported: true},
+		{name: "cafe", language: "dart", unsupported: false},
+		{name: "café", language: "cpp", unsupported: true},
+		{name: "名前", language: "cpp", unsupported: true},
+		{name: "cafe", language: "cpp", unsupported: false},
+		{name: "café", language: "rust", unsupported: false},
+		{name: "名前", language: "go", unsupported: false},
+		{name: "café", language: "unknown", unsupported: false},
+	}
+	for _, tc := range tests {
+		if got := IsUnsupportedIdentifier(tc.name, tc.language); got != tc.unsupported {
+			t.Errorf("IsUnsupportedIdentifier(%q, %q): expected %t, got %t", tc.name, tc.language, tc.unsupported, got)
+		}
+	}
+}
@@ -6,9 +6,12 @@ package fidlgen
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"sort"
 	"strconv"
@@ -35,15 +38,26 @@ func ReadJSONIr(filename string) (Root, error) {
 	if err != nil {
 		return Root{}, fmt.Errorf("Error reading from %s: %w", filename, err)
 	}
-	return DecodeJSONIr(f)
+	defer f.Close()
+	return DecodeJSONIrNamed(filename, f)
 }
 
 // DecodeJSONIr reads the JSON content from a reader.
 func DecodeJSONIr(r io.Reader) (Root, error) {
+	return DecodeJSONIrNamed("", r)
+}
+
+// DecodeJSONIrNamed reads the JSON content from a reader like DecodeJSONIr.
+// The name describes where the content comes from, such as a file name, and is
+// only used in error messages.
+func DecodeJSONIrNamed(name string, r io.Reader) (Root, error) {
 	d := json.NewDecoder(r)
 	var root Root
 	if err := d.Decode(&root); err != nil {
-		return Root{}, fmt.Errorf("Error parsing JSON IR: %w", err)
+		if name == "" {
+			return Root{}, fmt.Errorf("Error parsing JSON IR: %w", err)
+		}
+		return Root{}, fmt.Errorf("Error parsing JSON IR from %s: %w", name, err)
 	}
 
 	root.initializeDeclarationsMap()
@@ -51,11 +65,40 @@ func DecodeJSONIr(r io.Reader) (Root, error) {
 	return root, nil
 }
 
+// DecodeJSONIrStrict reads the JSON content from a reader like DecodeJSONIr,
+// and additionally verifies the consistency of the IR with CheckDeclOrder and
+// Validate.
+func DecodeJSONIrStrict(r io.Reader) (Root, error) {
+	root, err := DecodeJSONIr(r)
+	if err != nil {
+		return Root{}, err
+	}
+	if err := root.CheckDeclOrder(); err != nil {
+		return Root{}, fmt.Errorf("Error validating JSON IR: %w", err)
+	}
+	if err := root.Validate(); err != nil {
+		return Root{}, fmt.Errorf("Error validating JSON IR: %w", err)
+	}
+	return root, nil
+}
+
 // ReadJSONIrContent reads JSON IR content.
 func ReadJSONIrContent(b []byte) (Root, error) {
 	return DecodeJSONIr(bytes.NewReader(b))
 }
 
+// EncodeJSON writes the JSON IR for the root to a writer, in the same schema
+// consumed by DecodeJSONIr. Only the serialized IR is written; derived state
+// such as the declarations map is rebuilt when the output is decoded.
+func (r *Root) EncodeJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(r); err != nil {
+		return fmt.Errorf("Error encoding JSON IR: %w", err)
+	}
+	return nil
+}
+
 type Identifier string
 
 type LibraryIdentifier []Identifier
@@ -183,6 +226,17 @@ var unsignedSubtypes = map[PrimitiveSubtype]struct{}{
 	Uint64: {},
 }
 
+var integerSubtypeBitSizes = map[PrimitiveSubtype]int{
+	Int8:   8,
+	Int16:  16,
+	Int32:  32,
+	Int64:  64,
+	Uint8:  8,
+	Uint16: 16,
+	Uint32: 32,
+	Uint64: 64,
+}
+
 // IsSigned indicates whether this subtype represents a signed number such as
 // `int16`, or `float32`.
 func (typ PrimitiveSubtype) IsSigned() bool {
@@ -427,6 +481,37 @@ type Type struct {
 	TypeShapeV2       TypeShape
 }
 
+// RequiresV2 reports whether the type uses features that require the v2 wire
+// format.
+func (t *Type) RequiresV2() bool {
+	return t.TypeShapeV2.RequiresV2(t.TypeShapeV1)
+}
+
+// Equal reports whether t and other are structurally identical, comparing
+// their element types and element counts by value rather than by pointer. Nil
+// types are only equal to each other.
+func (t *Type) Equal(other *Type) bool {
+	if t == nil || other == nil {
+		return t == other
+	}
+	if (t.ElementCount == nil) != (other.ElementCount == nil) ||
+		(t.ElementCount != nil && *t.ElementCount != *other.ElementCount) {
+		return false
+	}
+	return t.Kind == other.Kind &&
+		t.HandleSubtype == other.HandleSubtype &&
+		t.HandleRights == other.HandleRights &&
+		t.RequestSubtype == other.RequestSubtype &&
+		t.PrimitiveSubtype == other.PrimitiveSubtype &&
+		t.Identifier == other.Identifier &&
+		t.Nullable == other.Nullable &&
+		t.ProtocolTransport == other.ProtocolTransport &&
+		t.ObjType == other.ObjType &&
+		t.TypeShapeV1 == other.TypeShapeV1 &&
+		t.TypeShapeV2 == other.TypeShapeV2 &&
+		t.ElementType.Equal(other.ElementType)
+}
+
 // UnmarshalJSON customizes the JSON unmarshalling for Type.
 func (t *Type) UnmarshalJSON(b []byte) error {
 	var obj map[string]*json.RawMessage
@@ -543,6 +628,54 @@ func (t *Type) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalJSON customizes the JSON marshalling for Type, mirroring
+// UnmarshalJSON.
+func (t Type) MarshalJSON() ([]byte, error) {
+	obj := map[string]interface{}{
+		"kind":          t.Kind,
+		"type_shape_v1": t.TypeShapeV1,
+		"type_shape_v2": t.TypeShapeV2,
+	}
+
+	switch t.Kind {
+	case ArrayType:
+		obj["element_type"] = t.ElementType
+		obj["element_count"] = t.ElementCount
+	case VectorType:
+		obj["element_type"] = t.ElementType
+		if t.ElementCount != nil {
+			obj["maybe_element_count"] = t.ElementCount
+		}
+		obj["nullable"] = t.Nullable
+	case StringType:
+		if t.ElementCount != nil {
+			obj["maybe_element_count"] = t.ElementCount
+		}
+		obj["nullable"] = t.Nullable
+	case HandleType:
+		obj["subtype"] = t.HandleSubtype
+		obj["rights"] = t.HandleRights
+		obj["nullable"] = t.Nullable
+		obj["obj_type"] = t.ObjType
+	case RequestType:
+		obj["subtype"] = t.RequestSubtype
+		obj["nullable"] = t.Nullable
+		obj["protocol_transport"] = t.ProtocolTransport
+	case PrimitiveType:
+		obj["subtype"] = t.PrimitiveSubtype
+	case IdentifierType:
+		obj["identifier"] = t.Identifier
+		obj["nullable"] = t.Nullable
+		if t.ProtocolTransport != "" {
+			obj["protocol_transport"] = t.ProtocolTransport
+		}
+	default:
+		return nil, fmt.Errorf("Unknown type kind: %s", t.Kind)
+	}
+
+	return json.Marshal(obj)
+}
+
 type AttributeArg struct {
 	Name  Identifier `json:"name"`
 	Value Constant   `json:"value"`
@@ -616,6 +749,76 @@ func (el Attributes) DocComments() []string {
 	return strings.Split(docVal[0:len(docVal)-1], "\n")
 }
 
+// MaxBytes returns the byte budget set by the @max_bytes attribute, if any.
+func (el Attributes) MaxBytes() (uint64, bool) {
+	return el.lookupUint64Attribute("max_bytes")
+}
+
+// MaxHandles returns the handle budget set by the @max_handles attribute, if
+// any.
+func (el Attributes) MaxHandles() (uint64, bool) {
+	return el.lookupUint64Attribute("max_handles")
+}
+
+// lookupUint64Attribute returns the numeric value of the standalone argument
+// of the named attribute. Constant references are resolved by fidlc, so the
+// argument's value is used directly.
+func (el Attributes) lookupUint64Attribute(name Identifier) (uint64, bool) {
+	attr, ok := el.LookupAttribute(name)
+	if !ok {
+		return 0, false
+	}
+	arg, ok := attr.LookupArgStandalone()
+	if !ok {
+		return 0, false
+	}
+	val, err := strconv.ParseUint(arg.ValueString(), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+// Version numbers that @available arguments can refer to symbolically.
+const (
+	// VersionHead is the version number of HEAD, which is after every
+	// numbered version.
+	VersionHead uint64 = math.MaxUint64 - 1
+	// VersionLegacy is the version number of LEGACY, which is after HEAD.
+	VersionLegacy uint64 = math.MaxUint64
+)
+
+// Availability returns the versions set by the added, deprecated and removed
+// arguments of the @available attribute. HEAD and LEGACY are returned as
+// VersionHead and VersionLegacy. Arguments that are absent or are not a
+// version are nil. ok is false if there is no @available attribute.
+func (el Attributes) Availability() (added, deprecated, removed *uint64, ok bool) {
+	attr, ok := el.LookupAttribute("available")
+	if !ok {
+		return nil, nil, nil, false
+	}
+	version := func(name Identifier) *uint64 {
+		arg, ok := attr.LookupArg(name)
+		if !ok {
+			return nil
+		}
+		var v uint64
+		switch s := arg.ValueString(); s {
+		case "HEAD":
+			v = VersionHead
+		case "LEGACY":
+			v = VersionLegacy
+		default:
+			var err error
+			if v, err = strconv.ParseUint(s, 10, 64); err != nil {
+				return nil
+			}
+		}
+		return &v
+	}
+	return version("added"), version("deprecated"), version("removed"), true
+}
+
 func (el Attributes) Transports() map[string]struct{} {
 	transports := make(map[string]struct{})
 	attr, ok := el.LookupAttribute("transport")
@@ -634,6 +837,19 @@ func (el Attributes) Transports() map[string]struct{} {
 	return transports
 }
 
+// TransportsSorted returns the transports of Transports in alphabetical
+// order, without duplicates or empty names.
+func (el Attributes) TransportsSorted() []string {
+	transports := []string{}
+	for transport := range el.Transports() {
+		if transport != "" {
+			transports = append(transports, transport)
+		}
+	}
+	sort.Strings(transports)
+	return transports
+}
+
 // BindingsDenylistIncludes returns true if the comma-separated
 // bindings_denylist attribute includes targetLanguage (meaning the bindings for
 // targetLanguage should not emit this declaration).
@@ -665,6 +881,14 @@ type TypeShape struct {
 	HasFlexibleEnvelope bool `json:"has_flexible_envelope"`
 }
 
+// RequiresV2 reports whether a type with this v2 shape and the given v1 shape
+// uses features only the v2 wire format supports. That is the case if the
+// shapes differ, or if the type contains a flexible envelope, whose small
+// payloads are inlined in v2.
+func (s TypeShape) RequiresV2(v1 TypeShape) bool {
+	return s != v1 || s.HasFlexibleEnvelope || v1.HasFlexibleEnvelope
+}
+
 // FieldShape represents the shape of the field on the wire.
 // See JSON IR schema, e.g. fidlc --json-schema
 type FieldShape struct {
@@ -672,6 +896,14 @@ type FieldShape struct {
 	Padding int `json:"padding"`
 }
 
+// WireFormat is a version of the FIDL wire format.
+type WireFormat string
+
+const (
+	WireFormatV1 WireFormat = "v1"
+	WireFormatV2 WireFormat = "v2"
+)
+
 type Declaration interface {
 	GetName() EncodedCompoundIdentifier
 }
@@ -702,6 +934,24 @@ func (nc NamingContext) IsAnonymous() bool {
 	return len(nc) > 1
 }
 
+// TopLevel returns the name of the outermost declaration in the NamingContext, which owns all of the
+// layouts nested within it. It returns an empty string for an empty NamingContext.
+func (nc NamingContext) TopLevel() string {
+	if len(nc) == 0 {
+		return ""
+	}
+	return nc[0]
+}
+
+// ParentContext returns the NamingContext of the declaration enclosing the described one. Top-level
+// declarations have no parent, so nil is returned for them.
+func (nc NamingContext) ParentContext() NamingContext {
+	if len(nc) <= 1 {
+		return nil
+	}
+	return nc[:len(nc)-1]
+}
+
 // scopedNamingContext stores a NamingContext that also includes the library from which that naming
 // context was sourced.  This is useful for comparing identical NamingContexts from different
 // libraries for uniqueness.
@@ -750,6 +1000,17 @@ func (l *Layout) IsAnonymous() bool {
 	return l.NamingContext.IsAnonymous()
 }
 
+// SourceName returns the name the layout is given in source FIDL, i.e. the last
+// element of its NamingContext. Unlike the declaration name, it is unaffected
+// by `@generated_name()`. If the NamingContext is empty, the unqualified
+// declaration name is returned.
+func (l *Layout) SourceName() Identifier {
+	if len(l.NamingContext) == 0 {
+		return l.Name.Parse().Name
+	}
+	return Identifier(l.NamingContext[len(l.NamingContext)-1])
+}
+
 // Assert that declarations conform to the Declaration interface
 var _ = []Declaration{
 	(*TypeAlias)(nil),
@@ -848,6 +1109,28 @@ func (t *Table) SortedMembersNoReserved() []TableMember {
 	return members
 }
 
+// IsEmpty returns true if the table has no non-reserved members.
+func (t *Table) IsEmpty() bool {
+	for _, member := range t.Members {
+		if !member.Reserved {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxOrdinal returns the largest ordinal of the table's non-reserved members,
+// or 0 if the table is empty.
+func (t *Table) MaxOrdinal() int {
+	max := 0
+	for _, member := range t.Members {
+		if !member.Reserved && member.Ordinal > max {
+			max = member.Ordinal
+		}
+	}
+	return max
+}
+
 // Struct represents a declaration of a FIDL struct.
 type Struct struct {
 	Layout
@@ -868,6 +1151,47 @@ type StructMember struct {
 	FieldShapeV2      FieldShape `json:"field_shape_v2"`
 }
 
+// FieldShape returns the shape of the member in the given wire format, or an
+// error if the format is unknown.
+func (m *StructMember) FieldShape(format WireFormat) (FieldShape, error) {
+	switch format {
+	case WireFormatV1:
+		return m.FieldShapeV1, nil
+	case WireFormatV2:
+		return m.FieldShapeV2, nil
+	default:
+		return FieldShape{}, fmt.Errorf("unknown wire format: %q", format)
+	}
+}
+
+// StructFieldLayout is the position of a struct member in a wire format.
+type StructFieldLayout struct {
+	Member StructMember
+	// Offset is the offset of the member from the start of the struct.
+	Offset int
+	// Padding is the number of padding bytes following the member.
+	Padding int
+}
+
+// FieldLayout returns the members of the struct in declaration order, along
+// with their offsets and padding in the given wire format, or an error if the
+// format is unknown.
+func (s *Struct) FieldLayout(format WireFormat) ([]StructFieldLayout, error) {
+	layout := make([]StructFieldLayout, 0, len(s.Members))
+	for _, member := range s.Members {
+		shape, err := member.FieldShape(format)
+		if err != nil {
+			return nil, err
+		}
+		layout = append(layout, StructFieldLayout{
+			Member:  member,
+			Offset:  shape.Offset,
+			Padding: shape.Padding,
+		})
+	}
+	return layout, nil
+}
+
 // EmptyStructMember returns a StructMember that's suitable as the sole member
 // of an empty struct.
 func EmptyStructMember(name string) StructMember {
@@ -897,8 +1221,15 @@ type Protocol struct {
 	Methods []Method `json:"methods"`
 }
 
+// GetServiceName returns the quoted discoverable name of the protocol, or the
+// empty string if the protocol is not discoverable. The name defaults to the
+// fully qualified protocol name, and may be overridden with
+// `@discoverable(name="...")`.
 func (d *Protocol) GetServiceName() string {
-	if found := d.HasAttribute("discoverable"); found {
+	if attr, found := d.LookupAttribute("discoverable"); found {
+		if arg, ok := attr.LookupArg("name"); ok && arg.ValueString() != "" {
+			return fmt.Sprintf("\"%s\"", arg.ValueString())
+		}
 		ci := d.Name.Parse()
 		var parts []string
 		for _, i := range ci.Library {
@@ -910,6 +1241,19 @@ func (d *Protocol) GetServiceName() string {
 	return ""
 }
 
+// Events returns the protocol's events, i.e. its server-to-client methods,
+// sorted by ordinal.
+func (d *Protocol) Events() []Method {
+	var events []Method
+	for _, m := range d.Methods {
+		if m.IsEvent() {
+			events = append(events, m)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Ordinal < events[j].Ordinal })
+	return events
+}
+
 // Service represents the declaration of a FIDL service.
 type Service struct {
 	Decl
@@ -926,6 +1270,32 @@ func (s *Service) GetServiceName() string {
 	return strings.Join(parts, ".")
 }
 
+// ResolvedServiceMember is a service member along with the protocol it
+// refers to.
+type ResolvedServiceMember struct {
+	Name     Identifier
+	Protocol *Protocol
+}
+
+// ResolvedMembers returns the service's members in order, each with its
+// protocol looked up in root. It returns an error if a member's protocol is
+// not declared in root.
+func (s *Service) ResolvedMembers(root *Root) ([]ResolvedServiceMember, error) {
+	members := make([]ResolvedServiceMember, 0, len(s.Members))
+	for _, m := range s.Members {
+		name := m.Type.Identifier
+		if m.Type.Kind == RequestType {
+			name = m.Type.RequestSubtype
+		}
+		p, ok := root.LookupDecl(name).(*Protocol)
+		if !ok {
+			return nil, fmt.Errorf("service %s member %s: %s is not a protocol declared in %s", s.Name, m.Name, name, root.Name)
+		}
+		members = append(members, ResolvedServiceMember{Name: m.Name, Protocol: p})
+	}
+	return members, nil
+}
+
 // ServiceMember represents the declaration of a field in a FIDL service.
 type ServiceMember struct {
 	Attributes
@@ -982,6 +1352,12 @@ func (m *Method) HasResponsePayload() bool {
 	return m.ResponsePayload != nil
 }
 
+// IsEvent returns whether this method is an event, i.e. it is sent by the
+// server without a request.
+func (m *Method) IsEvent() bool {
+	return !m.HasRequest && m.HasResponse
+}
+
 // Enum represents a FIDL declaration of an enum.
 type Enum struct {
 	Layout
@@ -1033,6 +1409,40 @@ func (enum *Enum) UnknownValueForTmpl() interface{} {
 	return unknownValue
 }
 
+// Validate checks that the value of every member of the enum is representable
+// in the enum's underlying type. Values are parsed like int64OrUint64, so they
+// may be decimal or carry a 0x, 0b or 0o prefix.
+func (enum *Enum) Validate() error {
+	bitSize, ok := integerSubtypeBitSizes[enum.Type]
+	if !ok {
+		return fmt.Errorf("enum %s has non-integral underlying type %s", enum.Name, enum.Type)
+	}
+	for _, member := range enum.Members {
+		value := member.Value.Value
+		if !isRepresentable(value, bitSize, enum.Type.IsUnsigned()) {
+			return fmt.Errorf("enum %s member %s: value %q is not representable as %s", enum.Name, member.Name, value, enum.Type)
+		}
+	}
+	return nil
+}
+
+// isRepresentable returns true if value, in decimal or with a base prefix,
+// fits in an integer of the given bit size and signedness.
+func isRepresentable(value string, bitSize int, unsigned bool) bool {
+	for _, base := range []int{10, 0} {
+		var err error
+		if unsigned {
+			_, err = strconv.ParseUint(value, base, bitSize)
+		} else {
+			_, err = strconv.ParseInt(value, base, bitSize)
+		}
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // EnumMember represents a single variant in a FIDL enum.
 type EnumMember struct {
 	Attributes
@@ -1198,6 +1608,237 @@ func (r *Root) initializeDeclarationsMap() {
 	for i, d := range r.ExternalStructs {
 		r.declarations[d.Name] = &r.ExternalStructs[i]
 	}
+	for i, d := range r.TypeAliases {
+		r.declarations[d.Name] = &r.TypeAliases[i]
+	}
+}
+
+// ForEachDecl calls fn with each declaration of the library, in DeclOrder. It
+// stops at the first error returned by fn, and returns it. It is an error for
+// DeclOrder to name an unknown declaration.
+func (r *Root) ForEachDecl(fn func(EncodedCompoundIdentifier, Declaration) error) error {
+	for _, name := range r.DeclOrder {
+		decl, ok := r.declarations[name]
+		if !ok {
+			return fmt.Errorf("unknown declaration in declaration order: %s", name)
+		}
+		if err := fn(name, decl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllDocComments returns the doc comments of every declaration in the library
+// and of their members, keyed by identifier. Members are keyed by their
+// encoded member identifier, e.g. "example/Foo.bar". Declarations and members
+// without doc comments are omitted.
+func (r *Root) AllDocComments() map[EncodedCompoundIdentifier][]string {
+	comments := make(map[EncodedCompoundIdentifier][]string)
+	add := func(name EncodedCompoundIdentifier, attrs Attributes) {
+		if lines := attrs.DocComments(); len(lines) != 0 {
+			comments[name] = lines
+		}
+	}
+	member := func(decl EncodedCompoundIdentifier, name Identifier) EncodedCompoundIdentifier {
+		ci := decl.Parse()
+		ci.Member = name
+		return ci.Encode()
+	}
+	for _, d := range r.Consts {
+		add(d.Name, d.Attributes)
+	}
+	for _, d := range r.Bits {
+		add(d.Name, d.Attributes)
+		for _, m := range d.Members {
+			add(member(d.Name, m.Name), m.Attributes)
+		}
+	}
+	for _, d := range r.Enums {
+		add(d.Name, d.Attributes)
+		for _, m := range d.Members {
+			add(member(d.Name, m.Name), m.Attributes)
+		}
+	}
+	for _, d := range r.Protocols {
+		add(d.Name, d.Attributes)
+		for _, m := range d.Methods {
+			add(member(d.Name, m.Name), m.Attributes)
+		}
+	}
+	for _, d := range r.Services {
+		add(d.Name, d.Attributes)
+		for _, m := range d.Members {
+			add(member(d.Name, m.Name), m.Attributes)
+		}
+	}
+	for _, d := range r.Structs {
+		add(d.Name, d.Attributes)
+		for _, m := range d.Members {
+			add(member(d.Name, m.Name), m.Attributes)
+		}
+	}
+	for _, d := range r.Tables {
+		add(d.Name, d.Attributes)
+		for _, m := range d.Members {
+			add(member(d.Name, m.Name), m.Attributes)
+		}
+	}
+	for _, d := range r.Unions {
+		add(d.Name, d.Attributes)
+		for _, m := range d.Members {
+			add(member(d.Name, m.Name), m.Attributes)
+		}
+	}
+	for _, d := range r.TypeAliases {
+		add(d.Name, d.Attributes)
+	}
+	return comments
+}
+
+// CheckDeclOrder verifies that DeclOrder lists every key of Decls exactly once,
+// and nothing else. Backends that iterate over DeclOrder would otherwise skip
+// or duplicate declarations.
+func (r *Root) CheckDeclOrder() error {
+	var missing, unknown, duplicate []string
+	seen := make(map[EncodedCompoundIdentifier]struct{}, len(r.DeclOrder))
+	for _, name := range r.DeclOrder {
+		if _, ok := seen[name]; ok {
+			duplicate = append(duplicate, string(name))
+			continue
+		}
+		seen[name] = struct{}{}
+		if _, ok := r.Decls[name]; !ok {
+			unknown = append(unknown, string(name))
+		}
+	}
+	for name := range r.Decls {
+		if _, ok := seen[name]; !ok {
+			missing = append(missing, string(name))
+		}
+	}
+	if len(missing) == 0 && len(unknown) == 0 && len(duplicate) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	var problems []string
+	if len(missing) != 0 {
+		problems = append(problems, fmt.Sprintf("declarations missing from declaration order: %s", strings.Join(missing, ", ")))
+	}
+	if len(unknown) != 0 {
+		problems = append(problems, fmt.Sprintf("unknown declarations in declaration order: %s", strings.Join(unknown, ", ")))
+	}
+	if len(duplicate) != 0 {
+		problems = append(problems, fmt.Sprintf("duplicate declarations in declaration order: %s", strings.Join(duplicate, ", ")))
+	}
+	return fmt.Errorf("inconsistent declaration order: %s", strings.Join(problems, "; "))
+}
+
+// Validate verifies that the identifier of every identifier type in the
+// library names a declaration of the library or of one of its dependencies, as
+// listed by DeclsWithDependencies. Backends would otherwise fail on a nil
+// lookup when generating code for truncated or malformed IR.
+func (r *Root) Validate() error {
+	decls := r.DeclsWithDependencies()
+	unresolved := make(map[EncodedCompoundIdentifier]struct{})
+	visitType := func(t *Type) {
+		for ; t != nil; t = t.ElementType {
+			if t.Kind != IdentifierType {
+				continue
+			}
+			if _, ok := decls[t.Identifier]; !ok {
+				unresolved[t.Identifier] = struct{}{}
+			}
+		}
+	}
+	for i := range r.Consts {
+		visitType(&r.Consts[i].Type)
+	}
+	for i := range r.Bits {
+		visitType(&r.Bits[i].Type)
+	}
+	for _, d := range r.Protocols {
+		for _, m := range d.Methods {
+			visitType(m.RequestPayload)
+			visitType(m.ResponsePayload)
+			visitType(m.ResultType)
+			visitType(m.ValueType)
+			visitType(m.ErrorType)
+		}
+	}
+	for _, d := range r.Services {
+		for i := range d.Members {
+			visitType(&d.Members[i].Type)
+		}
+	}
+	for _, structs := range [][]Struct{r.Structs, r.ExternalStructs} {
+		for _, d := range structs {
+			for i := range d.Members {
+				visitType(&d.Members[i].Type)
+			}
+		}
+	}
+	for _, d := range r.Tables {
+		for i, m := range d.Members {
+			if !m.Reserved {
+				visitType(&d.Members[i].Type)
+			}
+		}
+	}
+	for _, d := range r.Unions {
+		for i, m := range d.Members {
+			if !m.Reserved {
+				visitType(&d.Members[i].Type)
+			}
+		}
+	}
+	if len(unresolved) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(unresolved))
+	for name := range unresolved {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unresolved identifiers: %s", strings.Join(names, ", "))
+}
+
+// Fingerprint returns a hash of the library's declarations, including their
+// names, members, ordinals, attributes and type shapes, and of its
+// dependencies. Source locations are ignored, so that reformatting a library
+// without changing its meaning does not change its fingerprint. The hash does
+// not depend on map iteration order.
+func (r *Root) Fingerprint() string {
+	// Go through the generic JSON representation, whose object keys are
+	// sorted when marshaled, to drop locations wherever they are.
+	b, err := json.Marshal(r)
+	if err != nil {
+		panic(fmt.Sprintf("cannot encode JSON IR: %s", err))
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		panic(fmt.Sprintf("cannot decode JSON IR: %s", err))
+	}
+	var strip func(interface{})
+	strip = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			delete(v, "location")
+			for _, e := range v {
+				strip(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				strip(e)
+			}
+		}
+	}
+	strip(v)
+	if b, err = json.Marshal(v); err != nil {
+		panic(fmt.Sprintf("cannot encode JSON IR: %s", err))
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
 }
 
 // DeclsWithDependencies returns a single DeclInfoMap containing the FIDL
@@ -1244,6 +1885,63 @@ func (r *Root) GetMessageBodyTypeNames() map[EncodedCompoundIdentifier]struct{}
 	return mbtn
 }
 
+// CheckMethodPayloads verifies that the request and response payload of every
+// protocol method refers to a struct, table, or union declared in this library
+// or one of its dependencies. It returns one error per offending payload.
+func (r *Root) CheckMethodPayloads() []error {
+	decls := r.DeclsWithDependencies()
+	var errs []error
+	check := func(p Protocol, m Method, kind string, payload *Type) {
+		if payload == nil {
+			return
+		}
+		if payload.Kind != IdentifierType {
+			errs = append(errs, fmt.Errorf("protocol %s method %s: %s payload is a %s, not an identifier", p.Name, m.Name, kind, payload.Kind))
+			return
+		}
+		info, ok := decls[payload.Identifier]
+		if !ok {
+			errs = append(errs, fmt.Errorf("protocol %s method %s: %s payload %s is not declared", p.Name, m.Name, kind, payload.Identifier))
+			return
+		}
+		switch info.Type {
+		case StructDeclType, TableDeclType, UnionDeclType:
+		default:
+			errs = append(errs, fmt.Errorf("protocol %s method %s: %s payload %s is a %s, not a layout", p.Name, m.Name, kind, payload.Identifier, info.Type))
+		}
+	}
+	for _, p := range r.Protocols {
+		for _, m := range p.Methods {
+			check(p, m, "request", m.RequestPayload)
+			check(p, m, "response", m.ResponsePayload)
+		}
+	}
+	return errs
+}
+
+// DeclsRequiringV2 returns the names, sorted, of the structs, tables, and
+// unions in this library that use features requiring the v2 wire format.
+func (r *Root) DeclsRequiringV2() []EncodedCompoundIdentifier {
+	var names []EncodedCompoundIdentifier
+	for _, v := range r.Structs {
+		if v.TypeShapeV2.RequiresV2(v.TypeShapeV1) {
+			names = append(names, v.Name)
+		}
+	}
+	for _, v := range r.Tables {
+		if v.TypeShapeV2.RequiresV2(v.TypeShapeV1) {
+			names = append(names, v.Name)
+		}
+	}
+	for _, v := range r.Unions {
+		if v.TypeShapeV2.RequiresV2(v.TypeShapeV1) {
+			names = append(names, v.Name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
 // deniedContexts produces a list of scopedNamingContexts. Any types/methods that begin with the
 // scopedNamingContext in that list should be denied as well when run through the isDenied()
 // function.
@@ -1452,10 +2150,330 @@ func (r *Root) ForBindings(language string) Root {
 	return res
 }
 
+// SubsetForProtocol returns a Root containing only the named protocol and the
+// declarations of this library it transitively references, such as method
+// payloads, the types of their members, and constants used as default values.
+// Library dependencies are carried over unchanged, so references to other
+// libraries remain resolvable.
+func (r *Root) SubsetForProtocol(name EncodedCompoundIdentifier) (Root, error) {
+	if _, ok := r.LookupDecl(name).(*Protocol); !ok {
+		return Root{}, fmt.Errorf("%s is not a protocol declared in library %s", name, r.Name)
+	}
+	return r.Subset(name)
+}
+
+// Subset returns a Root containing only the named declarations and the
+// declarations of this library they transitively reference. Like
+// SubsetForProtocol, library dependencies are carried over unchanged. It is an
+// error for a name not to be declared in this library.
+func (r *Root) Subset(names ...EncodedCompoundIdentifier) (Root, error) {
+	var unknown []string
+	for _, name := range names {
+		if r.LookupDecl(name) == nil {
+			unknown = append(unknown, string(name))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return Root{}, fmt.Errorf("not declared in library %s: %s", r.Name, strings.Join(unknown, ", "))
+	}
+	reachable := r.reachableDecls(names...)
+	res := Root{
+		Name:      r.Name,
+		Libraries: r.Libraries,
+		Decls:     make(DeclMap, len(reachable)),
+	}
+	keep := func(name EncodedCompoundIdentifier) bool {
+		if _, ok := reachable[name]; !ok {
+			return false
+		}
+		if declType, ok := r.Decls[name]; ok {
+			res.Decls[name] = declType
+		}
+		return true
+	}
+
+	for _, v := range r.Consts {
+		if keep(v.Name) {
+			res.Consts = append(res.Consts, v)
+		}
+	}
+	for _, v := range r.Bits {
+		if keep(v.Name) {
+			res.Bits = append(res.Bits, v)
+		}
+	}
+	for _, v := range r.Enums {
+		if keep(v.Name) {
+			res.Enums = append(res.Enums, v)
+		}
+	}
+	for _, v := range r.Protocols {
+		if keep(v.Name) {
+			res.Protocols = append(res.Protocols, v)
+		}
+	}
+	for _, v := range r.Services {
+		if keep(v.Name) {
+			res.Services = append(res.Services, v)
+		}
+	}
+	for _, v := range r.Structs {
+		if keep(v.Name) {
+			res.Structs = append(res.Structs, v)
+		}
+	}
+	for _, v := range r.ExternalStructs {
+		if keep(v.Name) {
+			res.ExternalStructs = append(res.ExternalStructs, v)
+		}
+	}
+	for _, v := range r.Tables {
+		if keep(v.Name) {
+			res.Tables = append(res.Tables, v)
+		}
+	}
+	for _, v := range r.Unions {
+		if keep(v.Name) {
+			res.Unions = append(res.Unions, v)
+		}
+	}
+	for _, v := range r.TypeAliases {
+		if keep(v.Name) {
+			res.TypeAliases = append(res.TypeAliases, v)
+		}
+	}
+
+	for _, d := range r.DeclOrder {
+		if _, ok := res.Decls[d]; ok {
+			res.DeclOrder = append(res.DeclOrder, d)
+		}
+	}
+
+	res.initializeDeclarationsMap()
+
+	return res, nil
+}
+
+// ReachableTypes returns the names of the struct, table and union
+// declarations transitively reachable from the request, response and error
+// payloads of the methods of p, which must be a protocol of r.
+func (r *Root) ReachableTypes(p *Protocol) map[EncodedCompoundIdentifier]struct{} {
+	var roots []EncodedCompoundIdentifier
+	for _, m := range p.Methods {
+		for _, t := range []*Type{m.RequestPayload, m.ResponsePayload, m.ResultType, m.ValueType, m.ErrorType} {
+			if t != nil && t.Kind == IdentifierType {
+				roots = append(roots, t.Identifier)
+			}
+		}
+	}
+	types := make(map[EncodedCompoundIdentifier]struct{})
+	for name := range r.reachableDecls(roots...) {
+		switch r.LookupDecl(name).(type) {
+		case *Struct, *Table, *Union:
+			types[name] = struct{}{}
+		}
+	}
+	return types
+}
+
+// reachableDecls returns the names of the given declarations and of every
+// declaration they transitively reference. Names from other libraries are
+// included but not followed, since their definitions are not part of r.
+func (r *Root) reachableDecls(roots ...EncodedCompoundIdentifier) map[EncodedCompoundIdentifier]struct{} {
+	reachable := make(map[EncodedCompoundIdentifier]struct{})
+	aliases := make(map[EncodedCompoundIdentifier]*TypeAlias, len(r.TypeAliases))
+	for i, v := range r.TypeAliases {
+		aliases[v.Name] = &r.TypeAliases[i]
+	}
+
+	var visit func(EncodedCompoundIdentifier)
+	var visitType func(*Type)
+	var visitConstant func(*Constant)
+	var visitTypeConstructor func(PartialTypeConstructor)
+
+	visitType = func(t *Type) {
+		for ; t != nil; t = t.ElementType {
+			if t.Identifier != "" {
+				visit(t.Identifier)
+			}
+			if t.RequestSubtype != "" {
+				visit(t.RequestSubtype)
+			}
+		}
+	}
+	visitConstant = func(c *Constant) {
+		if c != nil && c.Kind == IdentifierConstant {
+			visit(c.Identifier.DeclName())
+		}
+	}
+	visitTypeConstructor = func(ctor PartialTypeConstructor) {
+		if _, ok := r.Decls[ctor.Name]; ok {
+			visit(ctor.Name)
+		} else if _, ok := aliases[ctor.Name]; ok {
+			visit(ctor.Name)
+		}
+		for _, arg := range ctor.Args {
+			visitTypeConstructor(arg)
+		}
+		visitConstant(ctor.MaybeSize)
+	}
+	visit = func(name EncodedCompoundIdentifier) {
+		if _, ok := reachable[name]; ok {
+			return
+		}
+		reachable[name] = struct{}{}
+		if alias, ok := aliases[name]; ok {
+			visitTypeConstructor(alias.PartialTypeConstructor)
+			return
+		}
+		switch decl := r.LookupDecl(name).(type) {
+		case *Const:
+			visitType(&decl.Type)
+			visitConstant(&decl.Value)
+		case *Bits:
+			visitType(&decl.Type)
+			for i := range decl.Members {
+				visitConstant(&decl.Members[i].Value)
+			}
+		case *Enum:
+			for i := range decl.Members {
+				visitConstant(&decl.Members[i].Value)
+			}
+		case *Protocol:
+			for _, m := range decl.Methods {
+				visitType(m.RequestPayload)
+				visitType(m.ResponsePayload)
+				visitType(m.ResultType)
+				visitType(m.ValueType)
+				visitType(m.ErrorType)
+			}
+		case *Service:
+			for i := range decl.Members {
+				visitType(&decl.Members[i].Type)
+			}
+		case *Struct:
+			for i := range decl.Members {
+				visitType(&decl.Members[i].Type)
+				visitConstant(decl.Members[i].MaybeDefaultValue)
+			}
+		case *Table:
+			for i, m := range decl.Members {
+				if !m.Reserved {
+					visitType(&decl.Members[i].Type)
+				}
+			}
+		case *Union:
+			for i, m := range decl.Members {
+				if !m.Reserved {
+					visitType(&decl.Members[i].Type)
+				}
+			}
+		}
+	}
+
+	for _, name := range roots {
+		visit(name)
+	}
+	return reachable
+}
+
 func (r *Root) LookupDecl(i EncodedCompoundIdentifier) Declaration {
 	return r.declarations[i]
 }
 
+// ResolveTypeAlias materializes the type alias with the given name into the
+// concrete Type it stands for, following aliases of aliases. Type shapes are
+// not computed.
+func (r *Root) ResolveTypeAlias(name EncodedCompoundIdentifier) (Type, error) {
+	return r.resolveTypeAlias(name, map[EncodedCompoundIdentifier]struct{}{})
+}
+
+func (r *Root) resolveTypeAlias(name EncodedCompoundIdentifier, seen map[EncodedCompoundIdentifier]struct{}) (Type, error) {
+	if _, ok := seen[name]; ok {
+		return Type{}, fmt.Errorf("type alias %s refers to itself", name)
+	}
+	seen[name] = struct{}{}
+	for _, alias := range r.TypeAliases {
+		if alias.Name == name {
+			t, err := r.resolvePartialTypeConstructor(alias.PartialTypeConstructor, seen)
+			if err != nil {
+				return Type{}, fmt.Errorf("resolving type alias %s: %w", name, err)
+			}
+			return t, nil
+		}
+	}
+	return Type{}, fmt.Errorf("unknown type alias %s", name)
+}
+
+func (r *Root) resolvePartialTypeConstructor(ctor PartialTypeConstructor, seen map[EncodedCompoundIdentifier]struct{}) (Type, error) {
+	elementCount := func() (*int, error) {
+		if ctor.MaybeSize == nil {
+			return nil, nil
+		}
+		n, err := strconv.ParseUint(ctor.MaybeSize.Value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q for %s: %w", ctor.MaybeSize.Value, ctor.Name, err)
+		}
+		count := int(n)
+		return &count, nil
+	}
+	elementType := func() (*Type, error) {
+		if len(ctor.Args) != 1 {
+			return nil, fmt.Errorf("%s takes 1 type argument, got %d", ctor.Name, len(ctor.Args))
+		}
+		t, err := r.resolvePartialTypeConstructor(ctor.Args[0], seen)
+		if err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+
+	switch PrimitiveSubtype(ctor.Name) {
+	case Bool, Int8, Int16, Int32, Int64, Uint8, Uint16, Uint32, Uint64, Float32, Float64:
+		return Type{Kind: PrimitiveType, PrimitiveSubtype: PrimitiveSubtype(ctor.Name)}, nil
+	}
+
+	var err error
+	t := Type{Nullable: ctor.Nullable}
+	switch ctor.Name {
+	case "string":
+		t.Kind = StringType
+		if t.ElementCount, err = elementCount(); err != nil {
+			return Type{}, err
+		}
+	case "vector", "array":
+		t.Kind = VectorType
+		if ctor.Name == "array" {
+			t.Kind = ArrayType
+		}
+		if t.ElementType, err = elementType(); err != nil {
+			return Type{}, err
+		}
+		if t.ElementCount, err = elementCount(); err != nil {
+			return Type{}, err
+		}
+		if t.Kind == ArrayType && t.ElementCount == nil {
+			return Type{}, fmt.Errorf("array is missing its size")
+		}
+	default:
+		if !strings.Contains(string(ctor.Name), "/") {
+			return Type{}, fmt.Errorf("unsupported type constructor %s", ctor.Name)
+		}
+		if r.Decls[ctor.Name] == TypeAliasDeclType {
+			aliased, err := r.resolveTypeAlias(ctor.Name, seen)
+			if err != nil {
+				return Type{}, err
+			}
+			aliased.Nullable = aliased.Nullable || ctor.Nullable
+			return aliased, nil
+		}
+		t.Kind = IdentifierType
+		t.Identifier = ctor.Name
+	}
+	return t, nil
+}
+
 type int64OrUint64 struct {
 	i int64
 	u uint64
@@ -1487,15 +2505,32 @@ func Int64OrUint64FromUint64ForTesting(val uint64) int64OrUint64 {
 }
 
 var _ json.Unmarshaler = (*int64OrUint64)(nil)
+var _ json.Marshaler = int64OrUint64{}
 
+// UnmarshalJSON accepts a JSON number, or a JSON string holding an integer
+// literal which may have a 0x, 0b or 0o radix prefix. Literals without a
+// prefix are always read in base 10, even with leading zeros.
 func (n *int64OrUint64) UnmarshalJSON(data []byte) error {
-	if u, err := strconv.ParseUint(string(data), 10, 64); err == nil {
-		n.u = u
-		return nil
-	}
-	if i, err := strconv.ParseInt(string(data), 10, 64); err == nil {
-		n.i = i
-		return nil
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	for _, base := range []int{10, 0} {
+		if u, err := strconv.ParseUint(s, base, 64); err == nil {
+			n.u = u
+			return nil
+		}
+		if i, err := strconv.ParseInt(s, base, 64); err == nil {
+			n.i = i
+			return nil
+		}
 	}
 	return fmt.Errorf("%s not representable as int64 or uint64", string(data))
 }
+
+func (n int64OrUint64) MarshalJSON() ([]byte, error) {
+	if n.i != 0 {
+		return []byte(strconv.FormatInt(n.i, 10)), nil
+	}
+	return []byte(strconv.FormatUint(n.u, 10)), nil
+}
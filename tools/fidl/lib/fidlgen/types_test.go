@@ -6,6 +6,8 @@ package fidlgen_test
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"reflect"
 	"sort"
@@ -53,6 +55,102 @@ func TestCanUnmarshalLargeOrdinal(t *testing.T) {
 	}
 }
 
+func TestCheckDeclOrder(t *testing.T) {
+	consistent := `{
+		"name": "example",
+		"declaration_order": ["example/Bar", "example/Foo"],
+		"declarations": {
+			"example/Bar": "struct",
+			"example/Foo": "struct"
+		}
+	}`
+	root, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(consistent))
+	if err != nil {
+		t.Fatalf("failed to decode consistent IR: %s", err)
+	}
+	if err := root.CheckDeclOrder(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	omitted := `{
+		"name": "example",
+		"declaration_order": ["example/Foo"],
+		"declarations": {
+			"example/Bar": "struct",
+			"example/Foo": "struct"
+		}
+	}`
+	root, err = fidlgen.DecodeJSONIr(strings.NewReader(omitted))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+	err = root.CheckDeclOrder()
+	if err == nil {
+		t.Fatal("expected error mentioning example/Bar, got nil")
+	}
+	if !strings.Contains(err.Error(), "example/Bar") {
+		t.Errorf("expected error mentioning example/Bar, got: %s", err)
+	}
+	if _, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(omitted)); err == nil {
+		t.Error("expected strict decoding to fail, got nil")
+	}
+}
+
+func TestAllDocComments(t *testing.T) {
+	doc := func(value string) string {
+		return fmt.Sprintf(`[{"name": "doc", "arguments": [{"name": "value", "value": {"kind": "literal", "value": %q}}]}]`, value)
+	}
+	input := `{
+		"name": "example",
+		"struct_declarations": [
+			{
+				"name": "example/Documented",
+				"maybe_attributes": ` + doc(" First line.\n Second line.\n") + `,
+				"members": [
+					{"name": "documented_member", "maybe_attributes": ` + doc(" Member.\n") + `},
+					{"name": "undocumented_member"}
+				]
+			},
+			{
+				"name": "example/Undocumented",
+				"members": []
+			}
+		],
+		"enum_declarations": [
+			{
+				"name": "example/Color",
+				"members": [
+					{"name": "RED", "maybe_attributes": ` + doc(" Red.\n") + `}
+				]
+			}
+		],
+		"interface_declarations": [
+			{
+				"name": "example/Protocol",
+				"maybe_attributes": ` + doc(" Protocol.\n") + `,
+				"methods": [
+					{"name": "Method", "maybe_attributes": ` + doc(" Method.\n") + `}
+				]
+			}
+		]
+	}`
+	root, err := fidlgen.DecodeJSONIr(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+
+	want := map[fidlgen.EncodedCompoundIdentifier][]string{
+		"example/Documented":                   {" First line.", " Second line."},
+		"example/Documented.documented_member": {" Member."},
+		"example/Color.RED":                    {" Red."},
+		"example/Protocol":                     {" Protocol."},
+		"example/Protocol.Method":              {" Method."},
+	}
+	if diff := cmp.Diff(want, root.AllDocComments()); diff != "" {
+		t.Errorf("AllDocComments() mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestCanUnmarshalAttributeValue(t *testing.T) {
 	root := fidlgentest.EndToEndTest{T: t}.Single(`
 		library example;
@@ -134,6 +232,132 @@ func TestCanUnmarshalAttributeValue(t *testing.T) {
 	}
 }
 
+func TestAttributesMaxBytesAndMaxHandles(t *testing.T) {
+	root := fidlgentest.EndToEndTest{T: t}.Single(`
+		library example;
+
+		const MAX_HANDLES string = "0";
+
+		@max_bytes("64")
+		@max_handles(MAX_HANDLES)
+		type Limited = struct {
+			value uint32;
+		};
+
+		type Unlimited = struct {
+			value uint32;
+		};
+	`)
+
+	structs := make(map[fidlgen.EncodedCompoundIdentifier]fidlgen.Struct)
+	for _, decl := range root.Structs {
+		structs[decl.Name] = decl
+	}
+
+	limited := structs["example/Limited"]
+	if got, ok := limited.MaxBytes(); !ok || got != 64 {
+		t.Errorf("Limited: got MaxBytes() = (%d, %t), want (64, true)", got, ok)
+	}
+	if got, ok := limited.MaxHandles(); !ok || got != 0 {
+		t.Errorf("Limited: got MaxHandles() = (%d, %t), want (0, true)", got, ok)
+	}
+
+	unlimited := structs["example/Unlimited"]
+	if got, ok := unlimited.MaxBytes(); ok {
+		t.Errorf("Unlimited: got MaxBytes() = (%d, %t), want (_, false)", got, ok)
+	}
+	if got, ok := unlimited.MaxHandles(); ok {
+		t.Errorf("Unlimited: got MaxHandles() = (%d, %t), want (_, false)", got, ok)
+	}
+}
+
+func TestAttributesAvailability(t *testing.T) {
+	available := func(args ...fidlgen.AttributeArg) fidlgen.Attributes {
+		return fidlgen.Attributes{Attributes: []fidlgen.Attribute{{Name: "available", Args: args}}}
+	}
+	arg := func(name fidlgen.Identifier, value string) fidlgen.AttributeArg {
+		return fidlgen.AttributeArg{Name: name, Value: fidlgen.Constant{Kind: fidlgen.LiteralConstant, Value: value}}
+	}
+	version := func(v uint64) *uint64 { return &v }
+
+	cases := []struct {
+		name                       string
+		attrs                      fidlgen.Attributes
+		added, deprecated, removed *uint64
+		ok                         bool
+	}{
+		{name: "absent", attrs: fidlgen.Attributes{}},
+		{name: "no arguments", attrs: available(), ok: true},
+		{
+			name:       "numbered",
+			attrs:      available(arg("added", "1"), arg("deprecated", "2"), arg("removed", "3")),
+			added:      version(1),
+			deprecated: version(2),
+			removed:    version(3),
+			ok:         true,
+		},
+		{
+			name:    "symbolic",
+			attrs:   available(arg("added", "HEAD"), arg("removed", "LEGACY")),
+			added:   version(fidlgen.VersionHead),
+			removed: version(fidlgen.VersionLegacy),
+			ok:      true,
+		},
+		{
+			name:  "invalid",
+			attrs: available(arg("added", "7"), arg("removed", "soon")),
+			added: version(7),
+			ok:    true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			added, deprecated, removed, ok := c.attrs.Availability()
+			if ok != c.ok {
+				t.Errorf("got ok = %t, want %t", ok, c.ok)
+			}
+			if diff := cmp.Diff(c.added, added); diff != "" {
+				t.Errorf("added mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(c.deprecated, deprecated); diff != "" {
+				t.Errorf("deprecated mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(c.removed, removed); diff != "" {
+				t.Errorf("removed mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAttributesTransportsSorted(t *testing.T) {
+	transport := func(value string) fidlgen.Attributes {
+		return fidlgen.Attributes{Attributes: []fidlgen.Attribute{{
+			Name: "transport",
+			Args: []fidlgen.AttributeArg{{Name: "value", Value: fidlgen.Constant{Kind: fidlgen.LiteralConstant, Value: value}}},
+		}}}
+	}
+	cases := []struct {
+		name  string
+		attrs fidlgen.Attributes
+		want  []string
+	}{
+		{name: "absent", attrs: fidlgen.Attributes{}, want: []string{"Channel"}},
+		{name: "single", attrs: transport("Driver"), want: []string{"Driver"}},
+		{name: "sorted", attrs: transport("Syscall,Driver,Banjo"), want: []string{"Banjo", "Driver", "Syscall"}},
+		{name: "whitespace", attrs: transport(" Driver ,  Channel"), want: []string{"Channel", "Driver"}},
+		{name: "duplicates", attrs: transport("Driver, Driver,Channel"), want: []string{"Channel", "Driver"}},
+		{name: "empty entries", attrs: transport("Driver, ,"), want: []string{"Driver"}},
+		{name: "empty", attrs: transport(""), want: []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if diff := cmp.Diff(c.want, c.attrs.TransportsSorted()); diff != "" {
+				t.Errorf("TransportsSorted() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestCanUnmarshalSignedEnums(t *testing.T) {
 
 	root := fidlgentest.EndToEndTest{T: t}.Single(`
@@ -318,6 +542,390 @@ func TestCanUnmarshalSignedEnums(t *testing.T) {
 	}
 }
 
+func TestCanUnmarshalUnknownValueWithRadix(t *testing.T) {
+	for _, tc := range []struct {
+		typ      fidlgen.PrimitiveSubtype
+		value    string
+		unsigned uint64
+		signed   int64
+	}{
+		{typ: fidlgen.Uint32, value: `4294967295`, unsigned: math.MaxUint32},
+		{typ: fidlgen.Uint32, value: `"4294967295"`, unsigned: math.MaxUint32},
+		{typ: fidlgen.Uint32, value: `"0xffffffff"`, unsigned: math.MaxUint32},
+		{typ: fidlgen.Uint8, value: `"0b1010"`, unsigned: 10},
+		{typ: fidlgen.Uint8, value: `"0o17"`, unsigned: 15},
+		{typ: fidlgen.Uint64, value: `"0x8000000000000000"`, unsigned: 1 << 63},
+		// Without a prefix, leading zeros do not make the literal octal.
+		{typ: fidlgen.Uint8, value: `"010"`, unsigned: 10},
+		{typ: fidlgen.Int64, value: `-9223372036854775808`, signed: math.MinInt64},
+		{typ: fidlgen.Int64, value: `"-0x10"`, signed: -16},
+		{typ: fidlgen.Int16, value: `"-0b11"`, signed: -3},
+	} {
+		var enum fidlgen.Enum
+		input := `{"type": "` + string(tc.typ) + `", "strict": false, "maybe_unknown_value": ` + tc.value + `}`
+		if err := json.Unmarshal([]byte(input), &enum); err != nil {
+			t.Errorf("unmarshalling %s: %s", tc.value, err)
+			continue
+		}
+		if enum.Type.IsSigned() {
+			got, err := enum.UnknownValueAsInt64()
+			if err != nil {
+				t.Errorf("UnknownValueAsInt64() for %s: %s", tc.value, err)
+			} else if got != tc.signed {
+				t.Errorf("got UnknownValueAsInt64() = %d for %s, want %d", got, tc.value, tc.signed)
+			}
+		} else {
+			got, err := enum.UnknownValueAsUint64()
+			if err != nil {
+				t.Errorf("UnknownValueAsUint64() for %s: %s", tc.value, err)
+			} else if got != tc.unsigned {
+				t.Errorf("got UnknownValueAsUint64() = %d for %s, want %d", got, tc.value, tc.unsigned)
+			}
+		}
+	}
+
+	for _, value := range []string{`"0xg"`, `"0b2"`, `"0x10000000000000000"`, `"one"`} {
+		var enum fidlgen.Enum
+		input := `{"type": "uint64", "strict": false, "maybe_unknown_value": ` + value + `}`
+		if err := json.Unmarshal([]byte(input), &enum); err == nil {
+			t.Errorf("unmarshalling %s succeeded, want error", value)
+		}
+	}
+}
+
+func TestEnumValidate(t *testing.T) {
+	member := func(name, value string) fidlgen.EnumMember {
+		return fidlgen.EnumMember{
+			Name: fidlgen.Identifier(name),
+			Value: fidlgen.Constant{
+				Kind:  fidlgen.LiteralConstant,
+				Value: value,
+				Literal: fidlgen.Literal{
+					Kind:  fidlgen.NumericLiteral,
+					Value: value,
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		enum    fidlgen.Enum
+		wantErr string
+	}{
+		{
+			name: "int8 in range",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Int8,
+				Members: []fidlgen.EnumMember{member("MIN", "-128"), member("MAX", "127")},
+			},
+		},
+		{
+			name: "int8 above range",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Int8,
+				Members: []fidlgen.EnumMember{member("OK", "1"), member("TOO_BIG", "128")},
+			},
+			wantErr: "TOO_BIG",
+		},
+		{
+			name: "int8 below range",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Int8,
+				Members: []fidlgen.EnumMember{member("TOO_SMALL", "-129")},
+			},
+			wantErr: "TOO_SMALL",
+		},
+		{
+			name: "uint8 negative",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Uint8,
+				Members: []fidlgen.EnumMember{member("NEGATIVE", "-1")},
+			},
+			wantErr: "NEGATIVE",
+		},
+		{
+			name: "uint64 max",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Uint64,
+				Members: []fidlgen.EnumMember{member("MAX", "18446744073709551615")},
+			},
+		},
+		{
+			name: "uint8 prefixed in range",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Uint8,
+				Members: []fidlgen.EnumMember{member("HEX", "0xff"), member("BIN", "0b1010"), member("OCT", "0o17")},
+			},
+		},
+		{
+			name: "int8 hex above range",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Int8,
+				Members: []fidlgen.EnumMember{member("TOO_BIG", "0x80")},
+			},
+			wantErr: "TOO_BIG",
+		},
+		{
+			name: "int8 hex negative in range",
+			enum: fidlgen.Enum{
+				Type:    fidlgen.Int8,
+				Members: []fidlgen.EnumMember{member("MIN", "-0x80")},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.enum.Validate()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error mentioning %s, got nil", test.wantErr)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("expected error mentioning %s, got: %s", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTableIsEmptyAndMaxOrdinal(t *testing.T) {
+	tests := []struct {
+		name           string
+		members        []fidlgen.TableMember
+		wantEmpty      bool
+		wantMaxOrdinal int
+	}{
+		{
+			name:           "no members",
+			wantEmpty:      true,
+			wantMaxOrdinal: 0,
+		},
+		{
+			name: "all reserved",
+			members: []fidlgen.TableMember{
+				{Ordinal: 1, Reserved: true},
+				{Ordinal: 2, Reserved: true},
+			},
+			wantEmpty:      true,
+			wantMaxOrdinal: 0,
+		},
+		{
+			name: "sparse",
+			members: []fidlgen.TableMember{
+				{Ordinal: 1, Name: "first"},
+				{Ordinal: 2, Reserved: true},
+				{Ordinal: 5, Name: "fifth"},
+				{Ordinal: 3, Name: "third"},
+				{Ordinal: 7, Reserved: true},
+			},
+			wantEmpty:      false,
+			wantMaxOrdinal: 5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := fidlgen.Table{Members: test.members}
+			if got := table.IsEmpty(); got != test.wantEmpty {
+				t.Errorf("got IsEmpty() = %t, want %t", got, test.wantEmpty)
+			}
+			if got := table.MaxOrdinal(); got != test.wantMaxOrdinal {
+				t.Errorf("got MaxOrdinal() = %d, want %d", got, test.wantMaxOrdinal)
+			}
+		})
+	}
+}
+
+func TestNamingContext(t *testing.T) {
+	cases := []struct {
+		nc         fidlgen.NamingContext
+		topLevel   string
+		parent     fidlgen.NamingContext
+		parentAnon bool
+	}{
+		{
+			nc:       fidlgen.NamingContext{"Foo"},
+			topLevel: "Foo",
+			parent:   nil,
+		},
+		{
+			nc:       fidlgen.NamingContext{"Foo", "Bar"},
+			topLevel: "Foo",
+			parent:   fidlgen.NamingContext{"Foo"},
+		},
+		{
+			nc:         fidlgen.NamingContext{"Foo", "Bar", "Baz"},
+			topLevel:   "Foo",
+			parent:     fidlgen.NamingContext{"Foo", "Bar"},
+			parentAnon: true,
+		},
+	}
+	for _, c := range cases {
+		if got := c.nc.TopLevel(); got != c.topLevel {
+			t.Errorf("%v.TopLevel(): got %q, want %q", c.nc, got, c.topLevel)
+		}
+		parent := c.nc.ParentContext()
+		if diff := cmp.Diff(c.parent, parent); diff != "" {
+			t.Errorf("%v.ParentContext() mismatch (-want +got):\n%s", c.nc, diff)
+		}
+		if got := parent.IsAnonymous(); got != c.parentAnon {
+			t.Errorf("%v.ParentContext().IsAnonymous(): got %t, want %t", c.nc, got, c.parentAnon)
+		}
+	}
+}
+
+func TestLayoutSourceName(t *testing.T) {
+	generatedName := fidlgen.Attribute{
+		Name: "generated_name",
+		Args: []fidlgen.AttributeArg{
+			{
+				Name: "value",
+				Value: fidlgen.Constant{
+					Kind: fidlgen.LiteralConstant,
+					Literal: fidlgen.Literal{
+						Kind:  fidlgen.StringLiteral,
+						Value: "Baz",
+					},
+					Value: "Baz",
+				},
+			},
+		},
+	}
+	cases := []struct {
+		name   string
+		layout fidlgen.Layout
+		want   fidlgen.Identifier
+	}{
+		{
+			name: "top level",
+			layout: fidlgen.Layout{
+				Decl:          fidlgen.Decl{Name: "example/Foo"},
+				NamingContext: fidlgen.NamingContext{"Foo"},
+			},
+			want: "Foo",
+		},
+		{
+			name: "anonymous",
+			layout: fidlgen.Layout{
+				Decl:          fidlgen.Decl{Name: "example/Bar"},
+				NamingContext: fidlgen.NamingContext{"Foo", "Bar"},
+			},
+			want: "Bar",
+		},
+		{
+			name: "generated name",
+			layout: fidlgen.Layout{
+				Decl: fidlgen.Decl{
+					Attributes: fidlgen.Attributes{Attributes: []fidlgen.Attribute{generatedName}},
+					Name:       "example/Baz",
+				},
+				NamingContext: fidlgen.NamingContext{"Foo", "Bar"},
+			},
+			want: "Bar",
+		},
+		{
+			name: "no naming context",
+			layout: fidlgen.Layout{
+				Decl: fidlgen.Decl{Name: "example/Foo"},
+			},
+			want: "Foo",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.layout.SourceName(); got != c.want {
+				t.Errorf("got SourceName() = %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestProtocolGetServiceName(t *testing.T) {
+	nameArg := func(value string) fidlgen.AttributeArg {
+		return fidlgen.AttributeArg{
+			Name: "name",
+			Value: fidlgen.Constant{
+				Kind: fidlgen.LiteralConstant,
+				Literal: fidlgen.Literal{
+					Kind:  fidlgen.StringLiteral,
+					Value: value,
+				},
+				Value: value,
+			},
+		}
+	}
+	cases := []struct {
+		name  string
+		attrs []fidlgen.Attribute
+		want  string
+	}{
+		{
+			name: "not discoverable",
+			want: "",
+		},
+		{
+			name:  "default",
+			attrs: []fidlgen.Attribute{{Name: "discoverable"}},
+			want:  `"fuchsia.foo.Bar"`,
+		},
+		{
+			name:  "override",
+			attrs: []fidlgen.Attribute{{Name: "discoverable", Args: []fidlgen.AttributeArg{nameArg("fuchsia.baz.Qux")}}},
+			want:  `"fuchsia.baz.Qux"`,
+		},
+		{
+			name:  "empty override",
+			attrs: []fidlgen.Attribute{{Name: "discoverable", Args: []fidlgen.AttributeArg{nameArg("")}}},
+			want:  `"fuchsia.foo.Bar"`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := fidlgen.Protocol{
+				Decl: fidlgen.Decl{
+					Attributes: fidlgen.Attributes{Attributes: c.attrs},
+					Name:       "fuchsia.foo/Bar",
+				},
+			}
+			if got := p.GetServiceName(); got != c.want {
+				t.Errorf("got GetServiceName() = %s, want = %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestProtocolEvents(t *testing.T) {
+	p := fidlgen.Protocol{
+		Decl: fidlgen.Decl{Name: "fuchsia.foo/Bar"},
+		Methods: []fidlgen.Method{
+			{Name: "TwoWay", Ordinal: 1, HasRequest: true, HasResponse: true},
+			{Name: "Second", Ordinal: 5, HasResponse: true},
+			{Name: "OneWay", Ordinal: 3, HasRequest: true},
+			{Name: "First", Ordinal: 2, HasResponse: true},
+			{Name: "AnotherTwoWay", Ordinal: 4, HasRequest: true, HasResponse: true},
+		},
+	}
+	var got []fidlgen.Identifier
+	for _, m := range p.Events() {
+		if !m.IsEvent() {
+			t.Errorf("got event %s with IsEvent() = false", m.Name)
+		}
+		got = append(got, m.Name)
+	}
+	want := []fidlgen.Identifier{"First", "Second"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Events() mismatch (-want +got):\n%s", diff)
+	}
+
+	if events := (&fidlgen.Protocol{}).Events(); len(events) != 0 {
+		t.Errorf("got Events() = %#v for a protocol without methods, want none", events)
+	}
+}
+
 func TestCanUnmarshalBits(t *testing.T) {
 	root := fidlgentest.EndToEndTest{T: t}.Single(`
 		library example;
@@ -626,6 +1234,191 @@ func TestCanUnmarshalTypeAliases(t *testing.T) {
 	}
 }
 
+func TestResolveTypeAlias(t *testing.T) {
+	size := func(value string) *fidlgen.Constant {
+		return &fidlgen.Constant{
+			Kind: fidlgen.LiteralConstant,
+			Literal: fidlgen.Literal{
+				Kind:  fidlgen.NumericLiteral,
+				Value: value,
+			},
+			Value: value,
+		}
+	}
+	intPtr := func(n int) *int { return &n }
+	root := fidlgen.Root{
+		Name: "example",
+		TypeAliases: []fidlgen.TypeAlias{
+			{
+				Decl: fidlgen.Decl{Name: "example/Foo"},
+				PartialTypeConstructor: fidlgen.PartialTypeConstructor{
+					Name: "vector",
+					Args: []fidlgen.PartialTypeConstructor{{Name: "uint32"}},
+				},
+			},
+			{
+				Decl: fidlgen.Decl{Name: "example/Baz"},
+				PartialTypeConstructor: fidlgen.PartialTypeConstructor{
+					Name:      "string",
+					MaybeSize: size("123"),
+				},
+			},
+			{
+				Decl: fidlgen.Decl{Name: "example/OptionalFoos"},
+				PartialTypeConstructor: fidlgen.PartialTypeConstructor{
+					Name:      "vector",
+					Args:      []fidlgen.PartialTypeConstructor{{Name: "example/Foo", Nullable: true}},
+					MaybeSize: size("4"),
+				},
+			},
+			{
+				Decl: fidlgen.Decl{Name: "example/Loop"},
+				PartialTypeConstructor: fidlgen.PartialTypeConstructor{
+					Name: "example/Loop",
+				},
+			},
+		},
+		Decls: fidlgen.DeclMap{
+			"example/Foo":          fidlgen.TypeAliasDeclType,
+			"example/Baz":          fidlgen.TypeAliasDeclType,
+			"example/OptionalFoos": fidlgen.TypeAliasDeclType,
+			"example/Loop":         fidlgen.TypeAliasDeclType,
+		},
+	}
+
+	uint32Vector := fidlgen.Type{
+		Kind: fidlgen.VectorType,
+		ElementType: &fidlgen.Type{
+			Kind:             fidlgen.PrimitiveType,
+			PrimitiveSubtype: fidlgen.Uint32,
+		},
+	}
+	optionalUint32Vector := uint32Vector
+	optionalUint32Vector.Nullable = true
+
+	for _, tc := range []struct {
+		name fidlgen.EncodedCompoundIdentifier
+		want fidlgen.Type
+	}{
+		{
+			name: "example/Foo",
+			want: uint32Vector,
+		},
+		{
+			name: "example/Baz",
+			want: fidlgen.Type{
+				Kind:         fidlgen.StringType,
+				ElementCount: intPtr(123),
+			},
+		},
+		{
+			name: "example/OptionalFoos",
+			want: fidlgen.Type{
+				Kind:         fidlgen.VectorType,
+				ElementType:  &optionalUint32Vector,
+				ElementCount: intPtr(4),
+			},
+		},
+	} {
+		got, err := root.ResolveTypeAlias(tc.name)
+		if err != nil {
+			t.Errorf("ResolveTypeAlias(%s): %s", tc.name, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("ResolveTypeAlias(%s): unexpected diff (-want +got):\n%s", tc.name, diff)
+		}
+	}
+
+	for _, name := range []fidlgen.EncodedCompoundIdentifier{"example/Loop", "example/Missing"} {
+		if _, err := root.ResolveTypeAlias(name); err == nil {
+			t.Errorf("ResolveTypeAlias(%s) succeeded, want error", name)
+		}
+	}
+}
+
+func TestEncodeJSONRoundTrip(t *testing.T) {
+	root := fidlgentest.EndToEndTest{T: t}.WithDependency(`
+		library zx;
+
+		type obj_type = enum : uint32 {
+			CHANNEL = 4;
+		};
+
+		resource_definition handle : uint32 {
+			properties {
+				subtype obj_type;
+			};
+		};
+	`).Single(`
+		library example;
+
+		using zx;
+
+		/// Doc comment.
+		type Struct = struct {
+			a array<uint8, 4>;
+			b vector<string:10>:optional;
+			c string;
+			d Table;
+			e Union:optional;
+			f flexible enum : int32 {
+				A = -1;
+			};
+			g Bits;
+		};
+
+		type Table = table {
+			1: a uint32;
+			2: reserved;
+			3: b Struct2;
+		};
+
+		type Struct2 = struct {};
+
+		type Union = strict union {
+			1: s string;
+			2: u uint64;
+		};
+
+		type Bits = bits {
+			ONE = 1;
+		};
+
+		type Resource = resource struct {
+			h zx.handle:<CHANNEL, optional>;
+			p client_end:Protocol;
+			r server_end:Protocol;
+		};
+
+		const VALUE uint32 = 3;
+
+		alias Alias = vector<Struct>;
+
+		@discoverable
+		protocol Protocol {
+			Method(struct { a Struct; }) -> (struct { b uint8; }) error uint32;
+			-> Event(struct { c string; });
+		};
+	`)
+
+	var b strings.Builder
+	if err := root.EncodeJSON(&b); err != nil {
+		t.Fatalf("EncodeJSON: %s", err)
+	}
+	decoded, err := fidlgen.ReadJSONIrContent([]byte(b.String()))
+	if err != nil {
+		t.Fatalf("ReadJSONIrContent: %s\n%s", err, b.String())
+	}
+	if !reflect.DeepEqual(root, decoded) {
+		var b2 strings.Builder
+		if err := decoded.EncodeJSON(&b2); err != nil {
+			t.Fatalf("EncodeJSON: %s", err)
+		}
+		t.Errorf("decoded IR does not match original (-want +got):\n%s", cmp.Diff(b.String(), b2.String()))
+	}
+}
+
 func TestEncodedCompoundIdentifierParsing(t *testing.T) {
 	type testCase struct {
 		input          fidlgen.EncodedCompoundIdentifier
@@ -670,3 +1463,745 @@ func compoundIdentifier(library []string, name, member string) fidlgen.CompoundI
 		Member:  fidlgen.Identifier(member),
 	}
 }
+
+func TestCheckMethodPayloads(t *testing.T) {
+	root := fidlgen.Root{
+		Name: "example",
+		Protocols: []fidlgen.Protocol{
+			{
+				Decl: fidlgen.Decl{Name: "example/Proto"},
+				Methods: []fidlgen.Method{
+					{
+						Name:            "Good",
+						RequestPayload:  &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Request"},
+						ResponsePayload: &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "dep/Response"},
+					},
+					{
+						Name:           "Missing",
+						RequestPayload: &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Missing"},
+					},
+					{
+						Name:            "NotALayout",
+						ResponsePayload: &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Enum"},
+					},
+					{
+						Name: "NoPayload",
+					},
+				},
+			},
+		},
+		Decls: fidlgen.DeclMap{
+			"example/Proto":   fidlgen.ProtocolDeclType,
+			"example/Request": fidlgen.StructDeclType,
+			"example/Enum":    fidlgen.EnumDeclType,
+		},
+		Libraries: []fidlgen.Library{
+			{
+				Name: "dep",
+				Decls: fidlgen.DeclInfoMap{
+					"dep/Response": {Type: fidlgen.TableDeclType},
+				},
+			},
+		},
+	}
+
+	errs := root.CheckMethodPayloads()
+	if len(errs) != 2 {
+		t.Fatalf("got CheckMethodPayloads() = %v, want 2 errors", errs)
+	}
+	for i, want := range []string{"Missing", "NotALayout"} {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("got errs[%d] = %q, want it to mention %s", i, errs[i], want)
+		}
+	}
+	if !strings.Contains(errs[0].Error(), "example/Missing") {
+		t.Errorf("got errs[0] = %q, want it to mention example/Missing", errs[0])
+	}
+}
+
+func TestRequiresV2(t *testing.T) {
+	structShape := fidlgen.TypeShape{InlineSize: 8, Alignment: 8}
+	tableShapeV1 := fidlgen.TypeShape{InlineSize: 16, Alignment: 8, Depth: 2, MaxOutOfLine: 24, HasFlexibleEnvelope: true}
+	tableShapeV2 := fidlgen.TypeShape{InlineSize: 16, Alignment: 8, Depth: 2, MaxOutOfLine: 8, HasFlexibleEnvelope: true}
+
+	plain := fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Plain", TypeShapeV1: structShape, TypeShapeV2: structShape}
+	if plain.RequiresV2() {
+		t.Errorf("got %s RequiresV2() = true, want = false", plain.Identifier)
+	}
+	table := fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Table", TypeShapeV1: tableShapeV1, TypeShapeV2: tableShapeV2}
+	if !table.RequiresV2() {
+		t.Errorf("got %s RequiresV2() = false, want = true", table.Identifier)
+	}
+
+	root := fidlgen.Root{
+		Name: "example",
+		Structs: []fidlgen.Struct{
+			{
+				Layout:      fidlgen.Layout{Decl: fidlgen.Decl{Name: "example/Plain"}},
+				TypeShapeV1: structShape,
+				TypeShapeV2: structShape,
+			},
+		},
+		Tables: []fidlgen.Table{
+			{
+				Layout:      fidlgen.Layout{Decl: fidlgen.Decl{Name: "example/Table"}},
+				TypeShapeV1: tableShapeV1,
+				TypeShapeV2: tableShapeV2,
+			},
+			{
+				// Identical shapes still require v2 for the flexible envelope.
+				Layout:      fidlgen.Layout{Decl: fidlgen.Decl{Name: "example/EmptyTable"}},
+				TypeShapeV1: fidlgen.TypeShape{InlineSize: 16, Alignment: 8, HasFlexibleEnvelope: true},
+				TypeShapeV2: fidlgen.TypeShape{InlineSize: 16, Alignment: 8, HasFlexibleEnvelope: true},
+			},
+		},
+	}
+	want := []fidlgen.EncodedCompoundIdentifier{"example/EmptyTable", "example/Table"}
+	if diff := cmp.Diff(want, root.DeclsRequiringV2()); diff != "" {
+		t.Errorf("DeclsRequiringV2() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStructFieldLayout(t *testing.T) {
+	// struct { a uint8; b union; c uint32; }, where the union is 24 bytes
+	// inline in v1 and 16 bytes in v2.
+	members := []fidlgen.StructMember{
+		{
+			Name:         "a",
+			FieldShapeV1: fidlgen.FieldShape{Offset: 0, Padding: 7},
+			FieldShapeV2: fidlgen.FieldShape{Offset: 0, Padding: 7},
+		},
+		{
+			Name:         "b",
+			FieldShapeV1: fidlgen.FieldShape{Offset: 8, Padding: 0},
+			FieldShapeV2: fidlgen.FieldShape{Offset: 8, Padding: 0},
+		},
+		{
+			Name:         "c",
+			FieldShapeV1: fidlgen.FieldShape{Offset: 32, Padding: 4},
+			FieldShapeV2: fidlgen.FieldShape{Offset: 24, Padding: 4},
+		},
+	}
+	s := fidlgen.Struct{
+		Layout:  fidlgen.Layout{Decl: fidlgen.Decl{Name: "example/WithUnion"}},
+		Members: members,
+	}
+
+	for _, tc := range []struct {
+		format fidlgen.WireFormat
+		want   []fidlgen.StructFieldLayout
+	}{
+		{
+			format: fidlgen.WireFormatV1,
+			want: []fidlgen.StructFieldLayout{
+				{Member: members[0], Offset: 0, Padding: 7},
+				{Member: members[1], Offset: 8, Padding: 0},
+				{Member: members[2], Offset: 32, Padding: 4},
+			},
+		},
+		{
+			format: fidlgen.WireFormatV2,
+			want: []fidlgen.StructFieldLayout{
+				{Member: members[0], Offset: 0, Padding: 7},
+				{Member: members[1], Offset: 8, Padding: 0},
+				{Member: members[2], Offset: 24, Padding: 4},
+			},
+		},
+	} {
+		got, err := s.FieldLayout(tc.format)
+		if err != nil {
+			t.Errorf("FieldLayout(%s) failed: %s", tc.format, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("FieldLayout(%s) mismatch (-want +got):\n%s", tc.format, diff)
+		}
+	}
+
+	if got, err := s.FieldLayout("v3"); err == nil {
+		t.Errorf("FieldLayout(v3) = %+v, want error", got)
+	}
+}
+
+func TestServiceResolvedMembers(t *testing.T) {
+	const shape = `"type_shape_v1": {}, "type_shape_v2": {}`
+	member := func(name, protocol string) string {
+		return `{"name": "` + name + `", "type": {"kind": "identifier", "identifier": "` + protocol + `", "nullable": false, ` + shape + `}}`
+	}
+	input := `{
+		"name": "example",
+		"interface_declarations": [
+			{"name": "example/First", "methods": []},
+			{"name": "example/Second", "methods": []}
+		],
+		"service_declarations": [
+			{
+				"name": "example/Service",
+				"members": [` + member("first", "example/First") + `, ` + member("second", "example/Second") + `]
+			},
+			{
+				"name": "example/Broken",
+				"members": [` + member("missing", "example/Missing") + `]
+			}
+		]
+	}`
+	root, err := fidlgen.DecodeJSONIr(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+
+	members, err := root.Services[0].ResolvedMembers(&root)
+	if err != nil {
+		t.Fatalf("ResolvedMembers() = %s", err)
+	}
+	var got []string
+	for _, m := range members {
+		got = append(got, string(m.Name)+"="+string(m.Protocol.Name))
+	}
+	want := []string{"first=example/First", "second=example/Second"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ResolvedMembers() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := root.Services[1].ResolvedMembers(&root); err == nil {
+		t.Error("got ResolvedMembers() = nil error for an unresolved protocol, want error")
+	}
+}
+
+func TestSubsetForProtocol(t *testing.T) {
+	identifier := func(name string) string {
+		return `{"kind": "identifier", "identifier": "` + name + `", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}`
+	}
+	vector := func(element string) string {
+		return `{"kind": "vector", "element_type": ` + element + `, "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}`
+	}
+	uint32Type := `{"kind": "primitive", "subtype": "uint32", "type_shape_v1": {}, "type_shape_v2": {}}`
+	input := `{
+		"name": "example",
+		"const_declarations": [
+			{"name": "example/DEFAULT", "type": ` + uint32Type + `, "value": {"kind": "literal", "value": "1"}},
+			{"name": "example/UNUSED", "type": ` + uint32Type + `, "value": {"kind": "literal", "value": "2"}}
+		],
+		"enum_declarations": [
+			{"name": "example/Color", "type": "uint32", "members": [], "strict": true}
+		],
+		"interface_declarations": [
+			{
+				"name": "example/Painter",
+				"methods": [{
+					"ordinal": 1,
+					"name": "Paint",
+					"has_request": true,
+					"maybe_request_payload": ` + identifier("example/PainterPaintRequest") + `,
+					"has_response": false
+				}]
+			},
+			{"name": "example/Other", "methods": []}
+		],
+		"struct_declarations": [
+			{
+				"name": "example/PainterPaintRequest",
+				"members": [
+					{"name": "strokes", "type": ` + vector(identifier("example/Stroke")) + `},
+					{"name": "width", "type": ` + uint32Type + `, "maybe_default_value": {"kind": "identifier", "identifier": "example/DEFAULT", "value": "1"}}
+				]
+			},
+			{"name": "example/Unused", "members": [{"name": "color", "type": ` + identifier("example/Color") + `}]}
+		],
+		"table_declarations": [
+			{"name": "example/Stroke", "members": [
+				{"ordinal": 1, "reserved": false, "name": "color", "type": ` + identifier("example/Color") + `},
+				{"ordinal": 2, "reserved": false, "name": "other", "type": ` + identifier("dependency/Thing") + `}
+			]}
+		],
+		"declaration_order": [
+			"example/Color",
+			"example/DEFAULT",
+			"example/Other",
+			"example/Stroke",
+			"example/PainterPaintRequest",
+			"example/Painter",
+			"example/UNUSED",
+			"example/Unused"
+		],
+		"declarations": {
+			"example/Color": "enum",
+			"example/DEFAULT": "const",
+			"example/Other": "interface",
+			"example/Painter": "interface",
+			"example/PainterPaintRequest": "struct",
+			"example/Stroke": "table",
+			"example/UNUSED": "const",
+			"example/Unused": "struct"
+		},
+		"library_dependencies": [
+			{"name": "dependency", "declarations": {"dependency/Thing": {"kind": "struct", "resource": false}}}
+		]
+	}`
+	root, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+
+	subset, err := root.SubsetForProtocol("example/Painter")
+	if err != nil {
+		t.Fatalf("SubsetForProtocol() = %s", err)
+	}
+	wantOrder := []fidlgen.EncodedCompoundIdentifier{
+		"example/Color",
+		"example/DEFAULT",
+		"example/Stroke",
+		"example/PainterPaintRequest",
+		"example/Painter",
+	}
+	if diff := cmp.Diff(wantOrder, subset.DeclOrder); diff != "" {
+		t.Errorf("DeclOrder mismatch (-want +got):\n%s", diff)
+	}
+	if err := subset.CheckDeclOrder(); err != nil {
+		t.Errorf("CheckDeclOrder() = %s", err)
+	}
+	for _, name := range subset.DeclOrder {
+		if subset.LookupDecl(name) == nil {
+			t.Errorf("LookupDecl(%s) = nil, want declaration", name)
+		}
+	}
+	if subset.LookupDecl("example/Unused") != nil {
+		t.Error("LookupDecl(example/Unused) != nil, want unreachable declaration dropped")
+	}
+	if _, ok := subset.DeclsWithDependencies()["dependency/Thing"]; !ok {
+		t.Error("dependency/Thing missing from DeclsWithDependencies(), want library dependencies kept")
+	}
+
+	var b strings.Builder
+	if err := subset.EncodeJSON(&b); err != nil {
+		t.Fatalf("EncodeJSON: %s", err)
+	}
+	decoded, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("failed to decode subset IR: %s\n%s", err, b.String())
+	}
+	if !reflect.DeepEqual(subset, decoded) {
+		var b2 strings.Builder
+		if err := decoded.EncodeJSON(&b2); err != nil {
+			t.Fatalf("EncodeJSON: %s", err)
+		}
+		t.Errorf("decoded subset does not match (-want +got):\n%s", cmp.Diff(b.String(), b2.String()))
+	}
+
+	for _, name := range []fidlgen.EncodedCompoundIdentifier{"example/Missing", "example/Stroke"} {
+		if _, err := root.SubsetForProtocol(name); err == nil {
+			t.Errorf("SubsetForProtocol(%s) = nil error, want error", name)
+		}
+	}
+}
+
+func TestSubset(t *testing.T) {
+	identifier := func(name string) string {
+		return `{"kind": "identifier", "identifier": "` + name + `", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}`
+	}
+	uint32Type := `{"kind": "primitive", "subtype": "uint32", "type_shape_v1": {}, "type_shape_v2": {}}`
+	input := `{
+		"name": "example",
+		"const_declarations": [
+			{"name": "example/MAX", "type": ` + uint32Type + `, "value": {"kind": "literal", "value": "1"}}
+		],
+		"enum_declarations": [
+			{"name": "example/Color", "type": "uint32", "members": [], "strict": true}
+		],
+		"struct_declarations": [
+			{"name": "example/Point", "members": [{"name": "color", "type": ` + identifier("example/Color") + `}]},
+			{"name": "example/Unused", "members": [{"name": "x", "type": ` + uint32Type + `}]}
+		],
+		"declaration_order": ["example/Color", "example/MAX", "example/Point", "example/Unused"],
+		"declarations": {
+			"example/Color": "enum",
+			"example/MAX": "const",
+			"example/Point": "struct",
+			"example/Unused": "struct"
+		}
+	}`
+	root, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+
+	subset, err := root.Subset("example/Point", "example/MAX")
+	if err != nil {
+		t.Fatalf("Subset() = %s", err)
+	}
+	wantOrder := []fidlgen.EncodedCompoundIdentifier{"example/Color", "example/MAX", "example/Point"}
+	if diff := cmp.Diff(wantOrder, subset.DeclOrder); diff != "" {
+		t.Errorf("DeclOrder mismatch (-want +got):\n%s", diff)
+	}
+	if subset.LookupDecl("example/Unused") != nil {
+		t.Error("LookupDecl(example/Unused) != nil, want unreachable declaration dropped")
+	}
+
+	_, err = root.Subset("example/Point", "example/Missing", "other/Point")
+	if err == nil {
+		t.Fatal("Subset() = nil error for unknown names, want error")
+	}
+	if want := "example/Missing, other/Point"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Subset() = %q, want error containing %q", err, want)
+	}
+}
+
+func TestForEachDecl(t *testing.T) {
+	identifier := func(name string) string {
+		return `{"kind": "identifier", "identifier": "` + name + `", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}`
+	}
+	uint32Type := `{"kind": "primitive", "subtype": "uint32", "type_shape_v1": {}, "type_shape_v2": {}}`
+	input := `{
+		"name": "example",
+		"const_declarations": [
+			{"name": "example/MAX", "type": ` + uint32Type + `, "value": {"kind": "literal", "value": "1"}}
+		],
+		"interface_declarations": [
+			{
+				"name": "example/Painter",
+				"methods": [{
+					"ordinal": 1,
+					"name": "Paint",
+					"has_request": true,
+					"maybe_request_payload": ` + identifier("example/PainterPaintRequest") + `,
+					"has_response": false
+				}]
+			}
+		],
+		"struct_declarations": [
+			{
+				"name": "example/PainterPaintRequest",
+				"naming_context": ["Painter", "Paint", "Request"],
+				"members": [{"name": "width", "type": ` + uint32Type + `}]
+			},
+			{"name": "example/Point", "naming_context": ["Point"], "members": []}
+		],
+		"type_alias_declarations": [
+			{"name": "example/Width", "partial_type_ctor": {"name": "uint32", "args": [], "nullable": false}}
+		],
+		"declaration_order": [
+			"example/Width",
+			"example/PainterPaintRequest",
+			"example/Painter",
+			"example/Point",
+			"example/MAX"
+		],
+		"declarations": {
+			"example/MAX": "const",
+			"example/Painter": "interface",
+			"example/PainterPaintRequest": "struct",
+			"example/Point": "struct",
+			"example/Width": "alias"
+		}
+	}`
+	root, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+
+	var got []fidlgen.EncodedCompoundIdentifier
+	if err := root.ForEachDecl(func(name fidlgen.EncodedCompoundIdentifier, decl fidlgen.Declaration) error {
+		if decl.GetName() != name {
+			t.Errorf("got declaration %s for %s", decl.GetName(), name)
+		}
+		got = append(got, name)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachDecl() = %s", err)
+	}
+	if diff := cmp.Diff(root.DeclOrder, got); diff != "" {
+		t.Errorf("ForEachDecl() order mismatch (-want +got):\n%s", diff)
+	}
+
+	stop := errors.New("stop")
+	got = nil
+	if err := root.ForEachDecl(func(name fidlgen.EncodedCompoundIdentifier, decl fidlgen.Declaration) error {
+		got = append(got, name)
+		if _, ok := decl.(*fidlgen.Protocol); ok {
+			return stop
+		}
+		return nil
+	}); err != stop {
+		t.Errorf("ForEachDecl() = %v, want %v", err, stop)
+	}
+	if diff := cmp.Diff(root.DeclOrder[:3], got); diff != "" {
+		t.Errorf("ForEachDecl() did not stop at the first error (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	identifier := func(name string) string {
+		return `{"kind": "identifier", "identifier": "` + name + `", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}`
+	}
+	vector := func(element string) string {
+		return `{"kind": "vector", "element_type": ` + element + `, "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}`
+	}
+	input := `{
+		"name": "example",
+		"struct_declarations": [
+			{"name": "example/Point", "members": []},
+			{
+				"name": "example/Shape",
+				"members": [
+					{"name": "origin", "type": ` + identifier("example/Point") + `},
+					{"name": "thing", "type": ` + identifier("dependency/Thing") + `},
+					{"name": "missing", "type": ` + identifier("example/Missing") + `},
+					{"name": "gone", "type": ` + vector(identifier("dependency/Gone")) + `},
+					{"name": "again", "type": ` + vector(identifier("example/Missing")) + `}
+				]
+			}
+		],
+		"declaration_order": ["example/Point", "example/Shape"],
+		"declarations": {
+			"example/Point": "struct",
+			"example/Shape": "struct"
+		},
+		"library_dependencies": [
+			{"name": "dependency", "declarations": {"dependency/Thing": {"kind": "struct", "resource": false}}}
+		]
+	}`
+
+	root, err := fidlgen.DecodeJSONIr(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("DecodeJSONIr() = %s, want no validation", err)
+	}
+	err = root.Validate()
+	if err == nil {
+		t.Fatal("Validate() succeeded, want unresolved identifiers")
+	}
+	if want := "unresolved identifiers: dependency/Gone, example/Missing"; err.Error() != want {
+		t.Errorf("got Validate() = %q, want %q", err, want)
+	}
+	if _, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(input)); err == nil {
+		t.Error("DecodeJSONIrStrict() succeeded, want unresolved identifiers")
+	}
+
+	root.Structs = root.Structs[:1]
+	if err := root.Validate(); err != nil {
+		t.Errorf("Validate() = %s, want nil", err)
+	}
+}
+
+func TestDecodeJSONIrNamed(t *testing.T) {
+	root, err := fidlgen.DecodeJSONIrNamed("example.fidl.json", strings.NewReader(`{"name": "example"}`))
+	if err != nil {
+		t.Fatalf("DecodeJSONIrNamed() = %s", err)
+	}
+	if root.Name != "example" {
+		t.Errorf("got library name %q, want %q", root.Name, "example")
+	}
+
+	_, err = fidlgen.DecodeJSONIrNamed("truncated.fidl.json", strings.NewReader(`{"name": `))
+	if err == nil || !strings.Contains(err.Error(), "from truncated.fidl.json") {
+		t.Errorf("got DecodeJSONIrNamed() = %v, want an error naming truncated.fidl.json", err)
+	}
+	if _, err := fidlgen.DecodeJSONIr(strings.NewReader(`{"name": `)); err == nil || strings.Contains(err.Error(), " from ") {
+		t.Errorf("got DecodeJSONIr() = %v, want an error without a name", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	uint32Type := `{"kind": "primitive", "subtype": "uint32", "type_shape_v1": {"inline_size": 4, "alignment": 4}, "type_shape_v2": {"inline_size": 4, "alignment": 4}}`
+	input := `{
+		"name": "example",
+		"interface_declarations": [
+			{
+				"name": "example/Painter",
+				"location": {"filename": "example.fidl", "line": 3, "column": 10, "length": 7},
+				"methods": [{"ordinal": 1, "name": "Paint", "has_request": true, "has_response": false}]
+			}
+		],
+		"struct_declarations": [
+			{
+				"name": "example/Point",
+				"location": {"filename": "example.fidl", "line": 7, "column": 6, "length": 5},
+				"members": [
+					{"name": "x", "type": ` + uint32Type + `},
+					{"name": "y", "type": ` + uint32Type + `}
+				]
+			}
+		],
+		"declaration_order": ["example/Painter", "example/Point"],
+		"declarations": {
+			"example/Painter": "interface",
+			"example/Point": "struct"
+		}
+	}`
+	decode := func() fidlgen.Root {
+		root, err := fidlgen.DecodeJSONIrStrict(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("failed to decode IR: %s", err)
+		}
+		return root
+	}
+	root := decode()
+	want := root.Fingerprint()
+	again := decode()
+	if got := again.Fingerprint(); got != want {
+		t.Errorf("got Fingerprint() = %s for the same IR, want %s", got, want)
+	}
+
+	reformatted := decode()
+	reformatted.Structs[0].Location = fidlgen.Location{Filename: "example.fidl", Line: 9, Column: 2, Length: 5}
+	if got := reformatted.Fingerprint(); got != want {
+		t.Errorf("got Fingerprint() = %s after moving a declaration, want %s", got, want)
+	}
+
+	mutations := map[string]func(*fidlgen.Root){
+		"member name": func(r *fidlgen.Root) {
+			r.Structs[0].Members[1].Name = "z"
+		},
+		"member type": func(r *fidlgen.Root) {
+			r.Structs[0].Members[0].Type.PrimitiveSubtype = fidlgen.Uint64
+		},
+		"type shape": func(r *fidlgen.Root) {
+			r.Structs[0].Members[0].Type.TypeShapeV2.InlineSize = 8
+		},
+		"member removed": func(r *fidlgen.Root) {
+			r.Structs[0].Members = r.Structs[0].Members[:1]
+		},
+		"ordinal": func(r *fidlgen.Root) {
+			r.Protocols[0].Methods[0].Ordinal = 2
+		},
+		"declaration name": func(r *fidlgen.Root) {
+			r.Protocols[0].Name = "example/Drawer"
+		},
+	}
+	for name, mutate := range mutations {
+		t.Run(name, func(t *testing.T) {
+			root := decode()
+			mutate(&root)
+			if got := root.Fingerprint(); got == want {
+				t.Errorf("got unchanged Fingerprint() = %s", got)
+			}
+		})
+	}
+}
+
+func TestReachableTypes(t *testing.T) {
+	identifier := func(name string) string {
+		return `{"kind": "identifier", "identifier": "` + name + `", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}`
+	}
+	uint32Type := `{"kind": "primitive", "subtype": "uint32", "type_shape_v1": {}, "type_shape_v2": {}}`
+	input := `{
+		"name": "example",
+		"enum_declarations": [
+			{"name": "example/Color", "type": "uint32", "members": [], "strict": true}
+		],
+		"interface_declarations": [
+			{
+				"name": "example/Painter",
+				"methods": [
+					{
+						"ordinal": 1,
+						"name": "Paint",
+						"has_request": true,
+						"maybe_request_payload": ` + identifier("example/PainterPaintRequest") + `,
+						"has_response": true,
+						"maybe_response_payload": ` + identifier("example/PainterPaintResponse") + `,
+						"maybe_response_result_type": ` + identifier("example/PainterPaintResult") + `,
+						"maybe_response_success_type": ` + identifier("example/PainterPaintSuccess") + `,
+						"maybe_response_err_type": ` + uint32Type + `
+					},
+					{"ordinal": 2, "name": "Clear", "has_request": true, "has_response": false}
+				]
+			}
+		],
+		"struct_declarations": [
+			{"name": "example/PainterPaintRequest", "members": [{"name": "stroke", "type": ` + identifier("example/Stroke") + `}]},
+			{"name": "example/PainterPaintResponse", "members": [{"name": "result", "type": ` + identifier("example/PainterPaintResult") + `}]},
+			{"name": "example/PainterPaintSuccess", "members": []},
+			{"name": "example/Unused", "members": []}
+		],
+		"table_declarations": [
+			{"name": "example/Stroke", "members": [
+				{"ordinal": 1, "reserved": false, "name": "color", "type": ` + identifier("example/Color") + `},
+				{"ordinal": 2, "reserved": false, "name": "shape", "type": ` + identifier("example/Shape") + `},
+				{"ordinal": 3, "reserved": false, "name": "other", "type": ` + identifier("dependency/Thing") + `}
+			]}
+		],
+		"union_declarations": [
+			{"name": "example/PainterPaintResult", "members": [
+				{"ordinal": 1, "reserved": false, "name": "response", "type": ` + identifier("example/PainterPaintSuccess") + `},
+				{"ordinal": 2, "reserved": false, "name": "err", "type": ` + uint32Type + `}
+			], "strict": true},
+			{"name": "example/Shape", "members": [], "strict": false}
+		],
+		"library_dependencies": [
+			{"name": "dependency", "declarations": {"dependency/Thing": {"kind": "struct", "resource": false}}}
+		]
+	}`
+	root, err := fidlgen.DecodeJSONIr(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+
+	want := map[fidlgen.EncodedCompoundIdentifier]struct{}{
+		"example/PainterPaintRequest":  {},
+		"example/PainterPaintResponse": {},
+		"example/PainterPaintResult":   {},
+		"example/PainterPaintSuccess":  {},
+		"example/Stroke":               {},
+		"example/Shape":                {},
+	}
+	if diff := cmp.Diff(want, root.ReachableTypes(&root.Protocols[0])); diff != "" {
+		t.Errorf("ReachableTypes() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTypeEqual(t *testing.T) {
+	count := func(n int) *int { return &n }
+	uint8Type := func() *fidlgen.Type {
+		return &fidlgen.Type{Kind: fidlgen.PrimitiveType, PrimitiveSubtype: fidlgen.Uint8}
+	}
+	vector := func(element *fidlgen.Type, n *int) *fidlgen.Type {
+		return &fidlgen.Type{Kind: fidlgen.VectorType, ElementType: element, ElementCount: n}
+	}
+	array := func(element *fidlgen.Type, n int) *fidlgen.Type {
+		return &fidlgen.Type{Kind: fidlgen.ArrayType, ElementType: element, ElementCount: count(n)}
+	}
+	handle := func(rights fidlgen.HandleRights) *fidlgen.Type {
+		return &fidlgen.Type{Kind: fidlgen.HandleType, HandleSubtype: fidlgen.Channel, HandleRights: rights}
+	}
+
+	cases := []struct {
+		name string
+		a, b *fidlgen.Type
+		want bool
+	}{
+		{name: "nil", want: true},
+		{name: "nil and non-nil", a: uint8Type(), want: false},
+		{name: "primitives", a: uint8Type(), b: uint8Type(), want: true},
+		{name: "nested vectors", a: vector(vector(uint8Type(), count(4)), nil), b: vector(vector(uint8Type(), count(4)), nil), want: true},
+		{name: "nested vector counts", a: vector(vector(uint8Type(), count(4)), nil), b: vector(vector(uint8Type(), count(5)), nil), want: false},
+		{name: "bounded and unbounded", a: vector(uint8Type(), count(4)), b: vector(uint8Type(), nil), want: false},
+		{name: "arrays of vectors", a: array(vector(uint8Type(), nil), 3), b: array(vector(uint8Type(), nil), 3), want: true},
+		{name: "array sizes", a: array(uint8Type(), 3), b: array(uint8Type(), 4), want: false},
+		{name: "array and vector", a: array(uint8Type(), 3), b: vector(uint8Type(), count(3)), want: false},
+		{name: "element types", a: array(uint8Type(), 3), b: array(&fidlgen.Type{Kind: fidlgen.PrimitiveType, PrimitiveSubtype: fidlgen.Int8}, 3), want: false},
+		{name: "handle rights", a: handle(fidlgen.HandleRightsDuplicate), b: handle(fidlgen.HandleRightsBasic), want: false},
+		{name: "same handles", a: handle(fidlgen.HandleRightsBasic), b: handle(fidlgen.HandleRightsBasic), want: true},
+		{
+			name: "nullability",
+			a:    &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Foo"},
+			b:    &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Foo", Nullable: true},
+			want: false,
+		},
+		{
+			name: "identifiers",
+			a:    &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Foo"},
+			b:    &fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "example/Bar"},
+			want: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.a.Equal(c.b); got != c.want {
+				t.Errorf("got a.Equal(b) = %t, want %t", got, c.want)
+			}
+			if got := c.b.Equal(c.a); got != c.want {
+				t.Errorf("got b.Equal(a) = %t, want %t", got, c.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -20,19 +22,8 @@ import (
 	"go.fuchsia.dev/fuchsia/tools/fidl/measure-tape/src/rust"
 )
 
-type listOfStrings []string
-
-func (l *listOfStrings) String() string {
-	return strings.Join(*l, " ")
-}
-
-func (l *listOfStrings) Set(s string) error {
-	*l = append(*l, s)
-	return nil
-}
-
-var jsonFiles listOfStrings
-var targetTypes listOfStrings
+var jsonFiles fidlgen.ListOfStrings
+var targetTypes fidlgen.ListOfStrings
 var targetBinding = flag.String("target-binding", "",
 	"Target binding for which to generate the measure tape")
 var outCc = flag.String("out-cc", "",
@@ -45,6 +36,10 @@ var onlyCheckToFile = flag.String("only-check-to-file", "",
 	"Enables verification only mode, which checks the .cc and .h\nRequired for target binding hlcpp")
 var outRs = flag.String("out-rs", "",
 	"Write path for .rs file\nRequired for target binding rust")
+var rustOnlyCheckToFile = flag.String("rust-only-check-to-file", "",
+	"Enables verification only mode, which checks the .rs\nOptional for target binding rust")
+var outJson = flag.String("out-json", "",
+	"Write path for .json file\nRequired for target binding json")
 
 func flagsValid() bool {
 	if len(jsonFiles) == 0 {
@@ -68,6 +63,10 @@ func flagsValid() bool {
 		if len(*outRs) == 0 {
 			return false
 		}
+	case "json":
+		if len(*outJson) == 0 {
+			return false
+		}
 	default:
 		return false
 	}
@@ -94,18 +93,28 @@ func main() {
 	}
 
 	var (
-		m          = measurer.NewMeasurer(roots)
-		allMethods = make(map[measurer.MethodID]*measurer.Method)
-		targetMts  []*measurer.MeasuringTape
+		m             = measurer.NewMeasurer(roots)
+		allMethods    = make(map[measurer.MethodID]*measurer.Method)
+		targetMts     []*measurer.MeasuringTape
+		targetMethods []map[measurer.MethodID]*measurer.Method
 	)
 	for _, targetType := range targetTypes {
 		targetMt, err := m.MeasuringTapeFor(targetType)
 		if err != nil {
-			panic(err)
+			// Only suggest a name when the target type itself is unknown, not
+			// when one of the types it refers to is.
+			var notFound *measurer.TypeNotFoundError
+			if errors.As(err, &notFound) && notFound.Name.FullyQualifiedName() == targetType {
+				reportTypeNotFound(targetType, notFound, m.MessageBodyTypes())
+				os.Exit(1)
+			}
+			log.Fatal(err)
 		}
 		targetMts = append(targetMts, targetMt)
 
-		for id, m := range measurer.NewCodeGenerator(targetMt).Generate() {
+		methods := measurer.NewCodeGenerator(targetMt).Generate()
+		targetMethods = append(targetMethods, methods)
+		for id, m := range methods {
 			allMethods[id] = m
 		}
 	}
@@ -114,8 +123,65 @@ func main() {
 	case "hlcpp":
 		hlcppGen(m, targetMts, allMethods)
 	case "rust":
-		rustGen(m, targetMts, allMethods)
+		rustGen(m, targetMts, targetMethods)
+	case "json":
+		jsonGen(targetTypes, targetMts)
+	}
+}
+
+func reportTypeNotFound(targetType string, err error, candidates []string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	if len(candidates) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nDid you mean %s?\n", closestName(targetType, candidates))
+	fmt.Fprintf(os.Stderr, "\nAvailable message body types:\n")
+	for _, candidate := range candidates {
+		fmt.Fprintf(os.Stderr, "\t%s\n", candidate)
+	}
+}
+
+// closestName returns the candidate with the smallest edit distance to name,
+// preferring the earliest one in case of a tie.
+func closestName(name string, candidates []string) string {
+	var (
+		closest     string
+		minDistance = -1
+	)
+	for _, candidate := range candidates {
+		if d := editDistance(name, candidate); minDistance < 0 || d < minDistance {
+			closest, minDistance = candidate, d
+		}
+	}
+	return closest
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < curr[j] {
+				curr[j] = d
+			}
+			if d := curr[j-1] + 1; d < curr[j] {
+				curr[j] = d
+			}
+		}
+		prev, curr = curr, prev
 	}
+	return prev[len(rb)]
 }
 
 func hlcppGen(m *measurer.Measurer, targetMts []*measurer.MeasuringTape,
@@ -132,7 +198,9 @@ func hlcppGen(m *measurer.Measurer, targetMts []*measurer.MeasuringTape,
 		writeFile(*outH, bufH.Bytes())
 		writeFile(*outCc, bufCc.Bytes())
 	} else {
-		verifyMeasureTape(bufH.Bytes(), bufCc.Bytes())
+		verifyMeasureTape("only-check-to-file", *onlyCheckToFile,
+			generatedFile{*outH, bufH.Bytes()},
+			generatedFile{*outCc, bufCc.Bytes()})
 	}
 }
 
@@ -142,20 +210,36 @@ func writeFile(path string, data []byte) {
 	}
 }
 
-func verifyMeasureTape(expectedH, expectedCc []byte) {
-	actualH, err := ioutil.ReadFile(*outH)
-	if err != nil {
-		panic(err)
-	}
-	actualCc, err := ioutil.ReadFile(*outCc)
-	if err != nil {
-		panic(err)
+type generatedFile struct {
+	path     string
+	expected []byte
+}
+
+// verifyMeasureTape checks that the files on disk match what was generated.
+// On mismatch, it prints the command to regenerate them, i.e. the current
+// command without the onlyCheckFlag, and exits. Otherwise, it writes an empty
+// stamp file.
+func verifyMeasureTape(onlyCheckFlag, stampPath string, files ...generatedFile) {
+	var (
+		paths    []string
+		upToDate = true
+	)
+	for _, file := range files {
+		actual, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			panic(err)
+		}
+		if bytes.Compare(actual, file.expected) != 0 {
+			upToDate = false
+		}
+		paths = append(paths, file.path)
 	}
-	if bytes.Compare(actualH, expectedH) != 0 || bytes.Compare(actualCc, expectedCc) != 0 {
-		fmt.Fprintf(os.Stderr, "%s and/or %s is out of date! Please run the following\n\n", *outH, *outCc)
+	if !upToDate {
+		fmt.Fprintf(os.Stderr, "%s is out of date! Please run the following\n\n", strings.Join(paths, " and/or "))
+		onlyCheckFlagRe := regexp.MustCompile("^-?-" + regexp.QuoteMeta(onlyCheckFlag) + "$")
 		skipUntil := 0
 		for i, arg := range os.Args {
-			if matched, _ := regexp.MatchString("^-?-only-check-to-file$", arg); matched {
+			if onlyCheckFlagRe.MatchString(arg) {
 				skipUntil = i + 2
 				continue
 			}
@@ -170,14 +254,46 @@ func verifyMeasureTape(expectedH, expectedCc []byte) {
 		fmt.Fprintf(os.Stderr, "\n\n")
 		os.Exit(1)
 	}
-	writeFile(*onlyCheckToFile, []byte{})
+	writeFile(stampPath, []byte{})
 }
 
 func rustGen(m *measurer.Measurer,
 	targetMts []*measurer.MeasuringTape,
-	allMethods map[measurer.MethodID]*measurer.Method) {
+	targetMethods []map[measurer.MethodID]*measurer.Method) {
 
 	var bufRs bytes.Buffer
-	rust.WriteRs(&bufRs, m, targetMts, allMethods)
-	writeFile(*outRs, bufRs.Bytes())
+	rust.WriteRs(&bufRs, m, targetMts, targetMethods)
+
+	if len(*rustOnlyCheckToFile) == 0 {
+		writeFile(*outRs, bufRs.Bytes())
+	} else {
+		verifyMeasureTape("rust-only-check-to-file", *rustOnlyCheckToFile,
+			generatedFile{*outRs, bufRs.Bytes()})
+	}
+}
+
+type measuringTapeShape struct {
+	TargetType           string `json:"target_type"`
+	InlineNumBytes       int    `json:"inline_num_bytes"`
+	MaxOutOfLineNumBytes int    `json:"max_out_of_line_num_bytes"`
+	MaxNumHandles        int    `json:"max_num_handles"`
+}
+
+func jsonGen(targetTypes []string, targetMts []*measurer.MeasuringTape) {
+	shapes := []measuringTapeShape{}
+	for i, targetMt := range targetMts {
+		shape := targetMt.Shape()
+		shapes = append(shapes, measuringTapeShape{
+			TargetType:           targetTypes[i],
+			InlineNumBytes:       shape.InlineNumBytes,
+			MaxOutOfLineNumBytes: shape.MaxOutOfLineNumBytes,
+			MaxNumHandles:        shape.MaxNumHandles,
+		})
+	}
+
+	bufJson, err := json.MarshalIndent(shapes, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	writeFile(*outJson, append(bufJson, '\n'))
 }
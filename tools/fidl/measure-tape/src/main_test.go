@@ -0,0 +1,52 @@
+// Copyright 2022 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestEditDistance(t *testing.T) {
+	for _, ex := range []struct {
+		a, b string
+		want int
+	}{
+		{a: "", b: "", want: 0},
+		{a: "", b: "abc", want: 3},
+		{a: "abc", b: "", want: 3},
+		{a: "abc", b: "abc", want: 0},
+		{a: "kitten", b: "sitting", want: 3},
+		{a: "flaw", b: "lawn", want: 2},
+		{a: "Command", b: "command", want: 1},
+		{a: "naïve", b: "naive", want: 1},
+	} {
+		if got := editDistance(ex.a, ex.b); got != ex.want {
+			t.Errorf("got editDistance(%q, %q) = %d, want = %d", ex.a, ex.b, got, ex.want)
+		}
+	}
+}
+
+func TestClosestName(t *testing.T) {
+	candidates := []string{
+		"fuchsia.ui.scenic/Command",
+		"fuchsia.ui.scenic/Event",
+		"fuchsia.ui.input/Command",
+	}
+	for _, ex := range []struct {
+		name, want string
+	}{
+		{name: "fuchsia.ui.scenic/Command", want: "fuchsia.ui.scenic/Command"},
+		{name: "fuchsia.ui.scenic/command", want: "fuchsia.ui.scenic/Command"},
+		{name: "fuchsia.ui.scenic/Events", want: "fuchsia.ui.scenic/Event"},
+		{name: "fuchsia.ui.input/Commands", want: "fuchsia.ui.input/Command"},
+	} {
+		if got := closestName(ex.name, candidates); got != ex.want {
+			t.Errorf("got closestName(%q, _) = %q, want = %q", ex.name, got, ex.want)
+		}
+	}
+
+	// Both candidates are one edit away; the first one wins.
+	if got, want := closestName("example/Ba", []string{"example/Bar", "example/Baz"}), "example/Bar"; got != want {
+		t.Errorf("got closestName(%q, _) = %q, want = %q", "example/Ba", got, want)
+	}
+}
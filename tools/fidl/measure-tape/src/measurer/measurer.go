@@ -6,6 +6,8 @@ package measurer
 
 import (
 	"fmt"
+	"math"
+	"sort"
 
 	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
 )
@@ -23,6 +25,25 @@ func (m *Measurer) RootLibraries() []fidlgen.LibraryName {
 	return libraryNames
 }
 
+// MessageBodyTypes returns the fully qualified names of the structs, tables,
+// and unions declared in the loaded libraries, in sorted order.
+func (m *Measurer) MessageBodyTypes() []string {
+	var names []string
+	for _, root := range m.roots {
+		for _, decl := range root.Structs {
+			names = append(names, string(decl.Name))
+		}
+		for _, decl := range root.Tables {
+			names = append(names, string(decl.Name))
+		}
+		for _, decl := range root.Unions {
+			names = append(names, string(decl.Name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func NewMeasurer(roots []fidlgen.Root) *Measurer {
 	m := &Measurer{
 		roots: make(map[fidlgen.LibraryName]fidlgen.Root),
@@ -91,6 +112,45 @@ func (mt *MeasuringTape) Name() fidlgen.Name {
 	return mt.name
 }
 
+// Shape is the static size of the values measured by a measuring tape, as
+// computed by fidlc for declarations. Unbounded maximums are math.MaxUint32.
+type Shape struct {
+	InlineNumBytes       int
+	MaxOutOfLineNumBytes int
+	MaxNumHandles        int
+}
+
+func (mt *MeasuringTape) Shape() Shape {
+	var typeShape fidlgen.TypeShape
+	switch decl := mt.decl.(type) {
+	case fidlgen.Struct:
+		typeShape = decl.TypeShapeV1
+	case fidlgen.Table:
+		typeShape = decl.TypeShapeV1
+	case fidlgen.Union:
+		typeShape = decl.TypeShapeV1
+	default:
+		// Without a declaration there is no type shape, and strings and
+		// vectors are treated as unbounded.
+		shape := Shape{
+			InlineNumBytes: mt.inlineNumBytes,
+			MaxNumHandles:  mt.inlineNumHandles,
+		}
+		if mt.hasOutOfLine {
+			shape.MaxOutOfLineNumBytes = math.MaxUint32
+			if mt.hasHandles {
+				shape.MaxNumHandles = math.MaxUint32
+			}
+		}
+		return shape
+	}
+	return Shape{
+		InlineNumBytes:       typeShape.InlineSize,
+		MaxOutOfLineNumBytes: typeShape.MaxOutOfLine,
+		MaxNumHandles:        typeShape.MaxHandles,
+	}
+}
+
 type measuringTapeMember struct {
 	name    string
 	ordinal int
@@ -343,10 +403,25 @@ func (m *Measurer) toDecl(typ fidlgen.Type) (keyedDecl, error) {
 	}
 }
 
+// TypeNotFoundError indicates that a name does not refer to a type declared in
+// the loaded libraries.
+type TypeNotFoundError struct {
+	Name fidlgen.Name
+
+	missingLibrary bool
+}
+
+func (e *TypeNotFoundError) Error() string {
+	if e.missingLibrary {
+		return fmt.Sprintf("missing definition for %s, you may be missing a JSON IR", e.Name)
+	}
+	return fmt.Sprintf("type %s not found in library %s", e.Name, e.Name.LibraryName())
+}
+
 func (m *Measurer) lookup(name fidlgen.Name) (keyedDecl, error) {
 	root, ok := m.roots[name.LibraryName()]
 	if !ok {
-		return keyedDecl{}, fmt.Errorf("missing definition for %s, you may be missing a JSON IR", name)
+		return keyedDecl{}, &TypeNotFoundError{Name: name, missingLibrary: true}
 	}
 	fqn := name.FullyQualifiedName()
 	for _, decl := range root.Structs {
@@ -385,7 +460,7 @@ func (m *Measurer) lookup(name fidlgen.Name) (keyedDecl, error) {
 			return keyedDecl{key: fqn, decl: handleDecl{}}, nil
 		}
 	}
-	panic(fmt.Sprintf("unreachable: %s does not refer to a type", name))
+	return keyedDecl{}, &TypeNotFoundError{Name: name}
 }
 
 func toSize(subtype fidlgen.PrimitiveSubtype) int {
@@ -0,0 +1,114 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package measurer
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+func TestShape(t *testing.T) {
+	root, err := fidlgen.DecodeJSONIr(strings.NewReader(`{
+		"name": "example",
+		"enum_declarations": [
+			{"name": "example/Color", "type": "uint16", "members": [], "strict": true}
+		],
+		"struct_declarations": [
+			{
+				"name": "example/Point",
+				"members": [],
+				"type_shape_v1": {"inline_size": 16, "max_out_of_line": 0, "max_handles": 0}
+			},
+			{
+				"name": "example/Named",
+				"members": [],
+				"type_shape_v1": {"inline_size": 16, "max_out_of_line": 4294967295, "max_handles": 2}
+			}
+		],
+		"declaration_order": ["example/Color", "example/Point", "example/Named"],
+		"declarations": {"example/Color": "enum", "example/Point": "struct", "example/Named": "struct"}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+	m := NewMeasurer([]fidlgen.Root{root})
+
+	cases := []struct {
+		targetType string
+		expected   Shape
+	}{
+		{
+			targetType: "example/Color",
+			expected:   Shape{InlineNumBytes: 2},
+		},
+		{
+			targetType: "example/Point",
+			expected:   Shape{InlineNumBytes: 16},
+		},
+		{
+			targetType: "example/Named",
+			expected:   Shape{InlineNumBytes: 16, MaxOutOfLineNumBytes: math.MaxUint32, MaxNumHandles: 2},
+		},
+	}
+	for _, ex := range cases {
+		mt, err := m.MeasuringTapeFor(ex.targetType)
+		if err != nil {
+			t.Fatalf("%s: %s", ex.targetType, err)
+		}
+		if actual := mt.Shape(); actual != ex.expected {
+			t.Errorf("%s: expected %+v, actual %+v", ex.targetType, ex.expected, actual)
+		}
+	}
+}
+
+func TestMeasuringTapeForUnknownType(t *testing.T) {
+	root, err := fidlgen.DecodeJSONIr(strings.NewReader(`{
+		"name": "example",
+		"enum_declarations": [
+			{"name": "example/Color", "type": "uint16", "members": [], "strict": true}
+		],
+		"struct_declarations": [
+			{"name": "example/Point", "members": [], "type_shape_v1": {"inline_size": 16}}
+		],
+		"table_declarations": [
+			{"name": "example/Options", "members": [], "type_shape_v1": {"inline_size": 16}}
+		],
+		"const_declarations": [
+			{
+				"name": "example/MAX",
+				"type": {"kind": "primitive", "subtype": "uint32", "type_shape_v1": {}, "type_shape_v2": {}},
+				"value": {"kind": "literal", "value": "1", "expression": "1"}
+			}
+		],
+		"declaration_order": ["example/Color", "example/Point", "example/Options", "example/MAX"],
+		"declarations": {"example/Color": "enum", "example/Point": "struct", "example/Options": "table", "example/MAX": "const"}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+	m := NewMeasurer([]fidlgen.Root{root})
+
+	for _, targetType := range []string{"example/Pointt", "example/point", "example/MAX", "other/Point"} {
+		_, err := m.MeasuringTapeFor(targetType)
+		var notFound *TypeNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Errorf("%s: expected a TypeNotFoundError, actual %v", targetType, err)
+			continue
+		}
+		if actual := notFound.Name.FullyQualifiedName(); actual != targetType {
+			t.Errorf("%s: expected name %s, actual %s", targetType, targetType, actual)
+		}
+	}
+
+	expected := []string{"example/Options", "example/Point"}
+	if actual := m.MessageBodyTypes(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected message body types %v, actual %v", expected, actual)
+	}
+}
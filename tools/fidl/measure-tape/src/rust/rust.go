@@ -16,20 +16,34 @@ import (
 	"go.fuchsia.dev/fuchsia/tools/fidl/measure-tape/src/utils"
 )
 
+// WriteRs writes the measuring tapes of the target types to buf. The methods
+// of each target type, given in targetMethods in the same order as targetMts,
+// are written to a module named after it, so that the helpers of two target
+// types never collide.
 func WriteRs(buf *bytes.Buffer,
 	m *measurer.Measurer,
 	targetMts []*measurer.MeasuringTape,
-	allMethods map[measurer.MethodID]*measurer.Method) {
+	targetMethods []map[measurer.MethodID]*measurer.Method) {
 
-	if err := topOfRs.Execute(buf, newTmplParams(m, targetMts)); err != nil {
+	params := newTmplParams(m, targetMts)
+	if err := topOfRs.Execute(buf, params); err != nil {
 		panic(err)
 	}
 
 	cb := codeBuffer{buf: buf}
-	utils.ForAllMethodsInOrder(allMethods, func(m *measurer.Method) {
-		buf.WriteString("\n")
-		cb.writeMethod(m)
-	})
+	for i, target := range params.Targets {
+		if err := topOfTargetMod.Execute(buf, target); err != nil {
+			panic(err)
+		}
+		utils.ForAllMethodsInOrder(targetMethods[target.index], func(m *measurer.Method) {
+			buf.WriteString("\n")
+			cb.writeMethod(m)
+		})
+		buf.WriteString("}\n") // and with that, we close the target module
+		if i != len(params.Targets)-1 {
+			buf.WriteString("\n")
+		}
+	}
 
 	buf.WriteRune('}') // and with that, we close the inner module
 }
@@ -233,9 +247,23 @@ func toTypeName(declName fidlgen.Name) string {
 		fidlgen.ToUpperCamelCase(declName.DeclarationName()))
 }
 
+func toModName(declName fidlgen.Name) string {
+	return fmt.Sprintf("%s_%s",
+		strings.Join(declName.LibraryName().Parts(), "_"),
+		fidlgen.ToSnakeCase(declName.DeclarationName()))
+}
+
 type tmplParams struct {
-	Uses        []string
-	TargetTypes []string
+	Targets []targetTmplParams
+}
+
+type targetTmplParams struct {
+	TypeName string
+	ModName  string
+	Uses     []string
+
+	// index is the index of the target type in the targetMts given to WriteRs.
+	index int
 }
 
 func newTmplParams(m *measurer.Measurer,
@@ -247,21 +275,31 @@ func newTmplParams(m *measurer.Measurer,
 	}
 	sort.Strings(uses)
 
-	var targetTypes []string
-	for _, targetMt := range targetMts {
-		targetTypes = append(targetTypes, toTypeName(targetMt.Name()))
+	var (
+		targets []targetTmplParams
+		seen    = make(map[string]struct{})
+	)
+	for i, targetMt := range targetMts {
+		modName := toModName(targetMt.Name())
+		if _, ok := seen[modName]; ok {
+			continue
+		}
+		seen[modName] = struct{}{}
+		targets = append(targets, targetTmplParams{
+			TypeName: toTypeName(targetMt.Name()),
+			ModName:  modName,
+			Uses:     uses,
+			index:    i,
+		})
 	}
 	return tmplParams{
-		Uses:        uses,
-		TargetTypes: targetTypes,
+		Targets: targets,
 	}
 }
 
 var topOfRs = template.Must(template.New("tmpls").Parse(
 	`// WARNING: This file is machine generated by measure-tape.
 
-use inner::MeasurableAll;
-
 #[derive(Debug, Eq, PartialEq)]
 pub struct Size {
   pub num_bytes: usize,
@@ -272,9 +310,10 @@ pub trait Measurable {
   fn measure(&self) -> Size;
 }
 
-{{ range $targetType := .TargetTypes }}
-impl Measurable for {{ $targetType }} {
+{{ range .Targets }}
+impl Measurable for {{ .TypeName }} {
   fn measure(&self) -> Size {
+    use inner::{{ .ModName }}::MeasurableAll;
     let mut size_agg = inner::SizeAgg { maxed_out: false, num_bytes: 0, num_handles: 0 };
     self.measure_all(&mut size_agg);
     size_agg.to_size()
@@ -283,13 +322,8 @@ impl Measurable for {{ $targetType }} {
 {{ end }}
 
 mod inner {
-#![allow(unused_imports)]
 use {
   crate::Size,
-  fidl::encoding::round_up_to_align,
-{{- range .Uses }}
-  {{ . }},
-{{- end }}
   fuchsia_zircon_types as zx,
 };
 
@@ -323,6 +357,19 @@ impl SizeAgg {
   }
 }
 
+`))
+
+var topOfTargetMod = template.Must(template.New("tmpls").Parse(
+	`pub mod {{ .ModName }} {
+#![allow(unused_imports)]
+use {
+  super::SizeAgg,
+  fidl::encoding::round_up_to_align,
+{{- range .Uses }}
+  {{ . }},
+{{- end }}
+};
+
 pub trait MeasurableAll {
   fn measure_all(&self, size_agg: &mut SizeAgg);
 }
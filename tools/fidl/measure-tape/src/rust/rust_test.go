@@ -0,0 +1,260 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package rust
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+	"go.fuchsia.dev/fuchsia/tools/fidl/measure-tape/src/measurer"
+)
+
+// Two target types sharing a nested struct must each get their own helpers
+// for it, in their own module.
+func TestWriteRsTargetTypesSharingNestedStruct(t *testing.T) {
+	root, err := fidlgen.DecodeJSONIr(strings.NewReader(`{
+		"name": "example",
+		"struct_declarations": [
+			{
+				"name": "example/Nested",
+				"members": [
+					{"name": "s", "type": {"kind": "string", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}}
+				],
+				"type_shape_v1": {"inline_size": 16, "depth": 1, "max_out_of_line": 4294967295}
+			},
+			{
+				"name": "example/First",
+				"members": [
+					{"name": "nested", "type": {"kind": "identifier", "identifier": "example/Nested", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}}
+				],
+				"type_shape_v1": {"inline_size": 16, "depth": 1, "max_out_of_line": 4294967295}
+			},
+			{
+				"name": "example/Second",
+				"members": [
+					{"name": "nested", "type": {"kind": "identifier", "identifier": "example/Nested", "nullable": false, "type_shape_v1": {}, "type_shape_v2": {}}},
+					{"name": "x", "type": {"kind": "primitive", "subtype": "uint32", "type_shape_v1": {}, "type_shape_v2": {}}}
+				],
+				"type_shape_v1": {"inline_size": 24, "depth": 1, "max_out_of_line": 4294967295}
+			}
+		],
+		"declaration_order": ["example/Nested", "example/First", "example/Second"],
+		"declarations": {"example/Nested": "struct", "example/First": "struct", "example/Second": "struct"}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to decode IR: %s", err)
+	}
+	m := measurer.NewMeasurer([]fidlgen.Root{root})
+
+	var (
+		targetMts     []*measurer.MeasuringTape
+		targetMethods []map[measurer.MethodID]*measurer.Method
+	)
+	for _, targetType := range []string{"example/First", "example/Second"} {
+		targetMt, err := m.MeasuringTapeFor(targetType)
+		if err != nil {
+			t.Fatalf("%s: %s", targetType, err)
+		}
+		targetMts = append(targetMts, targetMt)
+		targetMethods = append(targetMethods, measurer.NewCodeGenerator(targetMt).Generate())
+	}
+
+	var buf bytes.Buffer
+	WriteRs(&buf, m, targetMts, targetMethods)
+	if diff := cmp.Diff(goldenTargetTypesSharingNestedStruct, buf.String()); diff != "" {
+		t.Errorf("WriteRs() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+const goldenTargetTypesSharingNestedStruct = `// WARNING: This file is machine generated by measure-tape.
+
+#[derive(Debug, Eq, PartialEq)]
+pub struct Size {
+  pub num_bytes: usize,
+  pub num_handles: usize,
+}
+
+pub trait Measurable {
+  fn measure(&self) -> Size;
+}
+
+
+impl Measurable for fidl_example::First {
+  fn measure(&self) -> Size {
+    use inner::example_first::MeasurableAll;
+    let mut size_agg = inner::SizeAgg { maxed_out: false, num_bytes: 0, num_handles: 0 };
+    self.measure_all(&mut size_agg);
+    size_agg.to_size()
+  }
+}
+
+impl Measurable for fidl_example::Second {
+  fn measure(&self) -> Size {
+    use inner::example_second::MeasurableAll;
+    let mut size_agg = inner::SizeAgg { maxed_out: false, num_bytes: 0, num_handles: 0 };
+    self.measure_all(&mut size_agg);
+    size_agg.to_size()
+  }
+}
+
+
+mod inner {
+use {
+  crate::Size,
+  fuchsia_zircon_types as zx,
+};
+
+pub struct SizeAgg {
+  pub maxed_out: bool,
+  pub num_bytes: usize,
+  pub num_handles: usize,
+}
+
+impl SizeAgg {
+  #[inline(always)]
+  fn add_num_bytes(&mut self, num_bytes: usize) {
+    self.num_bytes += num_bytes;
+  }
+
+  #[inline(always)]
+  #[allow(dead_code)]
+  fn add_num_handles(&mut self, num_handles: usize) {
+    self.num_handles += num_handles;
+  }
+
+  #[inline(always)]
+  pub fn to_size(&self) -> Size {
+    if self.maxed_out {
+      return Size {
+        num_bytes: zx::ZX_CHANNEL_MAX_MSG_BYTES as usize,
+        num_handles: zx::ZX_CHANNEL_MAX_MSG_HANDLES as usize,
+      };
+    }
+    return Size { num_bytes: self.num_bytes, num_handles: self.num_handles };
+  }
+}
+
+pub mod example_first {
+#![allow(unused_imports)]
+use {
+  super::SizeAgg,
+  fidl::encoding::round_up_to_align,
+  fidl_example,
+};
+
+pub trait MeasurableAll {
+  fn measure_all(&self, size_agg: &mut SizeAgg);
+}
+
+trait MeasurableOutOfLine {
+  fn measure_out_of_line(&self, size_agg: &mut SizeAgg);
+}
+
+trait MeasurableHandles {
+  fn measure_handles(&self, size_agg: &mut SizeAgg);
+}
+
+impl MeasurableAll for fidl_example::First {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_all(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    size_agg.add_num_bytes(round_up_to_align(16, 8));
+    value.measure_out_of_line(size_agg);
+  }
+}
+
+impl MeasurableOutOfLine for fidl_example::First {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_out_of_line(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    value.nested.measure_out_of_line(size_agg);
+  }
+}
+
+impl MeasurableAll for fidl_example::Nested {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_all(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    size_agg.add_num_bytes(round_up_to_align(16, 8));
+    value.measure_out_of_line(size_agg);
+  }
+}
+
+impl MeasurableOutOfLine for fidl_example::Nested {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_out_of_line(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    size_agg.add_num_bytes(round_up_to_align(value.s.len(), 8));
+  }
+}
+}
+
+pub mod example_second {
+#![allow(unused_imports)]
+use {
+  super::SizeAgg,
+  fidl::encoding::round_up_to_align,
+  fidl_example,
+};
+
+pub trait MeasurableAll {
+  fn measure_all(&self, size_agg: &mut SizeAgg);
+}
+
+trait MeasurableOutOfLine {
+  fn measure_out_of_line(&self, size_agg: &mut SizeAgg);
+}
+
+trait MeasurableHandles {
+  fn measure_handles(&self, size_agg: &mut SizeAgg);
+}
+
+impl MeasurableAll for fidl_example::Nested {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_all(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    size_agg.add_num_bytes(round_up_to_align(16, 8));
+    value.measure_out_of_line(size_agg);
+  }
+}
+
+impl MeasurableOutOfLine for fidl_example::Nested {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_out_of_line(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    size_agg.add_num_bytes(round_up_to_align(value.s.len(), 8));
+  }
+}
+
+impl MeasurableAll for fidl_example::Second {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_all(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    size_agg.add_num_bytes(round_up_to_align(24, 8));
+    value.measure_out_of_line(size_agg);
+  }
+}
+
+impl MeasurableOutOfLine for fidl_example::Second {
+  #[inline]
+  #[allow(unused_variables)]
+  fn measure_out_of_line(&self, size_agg: &mut SizeAgg) {
+    let value = self;
+    value.nested.measure_out_of_line(size_agg);
+  }
+}
+}
+}`